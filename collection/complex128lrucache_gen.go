@@ -0,0 +1,279 @@
+// Code created from "lrucache.go.tmpl" - don't edit by hand
+//
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type complex128LRUEntry struct {
+	key     complex128
+	value   interface{}
+	expires time.Time
+}
+
+// Complex128LRUCache holds a cache of values keyed by complex128 values. When the
+// cache is full, the least recently used entry is evicted to make room. Entries
+// may also expire after a time-to-live. It is safe for concurrent use. A zero
+// value cache has no capacity limit and no time-to-live.
+type Complex128LRUCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[complex128]*list.Element
+}
+
+// NewComplex128LRUCache creates a new cache. A capacity less than 1 means the
+// cache will not be limited in size. A ttl less than 1 means entries will not
+// expire.
+func NewComplex128LRUCache(capacity int, ttl time.Duration) *Complex128LRUCache {
+	return &Complex128LRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+// Len returns the number of entries in the cache. Expired entries that have
+// not yet been pruned are included.
+func (c *Complex128LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Capacity returns the maximum number of entries the cache will hold.
+func (c *Complex128LRUCache) Capacity() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.capacity
+}
+
+// SetCapacity sets the maximum number of entries the cache will hold,
+// evicting the least recently used entries if needed.
+func (c *Complex128LRUCache) SetCapacity(capacity int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.capacity = capacity
+	c.evictIfNeeded()
+}
+
+// Clear the cache.
+func (c *Complex128LRUCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order = nil
+	c.entries = nil
+}
+
+// Set the value for a key, using the cache's default time-to-live.
+func (c *Complex128LRUCache) Set(key complex128, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.set(key, value, c.ttl)
+}
+
+// SetWithTTL sets the value for a key, using the specified time-to-live. A
+// ttl less than 1 means the entry will not expire.
+func (c *Complex128LRUCache) SetWithTTL(key complex128, value interface{}, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.set(key, value, ttl)
+}
+
+// Get returns the value for a key and marks it as most recently used. 'ok'
+// will be false if the key is not present or has expired.
+func (c *Complex128LRUCache) Get(key complex128) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem := c.live(key); elem != nil {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*complex128LRUEntry).value, true
+	}
+	return nil, false
+}
+
+// Peek returns the value for a key without changing its recency. 'ok' will be
+// false if the key is not present or has expired.
+func (c *Complex128LRUCache) Peek(key complex128) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem := c.live(key); elem != nil {
+		return elem.Value.(*complex128LRUEntry).value, true
+	}
+	return nil, false
+}
+
+// Contains returns true if the key exists within the cache and has not
+// expired.
+func (c *Complex128LRUCache) Contains(key complex128) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.live(key) != nil
+}
+
+// Delete a key from the cache. Returns true if the key was present.
+func (c *Complex128LRUCache) Delete(key complex128) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.remove(elem)
+	}
+	return ok
+}
+
+// Prune removes all expired entries from the cache and returns the number of
+// entries that were removed.
+func (c *Complex128LRUCache) Prune() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.order == nil {
+		return 0
+	}
+	now := time.Now()
+	count := 0
+	var next *list.Element
+	for elem := c.order.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		if e := elem.Value.(*complex128LRUEntry); !e.expires.IsZero() && !now.Before(e.expires) {
+			c.remove(elem)
+			count++
+		}
+	}
+	return count
+}
+
+// Keys returns the keys of all unexpired entries in the cache, from most to
+// least recently used.
+func (c *Complex128LRUCache) Keys() []complex128 {
+	entries := c.Entries()
+	keys := make([]complex128, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+// Entries returns all unexpired entries in the cache, from most to least
+// recently used.
+func (c *Complex128LRUCache) Entries() []Complex128Entry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := make([]Complex128Entry, 0, len(c.entries))
+	if c.order != nil {
+		now := time.Now()
+		for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+			if e := elem.Value.(*complex128LRUEntry); e.expires.IsZero() || now.Before(e.expires) {
+				entries = append(entries, Complex128Entry{Key: e.key, Value: e.value})
+			}
+		}
+	}
+	return entries
+}
+
+func (c *Complex128LRUCache) set(key complex128, value interface{}, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*complex128LRUEntry)
+		e.value = value
+		e.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = make(map[complex128]*list.Element)
+	}
+	c.entries[key] = c.order.PushFront(&complex128LRUEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+	c.evictIfNeeded()
+}
+
+func (c *Complex128LRUCache) live(key complex128) *list.Element {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if e := elem.Value.(*complex128LRUEntry); !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		c.remove(elem)
+		return nil
+	}
+	return elem
+}
+
+func (c *Complex128LRUCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*complex128LRUEntry).key)
+}
+
+func (c *Complex128LRUCache) evictIfNeeded() {
+	if c.capacity < 1 || c.order == nil {
+		return
+	}
+	for len(c.entries) > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Complex128LRUCache) load(entries []Complex128Entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order = nil
+	c.entries = nil
+	for i := len(entries) - 1; i >= 0; i-- {
+		c.set(entries[i].Key, entries[i].Value, c.ttl)
+	}
+}
+
+// MarshalJSON implements the json.Marshaler interface. Entries are written
+// from most to least recently used. Expiration times are not preserved.
+func (c *Complex128LRUCache) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Entries())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Entries are given
+// the cache's default time-to-live.
+func (c *Complex128LRUCache) UnmarshalJSON(data []byte) error {
+	var entries []Complex128Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.load(entries)
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface. Entries are written
+// from most to least recently used. Expiration times are not preserved.
+func (c *Complex128LRUCache) MarshalYAML() (interface{}, error) {
+	return c.Entries(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface. Entries are given
+// the cache's default time-to-live.
+func (c *Complex128LRUCache) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []Complex128Entry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	c.load(entries)
+	return nil
+}
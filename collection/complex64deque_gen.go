@@ -0,0 +1,182 @@
+// Code created from "deque.go.tmpl" - don't edit by hand
+//
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection
+
+import (
+	"encoding/json"
+)
+
+// Complex64Deque holds a double-ended queue of complex64 values, backed by a ring
+// buffer.
+type Complex64Deque struct {
+	buffer []complex64
+	head   int
+	count  int
+}
+
+// NewComplex64Deque creates a new deque from its input values, which are added to
+// the back in order.
+func NewComplex64Deque(values ...complex64) *Complex64Deque {
+	d := &Complex64Deque{}
+	for _, v := range values {
+		d.PushBack(v)
+	}
+	return d
+}
+
+// Len returns the number of values in the deque.
+func (d *Complex64Deque) Len() int {
+	return d.count
+}
+
+// Empty returns true if there are no values in the deque.
+func (d *Complex64Deque) Empty() bool {
+	return d.count == 0
+}
+
+// Clear the deque.
+func (d *Complex64Deque) Clear() {
+	d.buffer = nil
+	d.head = 0
+	d.count = 0
+}
+
+// PushFront adds a value to the front of the deque.
+func (d *Complex64Deque) PushFront(value complex64) {
+	d.growIfNeeded()
+	d.head = (d.head + len(d.buffer) - 1) % len(d.buffer)
+	d.buffer[d.head] = value
+	d.count++
+}
+
+// PushBack adds a value to the back of the deque.
+func (d *Complex64Deque) PushBack(value complex64) {
+	d.growIfNeeded()
+	d.buffer[(d.head+d.count)%len(d.buffer)] = value
+	d.count++
+}
+
+// PopFront removes and returns the value at the front of the deque. 'ok' will
+// be false if the deque was empty.
+func (d *Complex64Deque) PopFront() (value complex64, ok bool) {
+	if d.count == 0 {
+		return value, false
+	}
+	var zero complex64
+	value = d.buffer[d.head]
+	d.buffer[d.head] = zero
+	d.head = (d.head + 1) % len(d.buffer)
+	d.count--
+	return value, true
+}
+
+// PopBack removes and returns the value at the back of the deque. 'ok' will be
+// false if the deque was empty.
+func (d *Complex64Deque) PopBack() (value complex64, ok bool) {
+	if d.count == 0 {
+		return value, false
+	}
+	var zero complex64
+	i := (d.head + d.count - 1) % len(d.buffer)
+	value = d.buffer[i]
+	d.buffer[i] = zero
+	d.count--
+	return value, true
+}
+
+// Front returns the value at the front of the deque without removing it. 'ok'
+// will be false if the deque was empty.
+func (d *Complex64Deque) Front() (value complex64, ok bool) {
+	if d.count == 0 {
+		return value, false
+	}
+	return d.buffer[d.head], true
+}
+
+// Back returns the value at the back of the deque without removing it. 'ok'
+// will be false if the deque was empty.
+func (d *Complex64Deque) Back() (value complex64, ok bool) {
+	if d.count == 0 {
+		return value, false
+	}
+	return d.buffer[(d.head+d.count-1)%len(d.buffer)], true
+}
+
+// At returns the value at the specified index, where 0 is the front of the
+// deque. Panics if the index is out of range.
+func (d *Complex64Deque) At(index int) complex64 {
+	if index < 0 || index >= d.count {
+		panic("index out of range")
+	}
+	return d.buffer[(d.head+index)%len(d.buffer)]
+}
+
+// Values returns all values in the deque, from front to back.
+func (d *Complex64Deque) Values() []complex64 {
+	values := make([]complex64, d.count)
+	for i := range values {
+		values[i] = d.buffer[(d.head+i)%len(d.buffer)]
+	}
+	return values
+}
+
+func (d *Complex64Deque) growIfNeeded() {
+	if d.count < len(d.buffer) {
+		return
+	}
+	size := len(d.buffer) * 2
+	if size == 0 {
+		size = 8
+	}
+	buffer := make([]complex64, size)
+	for i := 0; i < d.count; i++ {
+		buffer[i] = d.buffer[(d.head+i)%len(d.buffer)]
+	}
+	d.buffer = buffer
+	d.head = 0
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d *Complex64Deque) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Values())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Complex64Deque) UnmarshalJSON(data []byte) error {
+	var values []complex64
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	d.Clear()
+	for _, v := range values {
+		d.PushBack(v)
+	}
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (d *Complex64Deque) MarshalYAML() (interface{}, error) {
+	return d.Values(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (d *Complex64Deque) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []complex64
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+	d.Clear()
+	for _, v := range values {
+		d.PushBack(v)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Code created from "orderedmap.go.tmpl" - don't edit by hand
+//
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection
+
+import (
+	"container/list"
+	"encoding/json"
+)
+
+// Complex64Entry holds a key/value pair keyed by a complex64. It is used when
+// marshaling the ordered maps and caches.
+type Complex64Entry struct {
+	Key   complex64   `json:"key" yaml:"key"`
+	Value interface{} `json:"value" yaml:"value"`
+}
+
+// Complex64OrderedMap holds a map keyed by complex64 values that remembers the order
+// in which keys were first inserted.
+type Complex64OrderedMap struct {
+	order   *list.List
+	entries map[complex64]*list.Element
+}
+
+// NewComplex64OrderedMap creates a new ordered map from its input entries.
+func NewComplex64OrderedMap(entries ...Complex64Entry) *Complex64OrderedMap {
+	m := &Complex64OrderedMap{}
+	for _, e := range entries {
+		m.Set(e.Key, e.Value)
+	}
+	return m
+}
+
+// Len returns the number of entries in the map.
+func (m *Complex64OrderedMap) Len() int {
+	return len(m.entries)
+}
+
+// Empty returns true if there are no entries in the map.
+func (m *Complex64OrderedMap) Empty() bool {
+	return len(m.entries) == 0
+}
+
+// Clear the map.
+func (m *Complex64OrderedMap) Clear() {
+	m.order = nil
+	m.entries = nil
+}
+
+// Set the value for a key. If the key already exists, its position in the
+// order is retained.
+func (m *Complex64OrderedMap) Set(key complex64, value interface{}) {
+	if elem, ok := m.entries[key]; ok {
+		elem.Value.(*Complex64Entry).Value = value
+		return
+	}
+	if m.entries == nil {
+		m.order = list.New()
+		m.entries = make(map[complex64]*list.Element)
+	}
+	m.entries[key] = m.order.PushBack(&Complex64Entry{Key: key, Value: value})
+}
+
+// Get returns the value for a key. 'ok' will be false if the key is not
+// present.
+func (m *Complex64OrderedMap) Get(key complex64) (value interface{}, ok bool) {
+	if elem, exists := m.entries[key]; exists {
+		return elem.Value.(*Complex64Entry).Value, true
+	}
+	return nil, false
+}
+
+// Contains returns true if the key exists within the map.
+func (m *Complex64OrderedMap) Contains(key complex64) bool {
+	_, ok := m.entries[key]
+	return ok
+}
+
+// Delete a key from the map. Returns true if the key was present.
+func (m *Complex64OrderedMap) Delete(key complex64) bool {
+	elem, ok := m.entries[key]
+	if ok {
+		m.order.Remove(elem)
+		delete(m.entries, key)
+	}
+	return ok
+}
+
+// Keys returns all keys in the map, in insertion order.
+func (m *Complex64OrderedMap) Keys() []complex64 {
+	keys := make([]complex64, 0, len(m.entries))
+	m.Each(func(key complex64, _ interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Values returns all values in the map, in insertion order.
+func (m *Complex64OrderedMap) Values() []interface{} {
+	values := make([]interface{}, 0, len(m.entries))
+	m.Each(func(_ complex64, value interface{}) bool {
+		values = append(values, value)
+		return true
+	})
+	return values
+}
+
+// Entries returns all entries in the map, in insertion order.
+func (m *Complex64OrderedMap) Entries() []Complex64Entry {
+	entries := make([]Complex64Entry, 0, len(m.entries))
+	m.Each(func(key complex64, value interface{}) bool {
+		entries = append(entries, Complex64Entry{Key: key, Value: value})
+		return true
+	})
+	return entries
+}
+
+// Each calls 'f' for each entry in the map, in insertion order. Iteration
+// stops early if 'f' returns false. 'f' must not modify the map.
+func (m *Complex64OrderedMap) Each(f func(key complex64, value interface{}) bool) {
+	if m.order == nil {
+		return
+	}
+	for elem := m.order.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*Complex64Entry)
+		if !f(e.Key, e.Value) {
+			return
+		}
+	}
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (m *Complex64OrderedMap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Entries())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (m *Complex64OrderedMap) UnmarshalJSON(data []byte) error {
+	var entries []Complex64Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	m.Clear()
+	for _, e := range entries {
+		m.Set(e.Key, e.Value)
+	}
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (m *Complex64OrderedMap) MarshalYAML() (interface{}, error) {
+	return m.Entries(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (m *Complex64OrderedMap) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []Complex64Entry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	m.Clear()
+	for _, e := range entries {
+		m.Set(e.Key, e.Value)
+	}
+	return nil
+}
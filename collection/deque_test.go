@@ -0,0 +1,71 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/collection"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDeque(t *testing.T) {
+	d := collection.NewIntDeque()
+	assert.True(t, d.Empty())
+	_, ok := d.PopFront()
+	assert.False(t, ok)
+	_, ok = d.PopBack()
+	assert.False(t, ok)
+	for i := 0; i < 20; i++ {
+		d.PushBack(i)
+		d.PushFront(-i - 1)
+	}
+	assert.Equal(t, 40, d.Len())
+	v, ok := d.Front()
+	assert.True(t, ok)
+	assert.Equal(t, -20, v)
+	v, ok = d.Back()
+	assert.True(t, ok)
+	assert.Equal(t, 19, v)
+	assert.Equal(t, -1, d.At(19))
+	assert.Equal(t, 0, d.At(20))
+	for i := 19; i >= 0; i-- {
+		v, ok = d.PopBack()
+		assert.True(t, ok)
+		assert.Equal(t, i, v)
+	}
+	for i := 20; i > 0; i-- {
+		v, ok = d.PopFront()
+		assert.True(t, ok)
+		assert.Equal(t, -i, v)
+	}
+	assert.True(t, d.Empty())
+	assert.Panics(t, func() { d.At(0) })
+}
+
+func TestDequeMarshaling(t *testing.T) {
+	d := collection.NewStringDeque("a", "b")
+	d.PushFront("z")
+	data, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.Equal(t, `["z","a","b"]`, string(data))
+	var d2 collection.StringDeque
+	require.NoError(t, json.Unmarshal(data, &d2))
+	assert.Equal(t, d.Values(), d2.Values())
+	data, err = yaml.Marshal(d)
+	require.NoError(t, err)
+	var d3 collection.StringDeque
+	require.NoError(t, yaml.Unmarshal(data, &d3))
+	assert.Equal(t, d.Values(), d3.Values())
+}
@@ -0,0 +1,279 @@
+// Code created from "lrucache.go.tmpl" - don't edit by hand
+//
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type float64LRUEntry struct {
+	key     float64
+	value   interface{}
+	expires time.Time
+}
+
+// Float64LRUCache holds a cache of values keyed by float64 values. When the
+// cache is full, the least recently used entry is evicted to make room. Entries
+// may also expire after a time-to-live. It is safe for concurrent use. A zero
+// value cache has no capacity limit and no time-to-live.
+type Float64LRUCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[float64]*list.Element
+}
+
+// NewFloat64LRUCache creates a new cache. A capacity less than 1 means the
+// cache will not be limited in size. A ttl less than 1 means entries will not
+// expire.
+func NewFloat64LRUCache(capacity int, ttl time.Duration) *Float64LRUCache {
+	return &Float64LRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+// Len returns the number of entries in the cache. Expired entries that have
+// not yet been pruned are included.
+func (c *Float64LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Capacity returns the maximum number of entries the cache will hold.
+func (c *Float64LRUCache) Capacity() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.capacity
+}
+
+// SetCapacity sets the maximum number of entries the cache will hold,
+// evicting the least recently used entries if needed.
+func (c *Float64LRUCache) SetCapacity(capacity int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.capacity = capacity
+	c.evictIfNeeded()
+}
+
+// Clear the cache.
+func (c *Float64LRUCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order = nil
+	c.entries = nil
+}
+
+// Set the value for a key, using the cache's default time-to-live.
+func (c *Float64LRUCache) Set(key float64, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.set(key, value, c.ttl)
+}
+
+// SetWithTTL sets the value for a key, using the specified time-to-live. A
+// ttl less than 1 means the entry will not expire.
+func (c *Float64LRUCache) SetWithTTL(key float64, value interface{}, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.set(key, value, ttl)
+}
+
+// Get returns the value for a key and marks it as most recently used. 'ok'
+// will be false if the key is not present or has expired.
+func (c *Float64LRUCache) Get(key float64) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem := c.live(key); elem != nil {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*float64LRUEntry).value, true
+	}
+	return nil, false
+}
+
+// Peek returns the value for a key without changing its recency. 'ok' will be
+// false if the key is not present or has expired.
+func (c *Float64LRUCache) Peek(key float64) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem := c.live(key); elem != nil {
+		return elem.Value.(*float64LRUEntry).value, true
+	}
+	return nil, false
+}
+
+// Contains returns true if the key exists within the cache and has not
+// expired.
+func (c *Float64LRUCache) Contains(key float64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.live(key) != nil
+}
+
+// Delete a key from the cache. Returns true if the key was present.
+func (c *Float64LRUCache) Delete(key float64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.remove(elem)
+	}
+	return ok
+}
+
+// Prune removes all expired entries from the cache and returns the number of
+// entries that were removed.
+func (c *Float64LRUCache) Prune() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.order == nil {
+		return 0
+	}
+	now := time.Now()
+	count := 0
+	var next *list.Element
+	for elem := c.order.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		if e := elem.Value.(*float64LRUEntry); !e.expires.IsZero() && !now.Before(e.expires) {
+			c.remove(elem)
+			count++
+		}
+	}
+	return count
+}
+
+// Keys returns the keys of all unexpired entries in the cache, from most to
+// least recently used.
+func (c *Float64LRUCache) Keys() []float64 {
+	entries := c.Entries()
+	keys := make([]float64, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+// Entries returns all unexpired entries in the cache, from most to least
+// recently used.
+func (c *Float64LRUCache) Entries() []Float64Entry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := make([]Float64Entry, 0, len(c.entries))
+	if c.order != nil {
+		now := time.Now()
+		for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+			if e := elem.Value.(*float64LRUEntry); e.expires.IsZero() || now.Before(e.expires) {
+				entries = append(entries, Float64Entry{Key: e.key, Value: e.value})
+			}
+		}
+	}
+	return entries
+}
+
+func (c *Float64LRUCache) set(key float64, value interface{}, ttl time.Duration) {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*float64LRUEntry)
+		e.value = value
+		e.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = make(map[float64]*list.Element)
+	}
+	c.entries[key] = c.order.PushFront(&float64LRUEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+	c.evictIfNeeded()
+}
+
+func (c *Float64LRUCache) live(key float64) *list.Element {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if e := elem.Value.(*float64LRUEntry); !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		c.remove(elem)
+		return nil
+	}
+	return elem
+}
+
+func (c *Float64LRUCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*float64LRUEntry).key)
+}
+
+func (c *Float64LRUCache) evictIfNeeded() {
+	if c.capacity < 1 || c.order == nil {
+		return
+	}
+	for len(c.entries) > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Float64LRUCache) load(entries []Float64Entry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order = nil
+	c.entries = nil
+	for i := len(entries) - 1; i >= 0; i-- {
+		c.set(entries[i].Key, entries[i].Value, c.ttl)
+	}
+}
+
+// MarshalJSON implements the json.Marshaler interface. Entries are written
+// from most to least recently used. Expiration times are not preserved.
+func (c *Float64LRUCache) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Entries())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. Entries are given
+// the cache's default time-to-live.
+func (c *Float64LRUCache) UnmarshalJSON(data []byte) error {
+	var entries []Float64Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.load(entries)
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface. Entries are written
+// from most to least recently used. Expiration times are not preserved.
+func (c *Float64LRUCache) MarshalYAML() (interface{}, error) {
+	return c.Entries(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface. Entries are given
+// the cache's default time-to-live.
+func (c *Float64LRUCache) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []Float64Entry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	c.load(entries)
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/collection"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestHeap(t *testing.T) {
+	h := collection.NewIntHeap(nil, 5, 3, 9, 1, 7)
+	assert.Equal(t, 5, h.Len())
+	v, ok := h.Peek()
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	assert.Equal(t, []int{1, 3, 5, 7, 9}, h.Values())
+	for _, expected := range []int{1, 3, 5, 7, 9} {
+		v, ok = h.Pop()
+		assert.True(t, ok)
+		assert.Equal(t, expected, v)
+	}
+	_, ok = h.Pop()
+	assert.False(t, ok)
+	h = collection.NewIntHeap(func(a, b int) bool { return a > b }, 5, 3, 9, 1, 7)
+	v, ok = h.Pop()
+	assert.True(t, ok)
+	assert.Equal(t, 9, v)
+}
+
+func TestHeapMarshaling(t *testing.T) {
+	h := collection.NewFloat64Heap(nil, 2.5, -1, 10)
+	data, err := json.Marshal(h)
+	require.NoError(t, err)
+	assert.Equal(t, `[-1,2.5,10]`, string(data))
+	var h2 collection.Float64Heap
+	require.NoError(t, json.Unmarshal(data, &h2))
+	assert.Equal(t, h.Values(), h2.Values())
+	data, err = yaml.Marshal(h)
+	require.NoError(t, err)
+	var h3 collection.Float64Heap
+	require.NoError(t, yaml.Unmarshal(data, &h3))
+	assert.Equal(t, h.Values(), h3.Values())
+}
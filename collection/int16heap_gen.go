@@ -0,0 +1,157 @@
+// Code created from "heap.go.tmpl" - don't edit by hand
+//
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Int16Heap holds a priority queue of int16 values. The value that sorts
+// first according to the heap's less function is always at the top. A zero
+// value heap orders its values from lowest to highest.
+type Int16Heap struct {
+	values []int16
+	less   func(a, b int16) bool
+}
+
+// NewInt16Heap creates a new heap from its input values. If 'less' is nil,
+// values are ordered from lowest to highest.
+func NewInt16Heap(less func(a, b int16) bool, values ...int16) *Int16Heap {
+	h := &Int16Heap{less: less}
+	h.Push(values...)
+	return h
+}
+
+// Len returns the number of values in the heap.
+func (h *Int16Heap) Len() int {
+	return len(h.values)
+}
+
+// Empty returns true if there are no values in the heap.
+func (h *Int16Heap) Empty() bool {
+	return len(h.values) == 0
+}
+
+// Clear the heap.
+func (h *Int16Heap) Clear() {
+	h.values = nil
+}
+
+// Push values onto the heap.
+func (h *Int16Heap) Push(values ...int16) {
+	for _, v := range values {
+		h.values = append(h.values, v)
+		h.up(len(h.values) - 1)
+	}
+}
+
+// Pop removes and returns the value at the top of the heap. 'ok' will be false
+// if the heap was empty.
+func (h *Int16Heap) Pop() (value int16, ok bool) {
+	n := len(h.values) - 1
+	if n < 0 {
+		return value, false
+	}
+	value = h.values[0]
+	h.values[0] = h.values[n]
+	h.values = h.values[:n]
+	if n > 0 {
+		h.down(0)
+	}
+	return value, true
+}
+
+// Peek returns the value at the top of the heap without removing it. 'ok' will
+// be false if the heap was empty.
+func (h *Int16Heap) Peek() (value int16, ok bool) {
+	if len(h.values) == 0 {
+		return value, false
+	}
+	return h.values[0], true
+}
+
+// Values returns all values in the heap, in the order they would be popped.
+func (h *Int16Heap) Values() []int16 {
+	values := make([]int16, len(h.values))
+	copy(values, h.values)
+	sort.Slice(values, func(i, j int) bool { return h.lessThan(values[i], values[j]) })
+	return values
+}
+
+func (h *Int16Heap) lessThan(a, b int16) bool {
+	if h.less != nil {
+		return h.less(a, b)
+	}
+	return a < b
+}
+
+func (h *Int16Heap) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h.lessThan(h.values[i], h.values[parent]) {
+			break
+		}
+		h.values[i], h.values[parent] = h.values[parent], h.values[i]
+		i = parent
+	}
+}
+
+func (h *Int16Heap) down(i int) {
+	n := len(h.values)
+	for {
+		child := 2*i + 1
+		if child >= n {
+			break
+		}
+		if right := child + 1; right < n && h.lessThan(h.values[right], h.values[child]) {
+			child = right
+		}
+		if !h.lessThan(h.values[child], h.values[i]) {
+			break
+		}
+		h.values[i], h.values[child] = h.values[child], h.values[i]
+		i = child
+	}
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (h *Int16Heap) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Values())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (h *Int16Heap) UnmarshalJSON(data []byte) error {
+	var values []int16
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	h.Clear()
+	h.Push(values...)
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (h *Int16Heap) MarshalYAML() (interface{}, error) {
+	return h.Values(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (h *Int16Heap) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []int16
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+	h.Clear()
+	h.Push(values...)
+	return nil
+}
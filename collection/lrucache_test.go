@@ -0,0 +1,67 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/collection"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := collection.NewStringLRUCache(2, 0)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	c.Set("c", 3)
+	assert.Equal(t, 2, c.Len())
+	assert.False(t, c.Contains("b"))
+	assert.Equal(t, []string{"c", "a"}, c.Keys())
+	v, ok := c.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	c.SetCapacity(1)
+	assert.Equal(t, []string{"c"}, c.Keys())
+	assert.True(t, c.Delete("c"))
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := collection.NewIntLRUCache(0, 10*time.Millisecond)
+	c.Set(1, "short")
+	c.SetWithTTL(2, "forever", 0)
+	time.Sleep(20 * time.Millisecond)
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+	c.Set(3, "short")
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, 1, c.Prune())
+	v, ok := c.Get(2)
+	assert.True(t, ok)
+	assert.Equal(t, "forever", v)
+}
+
+func TestLRUCacheMarshaling(t *testing.T) {
+	c := collection.NewIntLRUCache(10, 0)
+	c.Set(1, "a")
+	c.Set(2, "b")
+	data, err := json.Marshal(c)
+	require.NoError(t, err)
+	assert.Equal(t, `[{"key":2,"value":"b"},{"key":1,"value":"a"}]`, string(data))
+	var c2 collection.IntLRUCache
+	require.NoError(t, json.Unmarshal(data, &c2))
+	assert.Equal(t, c.Entries(), c2.Entries())
+}
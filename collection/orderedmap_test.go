@@ -0,0 +1,55 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package collection_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/collection"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestOrderedMap(t *testing.T) {
+	m := collection.NewStringOrderedMap()
+	assert.True(t, m.Empty())
+	m.Set("c", 1)
+	m.Set("a", 2)
+	m.Set("b", 3)
+	m.Set("c", 4)
+	assert.Equal(t, 3, m.Len())
+	assert.Equal(t, []string{"c", "a", "b"}, m.Keys())
+	assert.Equal(t, []interface{}{4, 2, 3}, m.Values())
+	v, ok := m.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, v)
+	assert.True(t, m.Delete("a"))
+	assert.False(t, m.Delete("a"))
+	assert.False(t, m.Contains("a"))
+	assert.Equal(t, []string{"c", "b"}, m.Keys())
+}
+
+func TestOrderedMapMarshaling(t *testing.T) {
+	m := collection.NewIntOrderedMap(collection.IntEntry{Key: 3, Value: "x"}, collection.IntEntry{Key: 1, Value: "y"})
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	assert.Equal(t, `[{"key":3,"value":"x"},{"key":1,"value":"y"}]`, string(data))
+	var m2 collection.IntOrderedMap
+	require.NoError(t, json.Unmarshal(data, &m2))
+	assert.Equal(t, m.Entries(), m2.Entries())
+	data, err = yaml.Marshal(m)
+	require.NoError(t, err)
+	var m3 collection.IntOrderedMap
+	require.NoError(t, yaml.Unmarshal(data, &m3))
+	assert.Equal(t, m.Entries(), m3.Entries())
+}
@@ -0,0 +1,150 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package quadtree
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/richardwilkes/toolbox/xmath/geom"
+)
+
+type candidate struct {
+	distance float64
+	tree     *node
+	obj      Node
+}
+
+type candidates []candidate
+
+func (c candidates) Len() int {
+	return len(c)
+}
+
+func (c candidates) Less(i, j int) bool {
+	return c[i].distance < c[j].distance
+}
+
+func (c candidates) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+func (c *candidates) Push(x interface{}) {
+	*c = append(*c, x.(candidate))
+}
+
+func (c *candidates) Pop() interface{} {
+	old := *c
+	n := len(old) - 1
+	x := old[n]
+	old[n] = candidate{}
+	*c = old[:n]
+	return x
+}
+
+// FindNearest returns the node whose bounds are closest to the point, or nil
+// if there are no nodes within maxDistance of the point. A node whose bounds
+// contain the point has a distance of 0. A negative maxDistance means no
+// limit.
+func (q *QuadTree) FindNearest(pt geom.Point, maxDistance float64) Node {
+	if result := q.nearest(nil, pt, 1, maxDistance); len(result) != 0 {
+		return result[0]
+	}
+	return nil
+}
+
+// FindMatchedNearest returns the node that the matcher returns true for whose
+// bounds are closest to the point, or nil if there are no such nodes within
+// maxDistance of the point. A node whose bounds contain the point has a
+// distance of 0. A negative maxDistance means no limit.
+func (q *QuadTree) FindMatchedNearest(matcher Matcher, pt geom.Point, maxDistance float64) Node {
+	if result := q.nearest(matcher, pt, 1, maxDistance); len(result) != 0 {
+		return result[0]
+	}
+	return nil
+}
+
+// FindKNearest returns up to k nodes whose bounds are closest to the point and
+// within maxDistance of it, ordered from nearest to farthest. A node whose
+// bounds contain the point has a distance of 0. A negative maxDistance means
+// no limit.
+func (q *QuadTree) FindKNearest(pt geom.Point, k int, maxDistance float64) []Node {
+	return q.nearest(nil, pt, k, maxDistance)
+}
+
+// FindMatchedKNearest returns up to k nodes that the matcher returns true for
+// whose bounds are closest to the point and within maxDistance of it, ordered
+// from nearest to farthest. A node whose bounds contain the point has a
+// distance of 0. A negative maxDistance means no limit.
+func (q *QuadTree) FindMatchedKNearest(matcher Matcher, pt geom.Point, k int, maxDistance float64) []Node {
+	return q.nearest(matcher, pt, k, maxDistance)
+}
+
+// nearest performs a best-first search of the tree. Since each tree node's
+// rect fully contains the bounds of everything stored beneath it, the
+// distance to a tree node's rect is a lower bound for the distance to any of
+// its contents, so nodes can be emitted as soon as they reach the front of the
+// queue.
+func (q *QuadTree) nearest(matcher Matcher, pt geom.Point, k int, maxDistance float64) []Node {
+	if k < 1 || q.count == 0 {
+		return nil
+	}
+	limit := math.Inf(1)
+	if maxDistance >= 0 {
+		limit = maxDistance * maxDistance
+	}
+	var queue candidates
+	for _, one := range q.outside {
+		if matcher == nil || matcher.Matches(one) {
+			if d := rectDistanceSquared(one.Bounds(), pt); d <= limit {
+				queue = append(queue, candidate{distance: d, obj: one})
+			}
+		}
+	}
+	if q.root != nil {
+		if d := rectDistanceSquared(q.root.rect, pt); d <= limit {
+			queue = append(queue, candidate{distance: d, tree: q.root})
+		}
+	}
+	heap.Init(&queue)
+	var result []Node
+	for queue.Len() > 0 && len(result) < k {
+		c := heap.Pop(&queue).(candidate)
+		if c.tree == nil {
+			result = append(result, c.obj)
+			continue
+		}
+		for _, one := range c.tree.contents {
+			if matcher == nil || matcher.Matches(one) {
+				if d := rectDistanceSquared(one.Bounds(), pt); d <= limit {
+					heap.Push(&queue, candidate{distance: d, obj: one})
+				}
+			}
+		}
+		if !c.tree.isLeaf() {
+			for _, child := range c.tree.children {
+				if d := rectDistanceSquared(child.rect, pt); d <= limit {
+					heap.Push(&queue, candidate{distance: d, tree: child})
+				}
+			}
+		}
+	}
+	return result
+}
+
+// rectDistanceSquared returns the square of the distance from the point to
+// the closest edge of the rect, or 0 if the rect contains the point. This is
+// the same value that the minimum of geom.PointSegmentDistanceSquared() across
+// each of the rect's edges would yield for a point outside of the rect.
+func rectDistanceSquared(rect geom.Rect, pt geom.Point) float64 {
+	dx := math.Max(math.Max(rect.X-pt.X, pt.X-rect.Right()), 0)
+	dy := math.Max(math.Max(rect.Y-pt.Y, pt.Y-rect.Bottom()), 0)
+	return dx*dx + dy*dy
+}
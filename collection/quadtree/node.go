@@ -50,18 +50,16 @@ func (n *node) insert(obj Node) {
 	n.contents = append(n.contents, obj)
 }
 
-func (n *node) remove(obj Node) bool {
+func (n *node) remove(obj Node, rect geom.Rect) bool {
 	for i, one := range n.contents {
 		if one == obj {
-			n.contents[i] = n.contents[len(n.contents)-1]
-			n.contents[len(n.contents)-1] = nil
-			n.contents = n.contents[:len(n.contents)-1]
+			n.removeAt(i)
 			return true
 		}
 	}
-	if !n.isLeaf() && n.rect.ContainsRect(obj.Bounds()) {
+	if !n.isLeaf() && n.rect.ContainsRect(rect) {
 		for _, child := range n.children {
-			if child.remove(obj) {
+			if child.remove(obj, rect) {
 				return true
 			}
 		}
@@ -69,6 +67,58 @@ func (n *node) remove(obj Node) bool {
 	return false
 }
 
+func (n *node) removeAt(i int) {
+	n.contents[i] = n.contents[len(n.contents)-1]
+	n.contents[len(n.contents)-1] = nil
+	n.contents = n.contents[:len(n.contents)-1]
+}
+
+// update locates obj using its old bounds and moves it to the appropriate
+// place for its new bounds. 'placed' will be false if obj was found but its new
+// bounds no longer fit within this node, in which case the caller is
+// responsible for placing it.
+func (n *node) update(obj Node, oldRect, newRect geom.Rect) (found, placed bool) {
+	for i, one := range n.contents {
+		if one == obj {
+			n.removeAt(i)
+			found = true
+			break
+		}
+	}
+	if !found && !n.isLeaf() && n.rect.ContainsRect(oldRect) {
+		for _, child := range n.children {
+			if found, placed = child.update(obj, oldRect, newRect); found {
+				if placed {
+					return true, true
+				}
+				break
+			}
+		}
+	}
+	if found && n.rect.ContainsRect(newRect) {
+		n.insert(obj)
+		return true, true
+	}
+	return found, false
+}
+
+func (n *node) stats(depth int, stats *Stats) {
+	stats.TreeNodes++
+	if depth > stats.Depth {
+		stats.Depth = depth
+	}
+	if len(n.contents) > stats.MaxNodesPerTreeNode {
+		stats.MaxNodesPerTreeNode = len(n.contents)
+	}
+	if n.isLeaf() {
+		stats.LeafTreeNodes++
+	} else {
+		for _, child := range n.children {
+			child.stats(depth+1, stats)
+		}
+	}
+}
+
 func (n *node) splitIfNeeded() {
 	if n.isLeaf() {
 		if len(n.contents) >= n.threshold {
@@ -34,10 +34,42 @@ type Matcher interface {
 
 // QuadTree stores two-dimensional nodes for fast lookup.
 type QuadTree struct {
-	Threshold int
-	count     int
-	root      *node
-	outside   []Node
+	Threshold       int
+	count           int
+	reorganizations int
+	root            *node
+	outside         []Node
+}
+
+// BoundsChange records the bounds a node had before it was changed. Used with
+// UpdateAll().
+type BoundsChange struct {
+	Node      Node
+	OldBounds geom.Rect
+}
+
+// Stats holds statistics about the structure of a QuadTree, useful for tuning
+// its threshold.
+type Stats struct {
+	// Nodes is the number of nodes contained within the QuadTree.
+	Nodes int
+	// Outside is the number of nodes that lie outside of the root's bounds
+	// and are waiting for a reorganization.
+	Outside int
+	// Depth is the number of levels in the tree, or 0 if there is no tree.
+	Depth int
+	// TreeNodes is the total number of subdivisions in the tree, including
+	// leaves.
+	TreeNodes int
+	// LeafTreeNodes is the number of subdivisions that have no children.
+	LeafTreeNodes int
+	// MaxNodesPerTreeNode is the largest number of nodes held directly by a
+	// single subdivision.
+	MaxNodesPerTreeNode int
+	// Reorganizations is the number of times the tree has been reorganized,
+	// either explicitly or because too many nodes were outside of the root's
+	// bounds.
+	Reorganizations int
 }
 
 // Size returns the number of nodes contained within the QuadTree.
@@ -53,42 +85,151 @@ func (q *QuadTree) threshold() int {
 }
 
 // Insert a node. NOTE: Once a node is inserted, the value it returns from a
-// call to Bounds() MUST REMAIN THE SAME until the node is removed.
+// call to Bounds() MUST REMAIN THE SAME until the node is removed or Update()
+// is called for it.
 func (q *QuadTree) Insert(n Node) {
+	if q.place(n) {
+		q.reorganizeIfNeeded()
+	}
+}
+
+// InsertAll inserts multiple nodes, reorganizing the QuadTree at most once.
+// This is considerably faster than calling Insert() for each node when loading
+// a large number of nodes.
+func (q *QuadTree) InsertAll(nodes ...Node) {
+	for _, n := range nodes {
+		q.place(n)
+	}
+	q.reorganizeIfNeeded()
+}
+
+func (q *QuadTree) place(n Node) bool {
 	rect := n.Bounds()
 	if rect.IsEmpty() {
-		return
+		return false
 	}
 	q.count++
 	if q.root != nil && q.root.rect.ContainsRect(rect) {
 		q.root.insert(n)
 	} else {
 		q.outside = append(q.outside, n)
-		if len(q.outside) > q.threshold() {
-			q.Reorganize()
-		}
+	}
+	return true
+}
+
+func (q *QuadTree) reorganizeIfNeeded() {
+	if len(q.outside) > q.threshold() {
+		q.Reorganize()
 	}
 }
 
 // Remove a node.
 func (q *QuadTree) Remove(n Node) {
-	for i, one := range q.outside {
-		if one != n {
-			continue
-		}
-		q.outside[i] = q.outside[len(q.outside)-1]
-		q.outside[len(q.outside)-1] = nil
-		q.outside = q.outside[:len(q.outside)-1]
+	q.remove(n, n.Bounds())
+}
+
+func (q *QuadTree) remove(n Node, rect geom.Rect) {
+	if i := q.outsideIndex(n); i != -1 {
+		q.removeOutside(i)
 		q.count--
 		return
 	}
 	if q.root != nil {
-		if q.root.remove(n) {
+		if q.root.remove(n, rect) {
 			q.count--
 		}
 	}
 }
 
+func (q *QuadTree) outsideIndex(n Node) int {
+	for i, one := range q.outside {
+		if one == n {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *QuadTree) removeOutside(i int) {
+	q.outside[i] = q.outside[len(q.outside)-1]
+	q.outside[len(q.outside)-1] = nil
+	q.outside = q.outside[:len(q.outside)-1]
+}
+
+// Update a node whose bounds have changed since it was inserted or last
+// updated. 'oldBounds' must be the value that the node's Bounds() method
+// returned at that time. This is much faster than removing and re-inserting
+// the node, as only the portion of the tree between the node's old and new
+// locations is touched. If the node was not present, it is inserted.
+func (q *QuadTree) Update(n Node, oldBounds geom.Rect) {
+	if q.update(n, oldBounds) {
+		q.reorganizeIfNeeded()
+	}
+}
+
+// UpdateAll updates multiple nodes whose bounds have changed, reorganizing the
+// QuadTree at most once. If a large fraction of the nodes have changed, the
+// QuadTree is simply reorganized, as that is cheaper than updating each node
+// individually.
+func (q *QuadTree) UpdateAll(changes []BoundsChange) {
+	if len(changes) > q.count/2 {
+		for _, change := range changes {
+			switch {
+			case change.OldBounds.IsEmpty():
+				q.place(change.Node)
+			case change.Node.Bounds().IsEmpty():
+				q.remove(change.Node, change.OldBounds)
+			}
+		}
+		q.Reorganize()
+		return
+	}
+	for _, change := range changes {
+		q.update(change.Node, change.OldBounds)
+	}
+	q.reorganizeIfNeeded()
+}
+
+func (q *QuadTree) update(n Node, oldBounds geom.Rect) bool {
+	if oldBounds.IsEmpty() {
+		return q.place(n)
+	}
+	rect := n.Bounds()
+	if rect.IsEmpty() {
+		q.remove(n, oldBounds)
+		return false
+	}
+	if i := q.outsideIndex(n); i != -1 {
+		if q.root != nil && q.root.rect.ContainsRect(rect) {
+			q.removeOutside(i)
+			q.root.insert(n)
+		}
+		return false
+	}
+	if q.root != nil {
+		if found, placed := q.root.update(n, oldBounds, rect); found {
+			if !placed {
+				q.outside = append(q.outside, n)
+			}
+			return !placed
+		}
+	}
+	return q.place(n)
+}
+
+// Stats returns statistics about the current structure of the QuadTree.
+func (q *QuadTree) Stats() Stats {
+	stats := Stats{
+		Nodes:           q.count,
+		Outside:         len(q.outside),
+		Reorganizations: q.reorganizations,
+	}
+	if q.root != nil {
+		q.root.stats(1, &stats)
+	}
+	return stats
+}
+
 // All returns all nodes.
 func (q *QuadTree) All() []Node {
 	all := make([]Node, 0, q.count)
@@ -106,6 +247,7 @@ func (q *QuadTree) Reorganize() {
 	for _, one := range all {
 		rect.Union(one.Bounds())
 	}
+	q.reorganizations++
 	q.root = nil
 	q.outside = make([]Node, 0)
 	if len(all) > 0 {
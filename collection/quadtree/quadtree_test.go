@@ -10,7 +10,9 @@
 package quadtree_test
 
 import (
+	"math"
 	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/richardwilkes/toolbox/collection/quadtree"
@@ -90,3 +92,109 @@ func TestGeneral(t *testing.T) {
 	assert.Subset(t, q.All(), []quadtree.Node{mine})
 	assert.Subset(t, q.FindContainedByRect(mine.Rect), []quadtree.Node{mine})
 }
+
+type evenMatcher struct{}
+
+func (evenMatcher) Matches(n quadtree.Node) bool {
+	return int(n.Bounds().X/10)%2 == 0
+}
+
+func TestFindNearest(t *testing.T) {
+	q := &quadtree.QuadTree{}
+	assert.Nil(t, q.FindNearest(geom.Point{}, -1))
+	var nodes []*node
+	for i := 0; i < 4*quadtree.DefaultQuadTreeThreshold; i++ {
+		n := newNode(float64(i*10), float64(i*10), 5, 5)
+		nodes = append(nodes, n)
+		q.Insert(n)
+	}
+	q.Reorganize()
+	assert.Equal(t, nodes[3], q.FindNearest(geom.NewPoint(32, 32), -1))
+	assert.Equal(t, nodes[3], q.FindNearest(geom.NewPoint(37, 37), -1))
+	assert.Equal(t, nodes[4], q.FindNearest(geom.NewPoint(39, 39), -1))
+	assert.Nil(t, q.FindNearest(geom.NewPoint(-10, -10), 5))
+	assert.Equal(t, nodes[0], q.FindNearest(geom.NewPoint(-10, -10), 15))
+	assert.Equal(t, nodes[4], q.FindMatchedNearest(evenMatcher{}, geom.NewPoint(36, 36), -1))
+	outside := newNode(-100, -100, 1, 1)
+	q.Insert(outside)
+	assert.Equal(t, outside, q.FindNearest(geom.NewPoint(-90, -90), -1))
+}
+
+func TestFindKNearest(t *testing.T) {
+	q := &quadtree.QuadTree{}
+	r := rand.New(rand.NewSource(22))
+	for i := 0; i < 20*quadtree.DefaultQuadTreeThreshold; i++ {
+		q.Insert(newNode(float64(r.Intn(10000)), float64(r.Intn(10000)), float64(1+r.Intn(50)), float64(1+r.Intn(50))))
+	}
+	q.Reorganize()
+	pt := geom.NewPoint(5000, 5000)
+	distance := func(n quadtree.Node) float64 {
+		b := n.Bounds()
+		return math.Min(math.Min(geom.PointSegmentDistance(b.Point, geom.NewPoint(b.Right(), b.Y), pt),
+			geom.PointSegmentDistance(b.Point, geom.NewPoint(b.X, b.Bottom()), pt)),
+			math.Min(geom.PointSegmentDistance(b.Max(), geom.NewPoint(b.Right(), b.Y), pt),
+				geom.PointSegmentDistance(b.Max(), geom.NewPoint(b.X, b.Bottom()), pt)))
+	}
+	all := q.All()
+	sort.Slice(all, func(i, j int) bool { return distance(all[i]) < distance(all[j]) })
+	found := q.FindKNearest(pt, 10, -1)
+	assert.Len(t, found, 10)
+	for i, one := range found {
+		assert.InDelta(t, distance(all[i]), distance(one), 0.000001)
+	}
+	for _, one := range q.FindKNearest(pt, 1000, 200) {
+		assert.True(t, distance(one) <= 200)
+	}
+	for _, one := range q.FindMatchedKNearest(evenMatcher{}, pt, 10, -1) {
+		assert.True(t, evenMatcher{}.Matches(one))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	q := &quadtree.QuadTree{}
+	r := rand.New(rand.NewSource(22))
+	nodes := make([]quadtree.Node, 0, 10*quadtree.DefaultQuadTreeThreshold)
+	for i := 0; i < 10*quadtree.DefaultQuadTreeThreshold; i++ {
+		nodes = append(nodes, newNode(float64(r.Intn(1000)), float64(r.Intn(1000)), float64(1+r.Intn(20)), float64(1+r.Intn(20))))
+	}
+	q.InsertAll(nodes...)
+	assert.Equal(t, len(nodes), q.Size())
+	stats := q.Stats()
+	assert.Equal(t, 1, stats.Reorganizations)
+	assert.Equal(t, 0, stats.Outside)
+	assert.True(t, stats.Depth > 1)
+	assert.Equal(t, len(nodes), stats.Nodes)
+
+	for i := 0; i < 50; i++ {
+		n := nodes[r.Intn(len(nodes))].(*node)
+		old := n.Rect
+		n.X = float64(r.Intn(1000))
+		n.Y = float64(r.Intn(1000))
+		q.Update(n, old)
+		assert.Equal(t, len(nodes), q.Size())
+		assert.Contains(t, q.FindContainsPoint(n.Point), quadtree.Node(n))
+		assert.NotContains(t, q.FindContainedByRect(old), quadtree.Node(n))
+	}
+	moved := nodes[0].(*node)
+	old := moved.Rect
+	moved.X = 5000
+	q.Update(moved, old)
+	assert.Equal(t, 1, q.Stats().Outside)
+	assert.Equal(t, moved, q.FindNearest(geom.NewPoint(5000, old.Y), 0))
+
+	changes := make([]quadtree.BoundsChange, 0, len(nodes))
+	for _, one := range nodes {
+		n := one.(*node)
+		changes = append(changes, quadtree.BoundsChange{Node: n, OldBounds: n.Rect})
+		n.X += 10
+		n.Y += 10
+	}
+	q.UpdateAll(changes)
+	assert.Equal(t, len(nodes), q.Size())
+	assert.Equal(t, 0, q.Stats().Outside)
+	for _, one := range nodes {
+		assert.Contains(t, q.FindContainsPoint(one.Bounds().Point), one)
+	}
+	q.Remove(moved)
+	assert.Equal(t, len(nodes)-1, q.Size())
+}
@@ -11,14 +11,17 @@ package json
 
 import (
 	"bytes"
+	"context"
 	"net/http"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
 )
 
-// GetRequest calls http.Get with the URL and returns the response body as a
-// new Data object.
+// GetRequest issues a GET request for the URL using xhttp.DefaultClient and
+// returns the response body as a new Data object.
 func GetRequest(url string) (statusCode int, body *Data, err error) {
 	var resp *http.Response
-	if resp, err = http.Get(url); err == nil { //nolint:gosec
+	if resp, err = xhttp.DefaultClient.Get(context.Background(), url); err == nil {
 		defer func() {
 			if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
 				err = closeErr
@@ -32,11 +35,12 @@ func GetRequest(url string) (statusCode int, body *Data, err error) {
 	return
 }
 
-// PostRequest calls http.Post with the URL and the contents of this Data
-// object and returns the response body as a new Data object.
+// PostRequest issues a POST request for the URL with the contents of this
+// Data object using xhttp.DefaultClient and returns the response body as a new
+// Data object.
 func (j *Data) PostRequest(url string) (statusCode int, body *Data, err error) {
 	var resp *http.Response
-	if resp, err = http.Post(url, "application/json", bytes.NewBuffer(j.Bytes())); err == nil { //nolint:gosec
+	if resp, err = xhttp.DefaultClient.Post(context.Background(), url, "application/json", bytes.NewReader(j.Bytes())); err == nil {
 		defer func() {
 			if closeErr := resp.Body.Close(); closeErr != nil && err == nil {
 				err = closeErr
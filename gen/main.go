@@ -96,6 +96,12 @@ func main() {
 	jot.FatalIfErr(errs.Wrap(err))
 	for _, one := range setTypes {
 		jot.FatalIfErr(writeGoTemplate(tmpls, "set.go.tmpl", "../collection/"+one+"set_gen.go", one))
+		jot.FatalIfErr(writeGoTemplate(tmpls, "deque.go.tmpl", "../collection/"+one+"deque_gen.go", one))
+		jot.FatalIfErr(writeGoTemplate(tmpls, "orderedmap.go.tmpl", "../collection/"+one+"orderedmap_gen.go", one))
+		jot.FatalIfErr(writeGoTemplate(tmpls, "lrucache.go.tmpl", "../collection/"+one+"lrucache_gen.go", one))
+		if isOrdered(one) {
+			jot.FatalIfErr(writeGoTemplate(tmpls, "heap.go.tmpl", "../collection/"+one+"heap_gen.go", one))
+		}
 	}
 	for _, one := range cmdlineTypes {
 		jot.FatalIfErr(writeGoTemplate(tmpls, "values.go.tmpl", "../cmdline/"+toName(one.Type)+"_value_gen.go", one))
@@ -118,6 +124,10 @@ func toName(in string) string {
 	return in
 }
 
+func isOrdered(in string) bool {
+	return !strings.HasPrefix(in, "complex")
+}
+
 func wrapCommentWithLength(in string, length int) string {
 	return txt.Wrap("// ", in, length)
 }
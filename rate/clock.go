@@ -0,0 +1,122 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package rate
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the time source used by a limiter.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc calls 'f' in its own goroutine once the duration has
+	// elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is returned by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. Returns false if the timer has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// SystemClock is a Clock that uses the system's time.
+type SystemClock struct{}
+
+// Now implements Clock.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc implements Clock.
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock is a Clock whose time only moves when Advance is called,
+// allowing limiters to be tested without depending on real time.
+type ManualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	when  time.Time
+	f     func()
+}
+
+// NewManualClock creates a new ManualClock set to the specified time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now implements Clock.
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// AfterFunc implements Clock. Unlike the system clock, 'f' is called
+// synchronously from within Advance.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &manualTimer{
+		clock: c,
+		when:  c.now.Add(d),
+		f:     f,
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing any timers that come due along the
+// way, in order. The clock reads each timer's due time while it fires.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	c.now = end
+	c.lock.Unlock()
+}
+
+// Stop implements Timer.
+func (t *manualTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, one := range t.clock.timers {
+		if one == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -9,7 +9,13 @@
 
 package rate
 
-// Limiter provides a rate limiter.
+import "context"
+
+// Limiter provides a rate limiter. Requests made through the same limiter are
+// granted in the order they were made, and a request that is waiting holds
+// back later requests that need the same capacity, so small requests cannot
+// starve large ones. Sibling limiters competing for their parent's capacity
+// share it in proportion to their weights.
 type Limiter interface {
 	// New returns a new limiter that is subordinate to this limiter, meaning
 	// that its cap rate is also capped by its parent.
@@ -24,10 +30,32 @@ type Limiter interface {
 	// LastUsed returns the capacity used in the last time period.
 	LastUsed() int
 
+	// Weight returns the weight used when sharing the parent's capacity with
+	// sibling limiters.
+	Weight() int
+
+	// SetWeight sets the weight used when sharing the parent's capacity with
+	// sibling limiters. A limiter with twice the weight of a sibling is
+	// given roughly twice the capacity when both are waiting. Values less
+	// than 1 are treated as 1, which is also the default.
+	SetWeight(weight int)
+
 	// Use returns a channel that will return nil when the request is
 	// successful, or an error if the request cannot be fulfilled.
 	Use(amount int) <-chan error
 
+	// Wait blocks until the request is successful, returning nil, or until
+	// it cannot be fulfilled or the context is done, returning an error.
+	Wait(ctx context.Context, amount int) error
+
+	// TryUse uses the capacity and returns true if it is available now
+	// without waiting, otherwise returns false and uses nothing.
+	TryUse(amount int) bool
+
+	// Reserve queues a request and returns a Reservation that can report
+	// when it is expected to be granted, or be cancelled.
+	Reserve(amount int) (*Reservation, error)
+
 	// Closed returns true if the limiter is closed.
 	Closed() bool
 
@@ -12,101 +12,157 @@
 package rate
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/richardwilkes/toolbox/errs"
 )
 
+// Config holds the configuration for a new top-level rate limiter.
+type Config struct {
+	// Algorithm used by the limiter and all of its children.
+	Algorithm Algorithm
+	// Capacity is the number of units (bytes, for example) allowed to be
+	// used in a particular time Period.
+	Capacity int
+	Period   time.Duration
+	// Burst is the largest number of units a TokenBucket limiter allows to
+	// be used at once. Defaults to Capacity. Children are given a burst in
+	// the same proportion to their capacity.
+	Burst int
+	// Clock defaults to SystemClock.
+	Clock Clock
+}
+
 type limiter struct {
 	controller *controller
 	parent     *limiter
 	children   []*limiter
-	last       int
+	policy     policy
 	capacity   int
+	statsStart time.Time
+	last       int
 	used       int
+	weight     int
+	vtime      float64
+	vfinish    float64
 	closed     bool
 }
 
 type controller struct {
+	config  Config
+	origin  time.Time
 	root    *limiter
-	ticker  *time.Ticker
-	done    chan bool
 	lock    sync.RWMutex
+	timer   Timer
 	waiting []*request
+	blocked map[*limiter]bool
+	seq     uint64
 }
 
+// request holds a request for capacity. To share capacity between siblings,
+// each request carries start-time fair queueing tags for every limiter on
+// its path below the root: a limiter's requests are stamped with
+// consecutive spans of virtual time, each span being the amount divided by
+// the limiter's weight, and siblings are served in order of those stamps.
 type request struct {
-	limiter *limiter
-	amount  int
-	done    chan error
+	limiter   *limiter
+	amount    int
+	seq       uint64
+	path      []*limiter
+	starts    []float64
+	finishes  []float64
+	done      chan error
+	pending   bool
+	granted   bool
+	grantedAt time.Time
 }
 
-// New creates a new top-level rate limiter. 'capacity' is the number of units
-// (bytes, for example) allowed to be used in a particular time 'period'.
+// New creates a new top-level fixed window rate limiter. 'capacity' is the
+// number of units (bytes, for example) allowed to be used in a particular
+// time 'period'.
 func New(capacity int, period time.Duration) Limiter {
+	return NewWithConfig(Config{
+		Algorithm: FixedWindow,
+		Capacity:  capacity,
+		Period:    period,
+	})
+}
+
+// NewTokenBucket creates a new top-level token bucket rate limiter, which
+// refills at 'capacity' units per 'period' and allows up to 'burst' units to
+// be used at once.
+func NewTokenBucket(capacity int, period time.Duration, burst int) Limiter {
+	return NewWithConfig(Config{
+		Algorithm: TokenBucket,
+		Capacity:  capacity,
+		Period:    period,
+		Burst:     burst,
+	})
+}
+
+// NewSlidingWindow creates a new top-level sliding window rate limiter, which
+// allows 'capacity' units to be used within any span of time 'period' long.
+func NewSlidingWindow(capacity int, period time.Duration) Limiter {
+	return NewWithConfig(Config{
+		Algorithm: SlidingWindow,
+		Capacity:  capacity,
+		Period:    period,
+	})
+}
+
+// NewWithConfig creates a new top-level rate limiter.
+func NewWithConfig(config Config) Limiter {
+	if config.Clock == nil {
+		config.Clock = SystemClock{}
+	}
+	if config.Burst < 1 {
+		config.Burst = config.Capacity
+	}
 	c := &controller{
-		ticker: time.NewTicker(period),
-		done:   make(chan bool),
+		config: config,
+		origin: config.Clock.Now(),
 	}
+	c.root = c.newLimiter(nil, config.Capacity)
+	return c.root
+}
+
+func (c *controller) newLimiter(parent *limiter, capacity int) *limiter {
 	l := &limiter{
 		controller: c,
+		parent:     parent,
 		capacity:   capacity,
+		statsStart: windowStart(c.origin, c.config.Clock.Now(), c.config.Period),
+		weight:     1,
 	}
-	c.root = l
-	go func() {
-		for {
-			select {
-			case <-c.ticker.C:
-				c.lock.Lock()
-				c.root.reset()
-				remaining := make([]*request, 0, len(c.waiting))
-				for _, req := range c.waiting {
-					if req.limiter.closed {
-						req.done <- errs.New("Limiter is closed")
-						continue
-					}
-					if req.amount > req.limiter.capacity {
-						req.done <- errs.Newf("Amount (%d) is greater than capacity (%d)", req.amount, req.limiter.capacity)
-						continue
-					}
-					if c.root.capacity-c.root.used > 0 {
-						available := req.limiter.capacity - req.limiter.used
-						p := req.limiter.parent
-						for p != nil {
-							pa := p.capacity - p.used
-							if pa < available {
-								available = pa
-							}
-							p = p.parent
-						}
-						if available >= req.amount {
-							req.limiter.used += req.amount
-							p = req.limiter.parent
-							for p != nil {
-								p.used += req.amount
-								p = p.parent
-							}
-							req.done <- nil
-							continue
-						}
-					}
-					remaining = append(remaining, req)
-				}
-				c.waiting = remaining
-				c.lock.Unlock()
-			case <-c.done:
-				c.ticker.Stop()
-				c.lock.Lock()
-				for _, req := range c.waiting {
-					req.done <- errs.New("Limiter is closed")
-				}
-				c.waiting = make([]*request, 0)
-				c.lock.Unlock()
-				return
-			}
+	now := c.config.Clock.Now()
+	switch c.config.Algorithm {
+	case TokenBucket:
+		burst := scaleBurst(c.config.Burst, c.config.Capacity, capacity)
+		l.policy = &tokenBucket{
+			period:   c.config.Period,
+			last:     now,
+			capacity: capacity,
+			burst:    burst,
+			tokens:   float64(burst),
+		}
+	case SlidingWindow:
+		l.policy = &slidingWindow{
+			origin:   c.origin,
+			period:   c.config.Period,
+			start:    windowStart(c.origin, now, c.config.Period),
+			capacity: capacity,
+		}
+	default:
+		l.policy = &fixedWindow{
+			origin:   c.origin,
+			period:   c.config.Period,
+			start:    windowStart(c.origin, now, c.config.Period),
+			capacity: capacity,
 		}
-	}()
+	}
 	return l
 }
 
@@ -116,11 +172,7 @@ func (l *limiter) New(capacity int) Limiter {
 	if l.closed {
 		return nil
 	}
-	child := &limiter{
-		controller: l.controller,
-		parent:     l,
-		capacity:   capacity,
-	}
+	child := l.controller.newLimiter(l, capacity)
 	l.children = append(l.children, child)
 	return child
 }
@@ -142,74 +194,412 @@ func (l *limiter) Cap(applyParentCaps bool) int {
 }
 
 func (l *limiter) SetCap(capacity int) {
-	l.controller.lock.Lock()
+	c := l.controller
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	l.capacity = capacity
-	l.controller.lock.Unlock()
+	l.policy.setCap(c.config.Clock.Now(), capacity)
+	c.process()
 }
 
-func (l *limiter) LastUsed() int {
+func (l *limiter) Weight() int {
 	l.controller.lock.RLock()
 	defer l.controller.lock.RUnlock()
+	return l.weight
+}
+
+func (l *limiter) SetWeight(weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	l.controller.lock.Lock()
+	l.weight = weight
+	l.controller.lock.Unlock()
+}
+
+func (l *limiter) LastUsed() int {
+	l.controller.lock.Lock()
+	defer l.controller.lock.Unlock()
+	l.rollStats(l.controller.config.Clock.Now())
 	return l.last
 }
 
+// rollStats moves the usage statistics forward to the period containing
+// 'now'.
+func (l *limiter) rollStats(now time.Time) {
+	period := l.controller.config.Period
+	if now.Sub(l.statsStart) >= period {
+		start := windowStart(l.controller.origin, now, period)
+		if start.Sub(l.statsStart) == period {
+			l.last = l.used
+		} else {
+			l.last = 0
+		}
+		l.used = 0
+		l.statsStart = start
+	}
+}
+
 func (l *limiter) Use(amount int) <-chan error {
-	done := make(chan error, 1)
-	if amount < 0 {
-		done <- errs.Newf("Amount (%d) must be positive", amount)
+	req, err := l.reserve(amount)
+	if err != nil {
+		done := make(chan error, 1)
+		done <- err
 		return done
 	}
+	return req.done
+}
+
+func (l *limiter) Wait(ctx context.Context, amount int) error {
+	if err := ctx.Err(); err != nil {
+		return errs.NewWithCause(err.Error(), err)
+	}
+	req, err := l.reserve(amount)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-req.done:
+		return err
+	case <-ctx.Done():
+		if l.controller.cancel(req) {
+			return errs.NewWithCause(ctx.Err().Error(), ctx.Err())
+		}
+		return <-req.done
+	}
+}
+
+func (l *limiter) TryUse(amount int) bool {
+	if amount < 0 {
+		return false
+	}
 	if amount == 0 {
-		done <- nil
-		return done
+		return true
 	}
-	l.controller.lock.Lock()
+	c := l.controller
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if l.check(amount) != nil {
+		return false
+	}
+	// Bring the set of blocked limiters up to date, so that capacity held
+	// back for waiting requests is not taken.
+	c.process()
+	now := c.config.Clock.Now()
+	if l.blockedBy(c.blocked) || !l.tryUse(now, amount) {
+		return false
+	}
+	c.grant(c.newRequest(l, amount), now)
+	return true
+}
+
+func (l *limiter) Reserve(amount int) (*Reservation, error) {
+	req, err := l.reserve(amount)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservation{
+		controller: l.controller,
+		req:        req,
+	}, nil
+}
+
+// reserve queues a request for 'amount' units, granting it right away if
+// possible.
+func (l *limiter) reserve(amount int) (*request, error) {
+	if amount < 0 {
+		return nil, errs.Newf("Amount (%d) must be positive", amount)
+	}
+	c := l.controller
+	if amount == 0 {
+		req := &request{
+			limiter:   l,
+			done:      make(chan error, 1),
+			granted:   true,
+			grantedAt: c.config.Clock.Now(),
+		}
+		req.done <- nil
+		return req, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := l.check(amount); err != nil {
+		return nil, err
+	}
+	req := c.newRequest(l, amount)
+	c.waiting = append(c.waiting, req)
+	c.process()
+	return req, nil
+}
+
+// check returns an error if a request for 'amount' units could never be
+// granted.
+func (l *limiter) check(amount int) error {
 	if l.closed {
-		l.controller.lock.Unlock()
-		done <- errs.New("Limiter is closed")
-		return done
+		return errs.New("Limiter is closed")
 	}
-	if amount > l.capacity {
-		capacity := l.capacity
-		l.controller.lock.Unlock()
-		done <- errs.Newf("Amount (%d) is greater than capacity (%d)", amount, capacity)
-		return done
+	max := l.policy.maxAmount()
+	for p := l.parent; p != nil; p = p.parent {
+		if pm := p.policy.maxAmount(); pm < max {
+			max = pm
+		}
+	}
+	if amount > max {
+		return errs.Newf("Amount (%d) is greater than capacity (%d)", amount, max)
+	}
+	return nil
+}
+
+// blockedBy returns true if this limiter or one of its ancestors is in the
+// blocked set.
+func (l *limiter) blockedBy(blocked map[*limiter]bool) bool {
+	for p := l; p != nil; p = p.parent {
+		if blocked[p] {
+			return true
+		}
 	}
-	available := l.capacity - l.used
-	p := l.parent
-	for p != nil {
-		pa := p.capacity - p.used
-		if pa < available {
+	return false
+}
+
+// available returns the units that may be used at 'now', taking the caps of
+// all ancestors into account.
+func (l *limiter) available(now time.Time) int {
+	available := l.policy.available(now)
+	for p := l.parent; p != nil; p = p.parent {
+		if pa := p.policy.available(now); pa < available {
 			available = pa
 		}
-		p = p.parent
 	}
-	if available >= amount {
-		l.used += amount
-		p = l.parent
-		for p != nil {
-			p.used += amount
-			p = p.parent
+	return available
+}
+
+// tryUse consumes 'amount' units from this limiter and its ancestors if all
+// of them have the capacity available.
+func (l *limiter) tryUse(now time.Time, amount int) bool {
+	if l.available(now) < amount {
+		return false
+	}
+	for p := l; p != nil; p = p.parent {
+		p.policy.use(now, amount)
+		p.rollStats(now)
+		p.used += amount
+	}
+	return true
+}
+
+// availableAt returns the earliest time at which 'amount' units may be used
+// from this limiter and its ancestors, assuming no other use.
+func (l *limiter) availableAt(now time.Time, amount int) (time.Time, bool) {
+	when := now
+	for p := l; p != nil; p = p.parent {
+		t, ok := p.policy.availableAt(now, amount)
+		if !ok {
+			return time.Time{}, false
+		}
+		if t.After(when) {
+			when = t
 		}
-		l.controller.lock.Unlock()
-		done <- nil
-		return done
 	}
-	l.controller.waiting = append(l.controller.waiting, &request{
+	return when, true
+}
+
+// newRequest creates a request and stamps it with its fair queueing tags.
+// Must be called with the lock held.
+func (c *controller) newRequest(l *limiter, amount int) *request {
+	c.seq++
+	req := &request{
 		limiter: l,
 		amount:  amount,
-		done:    done,
-	})
-	l.controller.lock.Unlock()
-	return done
+		seq:     c.seq,
+		done:    make(chan error, 1),
+		pending: true,
+	}
+	for n := l; n.parent != nil; n = n.parent {
+		start := n.vfinish
+		if n.parent.vtime > start {
+			start = n.parent.vtime
+		}
+		n.vfinish = start + float64(amount)/float64(n.weight)
+		req.path = append(req.path, n)
+		req.starts = append(req.starts, start)
+		req.finishes = append(req.finishes, n.vfinish)
+	}
+	return req
 }
 
-func (l *limiter) reset() {
-	l.last = l.used
-	l.used = 0
-	for _, child := range l.children {
-		child.reset()
+// before returns true if this request should be served before the other.
+// Requests are compared by their tags for the children of the deepest
+// limiter their paths share, falling back to the order they were made in.
+func (r *request) before(other *request) bool {
+	i := len(r.path) - 1
+	j := len(other.path) - 1
+	for i >= 0 && j >= 0 {
+		if r.path[i] != other.path[j] {
+			if r.finishes[i] != other.finishes[j] {
+				return r.finishes[i] < other.finishes[j]
+			}
+			break
+		}
+		i--
+		j--
+	}
+	return r.seq < other.seq
+}
+
+// grant marks a request as granted. Must be called with the lock held.
+func (c *controller) grant(req *request, now time.Time) {
+	for i, n := range req.path {
+		if req.starts[i] > n.parent.vtime {
+			n.parent.vtime = req.starts[i]
+		}
+	}
+	req.pending = false
+	req.granted = true
+	req.grantedAt = now
+	req.done <- nil
+}
+
+// fail marks a request as failed. Must be called with the lock held.
+func (c *controller) fail(req *request, err error) {
+	// Return the virtual time the request would have used, if nothing has
+	// been stamped after it.
+	for i, n := range req.path {
+		if n.vfinish == req.finishes[i] {
+			n.vfinish = req.starts[i]
+		}
+	}
+	req.pending = false
+	req.done <- err
+}
+
+// cancel removes a waiting request. Returns false if the request has
+// already been granted or failed.
+func (c *controller) cancel(req *request) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !req.pending {
+		return false
 	}
+	for i, one := range c.waiting {
+		if one == req {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			break
+		}
+	}
+	c.fail(req, errs.New("Request was cancelled"))
+	c.process()
+	return true
+}
+
+// sortWaiting puts the waiting requests into the order they should be
+// served in. Must be called with the lock held.
+func (c *controller) sortWaiting() {
+	sort.SliceStable(c.waiting, func(i, j int) bool { return c.waiting[i].before(c.waiting[j]) })
+}
+
+// process attempts to satisfy any waiting requests, in order. A request that
+// cannot be satisfied blocks the limiters it is waiting on, so that later
+// requests cannot take the capacity it needs. Must be called with the lock
+// held.
+func (c *controller) process() {
+	now := c.config.Clock.Now()
+	c.sortWaiting()
+	blocked := make(map[*limiter]bool)
+	remaining := make([]*request, 0, len(c.waiting))
+	for _, req := range c.waiting {
+		if err := req.limiter.check(req.amount); err != nil {
+			c.fail(req, err)
+			continue
+		}
+		if req.limiter.blockedBy(blocked) {
+			remaining = append(remaining, req)
+			continue
+		}
+		if req.limiter.tryUse(now, req.amount) {
+			c.grant(req, now)
+			continue
+		}
+		for p := req.limiter; p != nil; p = p.parent {
+			if p.policy.available(now) < req.amount {
+				blocked[p] = true
+			}
+		}
+		remaining = append(remaining, req)
+	}
+	c.waiting = remaining
+	c.blocked = blocked
+	c.schedule(now)
+}
+
+// estimate returns the time at which a waiting request is expected to be
+// granted, by playing the waiting requests forward in order against copies
+// of the limiters' state. Must be called with the lock held.
+func (c *controller) estimate(target *request) (time.Time, bool) {
+	c.sortWaiting()
+	policies := make(map[*limiter]policy)
+	policyFor := func(l *limiter) policy {
+		p, ok := policies[l]
+		if !ok {
+			p = l.policy.clone()
+			policies[l] = p
+		}
+		return p
+	}
+	at := c.config.Clock.Now()
+	for _, req := range c.waiting {
+		when := at
+		for p := req.limiter; p != nil; p = p.parent {
+			t, ok := policyFor(p).availableAt(at, req.amount)
+			if !ok {
+				return time.Time{}, false
+			}
+			if t.After(when) {
+				when = t
+			}
+		}
+		for p := req.limiter; p != nil; p = p.parent {
+			policyFor(p).use(when, req.amount)
+		}
+		at = when
+		if req == target {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// schedule arranges for process to be called when the first waiting request
+// could next be satisfied. Must be called with the lock held.
+func (c *controller) schedule(now time.Time) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	var next time.Time
+	for _, req := range c.waiting {
+		if when, ok := req.limiter.availableAt(now, req.amount); ok && (next.IsZero() || when.Before(next)) {
+			next = when
+		}
+	}
+	if next.IsZero() {
+		// Nothing can be satisfied by the passage of time alone, but caps
+		// may still change, so check again after a period.
+		if len(c.waiting) == 0 {
+			return
+		}
+		next = now.Add(c.config.Period)
+	}
+	delay := next.Sub(now)
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	c.timer = c.config.Clock.AfterFunc(delay, c.wake)
+}
+
+func (c *controller) wake() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.process()
 }
 
 func (l *limiter) Closed() bool {
@@ -219,12 +609,12 @@ func (l *limiter) Closed() bool {
 }
 
 func (l *limiter) Close() {
-	l.controller.lock.Lock()
+	c := l.controller
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if !l.closed {
 		l.close()
-		if l.parent == nil {
-			l.controller.done <- true
-		} else {
+		if l.parent != nil {
 			for i, child := range l.parent.children {
 				if child == l { //nolint:gocritic
 					j := len(l.parent.children) - 1
@@ -234,10 +624,9 @@ func (l *limiter) Close() {
 					break
 				}
 			}
-			l.closed = true
 		}
+		c.process()
 	}
-	l.controller.lock.Unlock()
 }
 
 func (l *limiter) close() {
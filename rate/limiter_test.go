@@ -10,6 +10,8 @@
 package rate_test
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -42,3 +44,230 @@ func TestUse(t *testing.T) {
 	rl.Close()
 	assert.True(t, rl.Closed())
 }
+
+func ready(ch <-chan error) (ok bool, err error) {
+	select {
+	case err = <-ch:
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func TestFixedWindowEdgeBurst(t *testing.T) {
+	clock := rate.NewManualClock(time.Unix(0, 0))
+	rl := rate.NewWithConfig(rate.Config{Capacity: 10, Period: time.Second, Clock: clock})
+	defer rl.Close()
+	clock.Advance(999 * time.Millisecond)
+	ok, err := ready(rl.Use(10))
+	require.True(t, ok)
+	require.NoError(t, err)
+	clock.Advance(time.Millisecond)
+	// A fixed window allows twice the capacity across a window edge.
+	ok, err = ready(rl.Use(10))
+	require.True(t, ok)
+	require.NoError(t, err)
+	assert.Equal(t, 10, rl.LastUsed())
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := rate.NewManualClock(time.Unix(0, 0))
+	rl := rate.NewWithConfig(rate.Config{
+		Algorithm: rate.TokenBucket,
+		Capacity:  10,
+		Period:    time.Second,
+		Burst:     20,
+		Clock:     clock,
+	})
+	defer rl.Close()
+	ok, err := ready(rl.Use(20))
+	require.True(t, ok, "a full bucket allows a burst")
+	require.NoError(t, err)
+	ch := rl.Use(5)
+	ok, _ = ready(ch)
+	require.False(t, ok)
+	clock.Advance(400 * time.Millisecond)
+	ok, _ = ready(ch)
+	require.False(t, ok)
+	clock.Advance(100 * time.Millisecond)
+	ok, err = ready(ch)
+	require.True(t, ok, "5 tokens refill in half a period")
+	require.NoError(t, err)
+
+	ok, err = ready(rl.Use(21))
+	require.True(t, ok)
+	assert.Error(t, err, "requests larger than the burst can never succeed")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clock := rate.NewManualClock(time.Unix(0, 0))
+	rl := rate.NewWithConfig(rate.Config{
+		Algorithm: rate.SlidingWindow,
+		Capacity:  10,
+		Period:    time.Second,
+		Clock:     clock,
+	})
+	defer rl.Close()
+	clock.Advance(999 * time.Millisecond)
+	ok, err := ready(rl.Use(10))
+	require.True(t, ok)
+	require.NoError(t, err)
+	clock.Advance(time.Millisecond)
+	// Unlike a fixed window, the previous window's usage still counts.
+	ch := rl.Use(5)
+	ok, _ = ready(ch)
+	require.False(t, ok)
+	clock.Advance(499 * time.Millisecond)
+	ok, _ = ready(ch)
+	require.False(t, ok)
+	clock.Advance(time.Millisecond)
+	ok, err = ready(ch)
+	require.True(t, ok)
+	require.NoError(t, err)
+}
+
+func TestChildCapping(t *testing.T) {
+	for _, algorithm := range []rate.Algorithm{rate.FixedWindow, rate.TokenBucket, rate.SlidingWindow} {
+		clock := rate.NewManualClock(time.Unix(0, 0))
+		rl := rate.NewWithConfig(rate.Config{
+			Algorithm: algorithm,
+			Capacity:  10,
+			Period:    time.Second,
+			Clock:     clock,
+		})
+		child1 := rl.New(8)
+		child2 := rl.New(8)
+		ok, err := ready(child1.Use(8))
+		require.True(t, ok, algorithm.String())
+		require.NoError(t, err, algorithm.String())
+		ch := child2.Use(4)
+		ok, _ = ready(ch)
+		require.False(t, ok, "%s: parent has only 2 units left", algorithm)
+		clock.Advance(2 * time.Second)
+		ok, err = ready(ch)
+		require.True(t, ok, algorithm.String())
+		require.NoError(t, err, algorithm.String())
+
+		ch = child1.Use(8)
+		if ok, _ = ready(ch); ok {
+			ch = child1.Use(8)
+		}
+		rl.Close()
+		ok, err = ready(ch)
+		require.True(t, ok, algorithm.String())
+		assert.Error(t, err, algorithm.String())
+		assert.True(t, child2.Closed(), algorithm.String())
+	}
+}
+
+func TestFairness(t *testing.T) {
+	clock := rate.NewManualClock(time.Unix(0, 0))
+	rl := rate.NewWithConfig(rate.Config{Capacity: 10, Period: time.Second, Clock: clock})
+	defer rl.Close()
+	require.True(t, rl.TryUse(8))
+	large := rl.Use(10)
+	small := rl.Use(1)
+	ok, _ := ready(small)
+	assert.False(t, ok, "a small request must not overtake a waiting large one")
+	assert.False(t, rl.TryUse(1))
+
+	clock.Advance(time.Second)
+	ok, err := ready(large)
+	require.True(t, ok)
+	require.NoError(t, err)
+	ok, _ = ready(small)
+	assert.False(t, ok)
+
+	clock.Advance(time.Second)
+	ok, err = ready(small)
+	require.True(t, ok)
+	require.NoError(t, err)
+	assert.True(t, rl.TryUse(9))
+	assert.False(t, rl.TryUse(1))
+}
+
+func TestWeightedSiblings(t *testing.T) {
+	clock := rate.NewManualClock(time.Unix(0, 0))
+	rl := rate.NewWithConfig(rate.Config{Capacity: 10, Period: time.Second, Clock: clock})
+	defer rl.Close()
+	a := rl.New(10)
+	a.SetWeight(3)
+	b := rl.New(10)
+	assert.Equal(t, 3, a.Weight())
+	assert.Equal(t, 1, b.Weight())
+	require.True(t, rl.TryUse(10))
+	var aWaits, bWaits []<-chan error
+	for i := 0; i < 20; i++ {
+		aWaits = append(aWaits, a.Use(1))
+		bWaits = append(bWaits, b.Use(1))
+	}
+	clock.Advance(time.Second)
+	count := func(waits []<-chan error) int {
+		n := 0
+		for _, ch := range waits {
+			if ok, err := ready(ch); ok {
+				require.NoError(t, err)
+				n++
+			}
+		}
+		return n
+	}
+	assert.Equal(t, 8, count(aWaits))
+	assert.Equal(t, 2, count(bWaits))
+}
+
+func TestWait(t *testing.T) {
+	rl := rate.New(10, time.Hour)
+	defer rl.Close()
+	require.NoError(t, rl.Wait(context.Background(), 10))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := rl.Wait(ctx, 5)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	// The abandoned request must not hold back later ones.
+	rl.SetCap(20)
+	assert.True(t, rl.TryUse(10))
+}
+
+func TestReservation(t *testing.T) {
+	clock := rate.NewManualClock(time.Unix(0, 0))
+	rl := rate.NewWithConfig(rate.Config{
+		Algorithm: rate.TokenBucket,
+		Capacity:  10,
+		Period:    time.Second,
+		Clock:     clock,
+	})
+	defer rl.Close()
+	require.True(t, rl.TryUse(10))
+	r1, err := rl.Reserve(5)
+	require.NoError(t, err)
+	r2, err := rl.Reserve(5)
+	require.NoError(t, err)
+	delay, ok := r1.Delay()
+	require.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+	delay, ok = r2.Delay()
+	require.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+
+	assert.True(t, r1.Cancel())
+	assert.False(t, r1.Cancel())
+	assert.Error(t, <-r1.Done())
+	_, ok = r1.ReadyAt()
+	assert.False(t, ok)
+	delay, ok = r2.Delay()
+	require.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, delay)
+
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, r2.Granted())
+	require.NoError(t, <-r2.Done())
+	when, ok := r2.ReadyAt()
+	require.True(t, ok)
+	assert.Equal(t, time.Unix(0, 0).Add(500*time.Millisecond), when)
+	assert.False(t, r2.Cancel())
+
+	_, err = rl.Reserve(11)
+	assert.Error(t, err)
+}
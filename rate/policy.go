@@ -0,0 +1,276 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package rate
+
+import (
+	"math"
+	"time"
+)
+
+// Algorithm identifies the rate limiting algorithm used by a hierarchy of
+// limiters.
+type Algorithm int
+
+// Possible Algorithm values.
+const (
+	// FixedWindow allows 'capacity' units within each period, resetting at
+	// the start of every period. Bursts of up to twice the capacity can
+	// occur around the edges of a window.
+	FixedWindow Algorithm = iota
+	// TokenBucket refills at a steady 'capacity' units per period and
+	// allows bursts of up to 'burst' units.
+	TokenBucket
+	// SlidingWindow allows 'capacity' units within any period-length span
+	// of time, estimated by weighting the previous window's usage by how
+	// much of it still overlaps the sliding window.
+	SlidingWindow
+)
+
+// String implements fmt.Stringer.
+func (a Algorithm) String() string {
+	switch a {
+	case FixedWindow:
+		return "fixed window"
+	case TokenBucket:
+		return "token bucket"
+	case SlidingWindow:
+		return "sliding window"
+	default:
+		return "unknown"
+	}
+}
+
+// policy tracks usage for a single limiter according to an algorithm.
+type policy interface {
+	// available returns the units that may be used at 'now'.
+	available(now time.Time) int
+	// use records the consumption of units at 'now'.
+	use(now time.Time, amount int)
+	// availableAt returns the earliest time at or after 'now' at which
+	// 'amount' units will be available, assuming no other use. 'ok' will be
+	// false if that will never happen.
+	availableAt(now time.Time, amount int) (when time.Time, ok bool)
+	// maxAmount returns the largest amount a single request may use.
+	maxAmount() int
+	// setCap changes the capacity per period.
+	setCap(now time.Time, capacity int)
+	// clone returns a copy of the policy's state.
+	clone() policy
+}
+
+// windowStart returns the start of the period-length window containing
+// 'now', with windows aligned to 'origin'.
+func windowStart(origin, now time.Time, period time.Duration) time.Time {
+	return origin.Add(now.Sub(origin) / period * period)
+}
+
+type fixedWindow struct {
+	origin   time.Time
+	period   time.Duration
+	start    time.Time
+	capacity int
+	used     int
+}
+
+func (p *fixedWindow) roll(now time.Time) {
+	if now.Sub(p.start) >= p.period {
+		p.start = windowStart(p.origin, now, p.period)
+		p.used = 0
+	}
+}
+
+func (p *fixedWindow) available(now time.Time) int {
+	p.roll(now)
+	if p.used >= p.capacity {
+		return 0
+	}
+	return p.capacity - p.used
+}
+
+func (p *fixedWindow) use(now time.Time, amount int) {
+	p.roll(now)
+	p.used += amount
+}
+
+func (p *fixedWindow) availableAt(now time.Time, amount int) (time.Time, bool) {
+	if p.available(now) >= amount {
+		return now, true
+	}
+	if amount > p.capacity {
+		return time.Time{}, false
+	}
+	return p.start.Add(p.period), true
+}
+
+func (p *fixedWindow) clone() policy {
+	other := *p
+	return &other
+}
+
+func (p *fixedWindow) maxAmount() int {
+	return p.capacity
+}
+
+func (p *fixedWindow) setCap(_ time.Time, capacity int) {
+	p.capacity = capacity
+}
+
+type tokenBucket struct {
+	period   time.Duration
+	last     time.Time
+	capacity int
+	burst    int
+	tokens   float64
+}
+
+func (p *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(p.last); elapsed > 0 {
+		p.tokens += float64(p.capacity) * float64(elapsed) / float64(p.period)
+		p.last = now
+	}
+	if p.tokens > float64(p.burst) {
+		p.tokens = float64(p.burst)
+	}
+}
+
+func (p *tokenBucket) available(now time.Time) int {
+	p.refill(now)
+	if p.tokens <= 0 {
+		return 0
+	}
+	return int(p.tokens + 1e-9)
+}
+
+func (p *tokenBucket) use(now time.Time, amount int) {
+	p.refill(now)
+	p.tokens -= float64(amount)
+}
+
+func (p *tokenBucket) availableAt(now time.Time, amount int) (time.Time, bool) {
+	if p.available(now) >= amount {
+		return now, true
+	}
+	if amount > p.burst || p.capacity < 1 {
+		return time.Time{}, false
+	}
+	needed := float64(amount) - p.tokens
+	return now.Add(time.Duration(math.Ceil(needed * float64(p.period) / float64(p.capacity)))), true
+}
+
+func (p *tokenBucket) clone() policy {
+	other := *p
+	return &other
+}
+
+func (p *tokenBucket) maxAmount() int {
+	return p.burst
+}
+
+func (p *tokenBucket) setCap(now time.Time, capacity int) {
+	p.refill(now)
+	if p.capacity > 0 {
+		p.burst = scaleBurst(p.burst, p.capacity, capacity)
+	} else {
+		p.burst = capacity
+	}
+	p.capacity = capacity
+	if p.tokens > float64(p.burst) {
+		p.tokens = float64(p.burst)
+	}
+}
+
+// scaleBurst returns a burst for 'capacity' that keeps the same ratio to it
+// that 'burst' has to 'base'.
+func scaleBurst(burst, base, capacity int) int {
+	if base < 1 {
+		return capacity
+	}
+	return int(math.Round(float64(burst) * float64(capacity) / float64(base)))
+}
+
+type slidingWindow struct {
+	origin   time.Time
+	period   time.Duration
+	start    time.Time
+	capacity int
+	previous int
+	current  int
+}
+
+func (p *slidingWindow) roll(now time.Time) {
+	if now.Sub(p.start) >= p.period {
+		start := windowStart(p.origin, now, p.period)
+		if start.Sub(p.start) == p.period {
+			p.previous = p.current
+		} else {
+			p.previous = 0
+		}
+		p.current = 0
+		p.start = start
+	}
+}
+
+// estimate returns the usage within the period ending at 'now'.
+func (p *slidingWindow) estimate(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(p.start))/float64(p.period)
+	return float64(p.previous)*overlap + float64(p.current)
+}
+
+func (p *slidingWindow) available(now time.Time) int {
+	p.roll(now)
+	remaining := float64(p.capacity) - p.estimate(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return int(remaining + 1e-9)
+}
+
+func (p *slidingWindow) use(now time.Time, amount int) {
+	p.roll(now)
+	p.current += amount
+}
+
+func (p *slidingWindow) availableAt(now time.Time, amount int) (time.Time, bool) {
+	if p.available(now) >= amount {
+		return now, true
+	}
+	if amount > p.capacity {
+		return time.Time{}, false
+	}
+	// Find how much of the window must pass for the weighted usage of the
+	// older of two adjacent windows to fall far enough.
+	start := p.start
+	older := p.previous
+	room := p.capacity - p.current - amount
+	if room < 0 {
+		start = start.Add(p.period)
+		older = p.current
+		room = p.capacity - amount
+	}
+	fraction := 1 - float64(room)/float64(older)
+	when := start.Add(time.Duration(math.Ceil(fraction * float64(p.period))))
+	if when.Before(now) {
+		when = now
+	}
+	return when, true
+}
+
+func (p *slidingWindow) clone() policy {
+	other := *p
+	return &other
+}
+
+func (p *slidingWindow) maxAmount() int {
+	return p.capacity
+}
+
+func (p *slidingWindow) setCap(_ time.Time, capacity int) {
+	p.capacity = capacity
+}
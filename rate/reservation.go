@@ -0,0 +1,74 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package rate
+
+import "time"
+
+// Reservation holds a queued request for capacity.
+type Reservation struct {
+	controller *controller
+	req        *request
+}
+
+// Amount returns the number of units reserved.
+func (r *Reservation) Amount() int {
+	return r.req.amount
+}
+
+// Done returns a channel that will return nil when the reservation is
+// granted, or an error if it cannot be fulfilled or is cancelled.
+func (r *Reservation) Done() <-chan error {
+	return r.req.done
+}
+
+// Granted returns true if the reservation has been granted.
+func (r *Reservation) Granted() bool {
+	r.controller.lock.RLock()
+	defer r.controller.lock.RUnlock()
+	return r.req.granted
+}
+
+// ReadyAt returns the time at which the reservation was granted or, if it is
+// still waiting, an estimate of when it will be, assuming capacities do not
+// change. Requests made later may still be served first when they belong to
+// a sibling limiter with a greater share, so the estimate can slip. 'ok' will
+// be false if the reservation failed, was cancelled, or will never be
+// granted.
+func (r *Reservation) ReadyAt() (when time.Time, ok bool) {
+	c := r.controller
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if r.req.granted {
+		return r.req.grantedAt, true
+	}
+	if !r.req.pending {
+		return time.Time{}, false
+	}
+	return c.estimate(r.req)
+}
+
+// Delay returns how long until the reservation is expected to be granted,
+// which will be 0 if it already has been. See ReadyAt.
+func (r *Reservation) Delay() (delay time.Duration, ok bool) {
+	when, ok := r.ReadyAt()
+	if !ok {
+		return 0, false
+	}
+	if delay = when.Sub(r.controller.config.Clock.Now()); delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// Cancel withdraws the reservation, returning true if it was still waiting.
+// Once cancelled, Done returns an error.
+func (r *Reservation) Cancel() bool {
+	return r.controller.cancel(r.req)
+}
@@ -0,0 +1,54 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package taskqueue
+
+import "context"
+
+// Future holds the eventual result of a task.
+type Future struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed once the task has completed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result waits for the task to complete and returns its result.
+func (f *Future) Result() (interface{}, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// Wait waits for the task to complete and returns its result. If the context
+// is done first, the context's error is returned instead. Note that this does
+// not stop the task from running.
+func (f *Future) Wait(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *Future) complete(result interface{}, err error) {
+	if f != nil {
+		f.result = result
+		f.err = err
+		close(f.done)
+	}
+}
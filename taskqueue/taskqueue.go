@@ -11,29 +11,131 @@
 package taskqueue
 
 import (
+	"container/heap"
+	"context"
+	"errors"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/richardwilkes/toolbox/errs"
 )
 
+// Errors that may be returned by futures.
+var (
+	// ErrShutdown is returned for tasks submitted after the queue has been
+	// shutdown.
+	ErrShutdown = errors.New("queue has been shutdown")
+	// ErrQueueFull is returned for tasks rejected because the queue was full
+	// and its policy is RejectWhenFull.
+	ErrQueueFull = errors.New("queue is full")
+	// ErrDropped is returned for tasks that were discarded to make room for
+	// newer tasks because the queue's policy is DropOldestWhenFull.
+	ErrDropped = errors.New("task dropped from full queue")
+	// ErrAbandoned is returned for tasks that were still pending when a call
+	// to ShutdownWithTimeout() ran out of time.
+	ErrAbandoned = errors.New("task abandoned during shutdown")
+)
+
 // Logger provides a way to log panics caused by workers in a queue.
 type Logger func(v ...interface{})
 
 // Task defines a unit of work.
 type Task func()
 
+// ResultTask defines a unit of work that produces a result. The context
+// passed in is the one supplied at submission time, allowing long-running
+// tasks to notice cancellation.
+type ResultTask func(ctx context.Context) (interface{}, error)
+
+// Priority defines the relative priority of a task. Tasks with a higher
+// priority are run before those with a lower priority. Tasks with the same
+// priority are run in the order they were submitted.
+type Priority int
+
+// Predefined priorities. Any Priority value may be used.
+const (
+	LowPriority    Priority = -1
+	NormalPriority Priority = 0
+	HighPriority   Priority = 1
+)
+
+// FullPolicy determines what happens when a task is submitted to a queue that
+// already has its maximum depth of pending tasks.
+type FullPolicy int
+
+// Possible values for FullPolicy.
+const (
+	// BlockWhenFull causes the submission to block until there is room.
+	BlockWhenFull FullPolicy = iota
+	// RejectWhenFull causes the submitted task to be discarded.
+	RejectWhenFull
+	// DropOldestWhenFull causes the oldest pending task to be discarded to
+	// make room for the submitted task.
+	DropOldestWhenFull
+)
+
+// Stats holds a snapshot of a queue's activity.
+type Stats struct {
+	// Workers is the number of workers the queue is configured to use.
+	Workers int
+	// Queued is the number of tasks waiting to be run.
+	Queued int
+	// Running is the number of tasks currently being run.
+	Running int
+	// Submitted is the number of tasks that have been accepted by the queue.
+	Submitted uint64
+	// Completed is the number of tasks that have finished running, including
+	// those that panicked.
+	Completed uint64
+	// Panicked is the number of tasks that panicked.
+	Panicked uint64
+	// Canceled is the number of tasks that were not run because their context
+	// was done before they started.
+	Canceled uint64
+	// Rejected is the number of tasks that were not accepted because the
+	// queue was full or shutdown.
+	Rejected uint64
+	// Dropped is the number of accepted tasks that were later discarded,
+	// either to make room for newer tasks or because they were abandoned
+	// during shutdown.
+	Dropped uint64
+	// MaxLatency is the longest time a task has waited between being
+	// submitted and starting to run.
+	MaxLatency time.Duration
+}
+
 // Option defines an option for the queue.
 type Option func(*Queue)
 
 // Queue holds the queue information.
 type Queue struct {
-	in              chan Task
-	done            chan bool
+	lock            sync.Mutex
+	notEmpty        *sync.Cond
+	notFull         *sync.Cond
+	backlog         backlog
+	seq             uint64
 	depth           int
+	fullPolicy      FullPolicy
 	workers         int
+	alive           int
+	shutdown        bool
+	running         sync.WaitGroup
 	recoveryHandler errs.RecoveryHandler
+	stats           Stats
 }
 
+type item struct {
+	ctx       context.Context
+	task      ResultTask
+	future    *Future
+	priority  Priority
+	seq       uint64
+	submitted time.Time
+}
+
+type backlog []*item
+
 // Log sets the logger for tasks that panic.
 //
 // Deprecated: Use RecoveryHandler instead.
@@ -47,13 +149,20 @@ func RecoveryHandler(recoveryHandler errs.RecoveryHandler) Option {
 	return func(q *Queue) { q.recoveryHandler = recoveryHandler }
 }
 
-// Depth sets the depth of the queue. Calls to Submit() will block when this
-// number of tasks are already pending execution. Pass in a negative number to
-// use an unbounded queue. Defaults to unbounded.
+// Depth sets the depth of the queue. When this number of tasks are already
+// pending execution, further submissions are handled according to the
+// queue's FullPolicy. Pass in a negative number to use an unbounded queue.
+// Defaults to unbounded.
 func Depth(depth int) Option {
 	return func(q *Queue) { q.depth = depth }
 }
 
+// WhenFull sets the policy used when a task is submitted to a queue that is
+// full. Defaults to BlockWhenFull.
+func WhenFull(policy FullPolicy) Option {
+	return func(q *Queue) { q.fullPolicy = policy }
+}
+
 // Workers sets the number of workers that will simultaneously process tasks.
 // If this is set to 1, tasks submitted to the queue will be executed
 // serially. Defaults to one plus the number of CPUs.
@@ -63,114 +172,296 @@ func Workers(workers int) Option {
 
 // New creates a queue which executes the tasks submitted to it.
 func New(options ...Option) *Queue {
-	numCPU := runtime.NumCPU()
-	q := &Queue{
-		in:    make(chan Task, numCPU*2),
-		done:  make(chan bool),
-		depth: -1,
-	}
+	q := &Queue{depth: -1}
+	q.notEmpty = sync.NewCond(&q.lock)
+	q.notFull = sync.NewCond(&q.lock)
 	for _, option := range options {
 		option(q)
 	}
 	if q.workers < 1 {
-		q.workers = 1 + numCPU
+		q.workers = 1 + runtime.NumCPU()
 	}
-	go q.process()
+	q.lock.Lock()
+	q.spawnWorkersIfNeeded()
+	q.lock.Unlock()
 	return q
 }
 
-// Submit a task to be run.
+// Workers returns the number of workers the queue is configured to use.
+func (q *Queue) Workers() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.workers
+}
+
+// SetWorkers changes the number of workers that will simultaneously process
+// tasks. When reducing the count, workers that are currently running a task
+// will exit once their task completes. Values less than 1 are treated as 1.
+// Has no effect once the queue has been shutdown.
+func (q *Queue) SetWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.shutdown {
+		return
+	}
+	q.workers = workers
+	q.spawnWorkersIfNeeded()
+	q.notEmpty.Broadcast()
+}
+
+// Must be called with the lock held.
+func (q *Queue) spawnWorkersIfNeeded() {
+	for q.alive < q.workers {
+		q.alive++
+		q.running.Add(1)
+		go q.work()
+	}
+}
+
+// Stats returns a snapshot of the queue's activity.
+func (q *Queue) Stats() Stats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := q.stats
+	stats.Workers = q.workers
+	stats.Queued = len(q.backlog)
+	return stats
+}
+
+// Submit a task to be run. If the queue has been shutdown, or is full and its
+// policy is RejectWhenFull, the task is silently discarded. Use TrySubmit() to
+// find out whether the task was accepted.
 func (q *Queue) Submit(task Task) {
-	q.in <- task
+	q.SubmitWithPriority(NormalPriority, task)
+}
+
+// SubmitWithPriority submits a task to be run with the specified priority. As
+// with Submit(), a rejected task is silently discarded.
+func (q *Queue) SubmitWithPriority(priority Priority, task Task) {
+	q.TrySubmitWithPriority(priority, task) //nolint:errcheck
+}
+
+// TrySubmit submits a task to be run, returning ErrShutdown or ErrQueueFull if
+// the queue rejects it.
+func (q *Queue) TrySubmit(task Task) error {
+	return q.TrySubmitWithPriority(NormalPriority, task)
+}
+
+// TrySubmitWithPriority submits a task to be run with the specified priority,
+// returning ErrShutdown or ErrQueueFull if the queue rejects it.
+func (q *Queue) TrySubmitWithPriority(priority Priority, task Task) error {
+	return q.enqueue(context.Background(), priority, func(context.Context) (interface{}, error) {
+		task()
+		return nil, nil
+	}, nil)
+}
+
+// SubmitFuture submits a task to be run with the specified priority and
+// returns a Future that will receive its result. If the context is done
+// before the task starts, the task will not be run and the Future will
+// receive the context's error. If the task panics, the Future will receive
+// the panic as an error, in addition to the queue's recovery handler being
+// called.
+func (q *Queue) SubmitFuture(ctx context.Context, priority Priority, task ResultTask) *Future {
+	f := newFuture()
+	q.enqueue(ctx, priority, task, f) //nolint:errcheck // Reported through the future
+	return f
+}
+
+// SubmitWait submits a task to be run with the specified priority and waits
+// for it to complete, returning its result. If the context is done before the
+// task completes, the context's error is returned.
+func (q *Queue) SubmitWait(ctx context.Context, priority Priority, task ResultTask) (interface{}, error) {
+	return q.SubmitFuture(ctx, priority, task).Wait(ctx)
 }
 
 // Shutdown the queue. Does not return until all pending tasks have completed.
 func (q *Queue) Shutdown() {
-	close(q.in)
-	<-q.done
+	q.beginShutdown()
+	q.running.Wait()
 }
 
-func (q *Queue) process() {
-	var received, processed uint64
-
-	// Setup backlog
-	var backlog []Task
-	if q.depth > 0 {
-		backlog = make([]Task, 0, q.depth)
+// ShutdownWithTimeout shuts down the queue, waiting for pending tasks to
+// complete until the context is done. At that point, any tasks that have not
+// yet started are abandoned and their futures receive ErrAbandoned. The number
+// of abandoned tasks is returned, along with the context's error if it
+// expired. Tasks that are already running when the context expires are not
+// interrupted, but are also not waited for.
+func (q *Queue) ShutdownWithTimeout(ctx context.Context) (abandoned int, err error) {
+	q.beginShutdown()
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
 	}
-
-	// Setup workers
-	ready := make(chan bool, q.workers)
-	tasks := make(chan Task, q.workers)
-	for i := 0; i < q.workers; i++ {
-		go q.work(tasks, ready)
+	q.lock.Lock()
+	pending := q.backlog
+	q.backlog = nil
+	q.stats.Dropped += uint64(len(pending))
+	q.lock.Unlock()
+	for _, one := range pending {
+		one.future.complete(nil, ErrAbandoned)
 	}
+	return len(pending), ctx.Err()
+}
 
-	// Main processing loop
-outer:
-	for {
-	inner:
-		select {
-		case task := <-q.in:
-			if task == nil {
-				break outer
-			}
-			received++
-			if len(backlog) == 0 {
-				select {
-				case tasks <- task:
-					break inner
-				default:
-				}
-			}
-			if q.depth < 0 || len(backlog) < q.depth {
-				backlog = append(backlog, task)
-			} else {
-				<-ready
-				processed++
-				tasks <- backlog[0]
-				copy(backlog, backlog[1:])
-				backlog[len(backlog)-1] = task
-			}
-		case <-ready:
-			processed++
-			if len(backlog) > 0 {
-				tasks <- backlog[0]
-				copy(backlog, backlog[1:])
-				backlog[len(backlog)-1] = nil
-				backlog = backlog[:len(backlog)-1]
+func (q *Queue) beginShutdown() {
+	q.lock.Lock()
+	q.shutdown = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.lock.Unlock()
+}
+
+func (q *Queue) enqueue(ctx context.Context, priority Priority, task ResultTask, f *Future) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.shutdown && q.full() {
+		switch q.fullPolicy {
+		case RejectWhenFull:
+			q.stats.Rejected++
+			f.complete(nil, ErrQueueFull)
+			return ErrQueueFull
+		case DropOldestWhenFull:
+			q.dropOldest()
+		default:
+			for !q.shutdown && q.full() {
+				q.notFull.Wait()
 			}
 		}
 	}
+	if q.shutdown {
+		q.stats.Rejected++
+		f.complete(nil, ErrShutdown)
+		return ErrShutdown
+	}
+	q.seq++
+	q.stats.Submitted++
+	heap.Push(&q.backlog, &item{
+		ctx:       ctx,
+		task:      task,
+		future:    f,
+		priority:  priority,
+		seq:       q.seq,
+		submitted: time.Now(),
+	})
+	q.notEmpty.Signal()
+	return nil
+}
 
-	// Finish any remaining tasks
-	for _, task := range backlog {
-	drain:
-		for {
-			select {
-			case tasks <- task:
-				break drain
-			case <-ready:
-				processed++
-			}
+// Must be called with the lock held.
+func (q *Queue) dropOldest() {
+	if len(q.backlog) == 0 {
+		return
+	}
+	oldest := 0
+	for i, one := range q.backlog {
+		if one.seq < q.backlog[oldest].seq {
+			oldest = i
 		}
 	}
-	for received != processed {
-		<-ready
-		processed++
+	one := heap.Remove(&q.backlog, oldest).(*item)
+	q.stats.Dropped++
+	one.future.complete(nil, ErrDropped)
+}
+
+func (q *Queue) full() bool {
+	if q.depth < 0 {
+		return false
+	}
+	// A depth of zero still permits a single pending task, so that
+	// submissions are handed off to the next available worker.
+	if q.depth == 0 {
+		return len(q.backlog) > 0
 	}
-	close(tasks)
-	q.done <- true
+	return len(q.backlog) >= q.depth
 }
 
-func (q *Queue) work(tasks <-chan Task, ready chan<- bool) {
-	for task := range tasks {
-		q.runTask(task)
-		ready <- true
+func (q *Queue) work() {
+	defer q.running.Done()
+	q.lock.Lock()
+	for {
+		for !q.shutdown && len(q.backlog) == 0 && q.alive <= q.workers {
+			q.notEmpty.Wait()
+		}
+		if len(q.backlog) == 0 || q.alive > q.workers {
+			q.alive--
+			q.lock.Unlock()
+			return
+		}
+		one := heap.Pop(&q.backlog).(*item)
+		q.notFull.Signal()
+		if err := one.ctx.Err(); err != nil {
+			q.stats.Canceled++
+			q.lock.Unlock()
+			one.future.complete(nil, err)
+			q.lock.Lock()
+			continue
+		}
+		if latency := time.Since(one.submitted); latency > q.stats.MaxLatency {
+			q.stats.MaxLatency = latency
+		}
+		q.stats.Running++
+		q.lock.Unlock()
+		panicked := q.runTask(one)
+		q.lock.Lock()
+		q.stats.Running--
+		q.stats.Completed++
+		if panicked {
+			q.stats.Panicked++
+		}
+	}
+}
+
+func (q *Queue) runTask(one *item) (panicked bool) {
+	var result interface{}
+	var err error
+	func() {
+		defer errs.Recovery(func(panicErr error) {
+			panicked = true
+			err = panicErr
+			if q.recoveryHandler != nil {
+				q.recoveryHandler(panicErr)
+			}
+		})
+		result, err = one.task(one.ctx)
+	}()
+	one.future.complete(result, err)
+	return panicked
+}
+
+func (b backlog) Len() int {
+	return len(b)
+}
+
+func (b backlog) Less(i, j int) bool {
+	if b[i].priority == b[j].priority {
+		return b[i].seq < b[j].seq
 	}
+	return b[i].priority > b[j].priority
+}
+
+func (b backlog) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b *backlog) Push(x interface{}) {
+	*b = append(*b, x.(*item))
 }
 
-func (q *Queue) runTask(task Task) {
-	defer errs.Recovery(q.recoveryHandler)
-	task()
+func (b *backlog) Pop() interface{} {
+	old := *b
+	n := len(old) - 1
+	x := old[n]
+	old[n] = nil
+	*b = old[:n]
+	return x
 }
@@ -10,8 +10,12 @@
 package taskqueue_test
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/richardwilkes/toolbox/taskqueue"
 	"github.com/stretchr/testify/assert"
@@ -95,3 +99,214 @@ func boom() {
 	// noinspection GoNilness
 	*bad = 1
 }
+
+func TestPriority(t *testing.T) {
+	q := taskqueue.New(taskqueue.Workers(1))
+	gate := make(chan struct{})
+	q.Submit(func() { <-gate })
+	var order []int
+	q.SubmitWithPriority(taskqueue.LowPriority, func() { order = append(order, 1) })
+	q.SubmitWithPriority(taskqueue.NormalPriority, func() { order = append(order, 2) })
+	q.SubmitWithPriority(taskqueue.HighPriority, func() { order = append(order, 3) })
+	q.SubmitWithPriority(taskqueue.NormalPriority, func() { order = append(order, 4) })
+	close(gate)
+	q.Shutdown()
+	assert.Equal(t, []int{3, 2, 4, 1}, order)
+}
+
+func TestFuture(t *testing.T) {
+	q := taskqueue.New()
+	f := q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return 42, nil
+	})
+	result, err := f.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+	failure := errors.New("failure")
+	result, err = q.SubmitWait(context.Background(), taskqueue.HighPriority, func(ctx context.Context) (interface{}, error) {
+		return nil, failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Nil(t, result)
+	q.Shutdown()
+	_, err = q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return nil, nil
+	}).Result()
+	assert.Equal(t, taskqueue.ErrShutdown, err)
+}
+
+func TestCancellation(t *testing.T) {
+	q := taskqueue.New(taskqueue.Workers(1))
+	gate := make(chan struct{})
+	q.Submit(func() { <-gate })
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	f := q.SubmitFuture(ctx, taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		ran = true
+		return nil, nil
+	})
+	cancel()
+	_, err := q.SubmitWait(ctx, taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	close(gate)
+	_, err = f.Result()
+	assert.Equal(t, context.Canceled, err)
+	q.Shutdown()
+	assert.False(t, ran)
+}
+
+func TestFuturePanic(t *testing.T) {
+	logged := false
+	q := taskqueue.New(taskqueue.RecoveryHandler(func(err error) { logged = true }))
+	_, err := q.SubmitWait(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		boom()
+		return nil, nil
+	})
+	assert.Error(t, err)
+	q.Shutdown()
+	assert.True(t, logged)
+}
+
+func TestStats(t *testing.T) {
+	q := taskqueue.New(taskqueue.Workers(2), taskqueue.RecoveryHandler(func(err error) {}))
+	gate := make(chan struct{})
+	started := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		q.Submit(func() {
+			started <- struct{}{}
+			<-gate
+		})
+	}
+	<-started
+	<-started
+	q.Submit(boom)
+	q.Submit(func() {})
+	stats := q.Stats()
+	assert.Equal(t, 2, stats.Workers)
+	assert.Equal(t, 2, stats.Running)
+	assert.Equal(t, 2, stats.Queued)
+	assert.EqualValues(t, 4, stats.Submitted)
+	close(gate)
+	q.Shutdown()
+	stats = q.Stats()
+	assert.Equal(t, 0, stats.Running)
+	assert.Equal(t, 0, stats.Queued)
+	assert.EqualValues(t, 4, stats.Completed)
+	assert.EqualValues(t, 1, stats.Panicked)
+	assert.True(t, stats.MaxLatency > 0)
+}
+
+func TestFullPolicies(t *testing.T) {
+	q := taskqueue.New(taskqueue.Workers(1), taskqueue.Depth(1), taskqueue.WhenFull(taskqueue.RejectWhenFull))
+	gate := make(chan struct{})
+	started := make(chan struct{})
+	q.Submit(func() {
+		close(started)
+		<-gate
+	})
+	<-started
+	first := q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return 1, nil
+	})
+	_, err := q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return 2, nil
+	}).Result()
+	assert.Equal(t, taskqueue.ErrQueueFull, err)
+	assert.Equal(t, taskqueue.ErrQueueFull, q.TrySubmit(func() {}))
+	q.Submit(func() { t.Error("rejected task should not run") })
+	close(gate)
+	result, err := first.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result)
+	q.Shutdown()
+	assert.EqualValues(t, 3, q.Stats().Rejected)
+	assert.Equal(t, taskqueue.ErrShutdown, q.TrySubmit(func() {}))
+	assert.NotPanics(t, func() { q.Submit(func() { t.Error("task submitted after shutdown should not run") }) })
+
+	q = taskqueue.New(taskqueue.Workers(1), taskqueue.Depth(1), taskqueue.WhenFull(taskqueue.DropOldestWhenFull))
+	gate = make(chan struct{})
+	started = make(chan struct{})
+	q.Submit(func() {
+		close(started)
+		<-gate
+	})
+	<-started
+	first = q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return 1, nil
+	})
+	second := q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return 2, nil
+	})
+	close(gate)
+	_, err = first.Result()
+	assert.Equal(t, taskqueue.ErrDropped, err)
+	result, err = second.Result()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result)
+	q.Shutdown()
+	assert.EqualValues(t, 1, q.Stats().Dropped)
+}
+
+func TestShutdownWithTimeout(t *testing.T) {
+	q := taskqueue.New(taskqueue.Workers(1))
+	gate := make(chan struct{})
+	started := make(chan struct{})
+	q.Submit(func() {
+		close(started)
+		<-gate
+	})
+	<-started
+	pending := q.SubmitFuture(context.Background(), taskqueue.NormalPriority, func(ctx context.Context) (interface{}, error) {
+		return nil, nil
+	})
+	q.Submit(func() {})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	abandoned, err := q.ShutdownWithTimeout(ctx)
+	assert.Equal(t, 2, abandoned)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = pending.Result()
+	assert.Equal(t, taskqueue.ErrAbandoned, err)
+	close(gate)
+
+	q = taskqueue.New()
+	q.Submit(func() {})
+	abandoned, err = q.ShutdownWithTimeout(context.Background())
+	assert.Equal(t, 0, abandoned)
+	assert.NoError(t, err)
+}
+
+func TestSetWorkers(t *testing.T) {
+	q := taskqueue.New(taskqueue.Workers(1))
+	var running, maxRunning int32
+	var lock sync.Mutex
+	task := func() {
+		n := atomic.AddInt32(&running, 1)
+		lock.Lock()
+		if n > maxRunning {
+			maxRunning = n
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+	q.SetWorkers(4)
+	assert.Equal(t, 4, q.Workers())
+	for i := 0; i < 20; i++ {
+		q.Submit(task)
+	}
+	q.Shutdown()
+	assert.True(t, maxRunning > 1)
+	assert.True(t, maxRunning <= 4)
+
+	q = taskqueue.New(taskqueue.Workers(4))
+	q.SetWorkers(1)
+	maxRunning = 0
+	for i := 0; i < 10; i++ {
+		q.Submit(task)
+	}
+	q.Shutdown()
+	assert.EqualValues(t, 1, maxRunning)
+}
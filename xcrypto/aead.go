@@ -0,0 +1,567 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// Algorithm identifies the cipher used for the body of a stream.
+type Algorithm byte
+
+// Possible Algorithm values. Only AES-256-GCM is currently defined for the
+// chunked format.
+const (
+	// AlgorithmLegacyCFB is reported for streams written by
+	// EncryptStreamWithPublicKey, which have no integrity protection.
+	AlgorithmLegacyCFB Algorithm = iota
+	AlgorithmAES256GCM
+)
+
+// String implements fmt.Stringer.
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmLegacyCFB:
+		return "AES-256-CFB (legacy)"
+	case AlgorithmAES256GCM:
+		return "AES-256-GCM"
+	default:
+		return "unknown"
+	}
+}
+
+// Stream format limits.
+const (
+	StreamVersion    = 1
+	DefaultChunkSize = 64 * 1024
+	MaxChunkSize     = 16 * 1024 * 1024
+	MaxRecipients    = 1024
+)
+
+const (
+	fileKeySize     = 32
+	noncePrefixSize = 7
+	gcmTagSize      = 16
+	stanzaRSA       = 1
+	rsaOAEPLabel    = "xcrypto stream v1"
+)
+
+var streamMagic = []byte("XCRY")
+
+// Errors that may be returned, possibly wrapped, when decrypting.
+var (
+	ErrAuthentication      = errors.New("stream authentication failed; data has been tampered with or the wrong key was used")
+	ErrTruncated           = errors.New("stream is truncated")
+	ErrNoMatchingRecipient = errors.New("stream is not encrypted for this key")
+	ErrUnsupported         = errors.New("unsupported stream format")
+)
+
+// stanza holds a copy of the stream's key, wrapped for one recipient.
+type stanza struct {
+	kind  byte
+	keyID string
+	body  []byte
+}
+
+// Recipient is able to wrap the key of a stream so that the corresponding
+// Identity can recover it.
+type Recipient interface {
+	wrapKey(fileKey []byte) (*stanza, error)
+}
+
+// Identity is able to unwrap the key of a stream encrypted for it.
+type Identity interface {
+	unwrapKey(stanzas []*stanza) ([]byte, error)
+}
+
+// RSARecipient encrypts the stream key with RSA-OAEP using SHA-256.
+type RSARecipient struct {
+	PublicKey *rsa.PublicKey
+	// KeyID is recorded in the header. Defaults to KeyID(PublicKey).
+	KeyID string
+}
+
+func (r *RSARecipient) wrapKey(fileKey []byte) (*stanza, error) {
+	keyID := r.KeyID
+	if keyID == "" {
+		var err error
+		if keyID, err = KeyID(r.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.PublicKey, fileKey, []byte(rsaOAEPLabel))
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return &stanza{kind: stanzaRSA, keyID: keyID, body: wrapped}, nil
+}
+
+// RSAIdentity decrypts streams encrypted for the public half of its key.
+type RSAIdentity struct {
+	PrivateKey *rsa.PrivateKey
+	// KeyID is used to select the matching recipient from the header.
+	// Defaults to KeyID(&PrivateKey.PublicKey). If no recipient has a
+	// matching key ID, all RSA recipients are tried.
+	KeyID string
+	// AllowLegacy permits reading streams written by
+	// EncryptStreamWithPublicKey. Such streams have no integrity protection
+	// and anyone holding the public key can forge one, so leave this off
+	// unless the data is known to predate the chunked format.
+	AllowLegacy bool
+}
+
+func (id *RSAIdentity) unwrapKey(stanzas []*stanza) ([]byte, error) {
+	keyID := id.KeyID
+	if keyID == "" {
+		var err error
+		if keyID, err = KeyID(&id.PrivateKey.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	var candidates []*stanza
+	for _, s := range stanzas {
+		if s.kind == stanzaRSA {
+			if s.keyID == keyID {
+				candidates = append([]*stanza{s}, candidates...)
+			} else {
+				candidates = append(candidates, s)
+			}
+		}
+	}
+	for _, s := range candidates {
+		if fileKey, err := rsa.DecryptOAEP(sha256.New(), nil, id.PrivateKey, s.body, []byte(rsaOAEPLabel)); err == nil && len(fileKey) == fileKeySize {
+			return fileKey, nil
+		}
+	}
+	return nil, errs.NewWithCause(ErrNoMatchingRecipient.Error(), ErrNoMatchingRecipient)
+}
+
+// KeyID returns a short identifier for a public key, derived from its
+// PKIX encoding.
+func KeyID(publicKey interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// StreamHeader describes an encrypted stream.
+type StreamHeader struct {
+	Version   int
+	Algorithm Algorithm
+	ChunkSize int
+	// KeyIDs holds the key ID of each recipient.
+	KeyIDs  []string
+	stanzas []*stanza
+	prefix  []byte
+	raw     []byte
+}
+
+func (h *StreamHeader) marshal() ([]byte, error) {
+	if len(h.stanzas) == 0 {
+		return nil, errs.New("at least one recipient is required")
+	}
+	if len(h.stanzas) > MaxRecipients {
+		return nil, errs.Newf("too many recipients (%d)", len(h.stanzas))
+	}
+	var buffer bytes.Buffer
+	buffer.Write(streamMagic)
+	buffer.WriteByte(byte(h.Version))
+	buffer.WriteByte(byte(h.Algorithm))
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], uint32(h.ChunkSize))
+	buffer.Write(scratch[:])
+	buffer.Write(h.prefix)
+	binary.BigEndian.PutUint16(scratch[:2], uint16(len(h.stanzas)))
+	buffer.Write(scratch[:2])
+	for _, s := range h.stanzas {
+		if len(s.keyID) > 255 || len(s.body) > 65535 {
+			return nil, errs.New("recipient data too large")
+		}
+		buffer.WriteByte(s.kind)
+		buffer.WriteByte(byte(len(s.keyID)))
+		buffer.WriteString(s.keyID)
+		binary.BigEndian.PutUint16(scratch[:2], uint16(len(s.body)))
+		buffer.Write(scratch[:2])
+		buffer.Write(s.body)
+	}
+	return buffer.Bytes(), nil
+}
+
+// readHeader reads the remainder of a header whose magic has already been
+// consumed.
+func readHeader(in io.Reader) (*StreamHeader, error) {
+	var raw bytes.Buffer
+	raw.Write(streamMagic)
+	r := io.TeeReader(in, &raw)
+	fixed := make([]byte, 2+4+noncePrefixSize+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, truncatedOr(err)
+	}
+	h := &StreamHeader{
+		Version:   int(fixed[0]),
+		Algorithm: Algorithm(fixed[1]),
+		ChunkSize: int(binary.BigEndian.Uint32(fixed[2:6])),
+		prefix:    append([]byte(nil), fixed[6:6+noncePrefixSize]...),
+	}
+	if h.Version != StreamVersion {
+		return nil, errs.NewWithCausef(ErrUnsupported, "unsupported stream version %d", h.Version)
+	}
+	if h.Algorithm != AlgorithmAES256GCM {
+		return nil, errs.NewWithCausef(ErrUnsupported, "unsupported algorithm %d", h.Algorithm)
+	}
+	if h.ChunkSize < 1 || h.ChunkSize > MaxChunkSize {
+		return nil, errs.NewWithCausef(ErrUnsupported, "invalid chunk size %d", h.ChunkSize)
+	}
+	count := int(binary.BigEndian.Uint16(fixed[6+noncePrefixSize:]))
+	if count == 0 || count > MaxRecipients {
+		return nil, errs.NewWithCausef(ErrUnsupported, "invalid recipient count %d", count)
+	}
+	for i := 0; i < count; i++ {
+		var kind [2]byte
+		if _, err := io.ReadFull(r, kind[:]); err != nil {
+			return nil, truncatedOr(err)
+		}
+		keyID := make([]byte, kind[1])
+		if _, err := io.ReadFull(r, keyID); err != nil {
+			return nil, truncatedOr(err)
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, truncatedOr(err)
+		}
+		body := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, truncatedOr(err)
+		}
+		h.stanzas = append(h.stanzas, &stanza{kind: kind[0], keyID: string(keyID), body: body})
+		h.KeyIDs = append(h.KeyIDs, string(keyID))
+	}
+	h.raw = raw.Bytes()
+	return h, nil
+}
+
+func truncatedOr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errs.NewWithCause(ErrTruncated.Error(), ErrTruncated)
+	}
+	return errs.Wrap(err)
+}
+
+// chunkNonce returns the nonce for a chunk: the stream's random prefix, the
+// chunk counter and a flag marking the final chunk, so that chunks cannot be
+// reordered, dropped or appended without detection.
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[noncePrefixSize+4] = 1
+	}
+	return nonce
+}
+
+func newGCM(fileKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return aead, nil
+}
+
+// EncryptStream copies 'in' to 'out', encrypting it with AES-256-GCM in
+// chunks so that truncation and tampering are detected on decryption. The
+// stream can be decrypted by any of the recipients.
+func EncryptStream(in io.Reader, out io.Writer, recipients ...Recipient) error {
+	w, err := NewEncryptWriter(out, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return errs.Wrap(err)
+	}
+	return w.Close()
+}
+
+// EncryptWriter encrypts the data written to it.
+type EncryptWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	buffer  []byte
+	counter uint32
+	closed  bool
+	err     error
+}
+
+// NewEncryptWriter writes a stream header to 'out' and returns a writer that
+// encrypts data written to it. Close must be called to write the final
+// chunk; it does not close 'out'.
+func NewEncryptWriter(out io.Writer, recipients ...Recipient) (*EncryptWriter, error) {
+	fileKey := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	h := &StreamHeader{
+		Version:   StreamVersion,
+		Algorithm: AlgorithmAES256GCM,
+		ChunkSize: DefaultChunkSize,
+		prefix:    make([]byte, noncePrefixSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, h.prefix); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	for _, recipient := range recipients {
+		s, err := recipient.wrapKey(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+	raw, err := h.marshal()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = out.Write(raw); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	sum := sha256.Sum256(raw)
+	return &EncryptWriter{
+		out:    out,
+		aead:   aead,
+		prefix: h.prefix,
+		aad:    sum[:],
+		buffer: make([]byte, 0, h.ChunkSize+gcmTagSize),
+	}, nil
+}
+
+// Write implements io.Writer.
+func (w *EncryptWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errs.New("write to closed stream")
+	}
+	written := 0
+	chunkSize := cap(w.buffer) - gcmTagSize
+	for len(data) > 0 {
+		// A full chunk is only sealed once more data arrives, since the
+		// last chunk must be marked as final.
+		if len(w.buffer) == chunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := chunkSize - len(w.buffer)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.buffer = append(w.buffer, data[:n]...)
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (w *EncryptWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err == nil {
+		w.err = w.seal(true)
+	}
+	return w.err
+}
+
+func (w *EncryptWriter) seal(final bool) error {
+	sealed := w.aead.Seal(w.buffer[:0], chunkNonce(w.prefix, w.counter, final), w.buffer, w.aad)
+	if _, err := w.out.Write(sealed); err != nil {
+		return errs.Wrap(err)
+	}
+	if w.counter == ^uint32(0) {
+		return errs.New("stream too long")
+	}
+	w.counter++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// DecryptStream copies 'in' to 'out', decrypting it along the way. Streams
+// written by EncryptStreamWithPublicKey are only accepted when 'identity' is
+// an *RSAIdentity with AllowLegacy set, as they cannot be checked for
+// tampering. Data may have been written to 'out' before tampering or
+// truncation is detected.
+func DecryptStream(in io.Reader, out io.Writer, identity Identity) error {
+	r, err := NewDecryptReader(in, identity)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// DecryptReader decrypts a stream as it is read. An error is returned from
+// Read as soon as tampering or truncation is detected, but data from earlier
+// chunks will already have been returned.
+type DecryptReader struct {
+	in      *bufio.Reader
+	header  *StreamHeader
+	aead    cipher.AEAD
+	aad     []byte
+	chunk   []byte
+	plain   []byte
+	counter uint32
+	legacy  io.Reader
+	done    bool
+	err     error
+}
+
+// NewDecryptReader reads the stream header from 'in' and returns a reader
+// that decrypts the rest of it.
+func NewDecryptReader(in io.Reader, identity Identity) (*DecryptReader, error) {
+	br := bufio.NewReader(in)
+	magic, err := br.Peek(len(streamMagic))
+	if err != nil && err != io.EOF {
+		return nil, errs.Wrap(err)
+	}
+	if !bytes.Equal(magic, streamMagic) {
+		rsaID, ok := identity.(*RSAIdentity)
+		if !ok || !rsaID.AllowLegacy {
+			return nil, errs.NewWithCause("stream is not in the chunked format", ErrUnsupported)
+		}
+		var legacy io.Reader
+		if legacy, err = newLegacyReader(br, rsaID.PrivateKey); err != nil {
+			return nil, err
+		}
+		return &DecryptReader{
+			header: &StreamHeader{Algorithm: AlgorithmLegacyCFB},
+			legacy: legacy,
+		}, nil
+	}
+	if _, err = br.Discard(len(streamMagic)); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := identity.unwrapKey(h.stanzas)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(h.raw)
+	return &DecryptReader{
+		in:     br,
+		header: h,
+		aead:   aead,
+		aad:    sum[:],
+		chunk:  make([]byte, h.ChunkSize+gcmTagSize),
+	}, nil
+}
+
+// Header returns the stream's header.
+func (r *DecryptReader) Header() *StreamHeader {
+	return r.header
+}
+
+// Read implements io.Reader.
+func (r *DecryptReader) Read(data []byte) (int, error) {
+	if r.legacy != nil {
+		return r.legacy.Read(data)
+	}
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.open()
+	}
+	n := copy(data, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *DecryptReader) open() error {
+	n, err := io.ReadFull(r.in, r.chunk)
+	switch {
+	case err == io.EOF:
+		return errs.NewWithCause(ErrTruncated.Error(), ErrTruncated)
+	case err == io.ErrUnexpectedEOF:
+		// A short chunk must be the final one.
+		r.done = true
+	case err != nil:
+		return errs.Wrap(err)
+	default:
+		if _, err = r.in.Peek(1); err == io.EOF {
+			r.done = true
+		} else if err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	if n < gcmTagSize {
+		return errs.NewWithCause(ErrTruncated.Error(), ErrTruncated)
+	}
+	// A failed Open may clobber its destination, so the final chunk, which
+	// might need a second attempt, is not opened in place.
+	dst := r.chunk[:0]
+	if r.done {
+		dst = nil
+	}
+	plain, err := r.aead.Open(dst, chunkNonce(r.header.prefix, r.counter, r.done), r.chunk[:n], r.aad)
+	if err != nil {
+		if !r.done {
+			return errs.NewWithCause(ErrAuthentication.Error(), ErrAuthentication)
+		}
+		// A final chunk that fails to open as final, but opens as a
+		// non-final chunk, means the stream was cut at a chunk boundary.
+		if _, err = r.aead.Open(nil, chunkNonce(r.header.prefix, r.counter, false), r.chunk[:n], r.aad); err == nil {
+			return errs.NewWithCause(ErrTruncated.Error(), ErrTruncated)
+		}
+		return errs.NewWithCause(ErrAuthentication.Error(), ErrAuthentication)
+	}
+	r.counter++
+	r.plain = plain
+	return nil
+}
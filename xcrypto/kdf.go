@@ -0,0 +1,79 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto
+
+import (
+	"hash"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptParams holds the cost parameters for the scrypt key derivation
+// function (RFC 7914). Memory use is roughly 128 * R * 2^LogN bytes.
+type ScryptParams struct {
+	LogN uint8
+	R    int
+	P    int
+}
+
+// MaxScryptMemory is the largest amount of memory, in bytes, that Scrypt()
+// will allocate.
+const MaxScryptMemory = 1 << 30
+
+// Default and limiting scrypt parameters. The limits, along with
+// MaxScryptMemory, are checked before any work is done, so that a hostile
+// header or key file cannot demand unbounded resources.
+var (
+	DefaultScryptParams = ScryptParams{LogN: 18, R: 8, P: 1}
+	MaxScryptParams     = ScryptParams{LogN: 20, R: 8, P: 16}
+)
+
+func (p ScryptParams) withDefaults() ScryptParams {
+	if p.LogN == 0 {
+		p.LogN = DefaultScryptParams.LogN
+	}
+	if p.R < 1 {
+		p.R = DefaultScryptParams.R
+	}
+	if p.P < 1 {
+		p.P = DefaultScryptParams.P
+	}
+	return p
+}
+
+func (p ScryptParams) validate() error {
+	if p.LogN < 1 || p.LogN > MaxScryptParams.LogN || p.R < 1 || p.R > MaxScryptParams.R || p.P < 1 || p.P > MaxScryptParams.P {
+		return errs.Newf("scrypt parameters out of range (logN=%d, r=%d, p=%d)", p.LogN, p.R, p.P)
+	}
+	if uint64(128*p.R)<<p.LogN > MaxScryptMemory {
+		return errs.Newf("scrypt parameters require too much memory (logN=%d, r=%d)", p.LogN, p.R)
+	}
+	return nil
+}
+
+// Scrypt derives a key of the given length from a passphrase and salt.
+func Scrypt(passphrase, salt []byte, params ScryptParams, keyLen int) ([]byte, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, 1<<params.LogN, params.R, params.P, keyLen)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return key, nil
+}
+
+// PBKDF2 derives a key of the given length from a password and salt using
+// PBKDF2 (RFC 8018) with HMAC over the supplied hash function.
+func PBKDF2(password, salt []byte, iterations, keyLen int, h func() hash.Hash) []byte {
+	return pbkdf2.Key(password, salt, iterations, keyLen, h)
+}
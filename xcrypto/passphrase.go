@@ -0,0 +1,119 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+const (
+	stanzaScrypt    = 2
+	scryptSaltSize  = 16
+	scryptWrapLabel = "xcrypto scrypt v1"
+	// maxScryptStanzas limits how many times scrypt may be run for a single
+	// header.
+	maxScryptStanzas = 4
+)
+
+// ErrIncorrectPassphrase is returned, possibly wrapped, when a passphrase
+// does not decrypt a stream or private key.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// PassphraseRecipient encrypts the stream key with a key derived from a
+// passphrase using scrypt. The salt and cost parameters are stored in the
+// header.
+type PassphraseRecipient struct {
+	Passphrase []byte
+	// Params defaults to DefaultScryptParams for any zero fields.
+	Params ScryptParams
+}
+
+func (r *PassphraseRecipient) wrapKey(fileKey []byte) (*stanza, error) {
+	params := r.Params.withDefaults()
+	salt := make([]byte, scryptSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	wrappingKey, err := Scrypt(r.Passphrase, salt, params, fileKeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 0, scryptSaltSize+3+fileKeySize+gcmTagSize)
+	body = append(body, salt...)
+	body = append(body, params.LogN, byte(params.R), byte(params.P))
+	// The wrapping key is unique to the salt, so a fixed nonce is safe.
+	body = aead.Seal(body, make([]byte, aead.NonceSize()), fileKey, []byte(scryptWrapLabel))
+	return &stanza{kind: stanzaScrypt, body: body}, nil
+}
+
+// PassphraseIdentity decrypts streams encrypted with a PassphraseRecipient.
+type PassphraseIdentity struct {
+	Passphrase []byte
+}
+
+func (id *PassphraseIdentity) unwrapKey(stanzas []*stanza) ([]byte, error) {
+	count := 0
+	for _, s := range stanzas {
+		if s.kind == stanzaScrypt {
+			count++
+		}
+	}
+	if count > maxScryptStanzas {
+		return nil, errs.NewWithCausef(ErrUnsupported, "too many passphrase recipients (%d)", count)
+	}
+	for _, s := range stanzas {
+		if s.kind != stanzaScrypt {
+			continue
+		}
+		if len(s.body) != scryptSaltSize+3+fileKeySize+gcmTagSize {
+			return nil, errs.NewWithCause("invalid passphrase recipient", ErrUnsupported)
+		}
+		params := ScryptParams{
+			LogN: s.body[scryptSaltSize],
+			R:    int(s.body[scryptSaltSize+1]),
+			P:    int(s.body[scryptSaltSize+2]),
+		}
+		wrappingKey, err := Scrypt(id.Passphrase, s.body[:scryptSaltSize], params, fileKeySize)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newGCM(wrappingKey)
+		if err != nil {
+			return nil, err
+		}
+		if fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), s.body[scryptSaltSize+3:], []byte(scryptWrapLabel)); err == nil {
+			return fileKey, nil
+		}
+	}
+	if count != 0 {
+		return nil, errs.NewWithCause(ErrIncorrectPassphrase.Error(), ErrIncorrectPassphrase)
+	}
+	return nil, errs.NewWithCause(ErrNoMatchingRecipient.Error(), ErrNoMatchingRecipient)
+}
+
+// EncryptStreamWithPassphrase copies 'in' to 'out', encrypting it with a key
+// derived from the passphrase using DefaultScryptParams.
+func EncryptStreamWithPassphrase(in io.Reader, out io.Writer, passphrase []byte) error {
+	return EncryptStream(in, out, &PassphraseRecipient{Passphrase: passphrase})
+}
+
+// DecryptStreamWithPassphrase copies 'in' to 'out', decrypting it with a key
+// derived from the passphrase.
+func DecryptStreamWithPassphrase(in io.Reader, out io.Writer, passphrase []byte) error {
+	return DecryptStream(in, out, &PassphraseIdentity{Passphrase: passphrase})
+}
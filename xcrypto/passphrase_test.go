@@ -0,0 +1,100 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/xcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Cheap parameters, so the tests run quickly.
+var testScryptParams = xcrypto.ScryptParams{LogN: 10, R: 8, P: 1}
+
+func TestScryptVectors(t *testing.T) {
+	// From RFC 7914, section 12.
+	key, err := xcrypto.Scrypt(nil, nil, xcrypto.ScryptParams{LogN: 4, R: 1, P: 1}, 64)
+	require.NoError(t, err)
+	assert.Equal(t, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906", hex.EncodeToString(key))
+	key, err = xcrypto.Scrypt([]byte("password"), []byte("NaCl"), xcrypto.ScryptParams{LogN: 10, R: 8, P: 16}, 64)
+	require.NoError(t, err)
+	assert.Equal(t, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640", hex.EncodeToString(key))
+
+	_, err = xcrypto.Scrypt(nil, nil, xcrypto.ScryptParams{LogN: 40, R: 8, P: 1}, 32)
+	assert.Error(t, err)
+	_, err = xcrypto.Scrypt(nil, nil, xcrypto.ScryptParams{LogN: 20, R: 16, P: 1}, 32)
+	assert.Error(t, err)
+}
+
+func TestPassphraseRejectsHostileParams(t *testing.T) {
+	encrypted := encrypt(t, []byte("data"), &xcrypto.PassphraseRecipient{Passphrase: []byte("pw"), Params: testScryptParams})
+	// Magic, fixed header fields, stanza kind, key ID length, body size, then
+	// the salt precede the cost parameters.
+	const paramsOffset = 4 + 15 + 4 + 16
+	require.Equal(t, []byte{testScryptParams.LogN, byte(testScryptParams.R), byte(testScryptParams.P)}, encrypted[paramsOffset:paramsOffset+3])
+	encrypted[paramsOffset] = 30
+	encrypted[paramsOffset+1] = 255
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var out bytes.Buffer
+	err := xcrypto.DecryptStreamWithPassphrase(bytes.NewReader(encrypted), &out, []byte("pw"))
+	runtime.ReadMemStats(&after)
+	assert.Error(t, err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestPassphraseRejectsTooManyStanzas(t *testing.T) {
+	recipients := make([]xcrypto.Recipient, 5)
+	for i := range recipients {
+		recipients[i] = &xcrypto.PassphraseRecipient{Passphrase: []byte("pw"), Params: testScryptParams}
+	}
+	encrypted := encrypt(t, []byte("data"), recipients...)
+	var out bytes.Buffer
+	err := xcrypto.DecryptStreamWithPassphrase(bytes.NewReader(encrypted), &out, []byte("pw"))
+	assert.True(t, errors.Is(err, xcrypto.ErrUnsupported), "%v", err)
+}
+
+func TestPassphraseStream(t *testing.T) {
+	data := randomData(t, xcrypto.DefaultChunkSize+10)
+	encrypted := encrypt(t, data, &xcrypto.PassphraseRecipient{Passphrase: []byte("open sesame"), Params: testScryptParams})
+
+	var out bytes.Buffer
+	require.NoError(t, xcrypto.DecryptStreamWithPassphrase(bytes.NewReader(encrypted), &out, []byte("open sesame")))
+	assert.Equal(t, data, out.Bytes())
+
+	err := xcrypto.DecryptStreamWithPassphrase(bytes.NewReader(encrypted), &out, []byte("open barley"))
+	assert.True(t, errors.Is(err, xcrypto.ErrIncorrectPassphrase), "%v", err)
+}
+
+func TestPassphraseAndKeyRecipients(t *testing.T) {
+	key := newKey(t)
+	data := []byte("shared secret")
+	encrypted := encrypt(t, data,
+		&xcrypto.PassphraseRecipient{Passphrase: []byte("pw"), Params: testScryptParams},
+		&xcrypto.RSARecipient{PublicKey: &key.PublicKey})
+
+	var out bytes.Buffer
+	require.NoError(t, xcrypto.DecryptStream(bytes.NewReader(encrypted), &out, &xcrypto.PassphraseIdentity{Passphrase: []byte("pw")}))
+	assert.Equal(t, data, out.Bytes())
+	out.Reset()
+	require.NoError(t, xcrypto.DecryptStream(bytes.NewReader(encrypted), &out, &xcrypto.RSAIdentity{PrivateKey: key}))
+	assert.Equal(t, data, out.Bytes())
+
+	other := encrypt(t, data, &xcrypto.RSARecipient{PublicKey: &key.PublicKey})
+	err := xcrypto.DecryptStream(bytes.NewReader(other), &out, &xcrypto.PassphraseIdentity{Passphrase: []byte("pw")})
+	assert.True(t, errors.Is(err, xcrypto.ErrNoMatchingRecipient), "%v", err)
+}
@@ -0,0 +1,374 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/bits"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// PEM block types.
+const (
+	PEMTypePrivateKey          = "PRIVATE KEY"
+	PEMTypeEncryptedPrivateKey = "ENCRYPTED PRIVATE KEY"
+	PEMTypeRSAPrivateKey       = "RSA PRIVATE KEY"
+	PEMTypeECPrivateKey        = "EC PRIVATE KEY"
+	PEMTypePublicKey           = "PUBLIC KEY"
+	PEMTypeRSAPublicKey        = "RSA PUBLIC KEY"
+	PEMTypeCertificate         = "CERTIFICATE"
+)
+
+// MaxPBKDF2Iterations limits the work a PBKDF2-encrypted private key may
+// demand.
+const MaxPBKDF2Iterations = 10000000
+
+// ErrPassphraseRequired is returned, possibly wrapped, when an encrypted
+// private key is decoded without a passphrase.
+var ErrPassphraseRequired = errors.New("private key is encrypted and requires a passphrase")
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type scryptASN1Params struct {
+	Salt            []byte
+	CostParameter   int
+	BlockSize       int
+	Parallelization int
+	KeyLength       int `asn1:"optional"`
+}
+
+type pbkdf2ASN1Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// EncodePrivateKeyPEM returns the PKCS #8 PEM encoding of an RSA, ECDSA or
+// Ed25519 private key. If 'passphrase' is not empty, the key is encrypted
+// with AES-256-CBC using a key derived with scrypt and DefaultScryptParams,
+// in the PBES2 form that OpenSSL also understands.
+func EncodePrivateKeyPEM(key crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: PEMTypePrivateKey, Bytes: der}), nil
+	}
+	if der, err = encryptPKCS8(der, passphrase, DefaultScryptParams); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeEncryptedPrivateKey, Bytes: der}), nil
+}
+
+// DecodePrivateKeyPEM returns the first private key found in PEM data. PKCS
+// #8 (optionally encrypted with PBES2), PKCS #1 and SEC 1 encodings are
+// accepted. The result is an *rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey.
+func DecodePrivateKeyPEM(data, passphrase []byte) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, errs.New("no private key found")
+		}
+		switch block.Type {
+		case PEMTypePrivateKey:
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			return key, errs.Wrap(err)
+		case PEMTypeEncryptedPrivateKey:
+			if len(passphrase) == 0 {
+				return nil, errs.NewWithCause(ErrPassphraseRequired.Error(), ErrPassphraseRequired)
+			}
+			der, err := decryptPKCS8(block.Bytes, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			key, err := x509.ParsePKCS8PrivateKey(der)
+			if err != nil {
+				return nil, errs.NewWithCause(ErrIncorrectPassphrase.Error(), ErrIncorrectPassphrase)
+			}
+			return key, nil
+		case PEMTypeRSAPrivateKey, PEMTypeECPrivateKey:
+			if _, encrypted := block.Headers["DEK-Info"]; encrypted {
+				return nil, errs.NewWithCause("legacy PEM encryption is not supported; convert the key to encrypted PKCS #8", ErrUnsupported)
+			}
+			if block.Type == PEMTypeRSAPrivateKey {
+				key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+				return key, errs.Wrap(err)
+			}
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			return key, errs.Wrap(err)
+		}
+	}
+}
+
+// EncodePublicKeyPEM returns the PKIX PEM encoding of an RSA, ECDSA or
+// Ed25519 public key.
+func EncodePublicKeyPEM(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypePublicKey, Bytes: der}), nil
+}
+
+// DecodePublicKeyPEM returns the first public key found in PEM data. PKIX and
+// PKCS #1 encodings are accepted, as are certificates. The result is an
+// *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+func DecodePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, errs.New("no public key found")
+		}
+		switch block.Type {
+		case PEMTypePublicKey:
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			return key, errs.Wrap(err)
+		case PEMTypeRSAPublicKey:
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			return key, errs.Wrap(err)
+		case PEMTypeCertificate:
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errs.Wrap(err)
+			}
+			return cert.PublicKey, nil
+		}
+	}
+}
+
+// LoadPrivateKeyPEM loads a private key from a PEM file. See
+// DecodePrivateKeyPEM.
+func LoadPrivateKeyPEM(path string, passphrase []byte) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return DecodePrivateKeyPEM(data, passphrase)
+}
+
+// SavePrivateKeyPEM saves a private key to a PEM file that only the owner can
+// read. See EncodePrivateKeyPEM.
+func SavePrivateKeyPEM(path string, key crypto.PrivateKey, passphrase []byte) error {
+	data, err := EncodePrivateKeyPEM(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return errs.Wrap(ioutil.WriteFile(path, data, 0600))
+}
+
+// LoadPublicKeyPEM loads a public key from a PEM file. See
+// DecodePublicKeyPEM.
+func LoadPublicKeyPEM(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return DecodePublicKeyPEM(data)
+}
+
+// SavePublicKeyPEM saves a public key to a PEM file.
+func SavePublicKeyPEM(path string, key crypto.PublicKey) error {
+	data, err := EncodePublicKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	return errs.Wrap(ioutil.WriteFile(path, data, 0644)) //nolint:gosec
+}
+
+func encryptPKCS8(der, passphrase []byte, params ScryptParams) ([]byte, error) {
+	salt := make([]byte, scryptSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	key, err := Scrypt(passphrase, salt, params, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	kdfParams, err := asn1.Marshal(scryptASN1Params{
+		Salt:            salt,
+		CostParameter:   1 << params.LogN,
+		BlockSize:       params.R,
+		Parallelization: params.P,
+		KeyLength:       32,
+	})
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	schemeParams, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidScrypt, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	result, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: schemeParams}},
+		EncryptedData: encrypted,
+	})
+	return result, errs.Wrap(err)
+}
+
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if err := unmarshalASN1(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errs.NewWithCausef(ErrUnsupported, "unsupported private key encryption %v", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if err := unmarshalASN1(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, errs.NewWithCausef(ErrUnsupported, "unsupported private key cipher %v", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if err := unmarshalASN1(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errs.New("invalid private key initialization vector")
+	}
+	key, err := deriveKDFKey(params.KeyDerivationFunc, passphrase, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := info.EncryptedData
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, errs.New("invalid encrypted private key length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding < 1 || padding > aes.BlockSize || !bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errs.NewWithCause(ErrIncorrectPassphrase.Error(), ErrIncorrectPassphrase)
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+func deriveKDFKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptASN1Params
+		if err := unmarshalASN1(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if params.CostParameter < 2 || params.CostParameter&(params.CostParameter-1) != 0 {
+			return nil, errs.New("invalid scrypt cost parameter")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLen {
+			return nil, errs.New("scrypt key length does not match cipher")
+		}
+		return Scrypt(passphrase, params.Salt, ScryptParams{
+			LogN: uint8(bits.TrailingZeros(uint(params.CostParameter))),
+			R:    params.BlockSize,
+			P:    params.Parallelization,
+		}, keyLen)
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2ASN1Params
+		if err := unmarshalASN1(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, err
+		}
+		if params.IterationCount < 1 || params.IterationCount > MaxPBKDF2Iterations {
+			return nil, errs.Newf("PBKDF2 iteration count out of range (%d)", params.IterationCount)
+		}
+		if params.KeyLength != 0 && params.KeyLength != keyLen {
+			return nil, errs.New("PBKDF2 key length does not match cipher")
+		}
+		var h func() hash.Hash
+		switch {
+		case len(params.PRF.Algorithm) == 0 || params.PRF.Algorithm.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case params.PRF.Algorithm.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		default:
+			return nil, errs.NewWithCausef(ErrUnsupported, "unsupported PBKDF2 function %v", params.PRF.Algorithm)
+		}
+		return PBKDF2(passphrase, params.Salt, params.IterationCount, keyLen, h), nil
+	default:
+		return nil, errs.NewWithCausef(ErrUnsupported, "unsupported key derivation function %v", kdf.Algorithm)
+	}
+}
+
+func unmarshalASN1(der []byte, value interface{}) error {
+	rest, err := asn1.Unmarshal(der, value)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if len(rest) != 0 {
+		return errs.New("trailing data after ASN.1 structure")
+	}
+	return nil
+}
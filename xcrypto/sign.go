@@ -0,0 +1,64 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"io"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+const streamSignatureContext = "xcrypto ed25519 stream signature v1\n"
+
+// ErrInvalidSignature is returned, possibly wrapped, when a signature does
+// not verify.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// SignStream returns a detached Ed25519 signature over the contents of 'in'.
+// The stream is hashed with SHA-512 and the digest, prefixed with a context
+// string, is what gets signed, so the signature must be checked with
+// VerifyStream rather than ed25519.Verify over the raw data.
+func SignStream(in io.Reader, privateKey ed25519.PrivateKey) ([]byte, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, errs.New("invalid Ed25519 private key")
+	}
+	message, err := streamSignatureMessage(in)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(privateKey, message), nil
+}
+
+// VerifyStream checks a signature produced by SignStream against the
+// contents of 'in'.
+func VerifyStream(in io.Reader, publicKey ed25519.PublicKey, signature []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errs.New("invalid Ed25519 public key")
+	}
+	message, err := streamSignatureMessage(in)
+	if err != nil {
+		return err
+	}
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(publicKey, message, signature) {
+		return errs.NewWithCause(ErrInvalidSignature.Error(), ErrInvalidSignature)
+	}
+	return nil
+}
+
+func streamSignatureMessage(in io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return h.Sum([]byte(streamSignatureContext)), nil
+}
@@ -0,0 +1,45 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/xcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	data := randomData(t, 100000)
+	signature, err := xcrypto.SignStream(bytes.NewReader(data), priv)
+	require.NoError(t, err)
+	assert.Len(t, signature, ed25519.SignatureSize)
+	assert.NoError(t, xcrypto.VerifyStream(bytes.NewReader(data), pub, signature))
+
+	data[500] ^= 1
+	err = xcrypto.VerifyStream(bytes.NewReader(data), pub, signature)
+	assert.True(t, errors.Is(err, xcrypto.ErrInvalidSignature), "%v", err)
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	data[500] ^= 1
+	err = xcrypto.VerifyStream(bytes.NewReader(data), otherPub, signature)
+	assert.True(t, errors.Is(err, xcrypto.ErrInvalidSignature), "%v", err)
+
+	err = xcrypto.VerifyStream(bytes.NewReader(data), pub, signature[:10])
+	assert.True(t, errors.Is(err, xcrypto.ErrInvalidSignature), "%v", err)
+}
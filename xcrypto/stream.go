@@ -23,6 +23,9 @@ import (
 // EncryptStreamWithPublicKey copies 'in' to 'out', encrypting the bytes along
 // the way. Note that the output stream will be larger than the input stream
 // by aes.BlockSize + publicKey.Size() bytes.
+//
+// Deprecated: The output has no integrity protection. Use EncryptStream with
+// an RSARecipient instead.
 func EncryptStreamWithPublicKey(in io.Reader, out io.Writer, publicKey *rsa.PublicKey) error {
 	iv := make([]byte, aes.BlockSize)
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
@@ -57,29 +60,39 @@ func EncryptStreamWithPublicKey(in io.Reader, out io.Writer, publicKey *rsa.Publ
 
 // DecryptStreamWithPrivateKey copies 'in' to 'out', decrypting the bytes
 // along the way. Note that the output stream will be smaller than the input
-// stream by aes.BlockSize + publicKey.Size() bytes.
+// stream by aes.BlockSize + publicKey.Size() bytes. Only streams written by
+// EncryptStreamWithPublicKey are accepted; use DecryptStream to accept both
+// formats.
 func DecryptStreamWithPrivateKey(in io.Reader, out io.Writer, privateKey *rsa.PrivateKey) error {
-	encryptedEncryptionKey := make([]byte, privateKey.PublicKey.Size())
-	if _, err := in.Read(encryptedEncryptionKey); err != nil {
+	r, err := newLegacyReader(in, privateKey)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err != nil {
 		return errs.Wrap(err)
 	}
+	return nil
+}
+
+func newLegacyReader(in io.Reader, privateKey *rsa.PrivateKey) (io.Reader, error) {
+	encryptedEncryptionKey := make([]byte, privateKey.PublicKey.Size())
+	if _, err := io.ReadFull(in, encryptedEncryptionKey); err != nil {
+		return nil, truncatedOr(err)
+	}
 	iv := make([]byte, aes.BlockSize)
-	if _, err := in.Read(iv); err != nil {
-		return errs.Wrap(err)
+	if _, err := io.ReadFull(in, iv); err != nil {
+		return nil, truncatedOr(err)
 	}
 	encryptionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedEncryptionKey, nil)
 	if err != nil {
-		return errs.Wrap(err)
+		return nil, errs.Wrap(err)
 	}
 	block, err := aes.NewCipher(encryptionKey)
 	if err != nil {
-		return errs.Wrap(err)
+		return nil, errs.Wrap(err)
 	}
-	if _, err = io.Copy(out, &cipher.StreamReader{
+	return &cipher.StreamReader{
 		S: cipher.NewCFBDecrypter(block, iv),
 		R: in,
-	}); err != nil {
-		return errs.Wrap(err)
-	}
-	return nil
+	}, nil
 }
@@ -0,0 +1,152 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xcrypto_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/richardwilkes/toolbox/xcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+	return data
+}
+
+func encrypt(t *testing.T, data []byte, recipients ...xcrypto.Recipient) []byte {
+	var buffer bytes.Buffer
+	require.NoError(t, xcrypto.EncryptStream(bytes.NewReader(data), &buffer, recipients...))
+	return buffer.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key1 := newKey(t)
+	key2 := newKey(t)
+	recipients := []xcrypto.Recipient{
+		&xcrypto.RSARecipient{PublicKey: &key1.PublicKey},
+		&xcrypto.RSARecipient{PublicKey: &key2.PublicKey},
+	}
+	for _, size := range []int{0, 1, xcrypto.DefaultChunkSize - 1, xcrypto.DefaultChunkSize, 2*xcrypto.DefaultChunkSize + 5} {
+		data := randomData(t, size)
+		encrypted := encrypt(t, data, recipients...)
+		for _, key := range []*rsa.PrivateKey{key1, key2} {
+			var out bytes.Buffer
+			require.NoError(t, xcrypto.DecryptStream(bytes.NewReader(encrypted), &out, &xcrypto.RSAIdentity{PrivateKey: key}), "size %d", size)
+			assert.Equal(t, data, out.Bytes(), "size %d", size)
+		}
+	}
+}
+
+func TestStreamHeader(t *testing.T) {
+	key := newKey(t)
+	keyID, err := xcrypto.KeyID(&key.PublicKey)
+	require.NoError(t, err)
+	encrypted := encrypt(t, []byte("hello"), &xcrypto.RSARecipient{PublicKey: &key.PublicKey})
+	r, err := xcrypto.NewDecryptReader(bytes.NewReader(encrypted), &xcrypto.RSAIdentity{PrivateKey: key})
+	require.NoError(t, err)
+	h := r.Header()
+	assert.Equal(t, xcrypto.StreamVersion, h.Version)
+	assert.Equal(t, xcrypto.AlgorithmAES256GCM, h.Algorithm)
+	assert.Equal(t, xcrypto.DefaultChunkSize, h.ChunkSize)
+	assert.Equal(t, []string{keyID}, h.KeyIDs)
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := newKey(t)
+	identity := &xcrypto.RSAIdentity{PrivateKey: key}
+	data := randomData(t, 3*xcrypto.DefaultChunkSize)
+	encrypted := encrypt(t, data, &xcrypto.RSARecipient{PublicKey: &key.PublicKey})
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-xcrypto.DefaultChunkSize] ^= 1
+	err := xcrypto.DecryptStream(bytes.NewReader(tampered), ioutil.Discard, identity)
+	assert.True(t, errors.Is(err, xcrypto.ErrAuthentication), "%v", err)
+
+	// Flipping the chunk size in the header invalidates every chunk.
+	tampered = append([]byte(nil), encrypted...)
+	tampered[8] ^= 1
+	err = xcrypto.DecryptStream(bytes.NewReader(tampered), ioutil.Discard, identity)
+	assert.Error(t, err)
+
+	// Appended data is rejected.
+	tampered = append(append([]byte(nil), encrypted...), 0)
+	err = xcrypto.DecryptStream(bytes.NewReader(tampered), ioutil.Discard, identity)
+	assert.Error(t, err)
+}
+
+func TestStreamTruncation(t *testing.T) {
+	key := newKey(t)
+	identity := &xcrypto.RSAIdentity{PrivateKey: key}
+	data := randomData(t, 2*xcrypto.DefaultChunkSize+100)
+	encrypted := encrypt(t, data, &xcrypto.RSARecipient{PublicKey: &key.PublicKey})
+
+	// Cut exactly at a chunk boundary.
+	truncated := encrypted[:len(encrypted)-(100+16)]
+	err := xcrypto.DecryptStream(bytes.NewReader(truncated), ioutil.Discard, identity)
+	assert.True(t, errors.Is(err, xcrypto.ErrTruncated), "%v", err)
+
+	// Cut in the middle of a chunk.
+	truncated = encrypted[:len(encrypted)-50]
+	err = xcrypto.DecryptStream(bytes.NewReader(truncated), ioutil.Discard, identity)
+	assert.Error(t, err)
+
+	// Cut within the header.
+	truncated = encrypted[:10]
+	err = xcrypto.DecryptStream(bytes.NewReader(truncated), ioutil.Discard, identity)
+	assert.True(t, errors.Is(err, xcrypto.ErrTruncated), "%v", err)
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	key := newKey(t)
+	other := newKey(t)
+	encrypted := encrypt(t, []byte("secret"), &xcrypto.RSARecipient{PublicKey: &key.PublicKey})
+	err := xcrypto.DecryptStream(bytes.NewReader(encrypted), ioutil.Discard, &xcrypto.RSAIdentity{PrivateKey: other})
+	assert.True(t, errors.Is(err, xcrypto.ErrNoMatchingRecipient), "%v", err)
+}
+
+func TestLegacyStream(t *testing.T) {
+	key := newKey(t)
+	data := randomData(t, 100000)
+	var buffer bytes.Buffer
+	require.NoError(t, xcrypto.EncryptStreamWithPublicKey(bytes.NewReader(data), &buffer, &key.PublicKey)) //nolint:staticcheck
+	encrypted := buffer.Bytes()
+
+	var out bytes.Buffer
+	require.NoError(t, xcrypto.DecryptStreamWithPrivateKey(iotest.OneByteReader(bytes.NewReader(encrypted)), &out, key))
+	assert.Equal(t, data, out.Bytes())
+
+	err := xcrypto.DecryptStream(bytes.NewReader(encrypted), ioutil.Discard, &xcrypto.RSAIdentity{PrivateKey: key})
+	assert.True(t, errors.Is(err, xcrypto.ErrUnsupported), "%v", err)
+
+	out.Reset()
+	r, err := xcrypto.NewDecryptReader(bytes.NewReader(encrypted), &xcrypto.RSAIdentity{PrivateKey: key, AllowLegacy: true})
+	require.NoError(t, err)
+	assert.Equal(t, xcrypto.AlgorithmLegacyCFB, r.Header().Algorithm)
+	_, err = io.Copy(&out, r)
+	require.NoError(t, err)
+	assert.Equal(t, data, out.Bytes())
+}
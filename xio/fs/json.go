@@ -13,9 +13,11 @@ import (
 	"bufio"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xcrypto"
 	"github.com/richardwilkes/toolbox/xio"
 	"github.com/richardwilkes/toolbox/xio/fs/safe"
 )
@@ -43,3 +45,50 @@ func SaveJSON(path string, data interface{}, format bool) error {
 		return errs.Wrap(encoder.Encode(data))
 	})
 }
+
+// LoadJSONEncrypted data from the specified path, which must have been
+// written by SaveJSONEncrypted or otherwise encrypted with an xcrypto stream.
+// The whole stream is authenticated before any of it is decoded, so legacy
+// streams without integrity protection are rejected.
+func LoadJSONEncrypted(path string, data interface{}, identity xcrypto.Identity) error {
+	in, err := loadEncrypted(path, identity)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(in, data); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// SaveJSONEncrypted data to the specified path, encrypted for the given
+// recipients. The file is only readable by its owner.
+func SaveJSONEncrypted(path string, data interface{}, format bool, recipients ...xcrypto.Recipient) error {
+	return safe.WriteEncryptedFile(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		if format {
+			encoder.SetIndent("", "  ")
+		}
+		return errs.Wrap(encoder.Encode(data))
+	}, recipients...)
+}
+
+func loadEncrypted(path string, identity xcrypto.Identity) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(f)
+	r, err := xcrypto.NewDecryptReader(f, identity)
+	if err != nil {
+		return nil, err
+	}
+	if r.Header().Algorithm == xcrypto.AlgorithmLegacyCFB {
+		return nil, errs.NewWithCause("unauthenticated legacy stream", xcrypto.ErrUnsupported)
+	}
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return in, nil
+}
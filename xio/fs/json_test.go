@@ -10,10 +10,15 @@
 package fs_test
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/richardwilkes/toolbox/xcrypto"
 	"github.com/richardwilkes/toolbox/xio/fs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,3 +42,46 @@ func TestLoadSaveJSON(t *testing.T) {
 	require.NoError(t, os.Remove(f.Name()))
 	assert.Equal(t, value, &value2)
 }
+
+func TestLoadSaveJSONEncrypted(t *testing.T) {
+	type data struct {
+		Name   string
+		Secret string
+	}
+	value := &data{
+		Name:   "Rich",
+		Secret: "hunter2",
+	}
+	recipient := &xcrypto.PassphraseRecipient{
+		Passphrase: []byte("pass"),
+		Params:     xcrypto.ScryptParams{LogN: 10, R: 8, P: 1},
+	}
+	f, err := ioutil.TempFile("", "json_test")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	defer os.Remove(f.Name()) //nolint:errcheck
+	require.NoError(t, fs.SaveJSONEncrypted(f.Name(), value, true, recipient))
+	raw, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "hunter2")
+	var value2 data
+	require.NoError(t, fs.LoadJSONEncrypted(f.Name(), &value2, &xcrypto.PassphraseIdentity{Passphrase: []byte("pass")}))
+	assert.Equal(t, value, &value2)
+	assert.Error(t, fs.LoadJSONEncrypted(f.Name(), &value2, &xcrypto.PassphraseIdentity{Passphrase: []byte("wrong")}))
+}
+
+func TestLoadJSONEncryptedRejectsLegacy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "json_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	err = xcrypto.EncryptStreamWithPublicKey(bytes.NewReader([]byte(`{"Name":"forged"}`)), f, &key.PublicKey) //nolint:staticcheck
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	var value map[string]string
+	err = fs.LoadJSONEncrypted(f.Name(), &value, &xcrypto.RSAIdentity{PrivateKey: key, AllowLegacy: true})
+	assert.True(t, errors.Is(err, xcrypto.ErrUnsupported), "%v", err)
+	assert.Empty(t, value)
+}
@@ -0,0 +1,111 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package safe
+
+import (
+	"io"
+	"os"
+
+	"github.com/richardwilkes/toolbox/xcrypto"
+)
+
+// EncryptedFile provides the same safe, atomic saving as File, but encrypts
+// everything written to it as an xcrypto stream, so the plaintext never
+// reaches the disk.
+type EncryptedFile struct {
+	file      *File
+	encrypter *xcrypto.EncryptWriter
+}
+
+// CreateEncrypted creates a temporary file in the same directory as filename,
+// which will be encrypted for the given recipients and renamed to the given
+// filename when calling Commit. The file is only readable by its owner.
+func CreateEncrypted(filename string, recipients ...xcrypto.Recipient) (*EncryptedFile, error) {
+	return CreateEncryptedWithMode(filename, 0600, recipients...)
+}
+
+// CreateEncryptedWithMode creates a temporary file in the same directory as
+// filename, which will be encrypted for the given recipients and renamed to
+// the given filename when calling Commit.
+func CreateEncryptedWithMode(filename string, mode os.FileMode, recipients ...xcrypto.Recipient) (*EncryptedFile, error) {
+	f, err := CreateWithMode(filename, mode)
+	if err != nil {
+		return nil, err
+	}
+	encrypter, err := xcrypto.NewEncryptWriter(f, recipients...)
+	if err != nil {
+		// noinspection GoUnhandledErrorResult
+		f.Close() //nolint: errcheck
+		return nil, err
+	}
+	return &EncryptedFile{
+		file:      f,
+		encrypter: encrypter,
+	}, nil
+}
+
+// OriginalName returns the original filename passed into CreateEncrypted().
+func (f *EncryptedFile) OriginalName() string {
+	return f.file.OriginalName()
+}
+
+// Write implements io.Writer.
+func (f *EncryptedFile) Write(data []byte) (int, error) {
+	return f.encrypter.Write(data)
+}
+
+// WriteString writes a string to the file.
+func (f *EncryptedFile) WriteString(s string) (int, error) {
+	return f.encrypter.Write([]byte(s))
+}
+
+// Commit finishes the encrypted stream, then commits the data into the
+// original file and removes the temporary file from disk. If the stream
+// cannot be finished, the original file is left untouched. Close() may still
+// be called, but will do nothing.
+func (f *EncryptedFile) Commit() error {
+	if f.file.committed {
+		return nil
+	}
+	if f.file.closed {
+		return os.ErrInvalid
+	}
+	if err := f.encrypter.Close(); err != nil {
+		// noinspection GoUnhandledErrorResult
+		f.file.Close() //nolint: errcheck
+		return err
+	}
+	return f.file.Commit()
+}
+
+// Close the temporary file and remove it, if it hasn't already been
+// committed. If it has been committed, nothing happens.
+func (f *EncryptedFile) Close() error {
+	return f.file.Close()
+}
+
+// WriteEncryptedFile uses writer to write data safely and atomically to a
+// file, encrypting it for the given recipients.
+func WriteEncryptedFile(filename string, writer func(io.Writer) error, recipients ...xcrypto.Recipient) (err error) {
+	var f *EncryptedFile
+	f, err = CreateEncrypted(filename, recipients...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	if err = writer(f); err != nil {
+		return
+	}
+	return f.Commit()
+}
@@ -0,0 +1,90 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package safe_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xcrypto"
+	"github.com/richardwilkes/toolbox/xio/fs/safe"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testRecipient = &xcrypto.PassphraseRecipient{
+		Passphrase: []byte("pass"),
+		Params:     xcrypto.ScryptParams{LogN: 10, R: 8, P: 1},
+	}
+	testIdentity = &xcrypto.PassphraseIdentity{Passphrase: []byte("pass")}
+)
+
+func TestEncryptedCommit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "safe_test_")
+	require.NoError(t, err)
+	defer removeAll(t, tmpdir)
+	filename := filepath.Join(tmpdir, "secret.txt")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("original"), 0600))
+	f, err := safe.CreateEncrypted(filename, testRecipient)
+	require.NoError(t, err)
+	n, err := f.WriteString("top secret")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	assert.NoError(t, f.Commit())
+	assert.NoError(t, f.Close())
+
+	data, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "top secret")
+	var out bytes.Buffer
+	require.NoError(t, xcrypto.DecryptStream(bytes.NewReader(data), &out, testIdentity))
+	assert.Equal(t, "top secret", out.String())
+	entries, err := ioutil.ReadDir(tmpdir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestEncryptedAbort(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "safe_test_")
+	require.NoError(t, err)
+	defer removeAll(t, tmpdir)
+	filename := filepath.Join(tmpdir, "secret.txt")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("original"), 0600))
+	err = safe.WriteEncryptedFile(filename, func(w io.Writer) error {
+		if _, werr := w.Write([]byte("replacement")); werr != nil {
+			return werr
+		}
+		return errs.New("abort")
+	}, testRecipient)
+	assert.Error(t, err)
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(data))
+	entries, err := ioutil.ReadDir(tmpdir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = safe.CreateEncrypted(filepath.Join(tmpdir, "none.txt"))
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(tmpdir, "none.txt"))
+	assert.True(t, os.IsNotExist(err))
+	entries, err = ioutil.ReadDir(tmpdir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -14,6 +14,7 @@ import (
 	"io/ioutil"
 
 	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xcrypto"
 	"github.com/richardwilkes/toolbox/xio/fs/safe"
 
 	"gopkg.in/yaml.v2"
@@ -44,3 +45,33 @@ func SaveYAML(path string, data interface{}) error {
 		return nil
 	})
 }
+
+// LoadYAMLEncrypted data from the specified path, which must have been
+// written by SaveYAMLEncrypted or otherwise encrypted with an xcrypto stream.
+// The whole stream is authenticated before any of it is decoded, so legacy
+// streams without integrity protection are rejected.
+func LoadYAMLEncrypted(path string, data interface{}, identity xcrypto.Identity) error {
+	in, err := loadEncrypted(path, identity)
+	if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(in, data); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// SaveYAMLEncrypted data to the specified path, encrypted for the given
+// recipients. The file is only readable by its owner.
+func SaveYAMLEncrypted(path string, data interface{}, recipients ...xcrypto.Recipient) error {
+	out, err := yaml.Marshal(data)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	return safe.WriteEncryptedFile(path, func(w io.Writer) error {
+		if _, err = w.Write(out); err != nil {
+			return errs.Wrap(err)
+		}
+		return nil
+	}, recipients...)
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/richardwilkes/toolbox/xcrypto"
 	"github.com/richardwilkes/toolbox/xio/fs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,3 +38,30 @@ func TestLoadSaveYAML(t *testing.T) {
 	require.NoError(t, os.Remove(f.Name()))
 	assert.Equal(t, value, &value2)
 }
+
+func TestLoadSaveYAMLEncrypted(t *testing.T) {
+	type data struct {
+		Name   string
+		Secret string
+	}
+	value := &data{
+		Name:   "Rich",
+		Secret: "hunter2",
+	}
+	recipient := &xcrypto.PassphraseRecipient{
+		Passphrase: []byte("pass"),
+		Params:     xcrypto.ScryptParams{LogN: 10, R: 8, P: 1},
+	}
+	f, err := ioutil.TempFile("", "yaml_test")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	defer os.Remove(f.Name()) //nolint:errcheck
+	require.NoError(t, fs.SaveYAMLEncrypted(f.Name(), value, recipient))
+	raw, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "hunter2")
+	var value2 data
+	require.NoError(t, fs.LoadYAMLEncrypted(f.Name(), &value2, &xcrypto.PassphraseIdentity{Passphrase: []byte("pass")}))
+	assert.Equal(t, value, &value2)
+	assert.Error(t, fs.LoadYAMLEncrypted(f.Name(), &value2, &xcrypto.PassphraseIdentity{Passphrase: []byte("wrong")}))
+}
@@ -10,54 +10,262 @@
 package network
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"strings"
 	"time"
 
+	"github.com/richardwilkes/toolbox/errs"
 	"github.com/richardwilkes/toolbox/xio"
+	"github.com/richardwilkes/toolbox/xio/network/natpmp"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
 )
 
-var sites = []string{
-	"http://whatismyip.akamai.com/",
-	"https://myip.dnsomatic.com/",
-	"http://icanhazip.com/",
-	"http://diagnostic.opendns.com/myip",
-	"https://myexternalip.com/raw",
-	"http://ifconfig.io/ip",
-	"http://api.ipify.org/",
-	"http://checkip.amazonaws.com/",
-	"http://ident.me/",
-	"https://canihazip.com/s",
-	"https://tnx.nl/ip",
+// DefaultExternalIPTimeout is the time allowed for discovery of the external
+// IP address when no other timeout is specified.
+const DefaultExternalIPTimeout = 10 * time.Second
+
+const maxExternalIPResponseSize = 1024
+
+var (
+	sites = []string{
+		"http://whatismyip.akamai.com/",
+		"https://myip.dnsomatic.com/",
+		"http://icanhazip.com/",
+		"http://diagnostic.opendns.com/myip",
+		"https://myexternalip.com/raw",
+		"http://ifconfig.io/ip",
+		"http://api.ipify.org/",
+		"http://checkip.amazonaws.com/",
+		"http://ident.me/",
+		"https://canihazip.com/s",
+		"https://tnx.nl/ip",
+	}
+	stunServers = []string{
+		"stun.l.google.com:19302",
+		"stun1.l.google.com:19302",
+		"stun.cloudflare.com:3478",
+	}
+	nonPublicNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+)
+
+// IPSource provides a way to discover the external IP address.
+type IPSource interface {
+	// Name returns a description of the source, for use in error messages.
+	Name() string
+	// ExternalIP returns the external IP address as seen by the source.
+	ExternalIP(ctx context.Context) (net.IP, error)
+}
+
+// IPPolicy determines how the results from multiple sources are combined.
+type IPPolicy int
+
+// Possible IPPolicy values.
+const (
+	// FirstWins accepts the first address returned by any source.
+	FirstWins IPPolicy = iota
+	// Majority accepts an address once more than half of the sources have
+	// returned it. If not all sources respond in time, an address returned
+	// by more than half of those that did respond is accepted.
+	Majority
+)
+
+// ExternalIPDiscovery queries a set of sources in parallel to discover the
+// external IP address. Addresses that are not publicly routable, such as the
+// private or carrier-grade NAT address reported by a gateway that is itself
+// behind NAT, are treated as failures.
+type ExternalIPDiscovery struct {
+	// Sources to query. Defaults to DefaultIPSources().
+	Sources []IPSource
+	// Policy determines how the results are combined.
+	Policy IPPolicy
+	// Timeout is the total time allowed. Defaults to
+	// DefaultExternalIPTimeout.
+	Timeout time.Duration
+}
+
+// DefaultIPSources returns NAT-PMP through the default gateway, a set of
+// public STUN servers and a set of public HTTP services.
+func DefaultIPSources() []IPSource {
+	sources := make([]IPSource, 0, 1+len(stunServers)+len(sites))
+	sources = append(sources, &NATPMPIPSource{})
+	for _, server := range stunServers {
+		sources = append(sources, &STUNIPSource{Server: server})
+	}
+	for _, site := range sites {
+		sources = append(sources, &HTTPIPSource{URL: site})
+	}
+	return sources
 }
 
 // ExternalIP returns your IP address as seen by external sites. It does this
-// by iterating through a list of websites that will return your IP address as
-// they see it. The first response with a valid IP address will be returned.
-// timeout sets the maximum amount of time for each attempt.
+// by querying all of the default sources at once and returning the first
+// valid, publicly routable IP address. timeout sets the maximum amount of time
+// to wait for the discovery as a whole, rather than for each source. An empty
+// string is returned if no address could be discovered.
 func ExternalIP(timeout time.Duration) string {
-	client := &http.Client{
-		Timeout: timeout,
+	ip, err := (&ExternalIPDiscovery{Timeout: timeout}).Discover(context.Background())
+	if err != nil {
+		return ""
 	}
-	for _, site := range sites {
-		if ip := externalIP(client, site); ip != "" {
-			return ip
+	return ip.String()
+}
+
+// Discover the external IP address.
+func (d *ExternalIPDiscovery) Discover(ctx context.Context) (net.IP, error) {
+	sources := d.Sources
+	if len(sources) == 0 {
+		sources = DefaultIPSources()
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultExternalIPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		source IPSource
+		ip     net.IP
+		err    error
+	}
+	results := make(chan result, len(sources))
+	for _, source := range sources {
+		go func(source IPSource) {
+			ip, err := source.ExternalIP(ctx)
+			results <- result{source: source, ip: ip, err: err}
+		}(source)
+	}
+	votes := make(map[string]int)
+	responded := 0
+	var failures error
+	for remaining := len(sources); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			if r.err == nil && r.ip == nil {
+				r.err = errs.New("no address returned")
+			}
+			if r.err == nil && !isPublicIP(r.ip) {
+				r.err = errs.Newf("non-public address %s", r.ip)
+			}
+			if r.err != nil {
+				msg := r.err.Error()
+				if detailed, ok := r.err.(*errs.Error); ok {
+					msg = detailed.Message()
+				}
+				failures = errs.Append(failures, errs.Newf("%s failed: %s", r.source.Name(), msg))
+				continue
+			}
+			if d.Policy == FirstWins {
+				return r.ip, nil
+			}
+			responded++
+			key := r.ip.String()
+			votes[key]++
+			if votes[key]*2 > len(sources) {
+				return r.ip, nil
+			}
+		case <-ctx.Done():
+			remaining = 0
 		}
 	}
-	return ""
+	if d.Policy == Majority {
+		for key, count := range votes {
+			if count*2 > responded {
+				return net.ParseIP(key), nil
+			}
+		}
+		if responded > 0 {
+			return nil, errs.Newf("no majority among the %d sources that responded", responded)
+		}
+	}
+	if failures == nil {
+		return nil, errs.NewWithCause("timed out discovering external IP address", ctx.Err())
+	}
+	return nil, failures
 }
 
-func externalIP(client *http.Client, site string) string {
-	if resp, err := client.Get(site); err == nil {
-		defer xio.CloseIgnoringErrors(resp.Body)
-		var body []byte
-		if body, err = ioutil.ReadAll(resp.Body); err == nil {
-			if ip := net.ParseIP(strings.TrimSpace(string(body))); ip != nil {
-				return ip.String()
-			}
+// HTTPIPSource is an IPSource that retrieves the address from a web service
+// that responds with the requester's address as plain text.
+type HTTPIPSource struct {
+	URL string
+	// Client to use. Defaults to an xhttp.Client that does not retry.
+	Client *xhttp.Client
+}
+
+// Name implements IPSource.
+func (s *HTTPIPSource) Name() string {
+	return s.URL
+}
+
+// ExternalIP implements IPSource.
+func (s *HTTPIPSource) ExternalIP(ctx context.Context) (net.IP, error) {
+	client := s.Client
+	if client == nil {
+		client = &xhttp.Client{MaxRetries: -1}
+	}
+	resp, err := client.Get(ctx, s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer xio.CloseIgnoringErrors(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errs.Newf("unexpected status %d", resp.StatusCode)
+	}
+	var body []byte
+	if body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxExternalIPResponseSize)); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	text := strings.TrimSpace(string(body))
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil, errs.Newf("invalid address '%s'", text)
+	}
+	return ip, nil
+}
+
+// NATPMPIPSource is an IPSource that asks the gateway for its external
+// address using NAT-PMP.
+type NATPMPIPSource struct {
+	// Client to use. Defaults to natpmp.DefaultClient().
+	Client *natpmp.Client
+}
+
+// Name implements IPSource.
+func (s *NATPMPIPSource) Name() string {
+	return "NAT-PMP"
+}
+
+// ExternalIP implements IPSource.
+func (s *NATPMPIPSource) ExternalIP(ctx context.Context) (net.IP, error) {
+	client := s.Client
+	if client == nil {
+		client = natpmp.DefaultClient()
+	}
+	return client.ExternalAddress(ctx)
+}
+
+func isPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
 		}
+		nets[i] = ipNet
 	}
-	return ""
+	return nets
 }
@@ -0,0 +1,207 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package network_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const magicCookie = 0x2112A442
+
+// startSTUN starts a STUN stand-in that reports 'mapped' as the client's
+// address. If 'legacy' is true, it uses MAPPED-ADDRESS rather than
+// XOR-MAPPED-ADDRESS. If 'errorCode' is not 0, it responds with an error.
+func startSTUN(t *testing.T, mapped net.IP, legacy bool, errorCode int) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() }) //nolint:errcheck
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, remote, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if n < 20 || binary.BigEndian.Uint16(buffer[0:2]) != 1 || binary.BigEndian.Uint32(buffer[4:8]) != magicCookie {
+				continue
+			}
+			var attr []byte
+			msgType := uint16(0x0101)
+			if errorCode != 0 {
+				msgType = 0x0111
+				reason := "Try Again"
+				attr = make([]byte, 8+len(reason)+1)
+				binary.BigEndian.PutUint16(attr[0:2], 0x0009)
+				binary.BigEndian.PutUint16(attr[2:4], uint16(4+len(reason)))
+				attr[6] = byte(errorCode / 100)
+				attr[7] = byte(errorCode % 100)
+				copy(attr[8:], reason)
+			} else {
+				ip := mapped.To4()
+				family := byte(1)
+				if ip == nil {
+					ip = mapped.To16()
+					family = 2
+				}
+				ip = append([]byte(nil), ip...)
+				port := uint16(remote.Port)
+				attrType := uint16(0x0001)
+				if !legacy {
+					attrType = 0x0020
+					for i := range ip {
+						ip[i] ^= buffer[4+i]
+					}
+					port ^= magicCookie >> 16
+				}
+				attr = make([]byte, 8+len(ip))
+				binary.BigEndian.PutUint16(attr[0:2], attrType)
+				binary.BigEndian.PutUint16(attr[2:4], uint16(4+len(ip)))
+				attr[5] = family
+				binary.BigEndian.PutUint16(attr[6:8], port)
+				copy(attr[8:], ip)
+			}
+			// An unknown, unpadded attribute precedes the address to
+			// exercise padding.
+			unknown := []byte{0x80, 0x22, 0, 3, 'a', 'b', 'c', 0}
+			rsp := make([]byte, 20, 20+len(unknown)+len(attr))
+			binary.BigEndian.PutUint16(rsp[0:2], msgType)
+			binary.BigEndian.PutUint16(rsp[2:4], uint16(len(unknown)+len(attr)))
+			copy(rsp[4:20], buffer[4:20])
+			rsp = append(rsp, unknown...)
+			rsp = append(rsp, attr...)
+			if _, err = conn.WriteToUDP(rsp, remote); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startIPService(t *testing.T, ip string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, ip)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+type stalledSource struct{}
+
+func (s stalledSource) Name() string {
+	return "stalled"
+}
+
+func (s stalledSource) ExternalIP(ctx context.Context) (net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSTUNIPSource(t *testing.T) {
+	ctx := context.Background()
+	for _, one := range []struct {
+		ip     string
+		legacy bool
+	}{
+		{"203.0.113.10", false},
+		{"2001:db8::10", false},
+		{"198.51.100.3", true},
+	} {
+		source := &network.STUNIPSource{Server: startSTUN(t, net.ParseIP(one.ip), one.legacy, 0)}
+		ip, err := source.ExternalIP(ctx)
+		require.NoError(t, err, one.ip)
+		assert.Equal(t, one.ip, ip.String())
+	}
+
+	source := &network.STUNIPSource{Server: startSTUN(t, nil, false, 300)}
+	_, err := source.ExternalIP(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "STUN error 300: Try Again")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }() //nolint:errcheck
+	source = &network.STUNIPSource{Server: conn.LocalAddr().String(), Retransmit: 10 * time.Millisecond}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = source.ExternalIP(timeoutCtx)
+	assert.Error(t, err)
+}
+
+func TestExternalIPDiscovery(t *testing.T) {
+	ctx := context.Background()
+
+	d := &network.ExternalIPDiscovery{
+		Sources: []network.IPSource{
+			stalledSource{},
+			&network.HTTPIPSource{URL: startIPService(t, "192.0.2.1")},
+		},
+		Timeout: 5 * time.Second,
+	}
+	start := time.Now()
+	ip, err := d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip.String())
+	assert.True(t, time.Since(start) < time.Second)
+
+	// A gateway behind carrier-grade NAT reports its own WAN address.
+	d.Sources[0] = &network.HTTPIPSource{URL: startIPService(t, "100.64.0.7")}
+	ip, err = d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip.String())
+	d.Sources = d.Sources[:1]
+	_, err = d.Discover(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "non-public address 100.64.0.7")
+
+	d = &network.ExternalIPDiscovery{
+		Sources: []network.IPSource{
+			&network.HTTPIPSource{URL: startIPService(t, "192.0.2.1")},
+			&network.HTTPIPSource{URL: startIPService(t, "192.0.2.2")},
+			&network.STUNIPSource{Server: startSTUN(t, net.ParseIP("192.0.2.2"), false, 0)},
+		},
+		Policy: network.Majority,
+	}
+	ip, err = d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2", ip.String())
+
+	// Only two of the three respond, and they agree.
+	d.Sources[0] = stalledSource{}
+	d.Timeout = 200 * time.Millisecond
+	ip, err = d.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2", ip.String())
+
+	d.Sources[1] = &network.HTTPIPSource{URL: startIPService(t, "192.0.2.3")}
+	_, err = d.Discover(ctx)
+	assert.Error(t, err)
+
+	d = &network.ExternalIPDiscovery{
+		Sources: []network.IPSource{
+			&network.HTTPIPSource{URL: startIPService(t, "not an address")},
+			&network.STUNIPSource{Server: startSTUN(t, nil, false, 500)},
+		},
+	}
+	_, err = d.Discover(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid address")
+	assert.Contains(t, err.Error(), "STUN error 500")
+}
@@ -0,0 +1,274 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package mdns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	initialQueryInterval = time.Second
+	maxQueryInterval     = time.Hour
+	resolveInterval      = time.Second
+)
+
+// ServiceEntry describes a service instance found by a Browser.
+type ServiceEntry struct {
+	Instance string
+	Type     string
+	Domain   string
+	// Host is the fully-qualified host name.
+	Host string
+	Port int
+	Text []string
+	IPs  []net.IP
+	TTL  time.Duration
+}
+
+// InstanceName returns the fully-qualified name of the service instance.
+func (e *ServiceEntry) InstanceName() string {
+	return escapeLabel(e.Instance) + "." + e.Type + "." + e.Domain + "."
+}
+
+// Browser finds service instances on the local network.
+type Browser struct {
+	// Interfaces to query on. Defaults to all interfaces that are up and
+	// support multicast.
+	Interfaces []net.Interface
+	// Groups holds the multicast addresses to use. Defaults to
+	// DefaultIPv4Group and DefaultIPv6Group.
+	Groups []string
+	// Domain defaults to DefaultDomain.
+	Domain string
+}
+
+type browseState struct {
+	entry    ServiceEntry
+	expires  time.Time
+	hasSRV   bool
+	reported string
+}
+
+// Browse for instances of a service type, such as "_http._tcp", until the
+// context is done. 'found' is called each time an instance is resolved or
+// its details change, and with 'removed' set to true when an instance
+// announces that it is going away or its records expire. Calls to 'found'
+// are made from a single goroutine.
+func (b *Browser) Browse(ctx context.Context, serviceType string, found func(entry *ServiceEntry, removed bool)) error {
+	serviceType = strings.Trim(serviceType, ".")
+	domain := strings.Trim(b.Domain, ".")
+	if domain == "" {
+		domain = DefaultDomain
+	}
+	typeName := serviceType + "." + domain + "."
+	conns, err := openConns(b.Interfaces, b.Groups)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	packets := make(chan packet, 16)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *conn) {
+			defer wg.Done()
+			receive(c, packets, done)
+		}(c)
+	}
+	defer func() {
+		close(done)
+		closeConns(conns)
+		wg.Wait()
+	}()
+	instances := make(map[string]*browseState)
+	hosts := make(map[string]map[string]time.Time)
+	query := func(questions []question) {
+		for _, c := range conns {
+			c.send(&message{questions: questions}, nil) //nolint:errcheck
+		}
+	}
+	query([]question{{name: typeName, qtype: typePTR, qclass: classIN}})
+	queryInterval := initialQueryInterval
+	queryTimer := time.NewTimer(queryInterval)
+	defer queryTimer.Stop()
+	resolveTicker := time.NewTicker(resolveInterval)
+	defer resolveTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-queryTimer.C:
+			// RFC 6762, section 5.2: the interval between queries doubles
+			// each time.
+			query([]question{{name: typeName, qtype: typePTR, qclass: classIN}})
+			if queryInterval *= 2; queryInterval > maxQueryInterval {
+				queryInterval = maxQueryInterval
+			}
+			queryTimer.Reset(queryInterval)
+		case <-resolveTicker.C:
+			now := time.Now()
+			var questions []question
+			for key, state := range instances {
+				if now.After(state.expires) {
+					delete(instances, key)
+					if state.reported != "" {
+						found(&state.entry, true)
+					}
+					continue
+				}
+				if !state.hasSRV {
+					questions = append(questions,
+						question{name: state.entry.InstanceName(), qtype: typeSRV, qclass: classIN},
+						question{name: state.entry.InstanceName(), qtype: typeTXT, qclass: classIN})
+				} else if len(liveIPs(hosts, state.entry.Host, now)) == 0 {
+					questions = append(questions,
+						question{name: state.entry.Host, qtype: typeA, qclass: classIN},
+						question{name: state.entry.Host, qtype: typeAAAA, qclass: classIN})
+				}
+			}
+			if len(questions) > 0 {
+				query(questions)
+			}
+		case p := <-packets:
+			if p.msg.flags&flagResponse == 0 {
+				continue
+			}
+			now := time.Now()
+			records := append(append([]record(nil), p.msg.answers...), p.msg.additionals...)
+			for _, rr := range records {
+				switch rr.rrtype {
+				case typePTR:
+					if !strings.EqualFold(rr.name, typeName) {
+						continue
+					}
+					key := strings.ToLower(rr.target)
+					state, exists := instances[key]
+					if rr.ttl == 0 {
+						if exists {
+							// RFC 6762, section 10.1: goodbyes are honored
+							// after one second, but there is no benefit to
+							// waiting here.
+							delete(instances, key)
+							if state.reported != "" {
+								found(&state.entry, true)
+							}
+						}
+						continue
+					}
+					if !exists {
+						instance, rest := splitFirstLabel(rr.target)
+						if !strings.EqualFold(rest, typeName) {
+							continue
+						}
+						state = &browseState{entry: ServiceEntry{Instance: instance, Type: serviceType, Domain: domain}}
+						instances[key] = state
+					}
+					state.entry.TTL = time.Duration(rr.ttl) * time.Second
+					state.expires = now.Add(state.entry.TTL)
+				case typeSRV:
+					if state, exists := instances[strings.ToLower(rr.name)]; exists {
+						state.entry.Host = rr.target
+						state.entry.Port = int(rr.port)
+						state.hasSRV = true
+					}
+				case typeTXT:
+					if state, exists := instances[strings.ToLower(rr.name)]; exists {
+						state.entry.Text = rr.text
+					}
+				case typeA, typeAAAA:
+					key := strings.ToLower(rr.name)
+					ips := hosts[key]
+					if ips == nil {
+						ips = make(map[string]time.Time)
+						hosts[key] = ips
+					}
+					if rr.ttl == 0 {
+						delete(ips, rr.ip.String())
+					} else {
+						ips[rr.ip.String()] = now.Add(time.Duration(rr.ttl) * time.Second)
+					}
+				}
+			}
+			for _, state := range instances {
+				if !state.hasSRV {
+					continue
+				}
+				state.entry.IPs = liveIPs(hosts, state.entry.Host, now)
+				if len(state.entry.IPs) == 0 {
+					continue
+				}
+				if signature := state.signature(); signature != state.reported {
+					state.reported = signature
+					entry := state.entry
+					found(&entry, false)
+				}
+			}
+		}
+	}
+}
+
+// Lookup browses for instances of a service type until the context is done
+// and returns the instances that were found.
+func (b *Browser) Lookup(ctx context.Context, serviceType string) ([]*ServiceEntry, error) {
+	entries := make(map[string]*ServiceEntry)
+	if err := b.Browse(ctx, serviceType, func(entry *ServiceEntry, removed bool) {
+		key := strings.ToLower(entry.Instance)
+		if removed {
+			delete(entries, key)
+		} else {
+			entries[key] = entry
+		}
+	}); err != nil {
+		return nil, err
+	}
+	list := make([]*ServiceEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Instance < list[j].Instance })
+	return list, nil
+}
+
+func (s *browseState) signature() string {
+	var sb strings.Builder
+	sb.WriteString(s.entry.Host)
+	sb.WriteByte(0)
+	sb.WriteString(strconv.Itoa(s.entry.Port))
+	for _, one := range s.entry.Text {
+		sb.WriteByte(0)
+		sb.WriteString(one)
+	}
+	for _, ip := range s.entry.IPs {
+		sb.WriteByte(0)
+		sb.WriteString(ip.String())
+	}
+	return sb.String()
+}
+
+func liveIPs(hosts map[string]map[string]time.Time, host string, now time.Time) []net.IP {
+	var ips []net.IP
+	for ip, expires := range hosts[strings.ToLower(host)] {
+		if now.Before(expires) {
+			parsed := net.ParseIP(ip)
+			if ip4 := parsed.To4(); ip4 != nil {
+				parsed = ip4
+			}
+			ips = append(ips, parsed)
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].String() < ips[j].String() })
+	return ips
+}
@@ -0,0 +1,420 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package mdns
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeANY  = 255
+
+	classIN         = 1
+	classMask       = 0x7fff
+	cacheFlush      = 0x8000
+	unicastResponse = 0x8000
+
+	flagResponse      = 0x8000
+	flagAuthoritative = 0x0400
+	opcodeMask        = 0x7800
+
+	maxLabelLength    = 63
+	maxNameLength     = 255
+	maxPointerHops    = 32
+	maxMessageSize    = 9000
+	headerSize        = 12
+	fixedRecordSize   = 10
+	fixedQuestionSize = 4
+)
+
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// record holds a resource record. Only the fields relevant to its type are
+// used.
+type record struct {
+	name     string
+	rrtype   uint16
+	class    uint16
+	ttl      uint32
+	target   string // PTR & SRV
+	priority uint16 // SRV
+	weight   uint16 // SRV
+	port     uint16 // SRV
+	text     []string
+	ip       net.IP // A & AAAA
+}
+
+// sameData returns true if the two records have the same name, type and
+// data, ignoring their TTLs.
+func (r *record) sameData(other *record) bool {
+	if r.rrtype != other.rrtype || r.class&classMask != other.class&classMask || !strings.EqualFold(r.name, other.name) {
+		return false
+	}
+	switch r.rrtype {
+	case typePTR:
+		return strings.EqualFold(r.target, other.target)
+	case typeSRV:
+		return strings.EqualFold(r.target, other.target) && r.port == other.port &&
+			r.priority == other.priority && r.weight == other.weight
+	case typeTXT:
+		if len(r.text) != len(other.text) {
+			return false
+		}
+		for i := range r.text {
+			if r.text[i] != other.text[i] {
+				return false
+			}
+		}
+		return true
+	case typeA, typeAAAA:
+		return r.ip.Equal(other.ip)
+	default:
+		return false
+	}
+}
+
+type message struct {
+	id          uint16
+	flags       uint16
+	questions   []question
+	answers     []record
+	authorities []record
+	additionals []record
+}
+
+func (m *message) pack() ([]byte, error) {
+	buffer := make([]byte, headerSize, 512)
+	binary.BigEndian.PutUint16(buffer[0:2], m.id)
+	binary.BigEndian.PutUint16(buffer[2:4], m.flags)
+	binary.BigEndian.PutUint16(buffer[4:6], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(buffer[6:8], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(buffer[8:10], uint16(len(m.authorities)))
+	binary.BigEndian.PutUint16(buffer[10:12], uint16(len(m.additionals)))
+	var err error
+	for _, q := range m.questions {
+		if buffer, err = appendName(buffer, q.name); err != nil {
+			return nil, err
+		}
+		buffer = appendUint16(buffer, q.qtype)
+		buffer = appendUint16(buffer, q.qclass)
+	}
+	for _, section := range [][]record{m.answers, m.authorities, m.additionals} {
+		for i := range section {
+			if buffer, err = appendRecord(buffer, &section[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(buffer) > maxMessageSize {
+		return nil, errs.Newf("message too large (%d bytes)", len(buffer))
+	}
+	return buffer, nil
+}
+
+func appendRecord(buffer []byte, r *record) ([]byte, error) {
+	var err error
+	if buffer, err = appendName(buffer, r.name); err != nil {
+		return nil, err
+	}
+	buffer = appendUint16(buffer, r.rrtype)
+	buffer = appendUint16(buffer, r.class)
+	buffer = append(buffer, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buffer[len(buffer)-6:], r.ttl)
+	start := len(buffer)
+	switch r.rrtype {
+	case typePTR:
+		if buffer, err = appendName(buffer, r.target); err != nil {
+			return nil, err
+		}
+	case typeSRV:
+		buffer = appendUint16(buffer, r.priority)
+		buffer = appendUint16(buffer, r.weight)
+		buffer = appendUint16(buffer, r.port)
+		if buffer, err = appendName(buffer, r.target); err != nil {
+			return nil, err
+		}
+	case typeTXT:
+		if len(r.text) == 0 {
+			// RFC 6763, section 6.1: an empty TXT record holds a single
+			// zero-length string.
+			buffer = append(buffer, 0)
+		}
+		for _, one := range r.text {
+			if len(one) > 255 {
+				return nil, errs.Newf("TXT string too long: %s", one)
+			}
+			buffer = append(buffer, byte(len(one)))
+			buffer = append(buffer, one...)
+		}
+	case typeA:
+		ip := r.ip.To4()
+		if ip == nil {
+			return nil, errs.Newf("not an IPv4 address: %v", r.ip)
+		}
+		buffer = append(buffer, ip...)
+	case typeAAAA:
+		buffer = append(buffer, r.ip.To16()...)
+	default:
+		return nil, errs.Newf("unsupported record type %d", r.rrtype)
+	}
+	binary.BigEndian.PutUint16(buffer[start-2:start], uint16(len(buffer)-start))
+	return buffer, nil
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+	return append(buffer, byte(value>>8), byte(value))
+}
+
+// appendName appends a name in wire format. Names use the usual dotted form,
+// with literal dots and backslashes within a label escaped by a backslash.
+// Compression is not used.
+func appendName(buffer []byte, name string) ([]byte, error) {
+	start := len(buffer)
+	var label []byte
+	escaped := false
+	flush := func() error {
+		if len(label) == 0 {
+			return errs.Newf("empty label in name '%s'", name)
+		}
+		if len(label) > maxLabelLength {
+			return errs.Newf("label too long in name '%s'", name)
+		}
+		buffer = append(buffer, byte(len(label)))
+		buffer = append(buffer, label...)
+		label = label[:0]
+		return nil
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		switch {
+		case escaped:
+			label = append(label, ch)
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == '.':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			label = append(label, ch)
+		}
+	}
+	if len(label) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	buffer = append(buffer, 0)
+	if len(buffer)-start > maxNameLength {
+		return nil, errs.Newf("name too long: '%s'", name)
+	}
+	return buffer, nil
+}
+
+func unpackMessage(data []byte) (*message, error) {
+	if len(data) < headerSize {
+		return nil, errs.New("message too short")
+	}
+	m := &message{
+		id:    binary.BigEndian.Uint16(data[0:2]),
+		flags: binary.BigEndian.Uint16(data[2:4]),
+	}
+	qdCount := int(binary.BigEndian.Uint16(data[4:6]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(data[6:8])),
+		int(binary.BigEndian.Uint16(data[8:10])),
+		int(binary.BigEndian.Uint16(data[10:12])),
+	}
+	offset := headerSize
+	for i := 0; i < qdCount; i++ {
+		var q question
+		var err error
+		if q.name, offset, err = readName(data, offset); err != nil {
+			return nil, err
+		}
+		if offset+fixedQuestionSize > len(data) {
+			return nil, errs.New("truncated question")
+		}
+		q.qtype = binary.BigEndian.Uint16(data[offset:])
+		q.qclass = binary.BigEndian.Uint16(data[offset+2:])
+		offset += fixedQuestionSize
+		m.questions = append(m.questions, q)
+	}
+	sections := []*[]record{&m.answers, &m.authorities, &m.additionals}
+	for s, count := range counts {
+		for i := 0; i < count; i++ {
+			r, next, err := readRecord(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			offset = next
+			if r != nil {
+				*sections[s] = append(*sections[s], *r)
+			}
+		}
+	}
+	return m, nil
+}
+
+// readRecord reads a resource record. A nil record with no error is returned
+// for record types that are not supported.
+func readRecord(data []byte, offset int) (*record, int, error) {
+	r := &record{}
+	var err error
+	if r.name, offset, err = readName(data, offset); err != nil {
+		return nil, 0, err
+	}
+	if offset+fixedRecordSize > len(data) {
+		return nil, 0, errs.New("truncated record")
+	}
+	r.rrtype = binary.BigEndian.Uint16(data[offset:])
+	r.class = binary.BigEndian.Uint16(data[offset+2:])
+	r.ttl = binary.BigEndian.Uint32(data[offset+4:])
+	length := int(binary.BigEndian.Uint16(data[offset+8:]))
+	offset += fixedRecordSize
+	end := offset + length
+	if end > len(data) {
+		return nil, 0, errs.New("truncated record data")
+	}
+	rdata := data[offset:end]
+	switch r.rrtype {
+	case typePTR:
+		if r.target, _, err = readName(data, offset); err != nil {
+			return nil, 0, err
+		}
+	case typeSRV:
+		if length < 7 {
+			return nil, 0, errs.New("truncated SRV record")
+		}
+		r.priority = binary.BigEndian.Uint16(rdata[0:])
+		r.weight = binary.BigEndian.Uint16(rdata[2:])
+		r.port = binary.BigEndian.Uint16(rdata[4:])
+		if r.target, _, err = readName(data, offset+6); err != nil {
+			return nil, 0, err
+		}
+	case typeTXT:
+		for i := 0; i < len(rdata); {
+			size := int(rdata[i])
+			i++
+			if i+size > len(rdata) {
+				return nil, 0, errs.New("truncated TXT record")
+			}
+			if size > 0 {
+				r.text = append(r.text, string(rdata[i:i+size]))
+			}
+			i += size
+		}
+	case typeA:
+		if length != net.IPv4len {
+			return nil, 0, errs.New("invalid A record")
+		}
+		r.ip = net.IP(append([]byte(nil), rdata...))
+	case typeAAAA:
+		if length != net.IPv6len {
+			return nil, 0, errs.New("invalid AAAA record")
+		}
+		r.ip = net.IP(append([]byte(nil), rdata...))
+	default:
+		return nil, end, nil
+	}
+	return r, end, nil
+}
+
+// readName reads a possibly compressed name, returning it and the offset just
+// past it.
+func readName(data []byte, offset int) (string, int, error) {
+	var sb strings.Builder
+	next := -1
+	hops := 0
+	for {
+		if offset >= len(data) {
+			return "", 0, errs.New("truncated name")
+		}
+		size := int(data[offset])
+		switch size & 0xC0 {
+		case 0x00:
+			offset++
+			if size == 0 {
+				if next < 0 {
+					next = offset
+				}
+				if sb.Len() == 0 {
+					sb.WriteByte('.')
+				}
+				if sb.Len() > maxNameLength*2 {
+					return "", 0, errs.New("name too long")
+				}
+				return sb.String(), next, nil
+			}
+			if offset+size > len(data) {
+				return "", 0, errs.New("truncated label")
+			}
+			for _, ch := range data[offset : offset+size] {
+				if ch == '.' || ch == '\\' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteByte(ch)
+			}
+			sb.WriteByte('.')
+			offset += size
+		case 0xC0:
+			if offset+1 >= len(data) {
+				return "", 0, errs.New("truncated name pointer")
+			}
+			if hops++; hops > maxPointerHops {
+				return "", 0, errs.New("too many name compression pointers")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3FFF)
+		default:
+			return "", 0, errs.New("invalid label type")
+		}
+	}
+}
+
+// escapeLabel escapes a single label for inclusion in a dotted name.
+func escapeLabel(label string) string {
+	return strings.NewReplacer(`\`, `\\`, `.`, `\.`).Replace(label)
+}
+
+// splitFirstLabel returns the first label of a name, unescaped, and the
+// remainder of the name.
+func splitFirstLabel(name string) (label, rest string) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		switch {
+		case ch == '\\' && i+1 < len(name):
+			i++
+			sb.WriteByte(name[i])
+		case ch == '.':
+			return sb.String(), name[i+1:]
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String(), ""
+}
@@ -0,0 +1,40 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// +build !windows,!plan9,!js
+
+package mdns
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+func enableMulticastLoopback(c *net.UDPConn, ipv6 bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	var setErr error
+	if err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			setErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, 1)
+		} else {
+			setErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+		}
+	}); err != nil {
+		return errs.Wrap(err)
+	}
+	if setErr != nil {
+		return errs.NewWithCause("unable to enable multicast loopback", setErr)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// Package mdns provides a multicast DNS responder and browser for advertising
+// and discovering services on the local network using DNS-based service
+// discovery. See https://tools.ietf.org/html/rfc6762 and
+// https://tools.ietf.org/html/rfc6763
+package mdns
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// Defaults used when a field is not set.
+const (
+	DefaultIPv4Group = "224.0.0.251:5353"
+	DefaultIPv6Group = "[ff02::fb]:5353"
+	DefaultDomain    = "local"
+	DefaultTTL       = 120 * time.Second
+)
+
+const (
+	servicesName = "_services._dns-sd._udp"
+	legacyMaxTTL = 10
+)
+
+// Service describes a service instance to advertise.
+type Service struct {
+	// Instance is the user-visible name of the instance, such as
+	// "Printer on Desk 3". It may contain spaces and dots.
+	Instance string
+	// Type is the service type, such as "_http._tcp".
+	Type string
+	// Domain defaults to DefaultDomain.
+	Domain string
+	// Host is the host name, without the domain. Defaults to the first label
+	// of the machine's host name.
+	Host string
+	Port int
+	// Text holds the key=value pairs of the TXT record.
+	Text []string
+	// IPs to advertise for the host. Defaults to the addresses of the
+	// interface a query arrives on.
+	IPs []net.IP
+	// TTL defaults to DefaultTTL.
+	TTL time.Duration
+}
+
+func (s *Service) normalize() (*Service, error) {
+	other := *s
+	other.Text = append([]string(nil), s.Text...)
+	other.IPs = append([]net.IP(nil), s.IPs...)
+	other.Type = strings.Trim(other.Type, ".")
+	other.Domain = strings.Trim(other.Domain, ".")
+	if other.Domain == "" {
+		other.Domain = DefaultDomain
+	}
+	if other.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, errs.NewWithCause("unable to determine host name", err)
+		}
+		other.Host = host
+	}
+	if i := strings.IndexByte(other.Host, '.'); i >= 0 {
+		other.Host = other.Host[:i]
+	}
+	if other.TTL <= 0 {
+		other.TTL = DefaultTTL
+	}
+	switch {
+	case other.Instance == "":
+		return nil, errs.New("service instance name is required")
+	case len(other.Instance) > maxLabelLength:
+		return nil, errs.Newf("service instance name too long: %s", other.Instance)
+	case !validServiceType(other.Type):
+		return nil, errs.Newf("invalid service type '%s'; expected something like '_http._tcp'", other.Type)
+	case other.Port < 1 || other.Port > 65535:
+		return nil, errs.Newf("port (%d) must be in the range 1-65535", other.Port)
+	}
+	return &other, nil
+}
+
+// InstanceName returns the fully-qualified name of the service instance.
+func (s *Service) InstanceName() string {
+	return escapeLabel(s.Instance) + "." + s.TypeName()
+}
+
+// TypeName returns the fully-qualified name of the service type.
+func (s *Service) TypeName() string {
+	return s.Type + "." + s.domain() + "."
+}
+
+// HostName returns the fully-qualified name of the host.
+func (s *Service) HostName() string {
+	return s.Host + "." + s.domain() + "."
+}
+
+func (s *Service) domain() string {
+	if s.Domain == "" {
+		return DefaultDomain
+	}
+	return s.Domain
+}
+
+func validServiceType(serviceType string) bool {
+	parts := strings.Split(serviceType, ".")
+	if len(parts) != 2 || len(parts[0]) < 2 || parts[0][0] != '_' {
+		return false
+	}
+	return parts[1] == "_tcp" || parts[1] == "_udp"
+}
+
+// conn is a socket joined to a multicast group on a single interface.
+type conn struct {
+	*net.UDPConn
+	iface net.Interface
+	group *net.UDPAddr
+}
+
+// addresses returns the addresses of the conn's interface.
+func (c *conn) addresses() []net.IP {
+	addrs, err := c.iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+func (c *conn) send(m *message, to *net.UDPAddr) error {
+	data, err := m.pack()
+	if err != nil {
+		return err
+	}
+	if to == nil {
+		to = c.group
+	}
+	if _, err = c.WriteToUDP(data, to); err != nil {
+		return errs.Wrap(err)
+	}
+	return nil
+}
+
+// openConns joins each multicast group on each interface. Interfaces that
+// cannot join a group are skipped. An error is returned only if no group
+// could be joined at all.
+func openConns(ifaces []net.Interface, groups []string) ([]*conn, error) {
+	if len(groups) == 0 {
+		groups = []string{DefaultIPv4Group, DefaultIPv6Group}
+	}
+	if len(ifaces) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		for _, iface := range all {
+			if iface.Flags&(net.FlagUp|net.FlagMulticast) == net.FlagUp|net.FlagMulticast {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+	var conns []*conn
+	var failures error
+	for _, group := range groups {
+		gaddr, err := net.ResolveUDPAddr("udp", group)
+		if err != nil {
+			return nil, errs.NewWithCausef(err, "invalid multicast group '%s'", group)
+		}
+		network := "udp4"
+		if gaddr.IP.To4() == nil {
+			network = "udp6"
+		}
+		for i := range ifaces {
+			iface := ifaces[i]
+			var c *net.UDPConn
+			if c, err = net.ListenMulticastUDP(network, &iface, gaddr); err != nil {
+				failures = errs.Append(failures, errs.NewWithCausef(err, "unable to join %s on %s", group, iface.Name))
+				continue
+			}
+			// The net package disables multicast loopback, but it is needed
+			// to see services on the same host.
+			if err = enableMulticastLoopback(c, network == "udp6"); err != nil {
+				c.Close() //nolint:errcheck
+				failures = errs.Append(failures, err)
+				continue
+			}
+			conns = append(conns, &conn{UDPConn: c, iface: iface, group: gaddr})
+		}
+	}
+	if len(conns) == 0 {
+		if failures == nil {
+			failures = errs.New("no multicast interfaces available")
+		}
+		return nil, failures
+	}
+	return conns, nil
+}
+
+func closeConns(conns []*conn) {
+	for _, c := range conns {
+		c.Close() //nolint:errcheck
+	}
+}
+
+// packet holds a message received on a conn.
+type packet struct {
+	conn *conn
+	msg  *message
+	from *net.UDPAddr
+}
+
+// receive reads messages from the conn and sends them to the channel until
+// the conn is closed.
+func receive(c *conn, packets chan<- packet, done <-chan struct{}) {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		n, from, err := c.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+		msg, err := unpackMessage(buffer[:n])
+		if err != nil || msg.flags&opcodeMask != 0 {
+			continue
+		}
+		select {
+		case packets <- packet{conn: c, msg: msg, from: from}:
+		case <-done:
+			return
+		}
+	}
+}
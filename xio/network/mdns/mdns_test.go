@@ -0,0 +1,185 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package mdns_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/mdns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loopback returns the loopback interface and a multicast group on an unused
+// port, so that tests do not interfere with any real mDNS traffic.
+func loopback(t *testing.T) ([]net.Interface, []string) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			require.NoError(t, err)
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			require.NoError(t, conn.Close())
+			return []net.Interface{iface}, []string{fmt.Sprintf("224.0.0.251:%d", port)}
+		}
+	}
+	t.Skip("no loopback interface")
+	return nil, nil
+}
+
+func TestBrowseAndLookup(t *testing.T) {
+	ifaces, groups := loopback(t)
+	r := &mdns.Responder{Interfaces: ifaces, Groups: groups}
+	defer func() { assert.NoError(t, r.Close()) }()
+	svc := &mdns.Service{
+		Instance: "Test Server. One",
+		Type:     "_http._tcp",
+		Host:     "testhost",
+		Port:     8080,
+		Text:     []string{"path=/api"},
+	}
+	require.NoError(t, r.Register(svc))
+	assert.Error(t, r.Register(svc))
+	require.NoError(t, r.Register(&mdns.Service{
+		Instance: "Other",
+		Type:     "_ipp._tcp",
+		Host:     "printer",
+		Port:     631,
+		IPs:      []net.IP{net.ParseIP("192.0.2.50")},
+	}))
+	assert.Len(t, r.Services(), 2)
+	assert.Equal(t, `Test Server\. One._http._tcp.local.`, svc.InstanceName())
+
+	b := &mdns.Browser{Interfaces: ifaces, Groups: groups}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	entries, err := b.Lookup(ctx, "_http._tcp")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, "Test Server. One", entry.Instance)
+	assert.Equal(t, "_http._tcp", entry.Type)
+	assert.Equal(t, "local", entry.Domain)
+	assert.Equal(t, "testhost.local.", entry.Host)
+	assert.Equal(t, 8080, entry.Port)
+	assert.Equal(t, []string{"path=/api"}, entry.Text)
+	assert.Equal(t, mdns.DefaultTTL, entry.TTL)
+	var hasLoopback bool
+	for _, ip := range entry.IPs {
+		if ip.IsLoopback() {
+			hasLoopback = true
+		}
+	}
+	assert.True(t, hasLoopback, "expected a loopback address in %v", entry.IPs)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	entries, err = b.Lookup(ctx, "_ipp._tcp")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Other", entries[0].Instance)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.50").To4()}, entries[0].IPs)
+	assert.Empty(t, entries[0].Text)
+}
+
+func TestBrowseRemoval(t *testing.T) {
+	ifaces, groups := loopback(t)
+	b := &mdns.Browser{Interfaces: ifaces, Groups: groups}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan string, 10)
+	browsing := make(chan error, 1)
+	go func() {
+		browsing <- b.Browse(ctx, "_test._udp", func(entry *mdns.ServiceEntry, removed bool) {
+			if removed {
+				events <- "removed " + entry.Instance
+			} else {
+				events <- fmt.Sprintf("found %s:%d", entry.Instance, entry.Port)
+			}
+		})
+	}()
+	// Give the browser a chance to join the group before announcing.
+	time.Sleep(100 * time.Millisecond)
+
+	r := &mdns.Responder{Interfaces: ifaces, Groups: groups}
+	defer func() { assert.NoError(t, r.Close()) }()
+	svc := &mdns.Service{Instance: "svc", Type: "_test._udp", Host: "box", Port: 9999}
+	require.NoError(t, r.Register(svc))
+	expect := func(event string) {
+		select {
+		case got := <-events:
+			assert.Equal(t, event, got)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for '%s'", event)
+		}
+	}
+	expect("found svc:9999")
+	require.NoError(t, r.Unregister(svc))
+	expect("removed svc")
+	assert.Error(t, r.Unregister(svc))
+	cancel()
+	assert.NoError(t, <-browsing)
+}
+
+func TestLegacyUnicastQuery(t *testing.T) {
+	ifaces, groups := loopback(t)
+	r := &mdns.Responder{Interfaces: ifaces, Groups: groups}
+	defer func() { assert.NoError(t, r.Close()) }()
+	require.NoError(t, r.Register(&mdns.Service{
+		Instance: "legacy",
+		Type:     "_ssh._tcp",
+		Host:     "server",
+		Port:     22,
+		IPs:      []net.IP{net.ParseIP("192.0.2.7")},
+	}))
+
+	// A conventional resolver asking for server.local's address from an
+	// ephemeral port should get a unicast reply that echoes its ID.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }() //nolint:errcheck
+	group, err := net.ResolveUDPAddr("udp4", groups[0])
+	require.NoError(t, err)
+	query := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	query = append(query, 6, 's', 'e', 'r', 'v', 'e', 'r', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 1, 0, 1)
+	_, err = conn.WriteToUDP(query, group)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	buffer := make([]byte, 9000)
+	n, _, err := conn.ReadFromUDP(buffer)
+	require.NoError(t, err)
+	rsp := buffer[:n]
+	require.True(t, len(rsp) > 12)
+	assert.Equal(t, uint16(0x1234), binary.BigEndian.Uint16(rsp[0:2]))
+	assert.NotZero(t, binary.BigEndian.Uint16(rsp[2:4])&0x8000)
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(rsp[4:6]), "question should be echoed")
+	assert.Equal(t, uint16(1), binary.BigEndian.Uint16(rsp[6:8]))
+	// The answer ends with the TTL (capped at 10), length and address.
+	assert.Equal(t, uint32(10), binary.BigEndian.Uint32(rsp[n-10:n-6]))
+	assert.Equal(t, net.IPv4(192, 0, 2, 7).To4(), net.IP(rsp[n-4:]))
+}
+
+func TestServiceValidation(t *testing.T) {
+	r := &mdns.Responder{}
+	for _, svc := range []*mdns.Service{
+		{Type: "_http._tcp", Port: 80},
+		{Instance: "x", Type: "http", Port: 80},
+		{Instance: "x", Type: "_http._xyz", Port: 80},
+		{Instance: "x", Type: "_http._tcp", Port: 0},
+	} {
+		assert.Error(t, r.Register(svc), "%+v", svc)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package mdns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+const (
+	announceCount    = 2
+	announceInterval = time.Second
+)
+
+// Responder answers multicast DNS queries for the services registered with
+// it. Name conflict probing is not performed, so instance names should be
+// chosen to be unique, for example by including the host name.
+type Responder struct {
+	// Interfaces to listen on. Defaults to all interfaces that are up and
+	// support multicast.
+	Interfaces []net.Interface
+	// Groups holds the multicast addresses to join. Defaults to
+	// DefaultIPv4Group and DefaultIPv6Group.
+	Groups   []string
+	lock     sync.Mutex
+	conns    []*conn
+	services map[string]*Service
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Start listening for queries. Register will call this if it has not been
+// called already.
+func (r *Responder) Start() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.start()
+}
+
+func (r *Responder) start() error {
+	if r.conns != nil {
+		return nil
+	}
+	conns, err := openConns(r.Interfaces, r.Groups)
+	if err != nil {
+		return err
+	}
+	r.conns = conns
+	r.done = make(chan struct{})
+	if r.services == nil {
+		r.services = make(map[string]*Service)
+	}
+	packets := make(chan packet, 16)
+	for _, c := range conns {
+		r.wg.Add(1)
+		go func(c *conn) {
+			defer r.wg.Done()
+			receive(c, packets, r.done)
+		}(c)
+	}
+	r.wg.Add(1)
+	go func(done chan struct{}) {
+		defer r.wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case p := <-packets:
+				r.handle(p)
+			}
+		}
+	}(r.done)
+	return nil
+}
+
+// Register a service and announce it. The service is copied, so changes to
+// it after registration have no effect.
+func (r *Responder) Register(svc *Service) error {
+	normalized, err := svc.normalize()
+	if err != nil {
+		return err
+	}
+	key := strings.ToLower(normalized.InstanceName())
+	r.lock.Lock()
+	if err = r.start(); err != nil {
+		r.lock.Unlock()
+		return err
+	}
+	if _, exists := r.services[key]; exists {
+		r.lock.Unlock()
+		return errs.Newf("service '%s' is already registered", normalized.InstanceName())
+	}
+	r.services[key] = normalized
+	conns := r.conns
+	done := r.done
+	r.lock.Unlock()
+	// RFC 6762, section 8.3: announce at least twice, one second apart.
+	r.announce(conns, normalized, false)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for i := 1; i < announceCount; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(announceInterval):
+			}
+			r.lock.Lock()
+			current := r.services[key]
+			r.lock.Unlock()
+			if current != normalized {
+				return
+			}
+			r.announce(conns, normalized, false)
+		}
+	}()
+	return nil
+}
+
+// Unregister a service, sending a goodbye so that browsers remove it.
+func (r *Responder) Unregister(svc *Service) error {
+	normalized, err := svc.normalize()
+	if err != nil {
+		return err
+	}
+	key := strings.ToLower(normalized.InstanceName())
+	r.lock.Lock()
+	registered, exists := r.services[key]
+	delete(r.services, key)
+	conns := r.conns
+	r.lock.Unlock()
+	if !exists {
+		return errs.Newf("service '%s' is not registered", normalized.InstanceName())
+	}
+	r.announce(conns, registered, true)
+	return nil
+}
+
+// Services returns the registered services.
+func (r *Responder) Services() []*Service {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	list := make([]*Service, 0, len(r.services))
+	for _, svc := range r.services {
+		list = append(list, svc)
+	}
+	return list
+}
+
+// Close sends goodbyes for all registered services and stops responding.
+func (r *Responder) Close() error {
+	r.lock.Lock()
+	conns := r.conns
+	done := r.done
+	services := r.services
+	r.conns = nil
+	r.done = nil
+	r.services = nil
+	r.lock.Unlock()
+	if conns == nil {
+		return nil
+	}
+	for _, svc := range services {
+		r.announce(conns, svc, true)
+	}
+	close(done)
+	closeConns(conns)
+	r.wg.Wait()
+	return nil
+}
+
+// announce sends an unsolicited response with all of the service's records.
+// If 'goodbye' is true, the records are sent with a TTL of zero.
+func (r *Responder) announce(conns []*conn, svc *Service, goodbye bool) {
+	for _, c := range conns {
+		records := serviceRecords(svc, c)
+		if goodbye {
+			// Only the shared PTR record needs a goodbye; the others are
+			// removed along with it.
+			records = records[:1]
+			records[0].ttl = 0
+		}
+		c.send(&message{flags: flagResponse | flagAuthoritative, answers: records}, nil) //nolint:errcheck
+	}
+}
+
+// serviceRecords returns the records for the service, starting with the PTR
+// record, then the SRV, TXT and address records.
+func serviceRecords(svc *Service, c *conn) []record {
+	ttl := uint32(svc.TTL / time.Second)
+	records := []record{
+		{name: svc.TypeName(), rrtype: typePTR, class: classIN, ttl: ttl, target: svc.InstanceName()},
+		{name: svc.InstanceName(), rrtype: typeSRV, class: classIN | cacheFlush, ttl: ttl, target: svc.HostName(), port: uint16(svc.Port)},
+		{name: svc.InstanceName(), rrtype: typeTXT, class: classIN | cacheFlush, ttl: ttl, text: svc.Text},
+	}
+	return append(records, addressRecords(svc, c)...)
+}
+
+func addressRecords(svc *Service, c *conn) []record {
+	ips := svc.IPs
+	if len(ips) == 0 {
+		ips = c.addresses()
+	}
+	ttl := uint32(svc.TTL / time.Second)
+	records := make([]record, 0, len(ips))
+	for _, ip := range ips {
+		rr := record{name: svc.HostName(), rrtype: typeAAAA, class: classIN | cacheFlush, ttl: ttl, ip: ip}
+		if ip4 := ip.To4(); ip4 != nil {
+			rr.rrtype = typeA
+			rr.ip = ip4
+		}
+		records = append(records, rr)
+	}
+	return records
+}
+
+func (r *Responder) handle(p packet) {
+	if p.msg.flags&flagResponse != 0 || len(p.msg.questions) == 0 {
+		return
+	}
+	r.lock.Lock()
+	services := make([]*Service, 0, len(r.services))
+	for _, svc := range r.services {
+		services = append(services, svc)
+	}
+	r.lock.Unlock()
+	// RFC 6762, section 6.7: queries not sent from the mDNS port come from
+	// simple resolvers that expect a conventional unicast reply.
+	legacy := p.from.Port != p.conn.group.Port
+	unicast := legacy
+	var answers, additionals []record
+	for _, q := range p.msg.questions {
+		if q.qclass&unicastResponse != 0 {
+			unicast = true
+		}
+		if q.qclass&classMask != classIN && q.qclass&classMask != typeANY {
+			continue
+		}
+		for _, svc := range services {
+			all := serviceRecords(svc, p.conn)
+			if q.qtype == typePTR && strings.EqualFold(q.name, servicesName+"."+svc.domain()+".") {
+				answers = appendUnique(answers, record{name: q.name, rrtype: typePTR, class: classIN, ttl: all[0].ttl, target: svc.TypeName()})
+				continue
+			}
+			for _, rr := range all {
+				if (q.qtype == rr.rrtype || q.qtype == typeANY) && strings.EqualFold(q.name, rr.name) {
+					answers = appendUnique(answers, rr)
+					switch rr.rrtype {
+					case typePTR:
+						additionals = append(additionals, all[1:]...)
+					case typeSRV:
+						additionals = append(additionals, all[3:]...)
+					}
+				}
+			}
+		}
+	}
+	answers = suppressKnownAnswers(answers, p.msg.answers)
+	if len(answers) == 0 {
+		return
+	}
+	var extra []record
+	for _, rr := range additionals {
+		if !containsRecord(answers, &rr) {
+			extra = appendUnique(extra, rr)
+		}
+	}
+	response := &message{flags: flagResponse | flagAuthoritative, answers: answers, additionals: extra}
+	var to *net.UDPAddr
+	if unicast {
+		to = p.from
+	}
+	if legacy {
+		response.id = p.msg.id
+		response.questions = p.msg.questions
+		for _, section := range [][]record{response.answers, response.additionals} {
+			for i := range section {
+				section[i].class &^= cacheFlush
+				if section[i].ttl > legacyMaxTTL {
+					section[i].ttl = legacyMaxTTL
+				}
+			}
+		}
+	}
+	p.conn.send(response, to) //nolint:errcheck
+}
+
+// suppressKnownAnswers removes answers the querier already has with at least
+// half of their TTL remaining. See RFC 6762, section 7.1.
+func suppressKnownAnswers(answers, known []record) []record {
+	if len(known) == 0 {
+		return answers
+	}
+	result := answers[:0]
+	for _, rr := range answers {
+		suppressed := false
+		for i := range known {
+			if known[i].ttl >= rr.ttl/2 && rr.sameData(&known[i]) {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+func appendUnique(records []record, rr record) []record {
+	if containsRecord(records, &rr) {
+		return records
+	}
+	return append(records, rr)
+}
+
+func containsRecord(records []record, rr *record) bool {
+	for i := range records {
+		if records[i].sameData(rr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,486 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio"
+)
+
+// Defaults used when a Client field is not set. The timeout and number of
+// tries follow the retransmission schedule in RFC 6886, section 3.1.
+const (
+	DefaultPort           = 5351
+	DefaultInitialTimeout = 250 * time.Millisecond
+	DefaultMaxTries       = 9
+	DefaultLifetime       = time.Hour
+)
+
+const (
+	protocolVersion    = 0
+	tcpFlag            = 0x10000
+	responseFlag       = 0x80
+	minRenewalInterval = time.Second
+	retryRenewalAfter  = time.Minute
+)
+
+const (
+	opExternalAddress = iota
+	opMapUDP
+	opMapTCP
+)
+
+// ResultCode holds a NAT-PMP result code.
+type ResultCode uint16
+
+// Possible ResultCode values.
+const (
+	Success ResultCode = iota
+	UnsupportedVersion
+	NotAuthorized
+	NetworkFailure
+	OutOfResources
+	UnsupportedOpcode
+)
+
+func (r ResultCode) String() string {
+	switch r {
+	case Success:
+		return "Success"
+	case UnsupportedVersion:
+		return "Unsupported version"
+	case NotAuthorized:
+		return "Not authorized"
+	case NetworkFailure:
+		return "Network failure"
+	case OutOfResources:
+		return "Out of resources"
+	case UnsupportedOpcode:
+		return "Unsupported opcode"
+	default:
+		return fmt.Sprintf("Unknown result code %d", uint16(r))
+	}
+}
+
+// ResultError is returned when the gateway rejects a request.
+type ResultError struct {
+	Code ResultCode
+}
+
+func (e *ResultError) Error() string {
+	return e.Code.String()
+}
+
+type mapping struct {
+	external   int
+	renew      time.Time
+	notifyChan chan interface{}
+}
+
+// Client talks to a single NAT-PMP gateway and keeps the mappings it creates
+// alive until they are unmapped or the client is closed. A zero value client
+// has no gateway and will fail all requests.
+type Client struct {
+	// Gateway is the address of the NAT-PMP gateway.
+	Gateway net.IP
+	// Port is the port of the gateway. Defaults to DefaultPort.
+	Port int
+	// InitialTimeout is the time to wait for the first response. It doubles
+	// after each try. Defaults to DefaultInitialTimeout.
+	InitialTimeout time.Duration
+	// MaxTries is the number of times a request is sent before giving up.
+	// Defaults to DefaultMaxTries.
+	MaxTries int
+	// Lifetime is the lifetime requested for mappings. Mappings are renewed
+	// when half of the lifetime granted by the gateway has passed. Defaults
+	// to DefaultLifetime.
+	Lifetime    time.Duration
+	lock        sync.Mutex
+	mappings    map[int]*mapping
+	epoch       uint32
+	epochTime   time.Time
+	wake        chan struct{}
+	cancelRenew context.CancelFunc
+	renewDone   chan struct{}
+}
+
+// NewClient creates a new client for the gateway.
+func NewClient(gw net.IP) *Client {
+	return &Client{Gateway: gw}
+}
+
+// ExternalAddress returns the external address the internet sees you as
+// having.
+func (c *Client) ExternalAddress(ctx context.Context) (net.IP, error) {
+	response, err := c.call(ctx, []byte{protocolVersion, opExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), response[8:12]...)), nil
+}
+
+// MapTCP maps the specified TCP port for external access. It returns the port
+// on the external address that can be used to connect to the internal port.
+// The mapping is renewed until it is unmapped or the client is closed. If you
+// wish to be notified of changes to the external port mapping, provide a
+// notify channel. It will be sent an int containing the updated external port
+// mapping when it changes or an error if a renewal fails. The channel will
+// only be sent to if it is ready.
+func (c *Client) MapTCP(ctx context.Context, port int, notifyChan chan interface{}) (int, error) {
+	return c.mapPort(ctx, opMapTCP, port, notifyChan)
+}
+
+// MapUDP maps the specified UDP port for external access. It returns the port
+// on the external address that can be used to connect to the internal port.
+// The mapping is renewed until it is unmapped or the client is closed. If you
+// wish to be notified of changes to the external port mapping, provide a
+// notify channel. It will be sent an int containing the updated external port
+// mapping when it changes or an error if a renewal fails. The channel will
+// only be sent to if it is ready.
+func (c *Client) MapUDP(ctx context.Context, port int, notifyChan chan interface{}) (int, error) {
+	return c.mapPort(ctx, opMapUDP, port, notifyChan)
+}
+
+// UnmapTCP unmaps a previously mapped internal TCP port.
+func (c *Client) UnmapTCP(ctx context.Context, port int) error {
+	return c.unmapPort(ctx, opMapTCP, port)
+}
+
+// UnmapUDP unmaps a previously mapped internal UDP port.
+func (c *Client) UnmapUDP(ctx context.Context, port int) error {
+	return c.unmapPort(ctx, opMapUDP, port)
+}
+
+// Close stops the renewal loop and unmaps all remaining mappings. The client
+// may be used again afterward.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	cancel := c.cancelRenew
+	done := c.renewDone
+	c.cancelRenew = nil
+	c.renewDone = nil
+	keys := make([]int, 0, len(c.mappings))
+	for key := range c.mappings {
+		keys = append(keys, key)
+	}
+	c.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	var result error
+	for _, key := range keys {
+		var err error
+		if key&tcpFlag != 0 {
+			err = c.UnmapTCP(context.Background(), key&^tcpFlag)
+		} else {
+			err = c.UnmapUDP(context.Background(), key)
+		}
+		if err != nil {
+			result = errs.Append(result, err)
+		}
+	}
+	c.lock.Lock()
+	c.mappings = nil
+	c.lock.Unlock()
+	return result
+}
+
+func (c *Client) mapPort(ctx context.Context, op byte, port int, notifyChan chan interface{}) (int, error) {
+	external, lifetime, err := c.requestMapping(ctx, op, port)
+	if err != nil {
+		return 0, err
+	}
+	c.lock.Lock()
+	if c.mappings == nil {
+		c.mappings = make(map[int]*mapping)
+	}
+	c.mappings[mappingKey(op, port)] = &mapping{
+		external:   external,
+		renew:      time.Now().Add(renewalInterval(lifetime)),
+		notifyChan: notifyChan,
+	}
+	c.startRenewalLoop()
+	c.lock.Unlock()
+	return external, nil
+}
+
+func (c *Client) unmapPort(ctx context.Context, op byte, port int) error {
+	if err := checkPort(port); err != nil {
+		return err
+	}
+	if _, err := c.call(ctx, makeUnmapBuffer(op, uint16(port)), 16); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	delete(c.mappings, mappingKey(op, port))
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *Client) requestMapping(ctx context.Context, op byte, port int) (external int, lifetime time.Duration, err error) {
+	if err = checkPort(port); err != nil {
+		return 0, 0, err
+	}
+	requested := c.Lifetime
+	if requested < time.Second {
+		requested = DefaultLifetime
+	}
+	var response []byte
+	if response, err = c.call(ctx, makeMapBuffer(op, uint16(port), requested), 16); err != nil {
+		return 0, 0, err
+	}
+	return int(binary.BigEndian.Uint16(response[10:12])),
+		time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second, nil
+}
+
+// startRenewalLoop must be called with the lock held.
+func (c *Client) startRenewalLoop() {
+	if c.cancelRenew != nil {
+		c.signalRenewalLoop()
+		return
+	}
+	var ctx context.Context
+	ctx, c.cancelRenew = context.WithCancel(context.Background())
+	c.renewDone = make(chan struct{})
+	c.wake = make(chan struct{}, 1)
+	go c.renewalLoop(ctx, c.wake, c.renewDone)
+}
+
+// signalRenewalLoop must be called with the lock held.
+func (c *Client) signalRenewalLoop() {
+	if c.wake != nil {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *Client) renewalLoop(ctx context.Context, wake <-chan struct{}, done chan struct{}) {
+	defer close(done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		c.lock.Lock()
+		var next time.Time
+		for _, m := range c.mappings {
+			if next.IsZero() || m.renew.Before(next) {
+				next = m.renew
+			}
+		}
+		c.lock.Unlock()
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-timer.C:
+			c.renewDue(ctx)
+		}
+	}
+}
+
+func (c *Client) renewDue(ctx context.Context) {
+	now := time.Now()
+	due := make(map[int]*mapping)
+	c.lock.Lock()
+	for key, m := range c.mappings {
+		if !now.Before(m.renew) {
+			due[key] = m
+		}
+	}
+	c.lock.Unlock()
+	for key, m := range due {
+		op := byte(opMapUDP)
+		portType := "UDP"
+		if key&tcpFlag != 0 {
+			op = opMapTCP
+			portType = "TCP"
+		}
+		port := key &^ tcpFlag
+		external, lifetime, err := c.requestMapping(ctx, op, port)
+		if ctx.Err() != nil {
+			return
+		}
+		c.lock.Lock()
+		if current, exists := c.mappings[key]; !exists || current != m {
+			// Unmapped or replaced while the renewal was in progress.
+			c.lock.Unlock()
+			continue
+		}
+		var notice interface{}
+		if err != nil {
+			m.renew = time.Now().Add(retryRenewalAfter)
+			notice = errs.NewWithCausef(err, "Mapping renewal for %s port %d failed", portType, port)
+		} else {
+			m.renew = time.Now().Add(renewalInterval(lifetime))
+			if m.external != external {
+				m.external = external
+				notice = external
+			}
+		}
+		c.lock.Unlock()
+		if notice != nil && m.notifyChan != nil {
+			select {
+			case m.notifyChan <- notice:
+			default:
+			}
+		}
+	}
+}
+
+// checkEpoch detects a gateway that has lost its state, per RFC 6886, section
+// 3.6, and schedules all mappings for immediate renewal when it has.
+func (c *Client) checkEpoch(epoch uint32) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.epochTime.IsZero() {
+		elapsed := uint32(now.Sub(c.epochTime) / time.Second)
+		if epoch+2 < c.epoch+elapsed*7/8 {
+			for _, m := range c.mappings {
+				m.renew = now
+			}
+			c.signalRenewalLoop()
+		}
+	}
+	c.epoch = epoch
+	c.epochTime = now
+}
+
+func (c *Client) call(ctx context.Context, msg []byte, resultSize int) ([]byte, error) {
+	if c.Gateway == nil {
+		return nil, errs.New("No gateway found")
+	}
+	port := c.Port
+	if port <= 0 {
+		port = DefaultPort
+	}
+	timeout := c.InitialTimeout
+	if timeout <= 0 {
+		timeout = DefaultInitialTimeout
+	}
+	tries := c.MaxTries
+	if tries <= 0 {
+		tries = DefaultMaxTries
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: c.Gateway, Port: port})
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(conn)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now()) //nolint:errcheck
+		case <-stop:
+		}
+	}()
+	result := make([]byte, 16)
+	for try := 0; try < tries && ctx.Err() == nil; try++ {
+		if _, err = conn.Write(msg); err != nil {
+			return nil, errs.Wrap(err)
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, errs.Wrap(err)
+		}
+		for ctx.Err() == nil {
+			var n int
+			if n, err = conn.Read(result); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, errs.Wrap(err)
+			}
+			if n < 4 {
+				continue
+			}
+			if result[0] != protocolVersion {
+				return nil, errs.Newf("Unknown protocol version (%d)", result[0])
+			}
+			if result[1] != msg[1]|responseFlag {
+				continue
+			}
+			if code := ResultCode(binary.BigEndian.Uint16(result[2:4])); code != Success {
+				resultErr := &ResultError{Code: code}
+				return nil, errs.NewWithCause(resultErr.Error(), resultErr)
+			}
+			if n != resultSize {
+				return nil, errs.Newf("Unexpected result size (received %d, expected %d)", n, resultSize)
+			}
+			if msg[1] != opExternalAddress && binary.BigEndian.Uint16(result[8:10]) != binary.BigEndian.Uint16(msg[4:6]) {
+				continue
+			}
+			c.checkEpoch(binary.BigEndian.Uint32(result[4:8]))
+			return result, nil
+		}
+		timeout *= 2
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, errs.NewWithCause("Request to gateway canceled", err)
+	}
+	return nil, errs.New("Timed out trying to contact gateway")
+}
+
+func mappingKey(op byte, port int) int {
+	if op == opMapTCP {
+		return port | tcpFlag
+	}
+	return port
+}
+
+func renewalInterval(lifetime time.Duration) time.Duration {
+	if interval := lifetime / 2; interval > minRenewalInterval {
+		return interval
+	}
+	return minRenewalInterval
+}
+
+func checkPort(port int) error {
+	if port > 0 && port < 65536 {
+		return nil
+	}
+	return errs.Newf("Port (%d) must be in the range 1-65535", port)
+}
+
+func makeMapBuffer(op byte, port uint16, lifetime time.Duration) []byte {
+	buffer := makeUnmapBuffer(op, port)
+	binary.BigEndian.PutUint16(buffer[6:8], port)
+	binary.BigEndian.PutUint32(buffer[8:12], uint32(lifetime/time.Second))
+	return buffer
+}
+
+func makeUnmapBuffer(op byte, port uint16) []byte {
+	buffer := make([]byte, 12)
+	buffer[0] = protocolVersion
+	buffer[1] = op
+	binary.BigEndian.PutUint16(buffer[4:6], port)
+	return buffer
+}
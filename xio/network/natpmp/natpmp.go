@@ -12,113 +12,42 @@
 package natpmp
 
 import (
-	"encoding/binary"
+	"context"
 	"net"
 	"sync"
-	"time"
 
 	"github.com/jackpal/gateway"
 	"github.com/richardwilkes/toolbox/atexit"
-	"github.com/richardwilkes/toolbox/errs"
 )
 
-const (
-	protocolVersion = 0
-	expiration      = uint32(time.Hour / time.Second)
-	tcpFlag         = 0x10000
-)
-
-const (
-	opExternalAddress = iota
-	opMapUDP
-	opMapTCP
-)
-
-type mapping struct {
-	external   int
-	renew      time.Time
-	notifyChan chan interface{}
-}
-
 var (
-	gw       net.IP
-	lock     sync.RWMutex
-	mappings = make(map[int]mapping)
+	defaultOnce   sync.Once
+	defaultClient *Client
 )
 
-func init() {
-	var err error
-	if gw, err = gateway.DiscoverGateway(); err == nil {
-		go func() {
+// DefaultClient returns the client used by the package-level functions. Its
+// gateway is discovered the first time this is called. If a gateway is
+// found, the client's mappings will be removed at exit.
+func DefaultClient() *Client {
+	defaultOnce.Do(func() {
+		gw, err := gateway.DiscoverGateway()
+		if err != nil {
+			gw = nil
+		}
+		defaultClient = NewClient(gw)
+		if gw != nil {
 			atexit.Register(func() {
-				lock.RLock()
-				ports := make([]int, len(mappings))
-				for port := range mappings {
-					ports = append(ports, port)
-				}
-				lock.RUnlock()
-				for _, port := range ports {
-					if port&tcpFlag != 0 {
-						err = UnmapTCP(port &^ tcpFlag)
-					} else {
-						err = UnmapUDP(port)
-					}
-				}
+				defaultClient.Close() //nolint:errcheck
 			})
-			for {
-				time.Sleep(time.Minute)
-				renew := make(map[int]mapping)
-				now := time.Now()
-				lock.RLock()
-				for k, v := range mappings {
-					if !now.Before(v.renew) {
-						renew[k] = v
-					}
-				}
-				lock.RUnlock()
-				for port, v := range renew {
-					var external int
-					if port&tcpFlag != 0 {
-						external, err = MapTCP(port&^tcpFlag, v.notifyChan)
-					} else {
-						external, err = MapUDP(port, v.notifyChan)
-					}
-					if v.notifyChan != nil {
-						if err != nil {
-							var portType string
-							if port&tcpFlag != 0 {
-								portType = "TCP"
-							} else {
-								portType = "UDP"
-							}
-							select {
-							case v.notifyChan <- errs.NewWithCausef(err, "Mapping renewal for %s port %d failed", portType, port):
-							default:
-							}
-						} else if v.external != external {
-							select {
-							case v.notifyChan <- external:
-							default:
-							}
-						}
-					}
-				}
-			}
-		}()
-	}
+		}
+	})
+	return defaultClient
 }
 
 // ExternalAddress returns the external address the internet sees you as
 // having.
 func ExternalAddress() (net.IP, error) {
-	buffer := make([]byte, 2)
-	buffer[0] = protocolVersion
-	buffer[1] = opExternalAddress
-	response, err := call(buffer, 12)
-	if err != nil {
-		return nil, err
-	}
-	return response[8:12], nil
+	return DefaultClient().ExternalAddress(context.Background())
 }
 
 // MapTCP maps the specified TCP port for external access. It returns the port
@@ -128,16 +57,7 @@ func ExternalAddress() (net.IP, error) {
 // port mapping when it changes or an error if a renewal fails. The channel
 // will only be sent to if it is ready.
 func MapTCP(port int, notifyChan chan interface{}) (int, error) {
-	if err := checkPort(port); err != nil {
-		return 0, err
-	}
-	response, err := call(makeMapBuffer(opMapTCP, uint16(port)), 16)
-	if err != nil {
-		return 0, err
-	}
-	external := int(binary.BigEndian.Uint16(response[10:12]))
-	addMapping(port|tcpFlag, external, notifyChan)
-	return external, nil
+	return DefaultClient().MapTCP(context.Background(), port, notifyChan)
 }
 
 // MapUDP maps the specified UDP port for external access. It returns the port
@@ -147,142 +67,15 @@ func MapTCP(port int, notifyChan chan interface{}) (int, error) {
 // port mapping when it changes or an error if a renewal fails. The channel
 // will only be sent to if it is ready.
 func MapUDP(port int, notifyChan chan interface{}) (int, error) {
-	if err := checkPort(port); err != nil {
-		return 0, err
-	}
-	response, err := call(makeMapBuffer(opMapUDP, uint16(port)), 16)
-	if err != nil {
-		return 0, err
-	}
-	external := int(binary.BigEndian.Uint16(response[10:12]))
-	addMapping(port, external, notifyChan)
-	return external, nil
+	return DefaultClient().MapUDP(context.Background(), port, notifyChan)
 }
 
 // UnmapTCP unmaps a previously mapped internal TCP port.
 func UnmapTCP(port int) error {
-	if err := checkPort(port); err != nil {
-		return err
-	}
-	_, err := call(makeUnmapBuffer(opMapTCP, uint16(port)), 16)
-	if err != nil {
-		return err
-	}
-	removeMapping(port | tcpFlag)
-	return err
+	return DefaultClient().UnmapTCP(context.Background(), port)
 }
 
 // UnmapUDP unmaps a previously mapped internal UDP port.
 func UnmapUDP(port int) error {
-	if err := checkPort(port); err != nil {
-		return err
-	}
-	_, err := call(makeUnmapBuffer(opMapUDP, uint16(port)), 16)
-	if err != nil {
-		return err
-	}
-	removeMapping(port)
-	return err
-}
-
-func checkPort(port int) error {
-	if port > 0 && port < 65536 {
-		return nil
-	}
-	return errs.Newf("Port (%d) must be in the range 1-65535", port)
-}
-
-func makeMapBuffer(op byte, port uint16) []byte {
-	buffer := makeUnmapBuffer(op, port)
-	binary.BigEndian.PutUint16(buffer[6:8], port)
-	binary.BigEndian.PutUint32(buffer[8:12], expiration)
-	return buffer
-}
-
-func makeUnmapBuffer(op byte, port uint16) []byte {
-	buffer := make([]byte, 12)
-	buffer[0] = protocolVersion
-	buffer[1] = op
-	binary.BigEndian.PutUint16(buffer[4:6], port)
-	return buffer
-}
-
-func addMapping(internal, external int, notifyChan chan interface{}) {
-	lock.Lock()
-	mappings[internal] = mapping{
-		external:   external,
-		renew:      time.Now().Add(50 * time.Minute),
-		notifyChan: notifyChan,
-	}
-	lock.Unlock()
-}
-
-func removeMapping(internal int) {
-	lock.Lock()
-	delete(mappings, internal)
-	lock.Unlock()
-}
-
-func call(msg []byte, resultSize int) ([]byte, error) {
-	if gw == nil {
-		return nil, errs.New("No gateway found")
-	}
-	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   gw,
-		Port: 5351,
-	})
-	if err != nil {
-		return nil, errs.Wrap(err)
-	}
-	defer func() { err = conn.Close() }()
-	timeout := time.Now().Add(30 * time.Second)
-	err = conn.SetDeadline(timeout)
-	if err != nil {
-		return nil, errs.Wrap(err)
-	}
-	result := make([]byte, resultSize)
-	for time.Now().Before(timeout) {
-		if _, err = conn.Write(msg); err != nil {
-			return nil, errs.Wrap(err)
-		}
-		var n int
-		var remote *net.UDPAddr
-		if n, remote, err = conn.ReadFromUDP(result); err != nil {
-			if err.(net.Error).Timeout() {
-				continue
-			}
-			return nil, errs.Wrap(err)
-		}
-		if !remote.IP.Equal(gw) {
-			continue
-		}
-		if n != resultSize {
-			return nil, errs.Newf("Unexpected result size (received %d, expected %d)", n, resultSize)
-		}
-		if result[0] != 0 {
-			return nil, errs.Newf("Unknown protocol version (%d)", result[0])
-		}
-		expectedOp := msg[1] | 0x80
-		if result[1] != expectedOp {
-			return nil, errs.Newf("Unexpected opcode (received %d, expected %d)", result[1], expectedOp)
-		}
-		code := binary.BigEndian.Uint16(result[2:4])
-		switch code {
-		case 0:
-			return result, nil
-		case 1:
-			return nil, errs.New("Unsupported version")
-		case 2:
-			return nil, errs.New("Not authorized")
-		case 3:
-			return nil, errs.New("Network failure")
-		case 4:
-			return nil, errs.New("Out of resources")
-		case 5:
-			return nil, errs.New("Unsupported opcode")
-		default:
-			return nil, errs.Newf("Unknown result code %d", code)
-		}
-	}
-	return nil, errs.Newf("Timed out trying to contact gateway")
+	return DefaultClient().UnmapUDP(context.Background(), port)
 }
@@ -0,0 +1,208 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package natpmp_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/natpmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeGateway struct {
+	conn     *net.UDPConn
+	lock     sync.Mutex
+	drop     int
+	offset   uint16
+	lifetime uint32
+	epoch    uint32
+	requests []string
+}
+
+func startFakeGateway(t *testing.T) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	g := &fakeGateway{conn: conn, offset: 1000, epoch: 5000}
+	go g.serve()
+	t.Cleanup(func() { _ = conn.Close() }) //nolint:errcheck
+	return g
+}
+
+func (g *fakeGateway) client() *natpmp.Client {
+	addr := g.conn.LocalAddr().(*net.UDPAddr)
+	c := natpmp.NewClient(addr.IP)
+	c.Port = addr.Port
+	c.InitialTimeout = 20 * time.Millisecond
+	return c
+}
+
+func (g *fakeGateway) serve() {
+	buffer := make([]byte, 64)
+	for {
+		n, remote, err := g.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		g.lock.Lock()
+		if g.drop > 0 {
+			g.drop--
+			g.lock.Unlock()
+			continue
+		}
+		var rsp []byte
+		op := buffer[1]
+		switch {
+		case n == 2 && op == 0:
+			g.requests = append(g.requests, "external")
+			rsp = make([]byte, 12)
+			copy(rsp[8:], net.IPv4(192, 0, 2, 33).To4())
+		case n == 12 && (op == 1 || op == 2):
+			internal := binary.BigEndian.Uint16(buffer[4:6])
+			lifetime := binary.BigEndian.Uint32(buffer[8:12])
+			rsp = make([]byte, 16)
+			copy(rsp[8:10], buffer[4:6])
+			switch {
+			case internal == 1:
+				binary.BigEndian.PutUint16(rsp[2:4], uint16(natpmp.NotAuthorized))
+			case lifetime == 0:
+				g.requests = append(g.requests, "unmap")
+			default:
+				g.requests = append(g.requests, "map")
+				binary.BigEndian.PutUint16(rsp[10:12], internal+g.offset)
+				if g.lifetime != 0 {
+					lifetime = g.lifetime
+				}
+				binary.BigEndian.PutUint32(rsp[12:16], lifetime)
+			}
+		default:
+			rsp = make([]byte, 8)
+			binary.BigEndian.PutUint16(rsp[2:4], uint16(natpmp.UnsupportedOpcode))
+		}
+		rsp[1] = op | 0x80
+		binary.BigEndian.PutUint32(rsp[4:8], g.epoch)
+		g.epoch++
+		g.lock.Unlock()
+		if _, err = g.conn.WriteToUDP(rsp, remote); err != nil {
+			return
+		}
+	}
+}
+
+func (g *fakeGateway) count(request string) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	count := 0
+	for _, one := range g.requests {
+		if one == request {
+			count++
+		}
+	}
+	return count
+}
+
+func TestClient(t *testing.T) {
+	g := startFakeGateway(t)
+	c := g.client()
+	ctx := context.Background()
+
+	ip, err := c.ExternalAddress(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.33", ip.String())
+
+	external, err := c.MapTCP(ctx, 8080, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 9080, external)
+	external, err = c.MapUDP(ctx, 5353, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 6353, external)
+
+	require.NoError(t, c.UnmapTCP(ctx, 8080))
+	assert.Equal(t, 1, g.count("unmap"))
+
+	_, err = c.MapTCP(ctx, 1, nil)
+	var resultErr *natpmp.ResultError
+	require.True(t, errors.As(err, &resultErr))
+	assert.Equal(t, natpmp.NotAuthorized, resultErr.Code)
+	assert.Equal(t, "Not authorized", resultErr.Code.String())
+
+	_, err = c.MapTCP(ctx, 0, nil)
+	assert.Error(t, err)
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, 2, g.count("unmap"))
+}
+
+func TestClientRetries(t *testing.T) {
+	g := startFakeGateway(t)
+	g.lock.Lock()
+	g.drop = 2
+	g.lock.Unlock()
+	c := g.client()
+	_, err := c.ExternalAddress(context.Background())
+	require.NoError(t, err)
+
+	g.lock.Lock()
+	g.drop = 100
+	g.lock.Unlock()
+	c.MaxTries = 3
+	start := time.Now()
+	_, err = c.ExternalAddress(context.Background())
+	assert.Error(t, err)
+	// 20ms + 40ms + 80ms
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 140*time.Millisecond && elapsed < time.Second, "elapsed %v", elapsed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.MaxTries = 0
+	start = time.Now()
+	_, err = c.ExternalAddress(ctx)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	c.Gateway = nil
+	_, err = c.ExternalAddress(context.Background())
+	assert.Error(t, err)
+}
+
+func TestClientRenewal(t *testing.T) {
+	g := startFakeGateway(t)
+	g.lock.Lock()
+	g.lifetime = 2
+	g.lock.Unlock()
+	c := g.client()
+	notify := make(chan interface{}, 1)
+	external, err := c.MapUDP(context.Background(), 4000, notify)
+	require.NoError(t, err)
+	assert.Equal(t, 5000, external)
+
+	g.lock.Lock()
+	g.offset = 2000
+	g.lock.Unlock()
+	select {
+	case n := <-notify:
+		assert.Equal(t, 6000, n)
+	case <-time.After(3 * time.Second):
+		t.Fatal("mapping was not renewed")
+	}
+	assert.Equal(t, 2, g.count("map"))
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, 1, g.count("unmap"))
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, 2, g.count("map"), "renewal should stop once closed")
+}
@@ -0,0 +1,85 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package portmap
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio/network/natpmp"
+)
+
+// NATPMP is a Mapper that uses a natpmp.Client. The client renews its
+// mappings on its own, so the mappings returned have a lifetime of 0. The
+// suggested external port and requested lifetime are ignored; set the
+// client's Lifetime field to change the lifetime it requests.
+type NATPMP struct {
+	// Client is the client to use. Defaults to natpmp.DefaultClient().
+	Client *natpmp.Client
+}
+
+// Name implements Mapper.
+func (n *NATPMP) Name() string {
+	return "NAT-PMP"
+}
+
+// ExternalAddress implements Mapper.
+func (n *NATPMP) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return n.client().ExternalAddress(ctx)
+}
+
+// AddMapping implements Mapper.
+func (n *NATPMP) AddMapping(ctx context.Context, protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	client := n.client()
+	var external int
+	var err error
+	switch protocol {
+	case TCP:
+		external, err = client.MapTCP(ctx, internalPort, nil)
+	case UDP:
+		external, err = client.MapUDP(ctx, internalPort, nil)
+	default:
+		return nil, errs.Newf("unknown protocol '%s'", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mapping := &Mapping{
+		Mapper:       n.Name(),
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: external,
+	}
+	if ip, ipErr := client.ExternalAddress(ctx); ipErr == nil {
+		mapping.ExternalIP = ip
+	}
+	return mapping, nil
+}
+
+// DeleteMapping implements Mapper.
+func (n *NATPMP) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	switch mapping.Protocol {
+	case TCP:
+		return n.client().UnmapTCP(ctx, mapping.InternalPort)
+	case UDP:
+		return n.client().UnmapUDP(ctx, mapping.InternalPort)
+	default:
+		return errs.Newf("unknown protocol '%s'", mapping.Protocol)
+	}
+}
+
+func (n *NATPMP) client() *natpmp.Client {
+	if n.Client != nil {
+		return n.Client
+	}
+	return natpmp.DefaultClient()
+}
@@ -0,0 +1,285 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package portmap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio"
+)
+
+// Defaults used by the UDP-based protocols when no value is specified.
+const (
+	DefaultGatewayPort       = 5351
+	DefaultTimeout           = 5 * time.Second
+	DefaultInitialRetransmit = 250 * time.Millisecond
+)
+
+const (
+	pcpVersion      = 2
+	pcpOpMap        = 1
+	pcpResponseFlag = 0x80
+	pcpHeaderSize   = 24
+	pcpMapSize      = pcpHeaderSize + 36
+	pcpMaxPacket    = 1100
+	ianaTCP         = 6
+	ianaUDP         = 17
+)
+
+// PCPResult holds a PCP result code.
+type PCPResult uint8
+
+// Possible PCPResult values. See https://tools.ietf.org/html/rfc6887#section-7.4
+const (
+	PCPSuccess PCPResult = iota
+	PCPUnsupportedVersion
+	PCPNotAuthorized
+	PCPMalformedRequest
+	PCPUnsupportedOpcode
+	PCPUnsupportedOption
+	PCPMalformedOption
+	PCPNetworkFailure
+	PCPNoResources
+	PCPUnsupportedProtocol
+	PCPUserExceededQuota
+	PCPCannotProvideExternal
+	PCPAddressMismatch
+	PCPExcessiveRemotePeers
+)
+
+var pcpResultNames = []string{
+	"success",
+	"unsupported version",
+	"not authorized",
+	"malformed request",
+	"unsupported opcode",
+	"unsupported option",
+	"malformed option",
+	"network failure",
+	"no resources",
+	"unsupported protocol",
+	"user exceeded quota",
+	"cannot provide external",
+	"address mismatch",
+	"excessive remote peers",
+}
+
+func (r PCPResult) String() string {
+	if int(r) < len(pcpResultNames) {
+		return pcpResultNames[r]
+	}
+	return fmt.Sprintf("unknown result code %d", r)
+}
+
+// PCPError is returned when a PCP server rejects a request.
+type PCPError struct {
+	Code PCPResult
+}
+
+func (e *PCPError) Error() string {
+	return "PCP request failed: " + e.Code.String()
+}
+
+// PCP is a Mapper that uses the Port Control Protocol. Both IPv4 and IPv6
+// gateways are supported. See https://tools.ietf.org/html/rfc6887
+type PCP struct {
+	// Gateway is the address of the PCP server. Required.
+	Gateway net.IP
+	// Port is the port of the PCP server. Defaults to DefaultGatewayPort.
+	Port int
+	// Timeout is the total time to wait for a response. Defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+	// InitialRetransmit is the time to wait before the first retransmission
+	// of a request. It doubles after each one. Defaults to
+	// DefaultInitialRetransmit.
+	InitialRetransmit time.Duration
+	once              sync.Once
+	nonce             [12]byte
+}
+
+// Name implements Mapper.
+func (p *PCP) Name() string {
+	return "PCP"
+}
+
+// ExternalAddress implements Mapper. PCP has no request for this, so it
+// always returns an error wrapping ErrUnsupported. The external address is
+// available from the mappings it creates.
+func (p *PCP) ExternalAddress(ctx context.Context) (net.IP, error) {
+	return nil, errs.NewWithCause("PCP does not provide the external address on its own", ErrUnsupported)
+}
+
+// AddMapping implements Mapper.
+func (p *PCP) AddMapping(ctx context.Context, protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	if err := checkPort(internalPort); err != nil {
+		return nil, err
+	}
+	if externalPort < 0 || externalPort > 65535 {
+		return nil, errs.Newf("external port (%d) must be in the range 0-65535", externalPort)
+	}
+	return p.mapRequest(ctx, protocol, internalPort, externalPort, lifetimeOrDefault(lifetime))
+}
+
+// DeleteMapping implements Mapper.
+func (p *PCP) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	_, err := p.mapRequest(ctx, mapping.Protocol, mapping.InternalPort, 0, 0)
+	return err
+}
+
+func (p *PCP) mapRequest(ctx context.Context, protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	var proto byte
+	switch protocol {
+	case TCP:
+		proto = ianaTCP
+	case UDP:
+		proto = ianaUDP
+	default:
+		return nil, errs.Newf("unknown protocol '%s'", protocol)
+	}
+	if p.Gateway == nil {
+		return nil, errs.New("no PCP gateway specified")
+	}
+	client, err := localAddressFor(p.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.initNonce(); err != nil {
+		return nil, err
+	}
+	request := make([]byte, pcpMapSize)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:8], uint32(lifetime/time.Second))
+	copy(request[8:24], client.To16())
+	copy(request[24:36], p.nonce[:])
+	request[36] = proto
+	binary.BigEndian.PutUint16(request[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[42:44], uint16(externalPort))
+	if client.To4() != nil {
+		copy(request[44:60], net.IPv4zero.To16())
+	}
+	var mapping *Mapping
+	err = exchange(ctx, p.Gateway, p.Port, p.Timeout, p.InitialRetransmit, request, func(response []byte) (bool, error) {
+		if len(response) < pcpHeaderSize || response[0] != pcpVersion {
+			if len(response) >= 2 && response[0] == 0 && response[1] >= pcpResponseFlag {
+				// A NAT-PMP-only server answered.
+				return false, errs.NewWithCause("gateway does not support PCP", ErrUnsupported)
+			}
+			return false, nil
+		}
+		if response[1] != pcpOpMap|pcpResponseFlag {
+			return false, nil
+		}
+		if code := PCPResult(response[3]); code != PCPSuccess {
+			if code == PCPUnsupportedVersion {
+				return false, errs.NewWithCause("gateway does not support PCP version 2", ErrUnsupported)
+			}
+			pcpErr := &PCPError{Code: code}
+			return false, errs.NewWithCause(pcpErr.Error(), pcpErr)
+		}
+		if len(response) < pcpMapSize || string(response[24:36]) != string(p.nonce[:]) ||
+			response[36] != proto || binary.BigEndian.Uint16(response[40:42]) != uint16(internalPort) {
+			return false, nil
+		}
+		ip := net.IP(append([]byte(nil), response[44:60]...))
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		mapping = &Mapping{
+			Mapper:       p.Name(),
+			Protocol:     protocol,
+			InternalPort: internalPort,
+			ExternalPort: int(binary.BigEndian.Uint16(response[42:44])),
+			ExternalIP:   ip,
+			Lifetime:     time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second,
+		}
+		return true, nil
+	})
+	return mapping, err
+}
+
+func (p *PCP) initNonce() error {
+	var err error
+	p.once.Do(func() {
+		if _, err = rand.Read(p.nonce[:]); err != nil {
+			err = errs.Wrap(err)
+		}
+	})
+	return err
+}
+
+// exchange sends a request to the gateway over UDP, retransmitting it with
+// an exponential backoff until 'handle' accepts a response or the timeout
+// expires. 'handle' returns true once a response has been accepted, or false
+// to keep waiting. An error returned from 'handle' stops the exchange.
+func exchange(ctx context.Context, gw net.IP, port int, timeout, retransmit time.Duration, request []byte, handle func(response []byte) (bool, error)) error {
+	if port <= 0 {
+		port = DefaultGatewayPort
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if retransmit <= 0 {
+		retransmit = DefaultInitialRetransmit
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gw, Port: port})
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(conn)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now()) //nolint:errcheck
+		case <-stop:
+		}
+	}()
+	deadline, _ := ctx.Deadline()
+	buffer := make([]byte, pcpMaxPacket)
+	for ctx.Err() == nil {
+		if _, err = conn.Write(request); err != nil {
+			return errs.Wrap(err)
+		}
+		next := time.Now().Add(retransmit)
+		if next.After(deadline) {
+			next = deadline
+		}
+		if err = conn.SetReadDeadline(next); err != nil {
+			return errs.Wrap(err)
+		}
+		for ctx.Err() == nil {
+			var n int
+			if n, err = conn.Read(buffer); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return errs.Wrap(err)
+			}
+			var done bool
+			if done, err = handle(buffer[:n]); err != nil || done {
+				return err
+			}
+		}
+		retransmit *= 2
+	}
+	return errs.NewWithCause("timed out waiting for a response from the gateway", ctx.Err())
+}
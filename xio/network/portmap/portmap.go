@@ -0,0 +1,207 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// Package portmap provides a common interface for requesting port mappings
+// from a gateway, with implementations for PCP, NAT-PMP and UPnP IGD.
+package portmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackpal/gateway"
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio"
+	"github.com/richardwilkes/toolbox/xio/network/natpmp"
+)
+
+// DefaultLifetime is the lifetime requested for a mapping when none is
+// specified.
+const DefaultLifetime = time.Hour
+
+// Protocol identifies the transport protocol of a mapping.
+type Protocol string
+
+// Possible Protocol values.
+const (
+	TCP Protocol = "tcp"
+	UDP Protocol = "udp"
+)
+
+// ErrUnsupported is returned by a Mapper for operations its protocol does not
+// provide.
+var ErrUnsupported = errors.New("operation not supported by this port mapping protocol")
+
+// Mapping describes a port mapping granted by a gateway.
+type Mapping struct {
+	// Mapper is the name of the Mapper that created the mapping.
+	Mapper       string
+	Protocol     Protocol
+	InternalPort int
+	ExternalPort int
+	// ExternalIP will be nil if the protocol does not report it.
+	ExternalIP net.IP
+	// Lifetime is the lifetime granted by the gateway. A value of 0 means the
+	// mapping does not expire. Mappings that expire must be renewed by adding
+	// them again before their lifetime runs out.
+	Lifetime time.Duration
+}
+
+// Mapper is implemented by each port mapping protocol.
+type Mapper interface {
+	// Name returns the name of the protocol.
+	Name() string
+	// ExternalAddress returns the external address of the gateway.
+	ExternalAddress(ctx context.Context) (net.IP, error)
+	// AddMapping requests a mapping of the internal port. 'externalPort' is a
+	// suggestion and may be 0 to let the gateway choose. A 'lifetime' less
+	// than 1 requests DefaultLifetime.
+	AddMapping(ctx context.Context, protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error)
+	// DeleteMapping removes a mapping previously returned by AddMapping.
+	DeleteMapping(ctx context.Context, mapping *Mapping) error
+}
+
+// Chain is a Mapper that tries each of its mappers in turn, remembering the
+// last one that succeeded so that it is tried first next time.
+type Chain struct {
+	lock      sync.Mutex
+	mappers   []Mapper
+	preferred Mapper
+}
+
+// New creates a Chain that tries PCP, then NAT-PMP, then UPnP IGD. If 'gw' is
+// nil, the default gateway will be discovered. An IPv6 gateway address may be
+// given, in which case PCP will request IPv6 mappings.
+func New(gw net.IP) (*Chain, error) {
+	if gw == nil {
+		var err error
+		if gw, err = gateway.DiscoverGateway(); err != nil {
+			return nil, errs.NewWithCause("unable to discover gateway", err)
+		}
+	}
+	return NewChain(&PCP{Gateway: gw}, &NATPMP{Client: natpmp.NewClient(gw)}, &UPnP{}), nil
+}
+
+// NewChain creates a Chain that tries the mappers in the order given.
+func NewChain(mappers ...Mapper) *Chain {
+	return &Chain{mappers: mappers}
+}
+
+// Name implements Mapper. It returns the name of the mapper that last
+// succeeded, or "chain" if none has.
+func (c *Chain) Name() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.preferred != nil {
+		return c.preferred.Name()
+	}
+	return "chain"
+}
+
+// Mappers returns the mappers in the chain.
+func (c *Chain) Mappers() []Mapper {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]Mapper(nil), c.mappers...)
+}
+
+// ExternalAddress implements Mapper.
+func (c *Chain) ExternalAddress(ctx context.Context) (net.IP, error) {
+	var ip net.IP
+	err := c.try(ctx, func(m Mapper) error {
+		var err error
+		ip, err = m.ExternalAddress(ctx)
+		return err
+	})
+	return ip, err
+}
+
+// AddMapping implements Mapper.
+func (c *Chain) AddMapping(ctx context.Context, protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	var mapping *Mapping
+	err := c.try(ctx, func(m Mapper) error {
+		var err error
+		mapping, err = m.AddMapping(ctx, protocol, internalPort, externalPort, lifetime)
+		return err
+	})
+	return mapping, err
+}
+
+// DeleteMapping implements Mapper. The mapping is removed through the mapper
+// that created it.
+func (c *Chain) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	for _, m := range c.Mappers() {
+		if m.Name() == mapping.Mapper {
+			return m.DeleteMapping(ctx, mapping)
+		}
+	}
+	return errs.Newf("no mapper named '%s' in chain", mapping.Mapper)
+}
+
+func (c *Chain) try(ctx context.Context, f func(m Mapper) error) error {
+	c.lock.Lock()
+	mappers := make([]Mapper, 0, len(c.mappers))
+	if c.preferred != nil {
+		mappers = append(mappers, c.preferred)
+	}
+	for _, m := range c.mappers {
+		if m != c.preferred {
+			mappers = append(mappers, m)
+		}
+	}
+	c.lock.Unlock()
+	var failures error
+	for _, m := range mappers {
+		if err := ctx.Err(); err != nil {
+			return errs.Append(failures, errs.Wrap(err))
+		}
+		err := f(m)
+		if err == nil {
+			c.lock.Lock()
+			c.preferred = m
+			c.lock.Unlock()
+			return nil
+		}
+		if !errors.Is(err, ErrUnsupported) {
+			failures = errs.Append(failures, errs.NewWithCausef(err, "%s failed", m.Name()))
+		}
+	}
+	if failures == nil {
+		return errs.NewWithCause("no port mapper supports the operation", ErrUnsupported)
+	}
+	return failures
+}
+
+func checkPort(port int) error {
+	if port > 0 && port < 65536 {
+		return nil
+	}
+	return errs.Newf("port (%d) must be in the range 1-65535", port)
+}
+
+func lifetimeOrDefault(lifetime time.Duration) time.Duration {
+	if lifetime < time.Second {
+		return DefaultLifetime
+	}
+	return lifetime
+}
+
+// localAddressFor returns the local address that would be used to reach the
+// remote address.
+func localAddressFor(remote net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: remote, Port: 9})
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(conn)
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,361 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package portmap_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/portmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePCP struct {
+	conn     *net.UDPConn
+	external net.IP
+	lock     sync.Mutex
+	deleted  []int
+}
+
+func startFakePCP(t *testing.T, network, address string, external net.IP) *fakePCP {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(address)})
+	if err != nil {
+		t.Skipf("unable to listen on %s: %v", address, err)
+	}
+	f := &fakePCP{conn: conn, external: external}
+	go f.serve()
+	t.Cleanup(func() { _ = conn.Close() }) //nolint:errcheck
+	return f
+}
+
+func (f *fakePCP) addr() *net.UDPAddr {
+	return f.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (f *fakePCP) serve() {
+	buffer := make([]byte, 1100)
+	for {
+		n, remote, err := f.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		req := buffer[:n]
+		rsp := make([]byte, 60)
+		rsp[0] = 2
+		rsp[1] = req[1] | 0x80
+		if n != 60 || req[0] != 2 || req[1] != 1 || !net.IP(req[8:24]).Equal(remote.IP) {
+			rsp[3] = byte(portmap.PCPMalformedRequest)
+		} else {
+			copy(rsp[24:44], req[24:44])
+			lifetime := binary.BigEndian.Uint32(req[4:8])
+			internal := binary.BigEndian.Uint16(req[40:42])
+			switch {
+			case internal == 1:
+				rsp[3] = byte(portmap.PCPNotAuthorized)
+			case lifetime == 0:
+				f.lock.Lock()
+				f.deleted = append(f.deleted, int(internal))
+				f.lock.Unlock()
+			default:
+				if binary.BigEndian.Uint16(req[42:44]) == 0 {
+					binary.BigEndian.PutUint16(rsp[42:44], internal+10000)
+				}
+				binary.BigEndian.PutUint32(rsp[4:8], lifetime/2)
+				copy(rsp[44:60], f.external.To16())
+			}
+		}
+		if _, err = f.conn.WriteToUDP(rsp, remote); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakePCP) deletedPorts() []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]int(nil), f.deleted...)
+}
+
+func TestPCP(t *testing.T) {
+	for _, one := range []struct {
+		network  string
+		address  string
+		external string
+	}{
+		{"udp4", "127.0.0.1", "203.0.113.7"},
+		{"udp6", "::1", "2001:db8::7"},
+	} {
+		t.Run(one.network, func(t *testing.T) {
+			external := net.ParseIP(one.external)
+			gw := startFakePCP(t, one.network, one.address, external)
+			p := &portmap.PCP{Gateway: gw.addr().IP, Port: gw.addr().Port}
+			ctx := context.Background()
+
+			m, err := p.AddMapping(ctx, portmap.TCP, 8080, 0, 2*time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, "PCP", m.Mapper)
+			assert.Equal(t, portmap.TCP, m.Protocol)
+			assert.Equal(t, 8080, m.InternalPort)
+			assert.Equal(t, 18080, m.ExternalPort)
+			assert.Equal(t, time.Hour, m.Lifetime)
+			assert.True(t, external.Equal(m.ExternalIP), "%v != %v", external, m.ExternalIP)
+
+			m, err = p.AddMapping(ctx, portmap.UDP, 9000, 9001, 0)
+			require.NoError(t, err)
+			assert.Equal(t, 9001, m.ExternalPort)
+			assert.Equal(t, portmap.DefaultLifetime/2, m.Lifetime)
+
+			require.NoError(t, p.DeleteMapping(ctx, m))
+			assert.Equal(t, []int{9000}, gw.deletedPorts())
+
+			_, err = p.AddMapping(ctx, portmap.TCP, 1, 0, 0)
+			var pcpErr *portmap.PCPError
+			require.True(t, errors.As(err, &pcpErr))
+			assert.Equal(t, portmap.PCPNotAuthorized, pcpErr.Code)
+
+			_, err = p.ExternalAddress(ctx)
+			assert.True(t, errors.Is(err, portmap.ErrUnsupported))
+		})
+	}
+}
+
+func TestPCPTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }() //nolint:errcheck
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	p := &portmap.PCP{
+		Gateway:           addr.IP,
+		Port:              addr.Port,
+		Timeout:           200 * time.Millisecond,
+		InitialRetransmit: 20 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err = p.AddMapping(context.Background(), portmap.TCP, 8080, 0, 0)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Requests should have been retransmitted several times.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	buffer := make([]byte, 1100)
+	count := 0
+	for {
+		if _, _, err = conn.ReadFromUDP(buffer); err != nil {
+			break
+		}
+		count++
+	}
+	assert.True(t, count >= 3, "only %d requests received", count)
+}
+
+const fakeDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+ <device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList>
+   <device>
+    <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+    <deviceList>
+     <device>
+      <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+      <serviceList>
+       <service>
+        <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+        <controlURL>/ctl/IPConn</controlURL>
+       </service>
+      </serviceList>
+     </device>
+    </deviceList>
+   </device>
+  </deviceList>
+ </device>
+</root>`
+
+type fakeIGD struct {
+	server   *httptest.Server
+	ssdp     *net.UDPConn
+	lock     sync.Mutex
+	mappings map[string]string
+}
+
+func startFakeIGD(t *testing.T) *fakeIGD {
+	f := &fakeIGD{mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, fakeDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", f.control)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	var err error
+	f.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.ssdp.Close() }) //nolint:errcheck
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, remote, err := f.ssdp.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buffer[:n]), "M-SEARCH") {
+				continue
+			}
+			rsp := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nUSN: uuid:fake::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\nLOCATION: %s/rootDesc.xml\r\n\r\n", f.server.URL)
+			if _, err = f.ssdp.WriteToUDP([]byte(rsp), remote); err != nil {
+				return
+			}
+		}
+	}()
+	return f
+}
+
+func (f *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body := string(data)
+	arg := func(name string) string {
+		start := strings.Index(body, "<"+name+">")
+		end := strings.Index(body, "</"+name+">")
+		if start < 0 || end < start {
+			return ""
+		}
+		return body[start+len(name)+2 : end]
+	}
+	action := r.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+	var result string
+	switch action {
+	case "GetExternalIPAddress":
+		result = "<NewExternalIPAddress>198.51.100.9</NewExternalIPAddress>"
+	case "AddPortMapping":
+		if arg("NewLeaseDuration") != "0" {
+			soapFault(w, 725, "OnlyPermanentLeasesSupported")
+			return
+		}
+		f.lock.Lock()
+		f.mappings[arg("NewProtocol")+arg("NewExternalPort")] = arg("NewInternalClient") + ":" + arg("NewInternalPort")
+		f.lock.Unlock()
+	case "DeletePortMapping":
+		key := arg("NewProtocol") + arg("NewExternalPort")
+		f.lock.Lock()
+		_, exists := f.mappings[key]
+		delete(f.mappings, key)
+		f.lock.Unlock()
+		if !exists {
+			soapFault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+	default:
+		soapFault(w, 401, "Invalid Action")
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`, action, result, action)
+}
+
+func (f *fakeIGD) mapping(key string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.mappings[key]
+}
+
+func soapFault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+func TestUPnP(t *testing.T) {
+	igd := startFakeIGD(t)
+	u := &portmap.UPnP{SSDPAddress: igd.ssdp.LocalAddr().String(), Description: "test"}
+	ctx := context.Background()
+
+	ip, err := u.ExternalAddress(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.9", ip.String())
+
+	m, err := u.AddMapping(ctx, portmap.UDP, 5000, 0, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "UPnP", m.Mapper)
+	assert.Equal(t, 5000, m.ExternalPort)
+	assert.Equal(t, time.Duration(0), m.Lifetime)
+	assert.Equal(t, "198.51.100.9", m.ExternalIP.String())
+	assert.Equal(t, "127.0.0.1:5000", igd.mapping("UDP5000"))
+
+	require.NoError(t, u.DeleteMapping(ctx, m))
+	assert.Equal(t, "", igd.mapping("UDP5000"))
+
+	err = u.DeleteMapping(ctx, m)
+	var upnpErr *portmap.UPnPError
+	require.True(t, errors.As(err, &upnpErr))
+	assert.Equal(t, 714, upnpErr.Code)
+	assert.Equal(t, "NoSuchEntryInArray", upnpErr.Description)
+}
+
+func TestChain(t *testing.T) {
+	// Nothing listens on this port, so PCP should fail quickly.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	dead := conn.LocalAddr().(*net.UDPAddr)
+	require.NoError(t, conn.Close())
+
+	igd := startFakeIGD(t)
+	chain := portmap.NewChain(
+		&portmap.PCP{Gateway: dead.IP, Port: dead.Port, Timeout: 300 * time.Millisecond, InitialRetransmit: 50 * time.Millisecond},
+		&portmap.UPnP{Location: igd.server.URL + "/rootDesc.xml"},
+	)
+	ctx := context.Background()
+	assert.Equal(t, "chain", chain.Name())
+
+	m, err := chain.AddMapping(ctx, portmap.TCP, 6000, 6001, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "UPnP", m.Mapper)
+	assert.Equal(t, 6001, m.ExternalPort)
+	assert.Equal(t, "UPnP", chain.Name())
+	assert.Equal(t, "127.0.0.1:6000", igd.mapping("TCP6001"))
+
+	ip, err := chain.ExternalAddress(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.9", ip.String())
+
+	require.NoError(t, chain.DeleteMapping(ctx, m))
+	assert.Equal(t, "", igd.mapping("TCP6001"))
+
+	pcp := startFakePCP(t, "udp4", "127.0.0.1", net.IPv4(203, 0, 113, 1))
+	chain = portmap.NewChain(&portmap.PCP{Gateway: pcp.addr().IP, Port: pcp.addr().Port}, &portmap.UPnP{Location: igd.server.URL + "/rootDesc.xml"})
+	ip, err = chain.ExternalAddress(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.9", ip.String())
+	m, err = chain.AddMapping(ctx, portmap.TCP, 7000, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "UPnP", m.Mapper, "mapper that last succeeded should be tried first")
+
+	chain = portmap.NewChain(&portmap.PCP{Gateway: dead.IP, Port: dead.Port, Timeout: 100 * time.Millisecond})
+	_, err = chain.AddMapping(ctx, portmap.TCP, 7000, 0, 0)
+	assert.Error(t, err)
+	_, err = chain.ExternalAddress(ctx)
+	assert.True(t, errors.Is(err, portmap.ErrUnsupported))
+}
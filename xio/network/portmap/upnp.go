@@ -0,0 +1,453 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/cmdline"
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio"
+)
+
+// DefaultSSDPAddress is the multicast address used to discover UPnP devices.
+const DefaultSSDPAddress = "239.255.255.250:1900"
+
+const (
+	upnpGatewayType           = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpWANIPConnection2      = "urn:schemas-upnp-org:service:WANIPConnection:2"
+	upnpErrOnlyPermanentLease = 725
+	upnpMaxResponseSize       = 1 << 20
+)
+
+var upnpServiceTypes = []string{
+	upnpWANIPConnection2,
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnPError is returned when a UPnP gateway rejects a request.
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("UPnP request failed: %d %s", e.Code, e.Description)
+}
+
+// UPnP is a Mapper that uses the UPnP Internet Gateway Device protocol.
+// See http://upnp.org/specs/gw/UPnP-gw-InternetGatewayDevice-v2-Device.pdf
+type UPnP struct {
+	// Location is the URL of the gateway's device description. If empty, it
+	// will be discovered with SSDP.
+	Location string
+	// SSDPAddress is the address discovery requests are sent to. Defaults to
+	// DefaultSSDPAddress.
+	SSDPAddress string
+	// Description is used to label mappings on the gateway. Defaults to
+	// cmdline.AppName.
+	Description string
+	// Timeout is the total time to wait for discovery and for each request.
+	// Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// HTTPClient is used to talk to the gateway. Defaults to
+	// http.DefaultClient.
+	HTTPClient  *http.Client
+	lock        sync.Mutex
+	controlURL  string
+	serviceType string
+}
+
+// Name implements Mapper.
+func (u *UPnP) Name() string {
+	return "UPnP"
+}
+
+// ExternalAddress implements Mapper.
+func (u *UPnP) ExternalAddress(ctx context.Context) (net.IP, error) {
+	result, err := u.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(result["NewExternalIPAddress"]))
+	if ip == nil {
+		return nil, errs.Newf("invalid external address '%s'", result["NewExternalIPAddress"])
+	}
+	return ip, nil
+}
+
+// AddMapping implements Mapper. If 'externalPort' is 0, the internal port is
+// requested. Gateways that only support permanent mappings are given one, in
+// which case the returned lifetime will be 0.
+func (u *UPnP) AddMapping(ctx context.Context, protocol Protocol, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	if err := checkPort(internalPort); err != nil {
+		return nil, err
+	}
+	if externalPort == 0 {
+		externalPort = internalPort
+	} else if err := checkPort(externalPort); err != nil {
+		return nil, err
+	}
+	proto, err := upnpProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	controlURL, serviceType, err := u.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cu, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	host := cu.Hostname()
+	gw := net.ParseIP(host)
+	if gw == nil {
+		var addrs []net.IPAddr
+		if addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host); err != nil || len(addrs) == 0 {
+			return nil, errs.NewWithCausef(err, "unable to resolve gateway '%s'", host)
+		}
+		gw = addrs[0].IP
+	}
+	client, err := localAddressFor(gw)
+	if err != nil {
+		return nil, err
+	}
+	lifetime = lifetimeOrDefault(lifetime)
+	for {
+		args := []string{
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(externalPort),
+			"NewProtocol", proto,
+			"NewInternalPort", strconv.Itoa(internalPort),
+			"NewInternalClient", client.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", u.description(),
+			"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second)),
+		}
+		action := "AddPortMapping"
+		if serviceType == upnpWANIPConnection2 {
+			action = "AddAnyPortMapping"
+		}
+		var result map[string]string
+		if result, err = u.call(ctx, action, args); err != nil {
+			var upnpErr *UPnPError
+			if lifetime != 0 && errors.As(err, &upnpErr) && upnpErr.Code == upnpErrOnlyPermanentLease {
+				lifetime = 0
+				continue
+			}
+			return nil, err
+		}
+		if reserved, ok := result["NewReservedPort"]; ok {
+			if externalPort, err = strconv.Atoi(strings.TrimSpace(reserved)); err != nil {
+				return nil, errs.NewWithCausef(err, "invalid reserved port '%s'", reserved)
+			}
+		}
+		break
+	}
+	mapping := &Mapping{
+		Mapper:       u.Name(),
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+		Lifetime:     lifetime,
+	}
+	if ip, ipErr := u.ExternalAddress(ctx); ipErr == nil {
+		mapping.ExternalIP = ip
+	}
+	return mapping, nil
+}
+
+// DeleteMapping implements Mapper.
+func (u *UPnP) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	proto, err := upnpProtocol(mapping.Protocol)
+	if err != nil {
+		return err
+	}
+	_, err = u.call(ctx, "DeletePortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(mapping.ExternalPort),
+		"NewProtocol", proto,
+	})
+	return err
+}
+
+func (u *UPnP) description() string {
+	if u.Description != "" {
+		return u.Description
+	}
+	if cmdline.AppName != "" {
+		return cmdline.AppName
+	}
+	return "toolbox"
+}
+
+func (u *UPnP) timeout() time.Duration {
+	if u.Timeout > 0 {
+		return u.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (u *UPnP) httpClient() *http.Client {
+	if u.HTTPClient != nil {
+		return u.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// call invokes a SOAP action on the gateway's connection service and returns
+// the values of the response's elements, keyed by name. 'args' holds
+// alternating argument names and values.
+func (u *UPnP) call(ctx context.Context, action string, args []string) (map[string]string, error) {
+	controlURL, serviceType, err := u.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, serviceType)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1])) //nolint:errcheck
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+	ctx, cancel := context.WithTimeout(ctx, u.timeout())
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, controlURL, &body)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, serviceType, action))
+	rsp, err := u.httpClient().Do(req)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(rsp.Body)
+	values, err := xmlLeafValues(io.LimitReader(rsp.Body, upnpMaxResponseSize))
+	if err != nil {
+		return nil, errs.NewWithCausef(err, "invalid response to %s", action)
+	}
+	if code, ok := values["errorCode"]; ok {
+		upnpErr := &UPnPError{Description: values["errorDescription"]}
+		upnpErr.Code, _ = strconv.Atoi(strings.TrimSpace(code)) //nolint:errcheck
+		return nil, errs.NewWithCause(upnpErr.Error(), upnpErr)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errs.Newf("%s failed with status %d", action, rsp.StatusCode)
+	}
+	return values, nil
+}
+
+// service returns the control URL and type of the gateway's connection
+// service, discovering it if needed.
+func (u *UPnP) service(ctx context.Context) (controlURL, serviceType string, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.controlURL != "" {
+		return u.controlURL, u.serviceType, nil
+	}
+	location := u.Location
+	if location == "" {
+		if location, err = u.discover(ctx); err != nil {
+			return "", "", err
+		}
+	}
+	if u.controlURL, u.serviceType, err = u.describe(ctx, location); err != nil {
+		return "", "", err
+	}
+	return u.controlURL, u.serviceType, nil
+}
+
+// discover sends SSDP search requests until a gateway responds.
+func (u *UPnP) discover(ctx context.Context) (string, error) {
+	addrStr := u.SSDPAddress
+	if addrStr == "" {
+		addrStr = DefaultSSDPAddress
+	}
+	addr, err := net.ResolveUDPAddr("udp4", addrStr)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(conn)
+	request := []byte(fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n", DefaultSSDPAddress, upnpGatewayType))
+	ctx, cancel := context.WithTimeout(ctx, u.timeout())
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	retransmit := DefaultInitialRetransmit
+	buffer := make([]byte, pcpMaxPacket*2)
+	for ctx.Err() == nil {
+		if _, err = conn.WriteToUDP(request, addr); err != nil {
+			return "", errs.Wrap(err)
+		}
+		next := time.Now().Add(retransmit)
+		if next.After(deadline) {
+			next = deadline
+		}
+		if err = conn.SetReadDeadline(next); err != nil {
+			return "", errs.Wrap(err)
+		}
+		for {
+			var n int
+			if n, _, err = conn.ReadFromUDP(buffer); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return "", errs.Wrap(err)
+			}
+			rsp, rspErr := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+			if rspErr != nil || rsp.StatusCode != http.StatusOK {
+				continue
+			}
+			if location := rsp.Header.Get("Location"); location != "" && strings.Contains(rsp.Header.Get("St"), "InternetGatewayDevice") {
+				return location, nil
+			}
+		}
+		retransmit *= 2
+	}
+	return "", errs.NewWithCause("no UPnP gateway found", ctx.Err())
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// describe fetches the device description and locates the connection
+// service within it.
+func (u *UPnP) describe(ctx context.Context, location string) (controlURL, serviceType string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout())
+	defer cancel()
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, location, nil); err != nil {
+		return "", "", errs.Wrap(err)
+	}
+	var rsp *http.Response
+	if rsp, err = u.httpClient().Do(req.WithContext(ctx)); err != nil {
+		return "", "", errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return "", "", errs.Newf("unable to retrieve device description from %s (status %d)", location, rsp.StatusCode)
+	}
+	var data []byte
+	if data, err = ioutil.ReadAll(io.LimitReader(rsp.Body, upnpMaxResponseSize)); err != nil {
+		return "", "", errs.Wrap(err)
+	}
+	var root upnpRoot
+	if err = xml.Unmarshal(data, &root); err != nil {
+		return "", "", errs.NewWithCausef(err, "invalid device description from %s", location)
+	}
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	var baseURL *url.URL
+	if baseURL, err = url.Parse(base); err != nil {
+		return "", "", errs.Wrap(err)
+	}
+	for _, st := range upnpServiceTypes {
+		if svc := findUPnPService(&root.Device, st); svc != nil {
+			var ctl *url.URL
+			if ctl, err = baseURL.Parse(strings.TrimSpace(svc.ControlURL)); err != nil {
+				return "", "", errs.Wrap(err)
+			}
+			return ctl.String(), st, nil
+		}
+	}
+	return "", "", errs.Newf("no WAN connection service found in device description from %s", location)
+}
+
+func findUPnPService(device *upnpDevice, serviceType string) *upnpService {
+	for i := range device.Services {
+		if strings.TrimSpace(device.Services[i].ServiceType) == serviceType {
+			return &device.Services[i]
+		}
+	}
+	for i := range device.Devices {
+		if svc := findUPnPService(&device.Devices[i], serviceType); svc != nil {
+			return svc
+		}
+	}
+	return nil
+}
+
+// xmlLeafValues returns the text of each element that has no child elements,
+// keyed by the element's local name.
+func xmlLeafValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+	var name string
+	var text []byte
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return values, nil
+			}
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text = text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				values[name] = string(text)
+			}
+			name = ""
+		}
+	}
+}
+
+func upnpProtocol(protocol Protocol) (string, error) {
+	switch protocol {
+	case TCP:
+		return "TCP", nil
+	case UDP:
+		return "UDP", nil
+	default:
+		return "", errs.Newf("unknown protocol '%s'", protocol)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio"
+)
+
+// DefaultSTUNRetransmit is the initial retransmission timeout for STUN
+// requests recommended by RFC 5389, section 7.2.1. It doubles after each
+// retransmission.
+const DefaultSTUNRetransmit = 500 * time.Millisecond
+
+const (
+	stunHeaderSize           = 20
+	stunMagicCookie          = 0x2112A442
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunBindingError         = 0x0111
+	stunAttrMappedAddress    = 0x0001
+	stunAttrErrorCode        = 0x0009
+	stunAttrXORMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+	stunMaxTransmissions     = 7
+	stunMaxMessageSize       = 1500
+)
+
+// STUNIPSource is an IPSource that sends a STUN binding request over UDP.
+// See https://tools.ietf.org/html/rfc5389
+type STUNIPSource struct {
+	// Server is the host:port of the STUN server.
+	Server string
+	// Retransmit is the initial retransmission timeout. Defaults to
+	// DefaultSTUNRetransmit.
+	Retransmit time.Duration
+}
+
+// Name implements IPSource.
+func (s *STUNIPSource) Name() string {
+	return "stun:" + s.Server
+}
+
+// ExternalIP implements IPSource.
+func (s *STUNIPSource) ExternalIP(ctx context.Context) (net.IP, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", s.Server)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	defer xio.CloseIgnoringErrors(conn)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now()) //nolint:errcheck
+		case <-stop:
+		}
+	}()
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	if _, err = rand.Read(request[8:20]); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	retransmit := s.Retransmit
+	if retransmit <= 0 {
+		retransmit = DefaultSTUNRetransmit
+	}
+	buffer := make([]byte, stunMaxMessageSize)
+	for i := 0; i < stunMaxTransmissions && ctx.Err() == nil; i++ {
+		if _, err = conn.Write(request); err != nil {
+			return nil, errs.Wrap(err)
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(retransmit)); err != nil {
+			return nil, errs.Wrap(err)
+		}
+		for ctx.Err() == nil {
+			var n int
+			if n, err = conn.Read(buffer); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, errs.Wrap(err)
+			}
+			var ip net.IP
+			var matched bool
+			if ip, matched, err = parseSTUNResponse(buffer[:n], request[8:20]); matched {
+				return ip, err
+			}
+		}
+		retransmit *= 2
+	}
+	if ctx.Err() != nil {
+		return nil, errs.NewWithCause("STUN request canceled", ctx.Err())
+	}
+	return nil, errs.New("no response from STUN server")
+}
+
+// parseSTUNResponse extracts the mapped address from a binding response.
+// 'matched' will be false if the message is not a response to the request
+// with the given transaction ID.
+func parseSTUNResponse(msg, transactionID []byte) (ip net.IP, matched bool, err error) {
+	if len(msg) < stunHeaderSize || binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie ||
+		!bytes.Equal(msg[8:20], transactionID) {
+		return nil, false, nil
+	}
+	msgType := binary.BigEndian.Uint16(msg[0:2])
+	if msgType != stunBindingSuccess && msgType != stunBindingError {
+		return nil, false, nil
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if stunHeaderSize+length > len(msg) {
+		return nil, true, errs.New("truncated STUN response")
+	}
+	attrs := msg[stunHeaderSize : stunHeaderSize+length]
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			return nil, true, errs.New("malformed STUN attribute")
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunAttrXORMappedAddress:
+			if ip = stunAddress(value, msg[4:20]); ip != nil {
+				return ip, true, nil
+			}
+		case stunAttrMappedAddress:
+			mapped = stunAddress(value, nil)
+		case stunAttrErrorCode:
+			if msgType == stunBindingError && len(value) >= 4 {
+				return nil, true, errs.Newf("STUN error %d: %s", int(value[2]&7)*100+int(value[3]), string(value[4:]))
+			}
+		}
+		// Attributes are padded to a multiple of 4 bytes.
+		attrLen = (attrLen + 3) &^ 3
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		attrs = attrs[4+attrLen:]
+	}
+	if msgType == stunBindingError {
+		return nil, true, errs.New("STUN binding request failed")
+	}
+	if mapped == nil {
+		return nil, true, errs.New("STUN response contained no mapped address")
+	}
+	return mapped, true, nil
+}
+
+// stunAddress decodes a MAPPED-ADDRESS value or, when 'xor' is not nil, an
+// XOR-MAPPED-ADDRESS value. 'xor' holds the magic cookie followed by the
+// transaction ID.
+func stunAddress(value, xor []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case stunFamilyIPv4:
+		size = net.IPv4len
+	case stunFamilyIPv6:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+size {
+		return nil
+	}
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if xor != nil {
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return ip
+}
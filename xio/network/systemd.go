@@ -0,0 +1,61 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package network
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const systemdFirstFD = 3
+
+// SystemdListeners returns the listeners passed to this process through
+// systemd-style socket activation, as described by the LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES environment variables. Returns nil if no
+// sockets were passed to this process. The environment variables are cleared
+// so that child processes don't also try to use the sockets.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, one := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(one) //nolint:errcheck
+	}
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(systemdFirstFD+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdFirstFD+i), name)
+		var ln net.Listener
+		ln, err = net.FileListener(f)
+		f.Close() //nolint:errcheck // net.FileListener() dups the descriptor
+		if err != nil {
+			for _, one := range listeners {
+				one.Close() //nolint:errcheck
+			}
+			return nil, errs.NewWithCausef(err, "unable to use inherited socket %s", name)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
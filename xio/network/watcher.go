@@ -0,0 +1,364 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package network
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/notifier"
+)
+
+// DefaultWatchInterval is the interval at which interfaces are rescanned when
+// no other interval is specified.
+const DefaultWatchInterval = 5 * time.Second
+
+// Notification names used when a Watcher sends changes to a
+// notifier.Notifier. Targets may register for NotificationPrefix to receive
+// all of them.
+const (
+	NotificationPrefix          = "network"
+	InterfaceUpNotification     = NotificationPrefix + ".interface.up"
+	InterfaceDownNotification   = NotificationPrefix + ".interface.down"
+	AddressAddedNotification    = NotificationPrefix + ".address.added"
+	AddressRemovedNotification  = NotificationPrefix + ".address.removed"
+	netlinkCoalescePeriod       = 100 * time.Millisecond
+	minimumNetlinkWatchInterval = time.Minute
+)
+
+// ChangeKind identifies the type of a Change.
+type ChangeKind int
+
+// Possible ChangeKind values.
+const (
+	InterfaceUp ChangeKind = iota
+	InterfaceDown
+	AddressAdded
+	AddressRemoved
+)
+
+// String implements fmt.Stringer.
+func (k ChangeKind) String() string {
+	switch k {
+	case InterfaceUp:
+		return "interface up"
+	case InterfaceDown:
+		return "interface down"
+	case AddressAdded:
+		return "address added"
+	case AddressRemoved:
+		return "address removed"
+	default:
+		return "unknown"
+	}
+}
+
+// NotificationName returns the name used when sending this kind of change to
+// a notifier.Notifier.
+func (k ChangeKind) NotificationName() string {
+	switch k {
+	case InterfaceUp:
+		return InterfaceUpNotification
+	case InterfaceDown:
+		return InterfaceDownNotification
+	case AddressAdded:
+		return AddressAddedNotification
+	case AddressRemoved:
+		return AddressRemovedNotification
+	default:
+		return NotificationPrefix
+	}
+}
+
+// Change describes a change to the network interfaces.
+type Change struct {
+	Kind      ChangeKind
+	Interface net.Interface
+	// Address is only set for AddressAdded and AddressRemoved changes.
+	Address *net.IPNet
+}
+
+// InterfaceState holds a snapshot of a network interface and its addresses.
+type InterfaceState struct {
+	Interface net.Interface
+	Addresses []*net.IPNet
+}
+
+// CurrentInterfaces returns a snapshot of the network interfaces.
+func CurrentInterfaces() ([]InterfaceState, error) {
+	iFaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	states := make([]InterfaceState, len(iFaces))
+	for i, iFace := range iFaces {
+		states[i].Interface = iFace
+		var addrs []net.Addr
+		if addrs, err = iFace.Addrs(); err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			switch v := addr.(type) {
+			case *net.IPNet:
+				states[i].Addresses = append(states[i].Addresses, v)
+			case *net.IPAddr:
+				bits := 8 * len(v.IP)
+				states[i].Addresses = append(states[i].Addresses, &net.IPNet{IP: v.IP, Mask: net.CIDRMask(bits, bits)})
+			}
+		}
+	}
+	return states, nil
+}
+
+// Watcher monitors the network interfaces for changes. On Linux, netlink is
+// used to learn of changes as they happen, with periodic rescans as a
+// fallback. Elsewhere, or if netlink is unavailable, the interfaces are
+// polled.
+type Watcher struct {
+	// Interval is the time between rescans when polling. Defaults to
+	// DefaultWatchInterval. When netlink is in use, rescans still occur, but
+	// no more often than once a minute.
+	Interval time.Duration
+	// DisableNetlink forces polling, even where netlink is available.
+	DisableNetlink bool
+	// Notifier, if set, will be sent each change, using the change kind's
+	// NotificationName(), the Change as the data and the Watcher as the
+	// producer. Changes found by the same scan are sent in a batch.
+	Notifier *notifier.Notifier
+	// Handler, if set, will be called with each change.
+	Handler func(change Change)
+	// Source provides the snapshots of the interfaces. Defaults to
+	// CurrentInterfaces.
+	Source func() ([]InterfaceState, error)
+	// scanLock serializes scans, so that snapshots are applied and reported
+	// in the order they were taken. It is acquired before lock.
+	scanLock sync.Mutex
+	lock     sync.Mutex
+	state    map[int]InterfaceState
+	stop     chan struct{}
+	done     chan struct{}
+	netlink  bool
+}
+
+// Start watching for changes. The current state of the interfaces is
+// recorded as the baseline; no changes are reported for it.
+func (w *Watcher) Start() error {
+	w.scanLock.Lock()
+	defer w.scanLock.Unlock()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.stop != nil {
+		return errs.New("watcher already started")
+	}
+	states, err := w.source()()
+	if err != nil {
+		return err
+	}
+	w.state = indexStates(states)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	trigger := make(chan struct{}, 1)
+	var closer func()
+	if !w.DisableNetlink {
+		if closer, err = watchNetlink(trigger); err == nil {
+			w.netlink = true
+		}
+	}
+	go w.run(w.stop, w.done, trigger, closer)
+	return nil
+}
+
+// Stop watching for changes.
+func (w *Watcher) Stop() {
+	w.lock.Lock()
+	stop := w.stop
+	done := w.done
+	w.stop = nil
+	w.done = nil
+	w.netlink = false
+	w.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// UsingNetlink returns true if the watcher is receiving change notices from
+// netlink rather than relying on polling alone.
+func (w *Watcher) UsingNetlink() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.netlink
+}
+
+// Interfaces returns the most recently observed state of the interfaces,
+// ordered by index.
+func (w *Watcher) Interfaces() []InterfaceState {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	states := make([]InterfaceState, 0, len(w.state))
+	for _, state := range w.state {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Interface.Index < states[j].Interface.Index })
+	return states
+}
+
+// Rescan the interfaces immediately, reporting any changes. Returns the
+// changes that were found.
+func (w *Watcher) Rescan() ([]Change, error) {
+	w.scanLock.Lock()
+	defer w.scanLock.Unlock()
+	states, err := w.source()()
+	if err != nil {
+		return nil, err
+	}
+	current := indexStates(states)
+	w.lock.Lock()
+	changes := diffStates(w.state, current)
+	w.state = current
+	w.lock.Unlock()
+	w.report(changes)
+	return changes, nil
+}
+
+func (w *Watcher) source() func() ([]InterfaceState, error) {
+	if w.Source != nil {
+		return w.Source
+	}
+	return CurrentInterfaces
+}
+
+func (w *Watcher) run(stop, done chan struct{}, trigger <-chan struct{}, closer func()) {
+	defer close(done)
+	if closer != nil {
+		defer closer()
+	}
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	if closer != nil && interval < minimumNetlinkWatchInterval {
+		interval = minimumNetlinkWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-trigger:
+			// Changes tend to arrive in bursts, so give the rest of the
+			// burst a chance to arrive before rescanning.
+			select {
+			case <-stop:
+				return
+			case <-time.After(netlinkCoalescePeriod):
+			}
+			select {
+			case <-trigger:
+			default:
+			}
+		}
+		w.Rescan() //nolint:errcheck
+	}
+}
+
+func (w *Watcher) report(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	if w.Notifier != nil {
+		w.Notifier.StartBatch()
+		for _, change := range changes {
+			w.Notifier.NotifyWithData(change.Kind.NotificationName(), change, w)
+		}
+		w.Notifier.EndBatch()
+	}
+	if w.Handler != nil {
+		for _, change := range changes {
+			w.Handler(change)
+		}
+	}
+}
+
+func indexStates(states []InterfaceState) map[int]InterfaceState {
+	m := make(map[int]InterfaceState, len(states))
+	for _, state := range states {
+		m[state.Interface.Index] = state
+	}
+	return m
+}
+
+// diffStates returns the changes needed to go from the old state to the new
+// one, ordered by interface index. Addresses are only reported for
+// interfaces that are up.
+func diffStates(old, current map[int]InterfaceState) []Change {
+	indexes := make(map[int]bool, len(old)+len(current))
+	for index := range old {
+		indexes[index] = true
+	}
+	for index := range current {
+		indexes[index] = true
+	}
+	ordered := make([]int, 0, len(indexes))
+	for index := range indexes {
+		ordered = append(ordered, index)
+	}
+	sort.Ints(ordered)
+	var changes []Change
+	for _, index := range ordered {
+		before, hadBefore := old[index]
+		after, hasAfter := current[index]
+		wasUp := hadBefore && before.Interface.Flags&net.FlagUp != 0
+		isUp := hasAfter && after.Interface.Flags&net.FlagUp != 0
+		var beforeAddrs, afterAddrs []*net.IPNet
+		if wasUp {
+			beforeAddrs = before.Addresses
+		}
+		if isUp {
+			afterAddrs = after.Addresses
+		}
+		iFace := after.Interface
+		if !hasAfter {
+			iFace = before.Interface
+		}
+		for _, addr := range beforeAddrs {
+			if !containsIPNet(afterAddrs, addr) {
+				changes = append(changes, Change{Kind: AddressRemoved, Interface: iFace, Address: addr})
+			}
+		}
+		switch {
+		case wasUp && !isUp:
+			changes = append(changes, Change{Kind: InterfaceDown, Interface: iFace})
+		case !wasUp && isUp:
+			changes = append(changes, Change{Kind: InterfaceUp, Interface: iFace})
+		}
+		for _, addr := range afterAddrs {
+			if !containsIPNet(beforeAddrs, addr) {
+				changes = append(changes, Change{Kind: AddressAdded, Interface: iFace, Address: addr})
+			}
+		}
+	}
+	return changes
+}
+
+func containsIPNet(list []*net.IPNet, target *net.IPNet) bool {
+	for _, one := range list {
+		if one.IP.Equal(target.IP) && one.Mask.String() == target.Mask.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// +build linux
+
+package network
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// Multicast groups from linux/rtnetlink.h, which the syscall package does not
+// define.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// watchNetlink subscribes to link and address changes and sends to 'trigger'
+// whenever one occurs. The messages themselves are not parsed, as the
+// watcher rescans the interfaces in response. Returns a function that stops
+// the subscription.
+func watchNetlink(trigger chan<- struct{}) (func(), error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd) //nolint:errcheck
+		return nil, errs.Wrap(err)
+	}
+	// Wrapping the non-blocking descriptor in a file lets the runtime poller
+	// manage it, so that closing the file interrupts a pending read.
+	f := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		buffer := make([]byte, os.Getpagesize())
+		for {
+			if _, readErr := f.Read(buffer); readErr != nil {
+				if pathErr, ok := readErr.(*os.PathError); ok && pathErr.Err == syscall.ENOBUFS {
+					// Messages were dropped; a rescan will catch up.
+					select {
+					case trigger <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				return
+			}
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return func() {
+		f.Close() //nolint:errcheck
+	}, nil
+}
@@ -0,0 +1,18 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// +build !linux
+
+package network
+
+import "github.com/richardwilkes/toolbox/errs"
+
+func watchNetlink(trigger chan<- struct{}) (func(), error) {
+	return nil, errs.New("netlink is not available on this platform")
+}
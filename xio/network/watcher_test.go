@@ -0,0 +1,217 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package network_test
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/notifier"
+	"github.com/richardwilkes/toolbox/xio/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeInterfaces struct {
+	lock   sync.Mutex
+	states []network.InterfaceState
+}
+
+func (f *fakeInterfaces) set(states ...network.InterfaceState) {
+	f.lock.Lock()
+	f.states = states
+	f.lock.Unlock()
+}
+
+func (f *fakeInterfaces) snapshot() ([]network.InterfaceState, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]network.InterfaceState(nil), f.states...), nil
+}
+
+type collector struct {
+	lock    sync.Mutex
+	names   []string
+	changes []network.Change
+	batches int
+}
+
+func (c *collector) HandleNotification(name string, data, producer interface{}) {
+	c.lock.Lock()
+	c.names = append(c.names, name)
+	c.changes = append(c.changes, data.(network.Change))
+	c.lock.Unlock()
+}
+
+func (c *collector) BatchMode(start bool) {
+	if start {
+		c.lock.Lock()
+		c.batches++
+		c.lock.Unlock()
+	}
+}
+
+func (c *collector) take() (names []string, changes []network.Change) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	names, changes = c.names, c.changes
+	c.names, c.changes = nil, nil
+	return names, changes
+}
+
+func iFace(index int, name string, up bool, cidrs ...string) network.InterfaceState {
+	state := network.InterfaceState{Interface: net.Interface{Index: index, Name: name}}
+	if up {
+		state.Interface.Flags = net.FlagUp
+	}
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ipNet.IP = ip
+		state.Addresses = append(state.Addresses, ipNet)
+	}
+	return state
+}
+
+func TestWatcherRescan(t *testing.T) {
+	fake := &fakeInterfaces{}
+	fake.set(iFace(1, "lo", true, "127.0.0.1/8"), iFace(2, "wlan0", true, "192.168.1.20/24"))
+	n := notifier.New(nil)
+	c := &collector{}
+	n.Register(c, 0, network.NotificationPrefix)
+	var handled []network.Change
+	w := &network.Watcher{
+		DisableNetlink: true,
+		Interval:       time.Hour,
+		Notifier:       n,
+		Handler:        func(change network.Change) { handled = append(handled, change) },
+		Source:         fake.snapshot,
+	}
+	require.NoError(t, w.Start())
+	defer w.Stop()
+	assert.False(t, w.UsingNetlink())
+	assert.Len(t, w.Interfaces(), 2)
+
+	changes, err := w.Rescan()
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// Wi-Fi moves to another network and a VPN comes up.
+	fake.set(iFace(1, "lo", true, "127.0.0.1/8"), iFace(2, "wlan0", true, "10.0.0.5/24"), iFace(7, "tun0", true, "172.16.0.2/32"))
+	changes, err = w.Rescan()
+	require.NoError(t, err)
+	names, notified := c.take()
+	assert.Equal(t, []string{
+		network.AddressRemovedNotification,
+		network.AddressAddedNotification,
+		network.InterfaceUpNotification,
+		network.AddressAddedNotification,
+	}, names)
+	assert.Equal(t, changes, notified)
+	assert.Equal(t, changes, handled)
+	assert.Equal(t, "192.168.1.20", changes[0].Address.IP.String())
+	assert.Equal(t, "wlan0", changes[0].Interface.Name)
+	assert.Equal(t, "10.0.0.5", changes[1].Address.IP.String())
+	assert.Equal(t, network.InterfaceUp, changes[2].Kind)
+	assert.Equal(t, "tun0", changes[2].Interface.Name)
+	assert.Equal(t, 1, c.batches)
+
+	// The VPN goes down, then disappears, and Wi-Fi is lost.
+	fake.set(iFace(1, "lo", true, "127.0.0.1/8"), iFace(2, "wlan0", false, "10.0.0.5/24"))
+	changes, err = w.Rescan()
+	require.NoError(t, err)
+	kinds := make([]network.ChangeKind, len(changes))
+	for i, change := range changes {
+		kinds[i] = change.Kind
+	}
+	assert.Equal(t, []network.ChangeKind{
+		network.AddressRemoved,
+		network.InterfaceDown,
+		network.AddressRemoved,
+		network.InterfaceDown,
+	}, kinds)
+	assert.Equal(t, "wlan0", changes[1].Interface.Name)
+	assert.Equal(t, "tun0", changes[3].Interface.Name)
+	assert.Equal(t, "interface down", changes[3].Kind.String())
+}
+
+func TestWatcherRescanSerialized(t *testing.T) {
+	fake := &fakeInterfaces{}
+	fake.set(iFace(1, "lo", true, "127.0.0.1/8"))
+	var calls int32
+	gate := make(chan struct{})
+	w := &network.Watcher{
+		DisableNetlink: true,
+		Source: func() ([]network.InterfaceState, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				<-gate
+			}
+			return fake.snapshot()
+		},
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w.Rescan() //nolint:errcheck
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		defer wg.Done()
+		w.Rescan() //nolint:errcheck
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls), "second scan started before the first finished")
+	close(gate)
+	wg.Wait()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestWatcherPolling(t *testing.T) {
+	fake := &fakeInterfaces{}
+	fake.set(iFace(1, "eth0", false))
+	received := make(chan network.Change, 10)
+	w := &network.Watcher{
+		DisableNetlink: true,
+		Interval:       10 * time.Millisecond,
+		Handler:        func(change network.Change) { received <- change },
+		Source:         fake.snapshot,
+	}
+	require.NoError(t, w.Start())
+	assert.Error(t, w.Start())
+	fake.set(iFace(1, "eth0", true, "fe80::1/64"))
+	for _, kind := range []network.ChangeKind{network.InterfaceUp, network.AddressAdded} {
+		select {
+		case change := <-received:
+			assert.Equal(t, kind, change.Kind)
+		case <-time.After(2 * time.Second):
+			t.Fatal("change not detected")
+		}
+	}
+	w.Stop()
+	fake.set(iFace(1, "eth0", false))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, received)
+}
+
+func TestWatcherLive(t *testing.T) {
+	w := &network.Watcher{}
+	require.NoError(t, w.Start())
+	assert.NotEmpty(t, w.Interfaces())
+	w.Stop()
+	w.Stop()
+}
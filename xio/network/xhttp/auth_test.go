@@ -0,0 +1,119 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func whoami(w http.ResponseWriter, req *http.Request) {
+	if p := xhttp.PrincipalFrom(req); p != nil {
+		w.Write([]byte(p.Scheme + ":" + p.ID)) //nolint:errcheck
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := xhttp.HashPasswordWithIterations("secret", 1000)
+	require.NoError(t, err)
+	assert.True(t, xhttp.VerifyPassword(hash, "secret"))
+	assert.False(t, xhttp.VerifyPassword(hash, "Secret"))
+	assert.False(t, xhttp.VerifyPassword("", "secret"))
+	other, err := xhttp.HashPasswordWithIterations("secret", 1000)
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+}
+
+func TestHashedBasicAuth(t *testing.T) {
+	hash, err := xhttp.HashPasswordWithIterations("secret", 1000)
+	require.NoError(t, err)
+	h := xhttp.NewHashedBasicAuth("test", func(user, realm string) string {
+		if user == "joe" {
+			return hash
+		}
+		return ""
+	}).Wrap(http.HandlerFunc(whoami))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("joe", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "Basic:joe", w.Body.String())
+	req.SetBasicAuth("joe", "wrong")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	req.SetBasicAuth("bob", "")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestTokenAuth(t *testing.T) {
+	shared := &xhttp.Principal{ID: "svc"}
+	validator := func(token string) *xhttp.Principal {
+		if xhttp.ConstantTimeEqual(token, "abc123") {
+			return shared
+		}
+		return nil
+	}
+	h := xhttp.NewBearerAuth("test", validator).Wrap(http.HandlerFunc(whoami))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer abc123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "Bearer:svc", w.Body.String())
+	req.Header.Set("Authorization", "Bearer nope")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	h = xhttp.NewAPIKeyAuth("X-API-Key", "key", validator).Wrap(http.HandlerFunc(whoami))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?key=abc123", nil))
+	assert.Equal(t, "APIKey:svc", w.Body.String())
+	assert.Empty(t, shared.Scheme)
+}
+
+func TestSessionAuth(t *testing.T) {
+	_, err := xhttp.NewSessionAuth("session", time.Hour, []byte("0123456789abcdef"))
+	assert.Error(t, err, "keys shorter than 32 bytes are rejected")
+
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	auth, err := xhttp.NewSessionAuth("session", time.Hour, oldKey)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	require.NoError(t, auth.Save(w, &xhttp.Principal{ID: "joe"}))
+	cookie := w.Result().Cookies()[0]
+	assert.True(t, cookie.HttpOnly)
+
+	rotated, err := xhttp.NewSessionAuth("session", time.Hour, []byte("fedcba9876543210fedcba9876543210"), oldKey)
+	require.NoError(t, err)
+	h := rotated.Wrap(http.HandlerFunc(whoami))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "Session:joe", w.Body.String())
+
+	tampered := *cookie
+	tampered.Value = "x" + cookie.Value[1:]
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&tampered)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -13,20 +13,63 @@ package xhttp
 import (
 	"fmt"
 	"net/http"
+	"sync"
 )
 
 // PasswordLookup provides a way to map a user in a realm to a password
 type PasswordLookup func(user string, realm string) string
 
-// BasicAuth provides basic HTTP authentication.
+// HashedPasswordLookup provides a way to map a user in a realm to a password
+// hash produced by HashPassword(). An empty string should be returned if the
+// user is unknown.
+type HashedPasswordLookup func(user string, realm string) string
+
+// BasicAuth provides basic HTTP authentication. On success, a Principal with
+// the user as its ID is made available through PrincipalFrom().
 type BasicAuth struct {
 	realm  string
-	lookup PasswordLookup
+	verify func(user, password string) bool
 }
 
-// NewBasicAuth creates a new BasicAuth.
+// NewBasicAuth creates a new BasicAuth that compares against plaintext
+// passwords. The comparison is made in constant time, but prefer
+// NewHashedBasicAuth() so that plaintext passwords need not be stored.
 func NewBasicAuth(realm string, lookup PasswordLookup) *BasicAuth {
-	return &BasicAuth{realm: realm, lookup: lookup}
+	return &BasicAuth{
+		realm: realm,
+		verify: func(user, password string) bool {
+			return ConstantTimeEqual(password, lookup(user, realm))
+		},
+	}
+}
+
+// NewHashedBasicAuth creates a new BasicAuth that verifies passwords against
+// hashes produced by HashPassword(). Unknown users are verified against a
+// dummy hash, so that they take as long to reject as known users.
+func NewHashedBasicAuth(realm string, lookup HashedPasswordLookup) *BasicAuth {
+	return &BasicAuth{
+		realm: realm,
+		verify: func(user, password string) bool {
+			hash := lookup(user, realm)
+			if hash == "" {
+				VerifyPassword(dummyPasswordHash(), password)
+				return false
+			}
+			return VerifyPassword(hash, password)
+		},
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword("")
+	})
+	return dummyHash
 }
 
 // Wrap an http.Handler.
@@ -41,8 +84,8 @@ type wrapper struct {
 
 func (hw *wrapper) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if user, pw, ok := req.BasicAuth(); ok {
-		if pw == hw.auth.lookup(user, hw.auth.realm) {
-			hw.handler.ServeHTTP(w, req)
+		if hw.auth.verify(user, pw) {
+			hw.handler.ServeHTTP(w, WithPrincipal(req, &Principal{ID: user, Scheme: "Basic"}))
 			return
 		}
 	}
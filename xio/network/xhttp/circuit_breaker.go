@@ -0,0 +1,162 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when a request is refused because the circuit
+// breaker for its host is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// DefaultBreakerCooldown is the default amount of time a CircuitBreaker stays
+// open before allowing a trial request through.
+const DefaultBreakerCooldown = 30 * time.Second
+
+// BreakerState holds the state of a CircuitBreaker.
+type BreakerState int
+
+// Possible values for BreakerState.
+const (
+	// BreakerClosed allows all requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen refuses all requests until the cooldown has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen allows a single trial request through. Its success
+	// closes the breaker, while its failure opens it again.
+	BreakerHalfOpen
+)
+
+// String implements fmt.Stringer.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops requests from being made to a failing service for a
+// period of time, giving it a chance to recover.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures that opens the breaker.
+	// A value less than 1 disables the breaker.
+	Threshold int
+	// Cooldown is how long the breaker stays open before allowing a trial
+	// request through. Defaults to DefaultBreakerCooldown.
+	Cooldown time.Duration
+	// Now returns the current time. Defaults to time.Now. Intended for tests.
+	Now      func() time.Time
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// NewCircuitBreaker creates a new CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance()
+	return b.state
+}
+
+// Allow returns true if a request may be made. When it does, the outcome of
+// the request must be reported by calling Success() or Failure().
+func (b *CircuitBreaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Threshold < 1 {
+		return true
+	}
+	b.advance()
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+	}
+	return true
+}
+
+// Success records a successful request, closing the breaker.
+func (b *CircuitBreaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure records a failed request, opening the breaker if the threshold of
+// consecutive failures has been reached or if the failure was a trial
+// request.
+func (b *CircuitBreaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Threshold < 1 {
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.Threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+		b.trial = false
+	}
+}
+
+// abandon records that a request allowed through did not complete for reasons
+// unrelated to the service, such as cancellation by the caller.
+func (b *CircuitBreaker) abandon() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+}
+
+func (b *CircuitBreaker) advance() {
+	if b.state != BreakerOpen {
+		return
+	}
+	cooldown := b.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	if b.now().Sub(b.openedAt) >= cooldown {
+		b.state = BreakerHalfOpen
+		b.trial = false
+	}
+}
+
+func (b *CircuitBreaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,381 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/rate"
+)
+
+// Defaults for the Client.
+const (
+	DefaultClientTimeout   = 30 * time.Second
+	DefaultMaxRetries      = 3
+	DefaultInitialBackoff  = 250 * time.Millisecond
+	DefaultMaxBackoff      = 10 * time.Second
+	DefaultMaxRetryAfter   = time.Minute
+	DefaultHostIdleTimeout = 10 * time.Minute
+)
+
+// IdempotencyKeyHeader is the header that marks a request using a
+// non-idempotent method as safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultClient is the Client used by the package-level helpers that fetch
+// URLs.
+var DefaultClient = &Client{}
+
+// Client wraps an http.Client, adding per-attempt timeouts, retries with
+// exponential backoff and jitter, per-host circuit breakers and per-host rate
+// limiting. The zero value is ready for use.
+type Client struct {
+	// HTTPClient is used to perform the requests. Defaults to
+	// http.DefaultClient. Its own Timeout, if any, also applies.
+	HTTPClient *http.Client
+	// Timeout is the maximum amount of time allowed for each attempt,
+	// including reading the response body. Defaults to DefaultClientTimeout.
+	// Set to a negative value to disable.
+	Timeout time.Duration
+	// MaxRetries is the maximum number of times a failed request will be
+	// retried. Defaults to DefaultMaxRetries. Set to a negative value to
+	// disable retries.
+	MaxRetries int
+	// InitialBackoff is the upper bound of the delay before the first retry.
+	// The bound doubles with each subsequent retry, up to MaxBackoff, and the
+	// actual delay is chosen randomly below it. Defaults to
+	// DefaultInitialBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff is the largest upper bound for the delay between retries.
+	// Defaults to DefaultMaxBackoff.
+	MaxBackoff time.Duration
+	// MaxRetryAfter is the longest Retry-After delay that will be honored.
+	// Responses asking for a longer delay are returned rather than retried.
+	// Defaults to DefaultMaxRetryAfter.
+	MaxRetryAfter time.Duration
+	// RetryStatus returns true if a response with the status code should be
+	// retried. Defaults to retrying 429, 502, 503 and 504 responses.
+	RetryStatus func(status int) bool
+	// BreakerThreshold is the number of consecutive failures, either network
+	// errors or 5xx responses, that will open the circuit breaker for a host.
+	// A value less than 1 disables the circuit breakers.
+	BreakerThreshold int
+	// BreakerCooldown is how long a host's circuit breaker stays open.
+	// Defaults to DefaultBreakerCooldown.
+	BreakerCooldown time.Duration
+	// RateLimiter, if set, limits the number of requests made per time
+	// period. Each host is given its own child limiter, so requests are capped
+	// both per host and overall.
+	RateLimiter rate.Limiter
+	// HostRateCap is the capacity of each host's child limiter. Defaults to
+	// the capacity of RateLimiter.
+	HostRateCap int
+	// HostIdleTimeout is how long a host's circuit breaker and child limiter
+	// are kept after its last request finishes. Defaults to
+	// DefaultHostIdleTimeout. Set to a negative value to keep them forever.
+	HostIdleTimeout time.Duration
+	lock            sync.Mutex
+	hosts           map[string]*clientHost
+	lastSweep       time.Time
+}
+
+type clientHost struct {
+	breaker  *CircuitBreaker
+	limiter  rate.Limiter
+	active   int
+	lastUsed time.Time
+}
+
+// Get issues a GET request for the URL.
+func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return c.Do(req.WithContext(ctx))
+}
+
+// Post issues a POST request for the URL. POST requests are only retried if
+// they carry an Idempotency-Key header, so use Do() to add one if retries are
+// desired.
+func (c *Client) Post(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req.WithContext(ctx))
+}
+
+// Do sends the request, retrying it if it fails and is safe to retry. A
+// request is safe to retry if its method is idempotent or it carries an
+// Idempotency-Key header, and its body, if any, can be replayed. The response
+// body must be closed by the caller.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	host := c.acquireHost(req.URL.Host)
+	defer c.releaseHost(host)
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	if !retryable(req) {
+		maxRetries = 0
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if host.limiter != nil {
+			if err := waitForLimiter(ctx, host.limiter); err != nil {
+				return nil, err
+			}
+		}
+		if !host.breaker.Allow() {
+			return nil, errs.NewWithCause(req.URL.Host, ErrCircuitOpen)
+		}
+		resp, err := c.attempt(req, attempt)
+		if err != nil {
+			if ctx.Err() != nil {
+				// The caller gave up, which says nothing about the host.
+				host.breaker.abandon()
+				return nil, errs.Wrap(ctx.Err())
+			}
+			host.breaker.Failure()
+			if attempt >= maxRetries {
+				return nil, errs.Wrap(err)
+			}
+			if err = sleep(ctx, c.backoff(attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			host.breaker.Failure()
+		} else {
+			host.breaker.Success()
+		}
+		if attempt >= maxRetries || !c.shouldRetryStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		delay := c.backoff(attempt)
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			maxRetryAfter := c.MaxRetryAfter
+			if maxRetryAfter <= 0 {
+				maxRetryAfter = DefaultMaxRetryAfter
+			}
+			if retryAfter > maxRetryAfter {
+				return resp, nil
+			}
+			delay = retryAfter
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024)) //nolint:errcheck
+		resp.Body.Close()                                           //nolint:errcheck
+		if err = sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx := req.Context()
+	cancel := context.CancelFunc(func() {})
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultClientTimeout
+	}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	one := req.WithContext(ctx)
+	if attempt > 0 && req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, errs.Wrap(err)
+		}
+		one.Body = body
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(one)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// acquireHost returns the state for the host, marking it as in use so that
+// it will not be evicted until releaseHost is called.
+func (c *Client) acquireHost(name string) *clientHost {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	c.evictIdleHosts(now)
+	if c.hosts == nil {
+		c.hosts = make(map[string]*clientHost)
+	}
+	h, ok := c.hosts[name]
+	if !ok {
+		h = &clientHost{breaker: NewCircuitBreaker(c.BreakerThreshold, c.BreakerCooldown)}
+		if c.RateLimiter != nil {
+			capacity := c.HostRateCap
+			if capacity <= 0 {
+				capacity = c.RateLimiter.Cap(false)
+			}
+			h.limiter = c.RateLimiter.New(capacity)
+		}
+		c.hosts[name] = h
+	}
+	h.active++
+	h.lastUsed = now
+	return h
+}
+
+func (c *Client) releaseHost(h *clientHost) {
+	c.lock.Lock()
+	h.active--
+	h.lastUsed = time.Now()
+	c.lock.Unlock()
+}
+
+// evictIdleHosts discards the state of hosts that have been idle for longer
+// than HostIdleTimeout, checking at most once per timeout period. Must be
+// called with the lock held.
+func (c *Client) evictIdleHosts(now time.Time) {
+	timeout := c.HostIdleTimeout
+	if timeout == 0 {
+		timeout = DefaultHostIdleTimeout
+	}
+	if timeout < 0 || now.Sub(c.lastSweep) < timeout {
+		return
+	}
+	c.lastSweep = now
+	for name, h := range c.hosts {
+		if h.active == 0 && now.Sub(h.lastUsed) >= timeout {
+			if h.limiter != nil {
+				h.limiter.Close()
+			}
+			delete(c.hosts, name)
+		}
+	}
+}
+
+// BreakerState returns the state of the circuit breaker for the host.
+func (c *Client) BreakerState(host string) BreakerState {
+	h := c.acquireHost(host)
+	defer c.releaseHost(h)
+	return h.breaker.State()
+}
+
+func (c *Client) shouldRetryStatus(status int) bool {
+	if c.RetryStatus != nil {
+		return c.RetryStatus(status)
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	initial := c.InitialBackoff
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+	maximum := c.MaxBackoff
+	if maximum <= 0 {
+		maximum = DefaultMaxBackoff
+	}
+	bound := initial
+	for i := 0; i < attempt && bound < maximum; i++ {
+		bound *= 2
+	}
+	if bound > maximum {
+		bound = maximum
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1)) //nolint:gosec // Jitter doesn't need a secure source
+}
+
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return req.Header.Get(IdempotencyKeyHeader) != ""
+	}
+}
+
+// parseRetryAfter parses a Retry-After header value, which may be either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		delay := time.Until(when)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+func waitForLimiter(ctx context.Context, limiter rate.Limiter) error {
+	return limiter.Wait(ctx, 1)
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errs.Wrap(ctx.Err())
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,205 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/rate"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countingServer(handler func(count int32, w http.ResponseWriter, req *http.Request)) (*httptest.Server, *int32) {
+	var count int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler(atomic.AddInt32(&count, 1), w, req)
+	})), &count
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	data, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(data)
+}
+
+func TestClientRetries(t *testing.T) {
+	server, count := countingServer(func(count int32, w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body) //nolint:errcheck
+		if count < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body) //nolint:errcheck
+	})
+	defer server.Close()
+	c := &xhttp.Client{InitialBackoff: time.Millisecond}
+
+	resp, err := c.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	readBody(t, resp)
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+
+	atomic.StoreInt32(count, 0)
+	resp, err = c.Post(context.Background(), server.URL, "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	readBody(t, resp)
+	assert.Equal(t, int32(1), atomic.LoadInt32(count))
+
+	atomic.StoreInt32(count, 0)
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("payload"))
+	require.NoError(t, err)
+	req.Header.Set(xhttp.IdempotencyKeyHeader, "abc")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "payload", readBody(t, resp))
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+
+	atomic.StoreInt32(count, 0)
+	c.MaxRetries = 1
+	resp, err = c.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	readBody(t, resp)
+	assert.Equal(t, int32(2), atomic.LoadInt32(count))
+}
+
+func TestClientRetryAfterTooLong(t *testing.T) {
+	server, count := countingServer(func(_ int32, w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer server.Close()
+	resp, err := (&xhttp.Client{}).Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(count))
+}
+
+func TestClientTimeout(t *testing.T) {
+	server, count := countingServer(func(count int32, w http.ResponseWriter, _ *http.Request) {
+		if count == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("ok")) //nolint:errcheck
+	})
+	defer server.Close()
+	c := &xhttp.Client{Timeout: 50 * time.Millisecond, InitialBackoff: time.Millisecond}
+	resp, err := c.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+	assert.Equal(t, int32(2), atomic.LoadInt32(count))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Get(ctx, server.URL)
+	assert.Error(t, err)
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	server, count := countingServer(func(_ int32, w http.ResponseWriter, _ *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	defer server.Close()
+	c := &xhttp.Client{MaxRetries: -1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}
+	host := strings.TrimPrefix(server.URL, "http://")
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(context.Background(), server.URL)
+		require.NoError(t, err)
+		readBody(t, resp)
+	}
+	assert.Equal(t, xhttp.BreakerOpen, c.BreakerState(host))
+	_, err := c.Get(context.Background(), server.URL)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(count))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, xhttp.BreakerHalfOpen, c.BreakerState(host))
+	atomic.StoreInt32(&failing, 0)
+	resp, err := c.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Equal(t, xhttp.BreakerClosed, c.BreakerState(host))
+}
+
+func TestClientEvictsIdleHosts(t *testing.T) {
+	server, _ := countingServer(func(_ int32, w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer server.Close()
+	c := &xhttp.Client{
+		MaxRetries:       -1,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+		HostIdleTimeout:  50 * time.Millisecond,
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	resp, err := c.Get(context.Background(), server.URL)
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Equal(t, xhttp.BreakerOpen, c.BreakerState(host))
+
+	// Once idle for long enough, the host's state is discarded.
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, xhttp.BreakerClosed, c.BreakerState(host))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := xhttp.NewCircuitBreaker(1, time.Second)
+	b.Now = func() time.Time { return now }
+	assert.True(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, xhttp.BreakerOpen, b.State())
+	assert.False(t, b.Allow())
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow(), "only one trial request is allowed")
+	b.Failure()
+	assert.Equal(t, xhttp.BreakerOpen, b.State())
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	b.Success()
+	assert.Equal(t, xhttp.BreakerClosed, b.State())
+	assert.Equal(t, "closed", b.State().String())
+}
+
+func TestClientRateLimit(t *testing.T) {
+	server, count := countingServer(func(_ int32, w http.ResponseWriter, _ *http.Request) {})
+	defer server.Close()
+	limiter := rate.New(10, 100*time.Millisecond)
+	defer limiter.Close()
+	c := &xhttp.Client{RateLimiter: limiter, HostRateCap: 2}
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(context.Background(), server.URL)
+		require.NoError(t, err)
+		readBody(t, resp)
+	}
+	assert.True(t, time.Since(started) >= 50*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(count))
+}
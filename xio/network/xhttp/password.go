@@ -0,0 +1,84 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xcrypto"
+)
+
+const (
+	passwordHashPrefix = "$pbkdf2-sha256$"
+	// DefaultPasswordIterations is the number of PBKDF2 iterations used by
+	// HashPassword().
+	DefaultPasswordIterations = 100000
+	passwordSaltSize          = 16
+	passwordKeySize           = 32
+)
+
+// HashPassword returns a salted hash of the password suitable for storage,
+// using PBKDF2 with HMAC-SHA256 and DefaultPasswordIterations. The result is
+// of the form "$pbkdf2-sha256$<iterations>$<salt>$<hash>", where the salt and
+// hash are unpadded base64.
+func HashPassword(password string) (string, error) {
+	return HashPasswordWithIterations(password, DefaultPasswordIterations)
+}
+
+// HashPasswordWithIterations is the same as HashPassword(), but allows the
+// number of iterations to be specified.
+func HashPasswordWithIterations(password string, iterations int) (string, error) {
+	if iterations < 1 {
+		return "", errs.Newf("invalid iteration count: %d", iterations)
+	}
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errs.Wrap(err)
+	}
+	key := xcrypto.PBKDF2([]byte(password), salt, iterations, passwordKeySize, sha256.New)
+	return fmt.Sprintf("%s%d$%s$%s", passwordHashPrefix, iterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword returns true if the password matches the hash previously
+// produced by HashPassword(). The comparison is made in constant time.
+func VerifyPassword(hash, password string) bool {
+	if !strings.HasPrefix(hash, passwordHashPrefix) {
+		return false
+	}
+	parts := strings.Split(hash[len(passwordHashPrefix):], "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	var salt, expected []byte
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return false
+	}
+	if expected, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil || len(expected) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(xcrypto.PBKDF2([]byte(password), salt, iterations, len(expected), sha256.New), expected) == 1
+}
+
+// ConstantTimeEqual returns true if the two strings are equal. The time taken
+// depends only on the length of the strings, not their content.
+func ConstantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,46 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp
+
+import (
+	"context"
+	"net/http"
+)
+
+type principalCtxKey int
+
+var principalKey principalCtxKey = 1
+
+// Principal holds information about an authenticated user or client.
+type Principal struct {
+	// ID identifies the user or client, such as a user name.
+	ID string `json:"id"`
+	// Scheme is the authentication scheme used, such as "Basic" or "Bearer".
+	Scheme string `json:"scheme"`
+	// Attributes holds any additional information the authenticator chose to
+	// attach.
+	Attributes map[string]string `json:"attrs,omitempty"`
+}
+
+// WithPrincipal returns a shallow copy of the request with the principal
+// stored in its context.
+func WithPrincipal(req *http.Request, principal *Principal) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), principalKey, principal))
+}
+
+// PrincipalFrom returns the principal that was authenticated for the request,
+// or nil if there isn't one.
+func PrincipalFrom(req *http.Request) *Principal {
+	p, ok := req.Context().Value(principalKey).(*Principal)
+	if !ok {
+		return nil
+	}
+	return p
+}
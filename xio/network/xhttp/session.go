@@ -0,0 +1,185 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+type sessionPayload struct {
+	Principal *Principal `json:"p"`
+	Expires   int64      `json:"e"`
+}
+
+// SessionAuth provides authentication through HMAC-signed session cookies.
+// The principal is stored in the cookie itself, so no server-side storage is
+// needed. Note that the cookie contents are signed, but not encrypted, so
+// nothing secret should be placed in the principal's attributes.
+type SessionAuth struct {
+	// CookieName is the name of the session cookie.
+	CookieName string
+	// Path is the path the cookie applies to. Defaults to "/".
+	Path string
+	// Domain is the domain the cookie applies to. Defaults to the host only.
+	Domain string
+	// MaxAge is how long a session remains valid after being saved.
+	MaxAge time.Duration
+	// Insecure permits the cookie to be sent over plain HTTP. Only intended
+	// for development.
+	Insecure bool
+	// SameSite controls the cookie's SameSite attribute. Defaults to
+	// http.SameSiteLaxMode.
+	SameSite http.SameSite
+	keys     [][]byte
+}
+
+const minSessionKeySize = 32
+
+// NewSessionAuth creates a new SessionAuth. The first key is used to sign new
+// sessions. Any additional keys are only used to verify existing sessions,
+// which permits keys to be rotated without logging everyone out. Keys must
+// be at least 32 bytes of random data, the size of an HMAC-SHA256 key.
+func NewSessionAuth(cookieName string, maxAge time.Duration, keys ...[]byte) (*SessionAuth, error) {
+	if len(keys) == 0 {
+		return nil, errs.New("at least one key must be provided")
+	}
+	for _, key := range keys {
+		if len(key) < minSessionKeySize {
+			return nil, errs.Newf("session keys must be at least %d bytes", minSessionKeySize)
+		}
+	}
+	return &SessionAuth{
+		CookieName: cookieName,
+		MaxAge:     maxAge,
+		keys:       keys,
+	}, nil
+}
+
+// Save sets a session cookie for the principal on the response.
+func (auth *SessionAuth) Save(w http.ResponseWriter, principal *Principal) error {
+	expires := time.Now().Add(auth.MaxAge)
+	data, err := json.Marshal(&sessionPayload{Principal: principal, Expires: expires.Unix()})
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	value := payload + "." + base64.RawURLEncoding.EncodeToString(auth.sign(auth.keys[0], payload))
+	http.SetCookie(w, auth.cookie(value, expires))
+	return nil
+}
+
+// Clear removes the session cookie.
+func (auth *SessionAuth) Clear(w http.ResponseWriter) {
+	c := auth.cookie("", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+// Load returns the principal stored in the request's session cookie, or an
+// error if there is no valid session.
+func (auth *SessionAuth) Load(req *http.Request) (*Principal, error) {
+	c, err := req.Cookie(auth.CookieName)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 2 {
+		return nil, errs.New("malformed session")
+	}
+	var sig []byte
+	if sig, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errs.New("malformed session")
+	}
+	valid := false
+	for _, key := range auth.keys {
+		if hmac.Equal(sig, auth.sign(key, parts[0])) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errs.New("invalid session signature")
+	}
+	var data []byte
+	if data, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, errs.New("malformed session")
+	}
+	var payload sessionPayload
+	if err = json.Unmarshal(data, &payload); err != nil || payload.Principal == nil {
+		return nil, errs.New("malformed session")
+	}
+	if time.Now().Unix() >= payload.Expires {
+		return nil, errs.New("session expired")
+	}
+	if payload.Principal.Scheme == "" {
+		payload.Principal.Scheme = "Session"
+	}
+	return payload.Principal, nil
+}
+
+// Wrap an http.Handler, requiring a valid session.
+func (auth *SessionAuth) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p, err := auth.Load(req)
+		if err != nil {
+			WriteHTTPStatus(w, http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, WithPrincipal(req, p))
+	})
+}
+
+// WrapOptional wraps an http.Handler, making the session's principal
+// available if there is a valid session, but calling the handler regardless.
+func (auth *SessionAuth) WrapOptional(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if p, err := auth.Load(req); err == nil {
+			req = WithPrincipal(req, p)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func (auth *SessionAuth) sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(auth.CookieName)) //nolint:errcheck
+	mac.Write([]byte{0})               //nolint:errcheck
+	mac.Write([]byte(payload))         //nolint:errcheck
+	return mac.Sum(nil)
+}
+
+func (auth *SessionAuth) cookie(value string, expires time.Time) *http.Cookie {
+	p := auth.Path
+	if p == "" {
+		p = "/"
+	}
+	sameSite := auth.SameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+	return &http.Cookie{
+		Name:     auth.CookieName,
+		Value:    value,
+		Path:     p,
+		Domain:   auth.Domain,
+		Expires:  expires,
+		Secure:   !auth.Insecure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
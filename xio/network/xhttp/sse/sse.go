@@ -0,0 +1,324 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// Package sse provides a broker for sending server-sent events to browsers.
+package sse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+)
+
+// Defaults for the Broker.
+const (
+	DefaultHeartbeatInterval = 15 * time.Second
+	DefaultHistorySize       = 100
+	DefaultBufferSize        = 64
+	DefaultTopicParameter    = "topic"
+)
+
+// Event holds a single server-sent event.
+type Event struct {
+	// ID is assigned by the Broker when the event is published. Clients send
+	// the ID of the last event they received when they reconnect, allowing
+	// missed events to be replayed.
+	ID uint64
+	// Topic is the topic the event was published to.
+	Topic string
+	// Type is the event type, which clients use to select a listener. May be
+	// empty, in which case clients receive it as a "message" event.
+	Type string
+	// Data is the event payload. It may contain multiple lines.
+	Data string
+}
+
+// Broker distributes published events to the clients subscribed to their
+// topics. It implements http.Handler; each request becomes a subscription to
+// the topics named by the request's "topic" query parameters. Each topic keeps
+// a history of recent events so that clients reconnecting with a
+// Last-Event-ID header receive the events they missed. Clients that fall too
+// far behind are disconnected, after which they reconnect and catch up from
+// the history.
+type Broker struct {
+	// HeartbeatInterval is how often a comment is sent to idle clients to keep
+	// intermediaries from closing the connection. Defaults to
+	// DefaultHeartbeatInterval. Set to a negative value to disable.
+	HeartbeatInterval time.Duration
+	// HistorySize is the number of events retained per topic for replay.
+	// Defaults to DefaultHistorySize.
+	HistorySize int
+	// BufferSize is the number of events that may be queued for a single
+	// client before it is disconnected. Defaults to DefaultBufferSize.
+	BufferSize int
+	// Retry, if greater than zero, is sent to clients as the delay they should
+	// wait before reconnecting.
+	Retry time.Duration
+	// Topics returns the topics a request subscribes to. Defaults to the
+	// values of the DefaultTopicParameter query parameter.
+	Topics func(req *http.Request) []string
+	lock   sync.Mutex
+	lastID uint64
+	topics map[string]*topic
+	closed chan struct{}
+}
+
+type topic struct {
+	history     []Event
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	events  chan Event
+	dropped chan struct{}
+}
+
+// NewBroker creates a new Broker with default settings.
+func NewBroker() *Broker {
+	return &Broker{}
+}
+
+func (b *Broker) init() {
+	if b.topics == nil {
+		b.topics = make(map[string]*topic)
+		b.closed = make(chan struct{})
+	}
+}
+
+func (b *Broker) topic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{subscribers: make(map[*subscriber]bool)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// Publish an event to a topic, returning the ID assigned to it.
+func (b *Broker) Publish(topicName, eventType, data string) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.init()
+	b.lastID++
+	event := Event{
+		ID:    b.lastID,
+		Topic: topicName,
+		Type:  eventType,
+		Data:  data,
+	}
+	t := b.topic(topicName)
+	historySize := b.HistorySize
+	if historySize == 0 {
+		historySize = DefaultHistorySize
+	}
+	if historySize > 0 {
+		if len(t.history) >= historySize {
+			copy(t.history, t.history[len(t.history)-historySize+1:])
+			t.history = t.history[:historySize-1]
+		}
+		t.history = append(t.history, event)
+	}
+	for s := range t.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			b.drop(s)
+		}
+	}
+	return event.ID
+}
+
+// Subscribers returns the number of clients currently subscribed to the topic.
+func (b *Broker) Subscribers(topicName string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if t, ok := b.topics[topicName]; ok {
+		return len(t.subscribers)
+	}
+	return 0
+}
+
+// Close disconnects all clients. Subsequent requests are rejected.
+func (b *Broker) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.init()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+}
+
+// drop disconnects a subscriber. Must be called with the lock held.
+func (b *Broker) drop(s *subscriber) {
+	for _, t := range b.topics {
+		delete(t.subscribers, s)
+	}
+	select {
+	case <-s.dropped:
+	default:
+		close(s.dropped)
+	}
+}
+
+func (b *Broker) subscribe(topics []string, lastID uint64, replay bool) (s *subscriber, missed []Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.init()
+	bufferSize := b.BufferSize
+	if bufferSize < 1 {
+		bufferSize = DefaultBufferSize
+	}
+	s = &subscriber{
+		events:  make(chan Event, bufferSize),
+		dropped: make(chan struct{}),
+	}
+	for _, name := range topics {
+		t := b.topic(name)
+		t.subscribers[s] = true
+		if replay {
+			for _, event := range t.history {
+				if event.ID > lastID {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].ID < missed[j].ID })
+	return s, missed
+}
+
+func (b *Broker) unsubscribe(s *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for name, t := range b.topics {
+		delete(t.subscribers, s)
+		if len(t.subscribers) == 0 && len(t.history) == 0 {
+			delete(b.topics, name)
+		}
+	}
+}
+
+func (b *Broker) requestTopics(req *http.Request) []string {
+	if b.Topics != nil {
+		return b.Topics(req)
+	}
+	return req.URL.Query()[DefaultTopicParameter]
+}
+
+// ServeHTTP implements http.Handler.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		xhttp.WriteHTTPStatus(w, http.StatusNotImplemented)
+		return
+	}
+	topics := b.requestTopics(req)
+	if len(topics) == 0 {
+		xhttp.WriteHTTPStatus(w, http.StatusBadRequest)
+		return
+	}
+	b.lock.Lock()
+	b.init()
+	closed := b.closed
+	b.lock.Unlock()
+	select {
+	case <-closed:
+		xhttp.WriteHTTPStatus(w, http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("lastEventId")
+	}
+	lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+	s, missed := b.subscribe(topics, lastID, err == nil)
+	defer b.unsubscribe(s)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if b.Retry > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", b.Retry/time.Millisecond)
+	}
+	for _, event := range missed {
+		if WriteEvent(w, event) != nil {
+			return
+		}
+		lastID = event.ID
+	}
+	flusher.Flush()
+
+	interval := b.HeartbeatInterval
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	var heartbeat <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-closed:
+			return
+		case <-s.dropped:
+			return
+		case event := <-s.events:
+			if event.ID <= lastID {
+				continue
+			}
+			if WriteEvent(w, event) != nil {
+				return
+			}
+			lastID = event.ID
+			flusher.Flush()
+		case <-heartbeat:
+			if _, err = io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// WriteEvent writes an event in the text/event-stream format.
+func WriteEvent(w io.Writer, event Event) error {
+	var buffer strings.Builder
+	if event.ID != 0 {
+		fmt.Fprintf(&buffer, "id: %d\n", event.ID)
+	}
+	if event.Type != "" {
+		fmt.Fprintf(&buffer, "event: %s\n", strings.NewReplacer("\r", "", "\n", "").Replace(event.Type))
+	}
+	// A lone carriage return also ends a line in the event stream format, so
+	// normalize all line endings before splitting.
+	data := strings.ReplaceAll(strings.ReplaceAll(event.Data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buffer, "data: %s\n", line)
+	}
+	buffer.WriteByte('\n')
+	_, err := io.WriteString(w, buffer.String())
+	return err
+}
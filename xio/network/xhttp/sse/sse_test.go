@@ -0,0 +1,116 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package sse_test
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/sse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connect(t *testing.T, url, lastEventID string) (*bufio.Reader, func()) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() } //nolint:errcheck
+}
+
+func readBlock(t *testing.T, r *bufio.Reader) string {
+	var buffer strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\n" {
+			return buffer.String()
+		}
+		buffer.WriteString(line)
+	}
+}
+
+func waitForSubscribers(b *sse.Broker, topic string, count int) {
+	for i := 0; i < 100 && b.Subscribers(topic) != count; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := sse.NewBroker()
+	b.Retry = 2 * time.Second
+	b.HeartbeatInterval = 50 * time.Millisecond
+	server := httptest.NewServer(b)
+	defer server.Close()
+	defer b.Close()
+
+	r, done := connect(t, server.URL+"?topic=news&topic=sports", "")
+	assert.Equal(t, "retry: 2000\n", readBlock(t, r))
+	waitForSubscribers(b, "news", 1)
+	assert.Equal(t, 1, b.Subscribers("sports"))
+	b.Publish("weather", "", "sunny")
+	id := b.Publish("news", "headline", "line one\nline two")
+	assert.Equal(t, "id: 2\nevent: headline\ndata: line one\ndata: line two\n", readBlock(t, r))
+	b.Publish("sports", "", "score")
+	assert.Equal(t, "id: 3\ndata: score\n", readBlock(t, r))
+	assert.Equal(t, ": heartbeat\n", readBlock(t, r))
+	done()
+	waitForSubscribers(b, "news", 0)
+	assert.Equal(t, 0, b.Subscribers("news"))
+
+	b.Publish("news", "", "missed one")
+	b.Publish("sports", "", "missed two")
+	r, done = connect(t, server.URL+"?topic=news&topic=sports", "2")
+	defer done()
+	assert.Equal(t, "retry: 2000\n", readBlock(t, r))
+	assert.Equal(t, "id: 3\ndata: score\n", readBlock(t, r))
+	assert.Equal(t, "id: 4\ndata: missed one\n", readBlock(t, r))
+	assert.Equal(t, "id: 5\ndata: missed two\n", readBlock(t, r))
+	assert.True(t, id < b.Publish("news", "", "live"))
+	assert.Equal(t, "id: 6\ndata: live\n", readBlock(t, r))
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	b := sse.NewBroker()
+	b.BufferSize = 1
+	b.HeartbeatInterval = -1
+	server := httptest.NewServer(b)
+	defer server.Close()
+	defer b.Close()
+	_, done := connect(t, server.URL+"?topic=t", "")
+	defer done()
+	waitForSubscribers(b, "t", 1)
+	for i := 0; i < 10000 && b.Subscribers("t") != 0; i++ {
+		b.Publish("t", "", strings.Repeat("x", 1024))
+	}
+	assert.Equal(t, 0, b.Subscribers("t"))
+}
+
+func TestWriteEventLineEndings(t *testing.T) {
+	var buffer bytes.Buffer
+	require.NoError(t, sse.WriteEvent(&buffer, sse.Event{ID: 7, Type: "up\rdate", Data: "a\r\nb\rid: 99\revent: evil\nc"}))
+	assert.Equal(t, "id: 7\nevent: update\ndata: a\ndata: b\ndata: id: 99\ndata: event: evil\ndata: c\n\n", buffer.String())
+}
@@ -9,7 +9,11 @@
 
 package xhttp
 
-import "net/http"
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
 
 // StatusResponseWriter wraps an http.ResponseWriter and provides methods to
 // retrieve the status code and number of bytes written.
@@ -62,3 +66,29 @@ func (w *StatusResponseWriter) Flush() {
 		f.Flush()
 	}
 }
+
+// Hijack implements http.Hijacker. Returns http.ErrNotSupported if the
+// original http.ResponseWriter does not support hijacking. A successful hijack
+// records http.StatusSwitchingProtocols as the status if no other status was
+// set.
+func (w *StatusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.Original.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher. Returns http.ErrNotSupported if the original
+// http.ResponseWriter does not support server push.
+func (w *StatusResponseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := w.Original.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
@@ -0,0 +1,91 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package xhttp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenValidator checks a bearer token or API key and returns the principal
+// it belongs to, or nil if it isn't valid. Implementations that compare
+// against known tokens should use ConstantTimeEqual() or compare hashes of
+// the tokens to avoid leaking timing information.
+type TokenValidator func(token string) *Principal
+
+// TokenAuth provides bearer token (RFC 6750) or API key authentication. On
+// success, the Principal returned by the validator is made available through
+// PrincipalFrom().
+type TokenAuth struct {
+	realm     string
+	header    string
+	query     string
+	validator TokenValidator
+}
+
+// NewBearerAuth creates a new TokenAuth that looks for a bearer token in the
+// Authorization header.
+func NewBearerAuth(realm string, validator TokenValidator) *TokenAuth {
+	return &TokenAuth{realm: realm, validator: validator}
+}
+
+// NewAPIKeyAuth creates a new TokenAuth that looks for an API key in the
+// specified header. If 'queryParam' is not empty, the key may also be
+// supplied as a query parameter with that name.
+func NewAPIKeyAuth(header, queryParam string, validator TokenValidator) *TokenAuth {
+	return &TokenAuth{header: header, query: queryParam, validator: validator}
+}
+
+// Wrap an http.Handler.
+func (auth *TokenAuth) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if token := auth.token(req); token != "" {
+			if p := auth.validator(token); p != nil {
+				if p.Scheme == "" {
+					// Copy, as the validator may return a shared principal.
+					cp := *p
+					cp.Scheme = auth.scheme()
+					p = &cp
+				}
+				handler.ServeHTTP(w, WithPrincipal(req, p))
+				return
+			}
+		}
+		if auth.header == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, auth.realm))
+		}
+		WriteHTTPStatus(w, http.StatusUnauthorized)
+	})
+}
+
+func (auth *TokenAuth) scheme() string {
+	if auth.header == "" {
+		return "Bearer"
+	}
+	return "APIKey"
+}
+
+func (auth *TokenAuth) token(req *http.Request) string {
+	if auth.header == "" {
+		const prefix = "bearer "
+		if value := req.Header.Get("Authorization"); len(value) > len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+			return strings.TrimSpace(value[len(prefix):])
+		}
+		return ""
+	}
+	if value := req.Header.Get(auth.header); value != "" {
+		return value
+	}
+	if auth.query != "" {
+		return req.URL.Query().Get(auth.query)
+	}
+	return ""
+}
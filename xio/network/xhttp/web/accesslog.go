@@ -0,0 +1,66 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/richardwilkes/toolbox/log/logadapter"
+)
+
+// AccessLogEntry holds information about a completed request.
+type AccessLogEntry struct {
+	Started      time.Time     `json:"started"`
+	Duration     time.Duration `json:"duration_ns"`
+	Status       int           `json:"status"`
+	BytesWritten int           `json:"bytes"`
+	Method       string        `json:"method"`
+	URL          string        `json:"url"`
+	RemoteAddr   string        `json:"remote_addr,omitempty"`
+	UserAgent    string        `json:"user_agent,omitempty"`
+	RequestID    string        `json:"request_id,omitempty"`
+}
+
+// AccessLogger emits an access log entry for a completed request.
+type AccessLogger func(logger logadapter.Logger, entry *AccessLogEntry)
+
+// TextAccessLogger logs a single human-readable line per request. This is the
+// default.
+func TextAccessLogger(logger logadapter.Logger, entry *AccessLogEntry) {
+	millis := int64(entry.Duration / time.Millisecond)
+	micros := int64(entry.Duration/time.Microsecond) - millis*1000
+	var bytes string
+	if entry.BytesWritten != 1 {
+		bytes = "bytes"
+	} else {
+		bytes = "byte"
+	}
+	if entry.RequestID != "" {
+		logger.Infof("%d | %s.%03dms | %s %s | %s %s | %s", entry.Status, humanize.Comma(millis), micros, humanize.Comma(int64(entry.BytesWritten)), bytes, entry.Method, entry.URL, entry.RequestID)
+	} else {
+		logger.Infof("%d | %s.%03dms | %s %s | %s %s", entry.Status, humanize.Comma(millis), micros, humanize.Comma(int64(entry.BytesWritten)), bytes, entry.Method, entry.URL)
+	}
+}
+
+// StructuredAccessLogger logs each request as a single line of JSON.
+func StructuredAccessLogger(logger logadapter.Logger, entry *AccessLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	logger.Info(string(data))
+}
+
+// DiscardAccessLogger does not log anything.
+func DiscardAccessLogger(logger logadapter.Logger, entry *AccessLogEntry) {
+}
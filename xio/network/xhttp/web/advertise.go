@@ -0,0 +1,87 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/richardwilkes/toolbox/cmdline"
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio/network/mdns"
+)
+
+// advertise registers the server with its mDNS responder, if requested.
+func (s *Server) advertise() {
+	if s.Advertise == nil || s.port == 0 {
+		return
+	}
+	svc := *s.Advertise
+	if svc.Port == 0 {
+		svc.Port = s.port
+	}
+	if svc.Type == "" {
+		svc.Type = "_" + s.Protocol() + "._tcp"
+	}
+	if svc.Instance == "" {
+		// Probing for name conflicts is not performed, so include the port
+		// to keep the names of multiple servers on the same host distinct.
+		svc.Instance = cmdline.AppName
+		if host, err := os.Hostname(); err == nil {
+			if svc.Instance == "" {
+				svc.Instance = host
+			} else {
+				svc.Instance += " on " + host
+			}
+		}
+		if svc.Instance != "" {
+			svc.Instance = fmt.Sprintf("%s:%d", svc.Instance, svc.Port)
+		}
+	}
+	s.advertiseLock.Lock()
+	defer s.advertiseLock.Unlock()
+	if s.advertisingStopped {
+		return
+	}
+	responder := s.Responder
+	if responder == nil {
+		responder = &mdns.Responder{}
+		s.ownedResponder = responder
+	}
+	if err := responder.Register(&svc); err != nil {
+		s.Logger.Warn(errs.NewWithCause("Unable to advertise server via mDNS", err))
+		return
+	}
+	s.advertised = &svc
+	s.Logger.Infof("Advertising %s via mDNS as '%s'", svc.Type, svc.Instance)
+}
+
+// stopAdvertising withdraws the server's mDNS advertisement, if any.
+func (s *Server) stopAdvertising() {
+	s.advertiseLock.Lock()
+	defer s.advertiseLock.Unlock()
+	s.advertisingStopped = true
+	if s.advertised != nil {
+		responder := s.Responder
+		if responder == nil {
+			responder = s.ownedResponder
+		}
+		if err := responder.Unregister(s.advertised); err != nil {
+			s.Logger.Warn(errs.NewWithCause("Unable to withdraw mDNS advertisement", err))
+		}
+		s.advertised = nil
+	}
+	if s.ownedResponder != nil {
+		if err := s.ownedResponder.Close(); err != nil {
+			s.Logger.Warn(errs.NewWithCause("Unable to close mDNS responder", err))
+		}
+		s.ownedResponder = nil
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/cmdline"
+	"github.com/richardwilkes/toolbox/xio/network/mdns"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvertise(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		if lo, err = net.InterfaceByName("lo0"); err != nil {
+			t.Skip("no loopback interface")
+		}
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	groups := []string{fmt.Sprintf("224.0.0.251:%d", conn.LocalAddr().(*net.UDPAddr).Port)}
+	require.NoError(t, conn.Close())
+	ifaces := []net.Interface{*lo}
+
+	s := &web.Server{
+		WebServer: &http.Server{
+			Addr:    "127.0.0.1",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		},
+		Advertise:   &mdns.Service{Host: "webhost"},
+		Responder:   &mdns.Responder{Interfaces: ifaces, Groups: groups},
+		StartedChan: make(chan interface{}),
+	}
+	defer func() { require.NoError(t, s.Responder.Close()) }()
+	savedAppName := cmdline.AppName
+	cmdline.AppName = "Test Web Server"
+	defer func() { cmdline.AppName = savedAppName }()
+	host, err := os.Hostname()
+	require.NoError(t, err)
+
+	b := &mdns.Browser{Interfaces: ifaces, Groups: groups}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan string, 10)
+	browsing := make(chan error, 1)
+	go func() {
+		browsing <- b.Browse(ctx, "_http._tcp", func(entry *mdns.ServiceEntry, removed bool) {
+			if removed {
+				events <- "removed " + entry.Instance
+			} else {
+				events <- fmt.Sprintf("found %s:%d", entry.Instance, entry.Port)
+			}
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	go s.Run() //nolint:errcheck
+	<-s.StartedChan
+	expect := func(event string) {
+		select {
+		case got := <-events:
+			assert.Equal(t, event, got)
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for '%s'", event)
+		}
+	}
+	instance := fmt.Sprintf("Test Web Server on %s:%d", host, s.Port())
+	expect(fmt.Sprintf("found %s:%d", instance, s.Port()))
+	s.Shutdown()
+	expect("removed " + instance)
+	assert.Empty(t, s.Responder.Services())
+	cancel()
+	assert.NoError(t, <-browsing)
+}
@@ -0,0 +1,132 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"bufio"
+	"compress/zlib"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/websocket"
+)
+
+// Deflate returns middleware that compresses responses using the "deflate"
+// content encoding when the client indicates it will accept it. 'level' is
+// one of the compression levels defined by the compress/flate package.
+// Responses that already have a Content-Encoding, or that have no body, and
+// WebSocket upgrades are left untouched.
+func Deflate(level int) Middleware {
+	if _, err := zlib.NewWriterLevel(nil, level); err != nil {
+		level = zlib.DefaultCompression
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsEncoding(req, "deflate") || websocket.IsUpgradeRequest(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			dw := &deflateResponseWriter{ResponseWriter: w, level: level}
+			defer dw.close()
+			next.ServeHTTP(dw, req)
+		})
+	}
+}
+
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	for _, one := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(one, ";")
+		if strings.EqualFold(strings.TrimSpace(parts[0]), encoding) {
+			for _, param := range parts[1:] {
+				if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+type deflateResponseWriter struct {
+	http.ResponseWriter
+	level       int
+	compressor  *zlib.Writer
+	wroteHeader bool
+}
+
+func (w *deflateResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if h.Get("Content-Encoding") == "" && status != http.StatusNoContent && status != http.StatusNotModified && status >= http.StatusOK {
+		h.Set("Content-Encoding", "deflate")
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		var err error
+		if w.compressor, err = zlib.NewWriterLevel(w.ResponseWriter, w.level); err != nil {
+			w.compressor = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deflateResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher.
+func (w *deflateResponseWriter) Flush() {
+	if w.compressor != nil {
+		w.compressor.Flush() //nolint:errcheck
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker. Returns http.ErrNotSupported if the
+// original http.ResponseWriter does not support hijacking.
+func (w *deflateResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return h.Hijack()
+}
+
+// Push implements http.Pusher. Returns http.ErrNotSupported if the original
+// http.ResponseWriter does not support server push.
+func (w *deflateResponseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := w.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+func (w *deflateResponseWriter) close() {
+	if w.compressor != nil {
+		w.compressor.Close() //nolint:errcheck
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions holds the configuration for the CORS middleware.
+type CORSOptions struct {
+	// AllowedOrigins holds the origins that may make cross-origin requests.
+	// A value of "*" allows any origin. If empty, no origins are allowed.
+	AllowedOrigins []string
+	// AllowedMethods holds the methods permitted for cross-origin requests.
+	// If empty, GET, HEAD and POST are permitted.
+	AllowedMethods []string
+	// AllowedHeaders holds the request headers permitted for cross-origin
+	// requests. If empty, the headers requested by the client in a preflight
+	// request are permitted.
+	AllowedHeaders []string
+	// ExposedHeaders holds the response headers that the client is permitted
+	// to access.
+	ExposedHeaders []string
+	// AllowCredentials indicates whether the request can include user
+	// credentials such as cookies.
+	AllowCredentials bool
+	// MaxAge is how long the results of a preflight request may be cached. If
+	// zero, no caching time is sent.
+	MaxAge time.Duration
+}
+
+// CORS returns middleware that implements Cross-Origin Resource Sharing.
+// Preflight requests are answered directly and not passed on.
+func CORS(options CORSOptions) Middleware {
+	anyOrigin := false
+	origins := make(map[string]bool)
+	for _, one := range options.AllowedOrigins {
+		if one == "*" {
+			anyOrigin = true
+		}
+		origins[strings.ToLower(one)] = true
+	}
+	methods := options.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	allowedMethods := strings.Join(methods, ", ")
+	allowedHeaders := strings.Join(options.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(options.ExposedHeaders, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if origin == "" || !(anyOrigin || origins[strings.ToLower(origin)]) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if anyOrigin && !options.AllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if options.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				h.Set("Access-Control-Allow-Methods", allowedMethods)
+				if allowedHeaders != "" {
+					h.Set("Access-Control-Allow-Headers", allowedHeaders)
+				} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					h.Set("Access-Control-Allow-Headers", requested)
+				}
+				if options.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", strconv.Itoa(int(options.MaxAge/time.Second)))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if exposedHeaders != "" {
+				h.Set("Access-Control-Expose-Headers", exposedHeaders)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
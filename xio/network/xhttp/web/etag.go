@@ -0,0 +1,159 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/websocket"
+)
+
+// ETag returns middleware that adds a strong ETag, computed from the response
+// body, to successful GET responses that don't already have one, and answers
+// conditional requests whose If-None-Match matches with a 304. The response is
+// buffered until the handler completes. Handlers that flush or hijack the
+// response, such as those serving server-sent events or WebSockets, are
+// passed through without an ETag. HEAD requests are also passed through, as
+// their empty body would not produce the same ETag as the matching GET.
+func ETag() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodGet || websocket.IsUpgradeRequest(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			bw := &bufferedResponseWriter{original: w}
+			next.ServeHTTP(bw, req)
+			if bw.passthrough {
+				return
+			}
+			status := bw.Status()
+			if status == http.StatusOK {
+				h := w.Header()
+				etag := h.Get("ETag")
+				if etag == "" {
+					etag = ContentETag(bw.buffer.Bytes())
+					h.Set("ETag", etag)
+				}
+				if ETagMatches(req.Header.Get("If-None-Match"), etag) {
+					h.Del("Content-Type")
+					h.Del("Content-Length")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			w.WriteHeader(status)
+			w.Write(bw.buffer.Bytes()) //nolint:errcheck
+		})
+	}
+}
+
+// ContentETag returns a strong ETag value derived from the content.
+func ContentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+// ETagMatches returns true if the If-None-Match header value matches the
+// ETag, using weak comparison as required for If-None-Match.
+func ETagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, one := range strings.Split(ifNoneMatch, ",") {
+		one = strings.TrimSpace(one)
+		if one == "*" || strings.TrimPrefix(one, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedResponseWriter holds the response body until the handler completes,
+// unless the handler flushes or hijacks, in which case everything is passed
+// through to the original writer from then on. Headers are shared with the
+// original writer, as nothing reaches the client until the status is written.
+type bufferedResponseWriter struct {
+	original    http.ResponseWriter
+	buffer      bytes.Buffer
+	status      int
+	passthrough bool
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.original.Header()
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	if w.passthrough {
+		return w.original.Write(data)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buffer.Write(data)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Flush implements http.Flusher.
+func (w *bufferedResponseWriter) Flush() {
+	if !w.passthrough {
+		w.passthrough = true
+		w.original.WriteHeader(w.Status())
+		w.original.Write(w.buffer.Bytes()) //nolint:errcheck
+		w.buffer.Reset()
+	}
+	if f, ok := w.original.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker. Returns http.ErrNotSupported if the
+// original http.ResponseWriter does not support hijacking.
+func (w *bufferedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.original.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.passthrough = true
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher. Returns http.ErrNotSupported if the original
+// http.ResponseWriter does not support server push.
+func (w *bufferedResponseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := w.original.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
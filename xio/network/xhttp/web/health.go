@@ -0,0 +1,216 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// Default paths the web.Server uses for its health and metrics handlers.
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	MetricsPath = "/metrics"
+)
+
+// DefaultHealthCheckTimeout is the default amount of time a single health
+// check is given to complete.
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// HealthCheck is called to determine whether some part of the system is
+// healthy. It should return nil if it is, or an error describing the problem
+// if not.
+type HealthCheck func(ctx context.Context) error
+
+// Health tracks the liveness and readiness of a service. Liveness checks
+// determine whether the process is working at all, while readiness checks
+// determine whether it should be sent traffic. A service that is shutting down
+// remains live, but is no longer ready.
+type Health struct {
+	// Timeout is the maximum amount of time each check is given. Defaults to
+	// DefaultHealthCheckTimeout.
+	Timeout      time.Duration
+	lock         sync.RWMutex
+	liveness     map[string]HealthCheck
+	readiness    map[string]HealthCheck
+	shuttingDown bool
+}
+
+// NewHealth creates a new Health with no checks.
+func NewHealth() *Health {
+	return &Health{
+		liveness:  make(map[string]HealthCheck),
+		readiness: make(map[string]HealthCheck),
+	}
+}
+
+// AddLivenessCheck adds a named check that must pass for the service to be
+// considered live. Liveness checks are also readiness checks. Adding a check
+// with the same name as an existing one replaces it.
+func (h *Health) AddLivenessCheck(name string, check HealthCheck) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.liveness[name] = check
+}
+
+// AddReadinessCheck adds a named check that must pass for the service to be
+// considered ready. Adding a check with the same name as an existing one
+// replaces it.
+func (h *Health) AddReadinessCheck(name string, check HealthCheck) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.readiness[name] = check
+}
+
+// RemoveCheck removes the named liveness and readiness checks.
+func (h *Health) RemoveCheck(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.liveness, name)
+	delete(h.readiness, name)
+}
+
+// SetShuttingDown marks the service as shutting down (or not), which causes
+// readiness to fail regardless of the checks. The web.Server calls this
+// automatically at the start of Shutdown().
+func (h *Health) SetShuttingDown(shuttingDown bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.shuttingDown = shuttingDown
+}
+
+// ShuttingDown returns true if the service has been marked as shutting down.
+func (h *Health) ShuttingDown() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.shuttingDown
+}
+
+// Live runs the liveness checks and returns the failures, keyed by check name.
+func (h *Health) Live(ctx context.Context) map[string]error {
+	_, failures := h.run(ctx, false)
+	return failures
+}
+
+// Ready runs the liveness and readiness checks and returns the failures, keyed
+// by check name.
+func (h *Health) Ready(ctx context.Context) map[string]error {
+	_, failures := h.run(ctx, true)
+	return failures
+}
+
+// LivenessHandler returns a handler that responds with 200 if all liveness
+// checks pass and 503 if not. The body lists the result of each check.
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.respond(w, req, false)
+	})
+}
+
+// ReadinessHandler returns a handler that responds with 200 if all liveness
+// and readiness checks pass and the service isn't shutting down, and 503 if
+// not. The body lists the result of each check.
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.respond(w, req, true)
+	})
+}
+
+func (h *Health) respond(w http.ResponseWriter, req *http.Request, ready bool) {
+	names, failures := h.run(req.Context(), ready)
+	var buffer strings.Builder
+	for _, name := range names {
+		if err, failed := failures[name]; failed {
+			fmt.Fprintf(&buffer, "[-] %s: %s\n", name, err)
+		} else {
+			fmt.Fprintf(&buffer, "[+] %s ok\n", name)
+		}
+	}
+	status := http.StatusOK
+	if len(failures) != 0 {
+		status = http.StatusServiceUnavailable
+		buffer.WriteString("failed\n")
+	} else {
+		buffer.WriteString("ok\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprint(w, buffer.String())
+}
+
+func (h *Health) run(ctx context.Context, ready bool) (names []string, failures map[string]error) {
+	h.lock.RLock()
+	checks := make(map[string]HealthCheck, len(h.liveness)+len(h.readiness))
+	for name, check := range h.liveness {
+		checks[name] = check
+	}
+	if ready {
+		for name, check := range h.readiness {
+			checks[name] = check
+		}
+	}
+	shuttingDown := h.shuttingDown
+	timeout := h.Timeout
+	h.lock.RUnlock()
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	failures = make(map[string]error)
+	if ready && shuttingDown {
+		failures["shutdown"] = errs.New("shutting down")
+		names = append(names, "shutdown")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		names = append(names, name)
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+			if err := runCheck(ctx, check); err != nil {
+				lock.Lock()
+				failures[name] = err
+				lock.Unlock()
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	sort.Strings(names)
+	return names, failures
+}
+
+func runCheck(ctx context.Context, check HealthCheck) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- errs.Newf("panic: %v", recovered)
+			}
+		}()
+		done <- check(ctx)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return errs.NewWithCause("timed out", ctx.Err())
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := web.NewMetrics(0.1, 1)
+	inFlight := make(chan int64, 1)
+	api := web.NewRouter()
+	api.Get("/users/:id", func(w http.ResponseWriter, req *http.Request) {
+		inFlight <- m.InFlight("/api/users/:id")
+		fmt.Fprint(w, web.RoutePattern(req))
+	})
+	r := web.NewRouter()
+	r.Mount("/api", api)
+	h := m.Middleware(r)
+
+	w := serve(h, http.MethodGet, "/api/users/1")
+	assert.Equal(t, "/api/users/:id", w.Body.String())
+	assert.Equal(t, int64(1), <-inFlight)
+	serve(h, http.MethodGet, "/api/users/2")
+	<-inFlight
+	serve(h, http.MethodGet, "/nowhere")
+	assert.Equal(t, int64(0), m.InFlight("/api/users/:id"))
+	assert.Equal(t, uint64(2), m.Requests("/api/users/:id", http.MethodGet, http.StatusOK))
+	assert.Equal(t, uint64(1), m.Requests("", http.MethodGet, http.StatusNotFound))
+
+	w = serve(m, http.MethodGet, "/metrics")
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE http_requests_total counter\n")
+	assert.Contains(t, body, `http_requests_total{route="/api/users/:id",method="GET",code="200"} 2`+"\n")
+	assert.Contains(t, body, `http_requests_total{route="unmatched",method="GET",code="404"} 1`+"\n")
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{route="/api/users/:id",method="GET",le="1"} 2`+"\n")
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{route="/api/users/:id",method="GET",le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, `http_request_duration_seconds_count{route="/api/users/:id",method="GET"} 2`+"\n")
+	assert.Contains(t, body, `http_requests_in_flight{route="/api/users/:id"} 0`+"\n")
+}
+
+func TestHealth(t *testing.T) {
+	h := web.NewHealth()
+	h.AddLivenessCheck("process", func(ctx context.Context) error { return nil })
+	var dbErr error
+	h.AddReadinessCheck("database", func(ctx context.Context) error { return dbErr })
+
+	w := serve(h.LivenessHandler(), http.MethodGet, "/healthz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[+] process ok\nok\n", w.Body.String())
+	w = serve(h.ReadinessHandler(), http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	dbErr = errors.New("connection refused")
+	w = serve(h.LivenessHandler(), http.MethodGet, "/healthz")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve(h.ReadinessHandler(), http.MethodGet, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "[-] database: connection refused\n[+] process ok\nfailed\n", w.Body.String())
+	assert.Len(t, h.Ready(context.Background()), 1)
+
+	dbErr = nil
+	h.Timeout = 10 * time.Millisecond
+	h.AddReadinessCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	failures := h.Ready(context.Background())
+	require.Contains(t, failures, "slow")
+	assert.Contains(t, failures["slow"].Error(), "timed out")
+	h.RemoveCheck("slow")
+	assert.Empty(t, h.Ready(context.Background()))
+}
+
+func TestServerReadinessDuringShutdown(t *testing.T) {
+	s := &web.Server{
+		WebServer: &http.Server{
+			Addr:    "127.0.0.1",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		},
+		Health:              web.NewHealth(),
+		Metrics:             web.NewMetrics(),
+		ShutdownDrainPeriod: 200 * time.Millisecond,
+		StartedChan:         make(chan interface{}),
+	}
+	go s.Run() //nolint:errcheck
+	<-s.StartedChan
+	get := func(p string) (int, string) {
+		resp, err := http.Get(s.LocalBaseURL() + p)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, string(data)
+	}
+	status, _ := get(web.ReadyzPath)
+	assert.Equal(t, http.StatusOK, status)
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	status, _ = get(web.ReadyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = get(web.HealthzPath)
+	assert.Equal(t, http.StatusOK, status)
+	_, body := get(web.MetricsPath)
+	assert.True(t, strings.Contains(body, `http_requests_total{route="/readyz",method="GET",code="503"} 1`), body)
+	<-done
+}
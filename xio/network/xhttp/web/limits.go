@@ -0,0 +1,47 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+)
+
+// Timeout returns middleware that limits the time a handler may take to
+// produce its response. If the limit is exceeded, the client receives a 503
+// and the request's context is canceled. Note that the response is buffered
+// until the handler completes, so this should not be used with handlers that
+// stream their output.
+func Timeout(limit time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, limit, http.StatusText(http.StatusServiceUnavailable))
+	}
+}
+
+// MaxBodySize returns middleware that limits the size of request bodies. If
+// the request declares a larger Content-Length, a 413 is returned without
+// calling the handler. Otherwise, reads from the body will fail once the
+// limit is exceeded.
+func MaxBodySize(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.ContentLength > limit {
+				xhttp.WriteHTTPStatus(w, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if req.Body != nil {
+				req.Body = http.MaxBytesReader(w, req.Body, limit)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio/network"
+)
+
+// Constants for the networks a Listener may use.
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
+)
+
+// Listener describes an additional address for the Server to listen on.
+type Listener struct {
+	// Network is the network to listen on, such as "tcp", "tcp4", "tcp6" or
+	// "unix". Defaults to "tcp".
+	Network string
+	// Address is the address to listen on. For TCP networks, this is a
+	// host:port pair. For unix domain sockets, this is the path to the socket,
+	// which will be replaced if it already exists.
+	Address string
+	// Plain forces this listener to serve plain HTTP, even if the server is
+	// serving HTTPS on its other listeners. Useful for local sidecars on unix
+	// domain sockets.
+	Plain bool
+	// RedirectToHTTPS causes this listener to respond to all requests with a
+	// redirect to the same URL on the server's HTTPS port, rather than
+	// serving the server's handler. Only meaningful when the server is
+	// serving HTTPS.
+	RedirectToHTTPS bool
+}
+
+type boundListener struct {
+	listener net.Listener
+	network  string
+	plain    bool
+	redirect bool
+}
+
+func (b *boundListener) address() string {
+	if b.network == NetworkUnix {
+		return "unix:" + b.listener.Addr().String()
+	}
+	return b.listener.Addr().String()
+}
+
+func (b *boundListener) port() int {
+	if tcp, ok := b.listener.Addr().(*net.TCPAddr); ok {
+		return tcp.Port
+	}
+	return 0
+}
+
+func listen(spec Listener) (*boundListener, error) {
+	netType := spec.Network
+	if netType == "" {
+		netType = NetworkTCP
+	}
+	if netType == NetworkUnix {
+		if fi, err := os.Lstat(spec.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(spec.Address); err != nil {
+				return nil, errs.Wrap(err)
+			}
+		}
+	}
+	ln, err := net.Listen(netType, spec.Address)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return newBoundListener(ln, spec.Plain, spec.RedirectToHTTPS), nil
+}
+
+func newBoundListener(ln net.Listener, plain, redirect bool) *boundListener {
+	b := &boundListener{
+		listener: ln,
+		network:  ln.Addr().Network(),
+		plain:    plain || redirect,
+		redirect: redirect,
+	}
+	if tcp, ok := ln.(*net.TCPListener); ok {
+		b.listener = network.TCPKeepAliveListener{TCPListener: tcp}
+		b.network = NetworkTCP
+	}
+	return b
+}
+
+func (s *Server) listenPrimary() (host string, err error) {
+	if s.SystemdListeners {
+		var inherited []net.Listener
+		if inherited, err = network.SystemdListeners(); err != nil {
+			return "", err
+		}
+		if len(inherited) != 0 {
+			for _, ln := range inherited {
+				s.listeners = append(s.listeners, newBoundListener(ln, false, false))
+			}
+			if tcp, ok := inherited[0].Addr().(*net.TCPAddr); ok && !tcp.IP.IsUnspecified() {
+				host = tcp.IP.String()
+			}
+			return host, nil
+		}
+	}
+	var ln net.Listener
+	if host, _, err = net.SplitHostPort(s.WebServer.Addr); err == nil {
+		ln, err = net.Listen(NetworkTCP, s.WebServer.Addr)
+	} else {
+		host = s.WebServer.Addr
+		ports := s.Ports
+		if len(ports) == 0 {
+			ports = []int{0}
+		}
+		for _, one := range ports {
+			if ln, err = net.Listen(NetworkTCP, net.JoinHostPort(s.WebServer.Addr, strconv.Itoa(one))); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	s.listeners = append(s.listeners, newBoundListener(ln, false, false))
+	return host, nil
+}
+
+func (s *Server) closeListeners() {
+	for _, one := range s.listeners {
+		one.listener.Close() //nolint:errcheck
+	}
+	s.listeners = nil
+}
+
+func (s *Server) redirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if s.port != 443 && s.port != 0 {
+			host = net.JoinHostPort(host, strconv.Itoa(s.port))
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		target := *req.URL
+		target.Scheme = ProtocolHTTPS
+		target.Host = host
+		http.Redirect(w, req, target.String(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipleListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockets")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) //nolint:errcheck
+	sockPath := filepath.Join(dir, "web.sock")
+	s := &web.Server{
+		SelfSigned: true,
+		WebServer: &http.Server{
+			Addr: "127.0.0.1",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprint(w, req.URL.Path)
+			}),
+		},
+		Listeners: []web.Listener{
+			{Network: web.NetworkUnix, Address: sockPath, Plain: true},
+			{Address: "127.0.0.1:0", RedirectToHTTPS: true},
+		},
+		StartedChan: make(chan interface{}),
+	}
+	go s.Run() //nolint:errcheck
+	<-s.StartedChan
+	defer s.Shutdown()
+
+	addresses := s.Addresses()
+	require.Len(t, addresses, 3)
+	assert.Equal(t, "unix:"+sockPath, addresses[1])
+	assert.True(t, strings.HasPrefix(addresses[2], "127.0.0.1:"))
+	assert.Contains(t, s.String(), "unix:"+sockPath+" (http)")
+	assert.Contains(t, s.String(), addresses[2]+" (redirect to https)")
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, web.NetworkUnix, sockPath)
+		},
+	}}
+	resp, err := client.Get("http://unix/over/socket")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "/over/socket", string(data))
+
+	client = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.Get("http://" + addresses[2] + "/some/path?q=1")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("https://127.0.0.1:%d/some/path?q=1", s.Port()), resp.Header.Get("Location"))
+}
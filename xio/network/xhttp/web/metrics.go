@@ -0,0 +1,273 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+)
+
+// UnmatchedRoute is the route label used in metrics for requests that were not
+// matched by a Router.
+const UnmatchedRoute = "unmatched"
+
+// DefaultLatencyBuckets holds the default upper bounds, in seconds, of the
+// request latency histogram buckets.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type latencyKey struct {
+	route  string
+	method string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics holds a registry of per-route request counts, latency histograms
+// and in-flight gauges. Routes are identified by their Router pattern, as
+// returned by RoutePattern(), so that path parameters don't create a new set
+// of metrics for every distinct path. It implements http.Handler, which writes
+// the metrics in the Prometheus text exposition format.
+type Metrics struct {
+	lock      sync.Mutex
+	buckets   []float64
+	requests  map[requestKey]uint64
+	bytes     map[latencyKey]uint64
+	latencies map[latencyKey]*histogram
+	inFlight  map[string]int64
+}
+
+// NewMetrics creates a new, empty metrics registry. The buckets are the upper
+// bounds, in seconds, of the latency histogram buckets. If none are provided,
+// DefaultLatencyBuckets will be used.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	return &Metrics{
+		buckets:   b,
+		requests:  make(map[requestKey]uint64),
+		bytes:     make(map[latencyKey]uint64),
+		latencies: make(map[latencyKey]*histogram),
+		inFlight:  make(map[string]int64),
+	}
+}
+
+// InFlight returns the number of requests currently being processed for the
+// route.
+func (m *Metrics) InFlight(route string) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.inFlight[routeLabel(route)]
+}
+
+// Requests returns the number of completed requests for the route, method and
+// status code.
+func (m *Metrics) Requests(route, method string, status int) uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.requests[requestKey{route: routeLabel(route), method: method, status: status}]
+}
+
+// Middleware returns middleware that records metrics for each request that
+// passes through it. The web.Server applies this automatically when its
+// Metrics field is set.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started := time.Now()
+		rt, req := routeFromRequest(req)
+		sw := newStatusWriter(w, req)
+		current := m.track(rt)
+		defer func() {
+			m.untrack(current)
+			m.Observe(rt.pattern, req.Method, sw.Status(), sw.BytesWritten(), time.Since(started))
+		}()
+		next.ServeHTTP(sw, req)
+	})
+}
+
+// track registers the request as in-flight for its current route and arranges
+// for it to move to a new route whenever a Router matches it.
+func (m *Metrics) track(rt *route) *string {
+	current := routeLabel(rt.pattern)
+	m.lock.Lock()
+	m.inFlight[current]++
+	m.lock.Unlock()
+	previous := rt.matched
+	rt.matched = func() {
+		label := routeLabel(rt.pattern)
+		m.lock.Lock()
+		m.inFlight[current]--
+		m.inFlight[label]++
+		current = label
+		m.lock.Unlock()
+		if previous != nil {
+			previous()
+		}
+	}
+	return &current
+}
+
+func (m *Metrics) untrack(current *string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.inFlight[*current]--
+}
+
+// Observe records a completed request.
+func (m *Metrics) Observe(route, method string, status, bytesWritten int, elapsed time.Duration) {
+	route = routeLabel(route)
+	seconds := elapsed.Seconds()
+	lk := latencyKey{route: route, method: method}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests[requestKey{route: route, method: method, status: status}]++
+	m.bytes[lk] += uint64(bytesWritten)
+	h, ok := m.latencies[lk]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latencies[lk] = h
+	}
+	for i, upper := range m.buckets {
+		if seconds <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	m.WriteTo(w) //nolint:errcheck
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(out io.Writer) (int64, error) {
+	var w bytes.Buffer
+	m.lock.Lock()
+
+	fmt.Fprintln(&w, "# HELP http_requests_total Total number of HTTP requests processed.")
+	fmt.Fprintln(&w, "# TYPE http_requests_total counter")
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, k := range requestKeys {
+		fmt.Fprintf(&w, "http_requests_total{route=%s,method=%s,code=\"%d\"} %d\n", quoteLabel(k.route), quoteLabel(k.method), k.status, m.requests[k])
+	}
+
+	latencyKeys := make([]latencyKey, 0, len(m.latencies))
+	for k := range m.latencies {
+		latencyKeys = append(latencyKeys, k)
+	}
+	sort.Slice(latencyKeys, func(i, j int) bool {
+		a, b := latencyKeys[i], latencyKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+	fmt.Fprintln(&w, "# HELP http_request_duration_seconds Latency of HTTP requests.")
+	fmt.Fprintln(&w, "# TYPE http_request_duration_seconds histogram")
+	for _, k := range latencyKeys {
+		h := m.latencies[k]
+		labels := "route=" + quoteLabel(k.route) + ",method=" + quoteLabel(k.method)
+		for i, upper := range m.buckets {
+			fmt.Fprintf(&w, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(upper), h.counts[i])
+		}
+		fmt.Fprintf(&w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&w, "http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(&w, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	fmt.Fprintln(&w, "# HELP http_response_size_bytes_total Total number of bytes written in HTTP response bodies.")
+	fmt.Fprintln(&w, "# TYPE http_response_size_bytes_total counter")
+	for _, k := range latencyKeys {
+		fmt.Fprintf(&w, "http_response_size_bytes_total{route=%s,method=%s} %d\n", quoteLabel(k.route), quoteLabel(k.method), m.bytes[k])
+	}
+
+	fmt.Fprintln(&w, "# HELP http_requests_in_flight Number of HTTP requests currently being processed.")
+	fmt.Fprintln(&w, "# TYPE http_requests_in_flight gauge")
+	routes := make([]string, 0, len(m.inFlight))
+	for k := range m.inFlight {
+		routes = append(routes, k)
+	}
+	sort.Strings(routes)
+	for _, k := range routes {
+		fmt.Fprintf(&w, "http_requests_in_flight{route=%s} %d\n", quoteLabel(k), m.inFlight[k])
+	}
+	m.lock.Unlock()
+	return w.WriteTo(out)
+}
+
+func newStatusWriter(w http.ResponseWriter, req *http.Request) *xhttp.StatusResponseWriter {
+	if sw, ok := w.(*xhttp.StatusResponseWriter); ok {
+		return sw
+	}
+	return &xhttp.StatusResponseWriter{
+		Original: w,
+		Head:     req.Method == http.MethodHead,
+	}
+}
+
+func routeLabel(route string) string {
+	if route == "" {
+		return UnmatchedRoute
+	}
+	return route
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,30 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import "net/http"
+
+// Middleware wraps an http.Handler to provide additional behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Chain combines multiple middleware into one. The first middleware given is
+// the outermost.
+func Chain(middleware ...Middleware) Middleware {
+	return func(handler http.Handler) http.Handler {
+		return wrap(handler, middleware)
+	}
+}
+
+func wrap(handler http.Handler, middleware []Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
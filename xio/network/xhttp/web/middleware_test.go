@@ -0,0 +1,176 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hello(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprint(w, strings.Repeat("hello ", 100))
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := web.RequestID()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = web.RequestIDFrom(req)
+	}))
+	w := serve(h, http.MethodGet, "/")
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, w.Header().Get(web.RequestIDHeader))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(web.RequestIDHeader, "abc")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "abc", seen)
+}
+
+func TestDeflate(t *testing.T) {
+	h := web.Deflate(-1)(http.HandlerFunc(hello))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	r, err := zlib.NewReader(w.Body)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("hello ", 100), string(data))
+	w = serve(h, http.MethodGet, "/")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strings.Repeat("hello ", 100), w.Body.String())
+}
+
+func TestCORS(t *testing.T) {
+	h := web.CORS(web.CORSOptions{AllowedOrigins: []string{"https://example.com"}, AllowedMethods: []string{http.MethodPut}})(http.HandlerFunc(hello))
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, http.MethodPut, w.Header().Get("Access-Control-Allow-Methods"))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://other.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	h := web.MaxBodySize(4)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("too long")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("too long"))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestETag(t *testing.T) {
+	h := web.Chain(web.SecurityHeaders(web.DefaultSecurityHeaderOptions()), web.ETag())(http.HandlerFunc(hello))
+	w := serve(h, http.MethodGet, "/")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestETagKeepsOuterHeaders(t *testing.T) {
+	h := web.Chain(web.Deflate(-1), web.ETag())(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		hello(w, req)
+	}))
+	w := serve(h, http.MethodGet, "/")
+	assert.Equal(t, []string{"Accept-Encoding", "Origin"}, w.Header()["Vary"])
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+}
+
+func TestETagSkipsHead(t *testing.T) {
+	h := web.ETag()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	w := serve(h, http.MethodHead, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestETagPassesThroughFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	h := web.ETag()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(rw, "data: one\n\n")
+		rw.(http.Flusher).Flush()
+		assert.Equal(t, "data: one\n\n", w.Body.String())
+		fmt.Fprint(rw, "data: two\n\n")
+	}))
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "data: one\n\ndata: two\n\n", w.Body.String())
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func checkWebSocketThrough(t *testing.T, middleware web.Middleware) {
+	server := httptest.NewServer(middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		if msgType, data, err := conn.ReadMessage(); err == nil {
+			conn.WriteMessage(msgType, data) //nolint:errcheck
+			conn.ReadMessage()               //nolint:errcheck // Wait for the client to close
+		}
+	})))
+	defer server.Close()
+	header := make(http.Header)
+	header.Set("Accept-Encoding", "deflate")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), header, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hi")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+	conn.Close(websocket.CloseNormal, "") //nolint:errcheck
+}
+
+func TestETagWebSocket(t *testing.T) {
+	checkWebSocketThrough(t, web.ETag())
+}
+
+func TestDeflateWebSocket(t *testing.T) {
+	checkWebSocketThrough(t, web.Chain(web.Deflate(-1), web.ETag()))
+}
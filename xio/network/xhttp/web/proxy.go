@@ -0,0 +1,462 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/log/logadapter"
+	"github.com/richardwilkes/toolbox/xio"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+)
+
+// Defaults for the ReverseProxy.
+const (
+	DefaultUpstreamCheckInterval = 10 * time.Second
+	DefaultUpstreamCheckTimeout  = 2 * time.Second
+	DefaultMirrorTimeout         = 10 * time.Second
+	DefaultMirrorMaxBody         = 1024 * 1024
+)
+
+// BalancePolicy determines how a ReverseProxy chooses between its upstreams.
+type BalancePolicy int
+
+// Possible values for BalancePolicy.
+const (
+	// RoundRobin sends requests to each healthy upstream in turn.
+	RoundRobin BalancePolicy = iota
+	// LeastConnections sends requests to the healthy upstream with the fewest
+	// requests in progress, choosing randomly between ties.
+	LeastConnections
+	// RandomUpstream sends requests to a randomly chosen healthy upstream.
+	RandomUpstream
+)
+
+// HeaderRewrite describes changes to make to a set of headers. Removals are
+// applied first, then sets, then additions.
+type HeaderRewrite struct {
+	Remove []string
+	Set    map[string]string
+	Add    map[string]string
+}
+
+func (h *HeaderRewrite) apply(header http.Header) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
+
+// UpstreamStatus holds the current status of one of a ReverseProxy's
+// upstreams.
+type UpstreamStatus struct {
+	URL     string
+	Healthy bool
+	Active  int64
+}
+
+type upstream struct {
+	url     *url.URL
+	healthy int32
+	active  int64
+}
+
+type upstreamCtxKey int
+
+var upstreamKey upstreamCtxKey = 1
+
+// ReverseProxy forwards requests to one or more upstream servers. It writes
+// through the http.ResponseWriter it is given, so the status and size of
+// proxied responses appear in the web.Server's access log, and WebSocket and
+// other protocol upgrades are passed through via the writer's http.Hijacker.
+type ReverseProxy struct {
+	// Policy determines how upstreams are chosen. Defaults to RoundRobin.
+	Policy BalancePolicy
+	// UseRemainingPath forwards the request's RemainingPath(), rather than
+	// its full path, so that a proxy mounted on a Router below some prefix
+	// does not pass that prefix along.
+	UseRemainingPath bool
+	// PreserveHost forwards the request's original Host header rather than
+	// that of the upstream.
+	PreserveHost bool
+	// RequestHeaders is applied to requests before they are forwarded.
+	RequestHeaders HeaderRewrite
+	// ResponseHeaders is applied to responses before they are returned.
+	ResponseHeaders HeaderRewrite
+	// Rewrite, if set, is called to make further changes to each request
+	// after it has been directed at its upstream.
+	Rewrite func(req *http.Request)
+	// HealthCheckPath, if set, enables active health checks once
+	// StartHealthChecks() is called. Upstreams that fail to respond to a GET
+	// of this path with a 2xx or 3xx status are taken out of rotation until
+	// they pass again.
+	HealthCheckPath string
+	// HealthCheckInterval is the time between health checks. Defaults to
+	// DefaultUpstreamCheckInterval.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout is the maximum time allowed for each health check.
+	// Defaults to DefaultUpstreamCheckTimeout.
+	HealthCheckTimeout time.Duration
+	// Mirror, if set, receives a copy of each request, whose response is
+	// discarded. Mirrored requests are sent asynchronously and never affect
+	// the response sent to the client. Protocol upgrades are not mirrored.
+	Mirror *url.URL
+	// MirrorMaxBody is the largest request body that will be mirrored.
+	// Requests with larger bodies are not mirrored. Defaults to
+	// DefaultMirrorMaxBody.
+	MirrorMaxBody int64
+	// MirrorTimeout is the maximum time allowed for each mirrored request.
+	// Defaults to DefaultMirrorTimeout.
+	MirrorTimeout time.Duration
+	// Transport is used to make the requests. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+	// FlushInterval is passed to httputil.ReverseProxy. A negative value
+	// flushes after each write, which is useful for streaming responses.
+	FlushInterval time.Duration
+	// Logger receives errors encountered while proxying. Defaults to
+	// discarding them. Messages are prefixed with the request ID when the
+	// RequestID middleware is in use.
+	Logger    logadapter.Logger
+	upstreams []*upstream
+	next      uint64
+	proxy     *httputil.ReverseProxy
+	once      sync.Once
+	stop      chan struct{}
+	stopInit  sync.Once
+	stopOnce  sync.Once
+}
+
+// NewReverseProxy creates a new ReverseProxy for the upstream base URLs.
+func NewReverseProxy(upstreams ...string) (*ReverseProxy, error) {
+	if len(upstreams) == 0 {
+		return nil, errs.New("at least one upstream is required")
+	}
+	p := &ReverseProxy{}
+	for _, one := range upstreams {
+		u, err := url.Parse(one)
+		if err != nil {
+			return nil, errs.NewWithCause(one, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errs.Newf("upstream must be an http or https URL: %s", one)
+		}
+		p.upstreams = append(p.upstreams, &upstream{url: u, healthy: 1})
+	}
+	return p, nil
+}
+
+// Upstreams returns the current status of each upstream.
+func (p *ReverseProxy) Upstreams() []UpstreamStatus {
+	status := make([]UpstreamStatus, len(p.upstreams))
+	for i, u := range p.upstreams {
+		status[i] = UpstreamStatus{
+			URL:     u.url.String(),
+			Healthy: atomic.LoadInt32(&u.healthy) != 0,
+			Active:  atomic.LoadInt64(&u.active),
+		}
+	}
+	return status
+}
+
+// StartHealthChecks starts checking the health of the upstreams in the
+// background, if HealthCheckPath is set. An initial check is run before
+// returning.
+func (p *ReverseProxy) StartHealthChecks() {
+	if p.HealthCheckPath == "" {
+		return
+	}
+	p.CheckHealth()
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultUpstreamCheckInterval
+	}
+	stop := p.stopChan()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.CheckHealth()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops any background health checks.
+func (p *ReverseProxy) Close() {
+	stop := p.stopChan()
+	p.stopOnce.Do(func() { close(stop) })
+}
+
+func (p *ReverseProxy) stopChan() chan struct{} {
+	p.stopInit.Do(func() { p.stop = make(chan struct{}) })
+	return p.stop
+}
+
+// CheckHealth checks each upstream once and updates its health.
+func (p *ReverseProxy) CheckHealth() {
+	timeout := p.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = DefaultUpstreamCheckTimeout
+	}
+	client := &http.Client{Transport: p.transport(), Timeout: timeout}
+	var wg sync.WaitGroup
+	for _, one := range p.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			target := *u.url
+			target.Path = joinURLPath(target.Path, p.HealthCheckPath)
+			var healthy int32
+			if resp, err := client.Get(target.String()); err == nil {
+				io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024)) //nolint:errcheck
+				xio.CloseIgnoringErrors(resp.Body)
+				if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+					healthy = 1
+				}
+			}
+			if atomic.SwapInt32(&u.healthy, healthy) != healthy {
+				state := "healthy"
+				if healthy == 0 {
+					state = "unhealthy"
+				}
+				p.logger().Infof("upstream %s is now %s", u.url, state)
+			}
+		}(one)
+	}
+	wg.Wait()
+}
+
+// ServeHTTP implements http.Handler.
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.once.Do(p.init)
+	u := p.choose()
+	if u == nil {
+		RequestLogger(req, p.logger()).Warn("no healthy upstream for ", req.URL.Path)
+		xhttp.WriteHTTPStatus(w, http.StatusServiceUnavailable)
+		return
+	}
+	if p.Mirror != nil && !isUpgrade(req) {
+		p.mirror(req)
+	}
+	atomic.AddInt64(&u.active, 1)
+	defer atomic.AddInt64(&u.active, -1)
+	p.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), upstreamKey, u)))
+}
+
+func (p *ReverseProxy) init() {
+	p.proxy = &httputil.ReverseProxy{
+		Director:      p.direct,
+		Transport:     p.transport(),
+		FlushInterval: p.FlushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			p.ResponseHeaders.apply(resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			status := http.StatusBadGateway
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			if req.Context().Err() == context.Canceled {
+				return
+			}
+			u, _ := req.Context().Value(upstreamKey).(*upstream) //nolint:errcheck
+			RequestLogger(req, p.logger()).Warn(errs.NewWithCausef(err, "unable to proxy to %s", u.url))
+			xhttp.WriteHTTPStatus(w, status)
+		},
+	}
+}
+
+func (p *ReverseProxy) direct(req *http.Request) {
+	u, ok := req.Context().Value(upstreamKey).(*upstream)
+	if !ok {
+		return
+	}
+	p.target(req, u.url)
+}
+
+func (p *ReverseProxy) target(req *http.Request, target *url.URL) {
+	reqPath := req.URL.Path
+	if p.UseRemainingPath {
+		reqPath = "/" + strings.TrimPrefix(RemainingPath(req), "/")
+	}
+	originalHost := req.Host
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = joinURLPath(target.Path, reqPath)
+	req.URL.RawPath = ""
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Prevent the default user agent from being added.
+		req.Header.Set("User-Agent", "")
+	}
+	if !p.PreserveHost {
+		req.Host = target.Host
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", originalHost)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		if req.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", ProtocolHTTPS)
+		} else {
+			req.Header.Set("X-Forwarded-Proto", ProtocolHTTP)
+		}
+	}
+	if id := RequestIDFrom(req); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	p.RequestHeaders.apply(req.Header)
+	if p.Rewrite != nil {
+		p.Rewrite(req)
+	}
+}
+
+func (p *ReverseProxy) choose() *upstream {
+	healthy := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if atomic.LoadInt32(&u.healthy) != 0 {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	switch p.Policy {
+	case LeastConnections:
+		var best []*upstream
+		var least int64
+		for _, u := range healthy {
+			active := atomic.LoadInt64(&u.active)
+			switch {
+			case len(best) == 0 || active < least:
+				best = append(best[:0], u)
+				least = active
+			case active == least:
+				best = append(best, u)
+			}
+		}
+		return best[rand.Intn(len(best))] //nolint:gosec // Doesn't need a secure source
+	case RandomUpstream:
+		return healthy[rand.Intn(len(healthy))] //nolint:gosec // Doesn't need a secure source
+	default:
+		return healthy[int((atomic.AddUint64(&p.next, 1)-1)%uint64(len(healthy)))]
+	}
+}
+
+func (p *ReverseProxy) mirror(req *http.Request) {
+	maxBody := p.MirrorMaxBody
+	if maxBody <= 0 {
+		maxBody = DefaultMirrorMaxBody
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > maxBody {
+			return
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1))
+		rest := req.Body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{Reader: io.MultiReader(bytes.NewReader(data), rest), Closer: rest}
+		if err != nil || int64(len(data)) > maxBody {
+			return
+		}
+		body = data
+	}
+	timeout := p.MirrorTimeout
+	if timeout <= 0 {
+		timeout = DefaultMirrorTimeout
+	}
+	// Target the shadow while it still carries the original context, so the
+	// remaining path and request ID are honored, then detach it from the
+	// primary request's lifetime.
+	shadow := req.Clone(req.Context())
+	shadow.RequestURI = ""
+	shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	p.target(shadow, p.Mirror)
+	if shadow.Header.Get("User-Agent") == "" {
+		shadow.Header.Del("User-Agent")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	shadow = shadow.WithContext(ctx)
+	go func() {
+		defer cancel()
+		resp, err := p.transport().RoundTrip(shadow)
+		if err != nil {
+			RequestLogger(req, p.logger()).Warn(errs.NewWithCausef(err, "unable to mirror to %s", p.Mirror))
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body) //nolint:errcheck
+		xio.CloseIgnoringErrors(resp.Body)
+	}()
+}
+
+func (p *ReverseProxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return http.DefaultTransport
+}
+
+func (p *ReverseProxy) logger() logadapter.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return &logadapter.Discarder{}
+}
+
+func isUpgrade(req *http.Request) bool {
+	for _, one := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(one), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+func joinURLPath(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return strings.TrimSuffix(a, "/") + "/" + strings.TrimPrefix(b, "/")
+}
@@ -0,0 +1,186 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUpstream(name string, healthy *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/health":
+			if atomic.LoadInt32(healthy) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		case "/ws":
+			conn, err := (&websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}).Upgrade(w, req)
+			if err != nil {
+				return
+			}
+			if _, data, err := conn.ReadMessage(); err == nil {
+				conn.WriteMessage(websocket.TextMessage, append([]byte(name+":"), data...)) //nolint:errcheck
+				conn.ReadMessage()                                                          //nolint:errcheck // Wait for the client to close
+			}
+		default:
+			w.Header().Set("X-Internal", "secret")
+			fmt.Fprintf(w, "%s %s %s %s", name, req.URL.Path, req.Header.Get("X-Env"), req.Header.Get("X-Forwarded-Proto"))
+		}
+	}))
+}
+
+func TestReverseProxy(t *testing.T) {
+	var healthyA, healthyB int32 = 1, 1
+	a := newUpstream("a", &healthyA)
+	defer a.Close()
+	b := newUpstream("b", &healthyB)
+	defer b.Close()
+	p, err := web.NewReverseProxy(a.URL, b.URL)
+	require.NoError(t, err)
+	defer p.Close()
+	p.UseRemainingPath = true
+	p.HealthCheckPath = "/health"
+	p.HealthCheckInterval = time.Hour
+	p.RequestHeaders.Set = map[string]string{"X-Env": "test"}
+	p.ResponseHeaders.Remove = []string{"X-Internal"}
+	p.StartHealthChecks()
+
+	r := web.NewRouter()
+	r.Mount("/api", p)
+	s := &web.Server{
+		WebServer:   &http.Server{Addr: "127.0.0.1", Handler: r},
+		StartedChan: make(chan interface{}),
+	}
+	go s.Run() //nolint:errcheck
+	<-s.StartedChan
+	defer s.Shutdown()
+
+	get := func() (string, http.Header) {
+		resp, err := http.Get(s.LocalBaseURL() + "/api/users")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(data), resp.Header
+	}
+	first, header := get()
+	second, _ := get()
+	assert.Empty(t, header.Get("X-Internal"))
+	assert.ElementsMatch(t, []string{"a /users test http", "b /users test http"}, []string{first, second})
+
+	atomic.StoreInt32(&healthyA, 0)
+	p.CheckHealth()
+	for i := 0; i < 3; i++ {
+		body, _ := get()
+		assert.Equal(t, "b /users test http", body)
+	}
+	status := p.Upstreams()
+	assert.False(t, status[0].Healthy)
+	assert.True(t, status[1].Healthy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.LocalBaseURL(), "http")+"/api/ws", nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hi")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "b:hi", string(data))
+	conn.Close(websocket.CloseNormal, "") //nolint:errcheck
+
+	atomic.StoreInt32(&healthyB, 0)
+	p.CheckHealth()
+	resp, err := http.Get(s.LocalBaseURL() + "/api/users")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestReverseProxyZeroValueClose(t *testing.T) {
+	var p web.ReverseProxy
+	assert.NotPanics(t, p.Close)
+	assert.NotPanics(t, p.Close)
+}
+
+func TestReverseProxyMirror(t *testing.T) {
+	var healthy int32 = 1
+	primary := newUpstream("primary", &healthy)
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body) //nolint:errcheck
+		mirrored <- req.Method + " " + req.URL.Path + " " + string(data)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	p, err := web.NewReverseProxy(primary.URL)
+	require.NoError(t, err)
+	p.Mirror, err = url.Parse(shadow.URL)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("order data")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "primary /orders  http", w.Body.String())
+	select {
+	case got := <-mirrored:
+		assert.Equal(t, "POST /orders order data", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	_, err = web.NewReverseProxy("ftp://example.com")
+	assert.Error(t, err)
+}
+
+func TestReverseProxyMirrorRemainingPath(t *testing.T) {
+	var healthy int32 = 1
+	primary := newUpstream("primary", &healthy)
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mirrored <- req.URL.Path + " " + req.Header.Get(web.RequestIDHeader)
+	}))
+	defer shadow.Close()
+	p, err := web.NewReverseProxy(primary.URL)
+	require.NoError(t, err)
+	p.UseRemainingPath = true
+	p.Mirror, err = url.Parse(shadow.URL)
+	require.NoError(t, err)
+	r := web.NewRouter()
+	r.Mount("/api", p, web.RequestID())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "primary /users  http", w.Body.String())
+	id := w.Header().Get(web.RequestIDHeader)
+	require.NotEmpty(t, id)
+	select {
+	case got := <-mirrored:
+		assert.Equal(t, "/users "+id, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/richardwilkes/toolbox/log/logadapter"
+)
+
+// RequestIDHeader is the header used to carry request IDs.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDCtxKey int
+
+var requestIDKey requestIDCtxKey = 1
+
+// RequestID returns middleware that assigns an ID to each request. If the
+// incoming request already carries an ID in the RequestIDHeader, it is reused.
+// The ID is stored in the request context, where it can be retrieved with
+// RequestIDFrom(), and is also set in the response's RequestIDHeader, which
+// allows the server's access log to include it.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			id := req.Header.Get(RequestIDHeader)
+			if id == "" || len(id) > 128 {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+		})
+	}
+}
+
+// RequestIDFrom returns the ID assigned to the request by the RequestID
+// middleware, or an empty string if there isn't one.
+func RequestIDFrom(req *http.Request) string {
+	id, ok := req.Context().Value(requestIDKey).(string)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// RequestLogger returns a logger that prefixes its output with the request's
+// ID, if it has one.
+func RequestLogger(req *http.Request, logger logadapter.Logger) logadapter.Logger {
+	if id := RequestIDFrom(req); id != "" {
+		return &logadapter.Prefixer{Logger: logger, Prefix: "[" + id + "] "}
+	}
+	return logger
+}
+
+func newRequestID() string {
+	var buffer [16]byte
+	if _, err := rand.Read(buffer[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buffer[:])
+}
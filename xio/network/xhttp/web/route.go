@@ -10,7 +10,9 @@
 package web
 
 import (
+	"context"
 	"net/http"
+	"path"
 	"strings"
 )
 
@@ -19,8 +21,19 @@ type routeCtxKey int
 var routeKey routeCtxKey = 1
 
 type route struct {
-	path string
-	last string
+	path    string
+	last    string
+	pattern string
+	params  map[string]string
+	matched func()
+}
+
+func routeFromRequest(req *http.Request) (*route, *http.Request) {
+	if r, ok := req.Context().Value(routeKey).(*route); ok {
+		return r, req
+	}
+	r := &route{path: path.Clean("/" + req.URL.Path)}
+	return r, req.WithContext(context.WithValue(req.Context(), routeKey, r))
 }
 
 func (r *route) shift() string {
@@ -78,3 +91,36 @@ func RemainingPath(req *http.Request) string {
 	}
 	return r.remaining()
 }
+
+// PathParam returns the value captured for the named parameter by a Router
+// pattern, or an empty string if no such parameter was captured.
+func PathParam(req *http.Request, name string) string {
+	r, ok := req.Context().Value(routeKey).(*route)
+	if !ok {
+		return ""
+	}
+	return r.params[name]
+}
+
+// PathParams returns a copy of all parameters captured by Router patterns for
+// the request.
+func PathParams(req *http.Request) map[string]string {
+	params := make(map[string]string)
+	if r, ok := req.Context().Value(routeKey).(*route); ok {
+		for k, v := range r.params {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+// RoutePattern returns the pattern of the Router route that matched the
+// request, including the patterns of any routes it was mounted under, such as
+// "/api/users/:id". Returns an empty string if no route has matched.
+func RoutePattern(req *http.Request) string {
+	r, ok := req.Context().Value(routeKey).(*route)
+	if !ok {
+		return ""
+	}
+	return r.pattern
+}
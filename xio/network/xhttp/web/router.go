@@ -0,0 +1,284 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+)
+
+const (
+	literalSegment = iota
+	paramSegment
+	wildcardSegment
+)
+
+type segment struct {
+	kind  int
+	value string
+}
+
+type routeEntry struct {
+	method   string
+	pattern  string
+	segments []segment
+	mount    bool
+	handler  http.Handler
+}
+
+// Router dispatches requests to handlers based on the request method and the
+// remaining path, as reported by RemainingPath(). Patterns are made up of
+// slash-separated segments, each of which may be a literal, a ':name'
+// parameter that matches any single segment, or, as the final segment, a
+// '*name' wildcard that matches the rest of the path. Captured values are
+// available through PathParam(). When more than one pattern matches, literal
+// segments are preferred over parameters, which are preferred over
+// wildcards. Matched segments, other than those matched by a wildcard, are
+// consumed, so PathHeadThenShift() and friends continue to work relative to
+// the unmatched portion of the path.
+type Router struct {
+	// NotFound is called when no route matches. Defaults to returning a 404.
+	NotFound http.Handler
+	// MethodNotAllowed is called when a route matches the path, but not the
+	// method. Defaults to returning a 405.
+	MethodNotAllowed http.Handler
+	routes           []*routeEntry
+	middleware       []Middleware
+}
+
+// NewRouter creates a new, empty Router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Use adds middleware that will wrap every handler dispatched by this router,
+// including the NotFound and MethodNotAllowed handlers. Middleware is applied
+// in the order given, so the first one added is the outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle registers a handler for the method and pattern. An empty method or
+// "*" matches any method. The middleware, if any, wraps only this handler.
+func (r *Router) Handle(method, pattern string, handler http.Handler, middleware ...Middleware) {
+	r.add(method, pattern, false, handler, middleware)
+}
+
+// HandleFunc registers a handler function for the method and pattern. An empty
+// method or "*" matches any method. The middleware, if any, wraps only this
+// handler.
+func (r *Router) HandleFunc(method, pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	r.add(method, pattern, false, handler, middleware)
+}
+
+// Get registers a handler function for GET requests. HEAD requests will also
+// be routed to it if no explicit HEAD route matches.
+func (r *Router) Get(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	r.HandleFunc(http.MethodGet, pattern, handler, middleware...)
+}
+
+// Post registers a handler function for POST requests.
+func (r *Router) Post(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	r.HandleFunc(http.MethodPost, pattern, handler, middleware...)
+}
+
+// Put registers a handler function for PUT requests.
+func (r *Router) Put(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	r.HandleFunc(http.MethodPut, pattern, handler, middleware...)
+}
+
+// Patch registers a handler function for PATCH requests.
+func (r *Router) Patch(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	r.HandleFunc(http.MethodPatch, pattern, handler, middleware...)
+}
+
+// Delete registers a handler function for DELETE requests.
+func (r *Router) Delete(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	r.HandleFunc(http.MethodDelete, pattern, handler, middleware...)
+}
+
+// Mount registers a handler, typically another Router, for all requests whose
+// path begins with the pattern, regardless of method. The matched prefix is
+// consumed before the handler is called.
+func (r *Router) Mount(pattern string, handler http.Handler, middleware ...Middleware) {
+	r.add("", pattern, true, handler, middleware)
+}
+
+func (r *Router) add(method, pattern string, mount bool, handler http.Handler, middleware []Middleware) {
+	if method == "*" {
+		method = ""
+	}
+	e := &routeEntry{
+		method:   strings.ToUpper(method),
+		pattern:  "/" + strings.Join(splitPath(pattern), "/"),
+		segments: parsePattern(pattern),
+		mount:    mount,
+		handler:  wrap(handler, middleware),
+	}
+	if n := len(e.segments); n > 0 && e.segments[n-1].kind == wildcardSegment {
+		e.mount = false
+	}
+	r.routes = append(r.routes, e)
+}
+
+func parsePattern(pattern string) []segment {
+	var segments []segment
+	for _, one := range splitPath(pattern) {
+		switch {
+		case strings.HasPrefix(one, ":"):
+			segments = append(segments, segment{kind: paramSegment, value: one[1:]})
+		case strings.HasPrefix(one, "*"):
+			segments = append(segments, segment{kind: wildcardSegment, value: one[1:]})
+			return segments
+		default:
+			segments = append(segments, segment{kind: literalSegment, value: one})
+		}
+	}
+	return segments
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt, req := routeFromRequest(req)
+	wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.dispatch(w, req, rt)
+	}), r.middleware).ServeHTTP(w, req)
+}
+
+func (r *Router) dispatch(w http.ResponseWriter, req *http.Request, rt *route) {
+	parts := splitPath(rt.path)
+	var best, pathOnly *routeEntry
+	var bestParams map[string]string
+	var bestConsumed int
+	allowed := make(map[string]bool)
+	for _, e := range r.routes {
+		params, consumed, ok := e.match(parts)
+		if !ok {
+			continue
+		}
+		if !e.matchesMethod(req.Method) {
+			if e.method != "" {
+				allowed[e.method] = true
+				if e.method == http.MethodGet {
+					allowed[http.MethodHead] = true
+				}
+			}
+			if pathOnly == nil {
+				pathOnly = e
+			}
+			continue
+		}
+		if best == nil || e.moreSpecificThan(best) || (e.method == req.Method && best.method != req.Method && !best.moreSpecificThan(e)) {
+			best = e
+			bestParams = params
+			bestConsumed = consumed
+		}
+	}
+	if best == nil {
+		if pathOnly != nil {
+			methods := make([]string, 0, len(allowed))
+			for m := range allowed {
+				methods = append(methods, m)
+			}
+			sort.Strings(methods)
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			if r.MethodNotAllowed != nil {
+				r.MethodNotAllowed.ServeHTTP(w, req)
+			} else {
+				xhttp.WriteHTTPStatus(w, http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		if r.NotFound != nil {
+			r.NotFound.ServeHTTP(w, req)
+		} else {
+			xhttp.WriteHTTPStatus(w, http.StatusNotFound)
+		}
+		return
+	}
+	if len(bestParams) != 0 {
+		if rt.params == nil {
+			rt.params = make(map[string]string)
+		}
+		for k, v := range bestParams {
+			rt.params[k] = v
+		}
+	}
+	for i := 0; i < bestConsumed; i++ {
+		rt.shift()
+	}
+	rt.pattern = path.Join(rt.pattern, best.pattern)
+	if rt.matched != nil {
+		rt.matched()
+	}
+	best.handler.ServeHTTP(w, req)
+}
+
+func (e *routeEntry) matchesMethod(method string) bool {
+	return e.method == "" || e.method == method || (method == http.MethodHead && e.method == http.MethodGet)
+}
+
+func (e *routeEntry) match(parts []string) (params map[string]string, consumed int, ok bool) {
+	for i, seg := range e.segments {
+		if seg.kind == wildcardSegment {
+			if seg.value != "" {
+				if params == nil {
+					params = make(map[string]string)
+				}
+				params[seg.value] = strings.Join(parts[i:], "/")
+			}
+			return params, i, true
+		}
+		if i >= len(parts) {
+			return nil, 0, false
+		}
+		switch seg.kind {
+		case literalSegment:
+			if seg.value != parts[i] {
+				return nil, 0, false
+			}
+		case paramSegment:
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg.value] = parts[i]
+		}
+	}
+	if !e.mount && len(parts) != len(e.segments) {
+		return nil, 0, false
+	}
+	return params, len(e.segments), true
+}
+
+func (e *routeEntry) moreSpecificThan(other *routeEntry) bool {
+	for i := 0; i < len(e.segments) && i < len(other.segments); i++ {
+		if e.segments[i].kind != other.segments[i].kind {
+			return e.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(e.segments) != len(other.segments) {
+		// The longer pattern consumed more of the path with non-wildcard
+		// segments, so it is the more specific of the two.
+		return len(e.segments) > len(other.segments)
+	}
+	return !e.mount && other.mount
+}
@@ -0,0 +1,83 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/stretchr/testify/assert"
+)
+
+func serve(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestRouter(t *testing.T) {
+	r := web.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) { fmt.Fprint(w, "root") })
+	r.Get("/users/:id", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "user %s", web.PathParam(req, "id"))
+	})
+	r.Get("/users/me", func(w http.ResponseWriter, req *http.Request) { fmt.Fprint(w, "me") })
+	r.Post("/users", func(w http.ResponseWriter, req *http.Request) { fmt.Fprint(w, "created") })
+	r.Get("/files/*path", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", web.PathParam(req, "path"), web.PathHeadThenShift(req), web.RemainingPath(req))
+	})
+
+	assert.Equal(t, "root", serve(r, http.MethodGet, "/").Body.String())
+	assert.Equal(t, "user 22", serve(r, http.MethodGet, "/users/22").Body.String())
+	assert.Equal(t, "me", serve(r, http.MethodGet, "/users/me").Body.String())
+	assert.Equal(t, "created", serve(r, http.MethodPost, "/users").Body.String())
+	assert.Equal(t, "a/b/c|a|b/c", serve(r, http.MethodGet, "/files/a/b/c").Body.String())
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodGet, "/users/22/more").Code)
+	w := serve(r, http.MethodDelete, "/users/22")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+	assert.Equal(t, http.StatusOK, serve(r, http.MethodHead, "/users/22").Code)
+}
+
+func TestMountedRouter(t *testing.T) {
+	sub := web.NewRouter()
+	sub.Get("/items/:item", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s/%s", web.PathParam(req, "org"), web.PathParam(req, "item"))
+	})
+	sub.HandleFunc("", "/raw/*", func(w http.ResponseWriter, req *http.Request) {
+		var segments []string
+		for web.HasMorePathSegments(req) {
+			segments = append(segments, web.PathHeadThenShift(req))
+		}
+		fmt.Fprint(w, segments)
+	})
+	var order []string
+	tag := func(name string) web.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	sub.Use(tag("sub"))
+	r := web.NewRouter()
+	r.Use(tag("root"))
+	r.Mount("/orgs/:org", sub, tag("mount"))
+
+	assert.Equal(t, "acme/widget", serve(r, http.MethodGet, "/orgs/acme/items/widget").Body.String())
+	assert.Equal(t, []string{"root", "mount", "sub"}, order)
+	assert.Equal(t, "[x y]", serve(r, http.MethodPut, "/orgs/acme/raw/x/y").Body.String())
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodGet, "/orgs/acme/nothing").Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodGet, "/elsewhere").Code)
+}
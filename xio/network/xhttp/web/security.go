@@ -0,0 +1,77 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SecurityHeaderOptions holds the configuration for the SecurityHeaders
+// middleware. Empty values cause the corresponding header to be omitted.
+type SecurityHeaderOptions struct {
+	// ContentTypeOptions is the value for X-Content-Type-Options.
+	ContentTypeOptions string
+	// FrameOptions is the value for X-Frame-Options.
+	FrameOptions string
+	// ReferrerPolicy is the value for Referrer-Policy.
+	ReferrerPolicy string
+	// ContentSecurityPolicy is the value for Content-Security-Policy.
+	ContentSecurityPolicy string
+	// HSTSMaxAge is the max-age for Strict-Transport-Security, which is only
+	// sent for requests received over TLS.
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains adds the includeSubDomains directive to
+	// Strict-Transport-Security.
+	HSTSIncludeSubdomains bool
+}
+
+// DefaultSecurityHeaderOptions returns a reasonable set of security header
+// options.
+func DefaultSecurityHeaderOptions() SecurityHeaderOptions {
+	return SecurityHeaderOptions{
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "DENY",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		HSTSMaxAge:         365 * 24 * time.Hour,
+	}
+}
+
+// SecurityHeaders returns middleware that adds security-related headers to
+// each response.
+func SecurityHeaders(options SecurityHeaderOptions) Middleware {
+	var hsts string
+	if options.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int64(options.HSTSMaxAge/time.Second))
+		if options.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			h := w.Header()
+			setIfNotEmpty(h, "X-Content-Type-Options", options.ContentTypeOptions)
+			setIfNotEmpty(h, "X-Frame-Options", options.FrameOptions)
+			setIfNotEmpty(h, "Referrer-Policy", options.ReferrerPolicy)
+			setIfNotEmpty(h, "Content-Security-Policy", options.ContentSecurityPolicy)
+			if req.TLS != nil {
+				setIfNotEmpty(h, "Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func setIfNotEmpty(h http.Header, key, value string) {
+	if value != "" {
+		h.Set(key, value)
+	}
+}
@@ -13,19 +13,19 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"net"
 	"net/http"
 	"path"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/dustin/go-humanize"
 	"github.com/richardwilkes/toolbox/atexit"
 	"github.com/richardwilkes/toolbox/errs"
 	"github.com/richardwilkes/toolbox/log/logadapter"
 	"github.com/richardwilkes/toolbox/xio/network"
+	"github.com/richardwilkes/toolbox/xio/network/mdns"
 	"github.com/richardwilkes/toolbox/xio/network/xhttp"
 )
 
@@ -39,34 +39,67 @@ const (
 type Server struct {
 	CertFile            string
 	KeyFile             string
+	CertReloadInterval  time.Duration      // How often to check CertFile & KeyFile for changes; 0 for the default, < 0 to disable
+	SelfSigned          bool               // If true and CertFile & KeyFile are not set, serve HTTPS with a generated self-signed certificate
+	ClientCAFile        string             // If set, client certificates will be verified against the CAs in this PEM file
+	ClientAuth          tls.ClientAuthType // Client certificate policy when ClientCAFile is set; defaults to requiring verified certificates
 	ShutdownGracePeriod time.Duration
 	Logger              logadapter.Logger
 	WebServer           *http.Server
 	Ports               []int
 	ShutdownCallback    func()
 	StartedChan         chan interface{} // If not nil, will be closed once the server is ready to accept connections
+	Middleware          []Middleware     // Applied to WebServer.Handler, with the first being the outermost
+	AccessLogger        AccessLogger     // If nil, TextAccessLogger will be used
+	Listeners           []Listener       // Additional addresses to listen on
+	SystemdListeners    bool             // If true, sockets passed in via systemd socket activation replace the listener for WebServer.Addr & Ports
+	Metrics             *Metrics         // If set, per-route metrics are collected and served at MetricsPath
+	Health              *Health          // If set, served at HealthzPath & ReadyzPath, with readiness failing once Shutdown() is called
+	ShutdownDrainPeriod time.Duration    // If Health is set, how long Shutdown() continues serving with readiness failing; counts against ShutdownGracePeriod
+	Advertise           *mdns.Service    // If set, advertised via mDNS/DNS-SD once StartedChan closes; unset Type & Port are filled in from the server and an unset Instance defaults to "<AppName> on <host>:<port>"
+	Responder           *mdns.Responder  // Used when Advertise is set; if nil, one is created for the server and closed by Shutdown()
 	addresses           []string
 	port                int
+	listeners           []*boundListener
+	redirectServer      *http.Server
+	advertiseLock       sync.Mutex
+	advertised          *mdns.Service
+	ownedResponder      *mdns.Responder
+	advertisingStopped  bool
 }
 
 // Protocol returns the protocol this server is handling.
 func (s *Server) Protocol() string {
-	if s.CertFile != "" && s.KeyFile != "" {
+	if (s.CertFile != "" && s.KeyFile != "") || s.SelfSigned {
 		return ProtocolHTTPS
 	}
 	return ProtocolHTTP
 }
 
-// Addresses returns the host addresses being listened to.
+// Addresses returns the host addresses being listened to on Port() by the
+// primary listener, followed by the full addresses of any other listeners,
+// such as "192.168.1.5:8443" or "unix:/run/app.sock".
 func (s *Server) Addresses() []string {
-	return s.addresses
+	addresses := make([]string, len(s.addresses), len(s.addresses)+len(s.listeners))
+	copy(addresses, s.addresses)
+	for _, one := range s.additionalListeners() {
+		addresses = append(addresses, one.address())
+	}
+	return addresses
 }
 
-// Port returns the port being listened to.
+// Port returns the port being listened to by the primary listener.
 func (s *Server) Port() int {
 	return s.port
 }
 
+func (s *Server) additionalListeners() []*boundListener {
+	if len(s.addresses) != 0 && len(s.listeners) != 0 {
+		return s.listeners[1:]
+	}
+	return s.listeners
+}
+
 // LocalBaseURL returns the local base URL that will reach the server.
 func (s *Server) LocalBaseURL() string {
 	return fmt.Sprintf("%s://127.0.0.1:%d", s.Protocol(), s.port)
@@ -82,6 +115,18 @@ func (s *Server) String() string {
 		}
 		fmt.Fprintf(&buffer, "%s:%d", addr, s.port)
 	}
+	for i, one := range s.additionalListeners() {
+		if i != 0 || len(s.addresses) != 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(one.address())
+		switch {
+		case one.redirect && s.Protocol() == ProtocolHTTPS:
+			buffer.WriteString(" (redirect to https)")
+		case one.plain && s.Protocol() == ProtocolHTTPS:
+			buffer.WriteString(" (http)")
+		}
+	}
 	return buffer.String()
 }
 
@@ -91,76 +136,164 @@ func (s *Server) Run() error {
 	if s.Logger == nil {
 		s.Logger = &logadapter.Discarder{}
 	}
-	handler := s.WebServer.Handler
+	if s.AccessLogger == nil {
+		s.AccessLogger = TextAccessLogger
+	}
+	if s.Protocol() == ProtocolHTTPS {
+		cfg, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		s.WebServer.TLSConfig = cfg
+	}
+	handler := wrap(s.WebServer.Handler, s.Middleware)
+	builtin := s.builtinHandlers()
 	s.WebServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		started := time.Now()
 		req.URL.Path = path.Clean(req.URL.Path)
-		req = req.WithContext(context.WithValue(req.Context(), routeKey, &route{path: req.URL.Path}))
+		rt := &route{path: req.URL.Path}
+		req = req.WithContext(context.WithValue(req.Context(), routeKey, rt))
 		sw := &xhttp.StatusResponseWriter{
 			Original: w,
 			Head:     req.Method == http.MethodHead,
 		}
+		target := handler
+		if h, ok := builtin[req.URL.Path]; ok {
+			rt.pattern = req.URL.Path
+			target = h
+		}
+		var current *string
+		if s.Metrics != nil {
+			current = s.Metrics.track(rt)
+		}
 		defer func() {
 			if err := recover(); err != nil {
 				s.Logger.Error(errs.Newf("recovered from panic in handler\n%+v", err))
 				sw.WriteHeader(http.StatusInternalServerError)
 			}
-			since := time.Since(started)
-			millis := int64(since / time.Millisecond)
-			micros := int64(since/time.Microsecond) - millis*1000
-			written := sw.BytesWritten()
-			var bytes string
-			if written != 1 {
-				bytes = "bytes"
-			} else {
-				bytes = "byte"
+			if s.Metrics != nil {
+				s.Metrics.untrack(current)
+				s.Metrics.Observe(rt.pattern, req.Method, sw.Status(), sw.BytesWritten(), time.Since(started))
 			}
-			s.Logger.Infof("%d | %s.%03dms | %s %s | %s %s", sw.Status(), humanize.Comma(millis), micros, humanize.Comma(int64(written)), bytes, req.Method, req.URL)
+			s.AccessLogger(s.Logger, &AccessLogEntry{
+				Started:      started,
+				Duration:     time.Since(started),
+				Status:       sw.Status(),
+				BytesWritten: sw.BytesWritten(),
+				Method:       req.Method,
+				URL:          req.URL.String(),
+				RemoteAddr:   req.RemoteAddr,
+				UserAgent:    req.UserAgent(),
+				RequestID:    sw.Header().Get(RequestIDHeader),
+			})
 		}()
-		handler.ServeHTTP(sw, req)
+		target.ServeHTTP(sw, req)
 	})
-	var ln net.Listener
-	host, _, err := net.SplitHostPort(s.WebServer.Addr)
-	if err == nil {
-		ln, err = net.Listen("tcp", s.WebServer.Addr)
-	} else {
-		ports := s.Ports
-		if len(ports) == 0 {
-			ports = []int{0}
+	host, err := s.listenPrimary()
+	if err != nil {
+		return err
+	}
+	usesTLS := s.Protocol() == ProtocolHTTPS
+	for _, one := range s.listeners {
+		one.plain = !usesTLS
+	}
+	for _, spec := range s.Listeners {
+		var b *boundListener
+		if b, err = listen(spec); err != nil {
+			s.closeListeners()
+			return err
 		}
-		for _, one := range ports {
-			if ln, err = net.Listen("tcp", net.JoinHostPort(s.WebServer.Addr, strconv.Itoa(one))); err == nil {
-				break
+		if b.redirect && usesTLS {
+			if s.redirectServer == nil {
+				s.redirectServer = &http.Server{
+					Handler:           s.redirectHandler(),
+					ReadHeaderTimeout: 10 * time.Second,
+				}
 			}
+		} else {
+			b.redirect = false
+			b.plain = b.plain || !usesTLS
 		}
+		s.listeners = append(s.listeners, b)
 	}
-	if err != nil {
-		return errs.Wrap(err)
-	}
-	listener := network.TCPKeepAliveListener{TCPListener: ln.(*net.TCPListener)}
-	_, portStr, err := net.SplitHostPort(ln.Addr().String())
-	if err != nil {
-		return errs.Wrap(err)
-	}
-	if s.port, err = strconv.Atoi(portStr); err != nil {
-		return errs.Wrap(err)
+	if primary := s.listeners[0]; primary.network == NetworkTCP {
+		s.port = primary.port()
+		s.addresses = network.AddressesForHost(host)
 	}
-	s.addresses = network.AddressesForHost(host)
 	s.Logger.Infof("Listening for %v", s)
 	go func() {
 		if s.StartedChan != nil {
 			close(s.StartedChan)
 		}
+		s.advertise()
 	}()
-	if s.Protocol() == ProtocolHTTPS {
-		err = s.WebServer.ServeTLS(listener, s.CertFile, s.KeyFile)
+	errChan := make(chan error, len(s.listeners))
+	for _, one := range s.listeners {
+		go func(b *boundListener) {
+			switch {
+			case b.redirect:
+				errChan <- s.redirectServer.Serve(b.listener)
+			case b.plain:
+				errChan <- s.WebServer.Serve(b.listener)
+			default:
+				errChan <- s.WebServer.ServeTLS(b.listener, "", "")
+			}
+		}(one)
+	}
+	var result error
+	for range s.listeners {
+		if err = <-errChan; err != nil && err != http.ErrServerClosed && result == nil {
+			result = errs.Wrap(err)
+			go s.Shutdown()
+		}
+	}
+	return result
+}
+
+func (s *Server) builtinHandlers() map[string]http.Handler {
+	builtin := make(map[string]http.Handler)
+	if s.Health != nil {
+		builtin[HealthzPath] = s.Health.LivenessHandler()
+		builtin[ReadyzPath] = s.Health.ReadinessHandler()
+	}
+	if s.Metrics != nil {
+		builtin[MetricsPath] = s.Metrics
+	}
+	return builtin
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	var cfg *tls.Config
+	if s.WebServer.TLSConfig != nil {
+		cfg = s.WebServer.TLSConfig.Clone()
 	} else {
-		err = s.WebServer.Serve(listener)
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
 	}
-	if err != nil && err != http.ErrServerClosed {
-		return errs.Wrap(err)
+	if s.CertFile != "" && s.KeyFile != "" {
+		reloader, err := NewCertificateReloader(s.CertFile, s.KeyFile, s.CertReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetCertificate = reloader.GetCertificate
+	} else {
+		cert, err := GenerateSelfSignedCertificate(SelfSignedHosts(), 365*24*time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if s.ClientCAFile != "" {
+		pool, err := LoadCertPool(s.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = s.ClientAuth
+		if cfg.ClientAuth == tls.NoClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 	}
-	return nil
+	return cfg, nil
 }
 
 // Shutdown the server gracefully.
@@ -172,6 +305,23 @@ func (s *Server) Shutdown() {
 	}
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(gracePeriod))
 	defer cancel()
+	s.stopAdvertising()
+	if s.Health != nil {
+		s.Health.SetShuttingDown(true)
+		if s.ShutdownDrainPeriod > 0 {
+			drain := time.NewTimer(s.ShutdownDrainPeriod)
+			select {
+			case <-drain.C:
+			case <-ctx.Done():
+				drain.Stop()
+			}
+		}
+	}
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			s.Logger.Warn(errs.NewWithCause("Unable to shutdown https redirect gracefully", err))
+		}
+	}
 	if err := s.WebServer.Shutdown(ctx); err != nil {
 		s.Logger.Warn(errs.NewWithCausef(err, "Unable to shutdown %s gracefully", s.Protocol()))
 	}
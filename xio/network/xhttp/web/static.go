@@ -0,0 +1,296 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/fs/embedded"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+)
+
+// DefaultIndexFile is the name of the file served for directory requests when
+// StaticOptions.Index is not set.
+const DefaultIndexFile = "index.html"
+
+var extraContentTypes = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".mjs":         "text/javascript; charset=utf-8",
+	".svg":         "image/svg+xml",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+// precompressed holds the encodings for which precompressed variants are
+// looked for, in order of preference.
+var precompressed = []struct {
+	encoding  string
+	extension string
+}{
+	{encoding: "br", extension: ".br"},
+	{encoding: "gzip", extension: ".gz"},
+}
+
+// CachePolicy returns the Cache-Control header value to use for the file at
+// the given path. An empty return value causes no Cache-Control header to be
+// sent.
+type CachePolicy func(name string) string
+
+// NoCachePolicy requires clients to revalidate every file before using a
+// cached copy. Since files are served with strong ETags, revalidation of an
+// unchanged file costs only a 304 response.
+func NoCachePolicy(_ string) string {
+	return "no-cache"
+}
+
+// MaxAgePolicy returns a CachePolicy that allows clients to cache every file
+// for the specified duration. If immutable is true, clients are told the file
+// will never change, which is appropriate for files whose names contain a
+// content hash.
+func MaxAgePolicy(maxAge time.Duration, immutable bool) CachePolicy {
+	value := "public, max-age=" + strconv.Itoa(int(maxAge/time.Second))
+	if immutable {
+		value += ", immutable"
+	}
+	return func(_ string) string { return value }
+}
+
+// HTMLNoCachePolicy returns a CachePolicy that requires revalidation of HTML
+// files, while allowing all other files to be cached for the specified
+// duration. This suits single-page apps, where the HTML entry point
+// references assets with content hashes in their names.
+func HTMLNoCachePolicy(maxAge time.Duration) CachePolicy {
+	other := MaxAgePolicy(maxAge, false)
+	return func(name string) string {
+		if strings.EqualFold(path.Ext(name), ".html") || strings.EqualFold(path.Ext(name), ".htm") {
+			return NoCachePolicy(name)
+		}
+		return other(name)
+	}
+}
+
+// StaticOptions holds the options for a StaticFiles handler.
+type StaticOptions struct {
+	// Index is the name of the file served for requests for a directory.
+	// Defaults to DefaultIndexFile.
+	Index string
+	// DirectoryListing enables an HTML listing of a directory's contents when
+	// it has no index file. When disabled, such requests receive a 404.
+	DirectoryListing bool
+	// SPAFallback causes requests for paths that don't exist and whose final
+	// segment has no file extension to be answered with the root index file,
+	// allowing a single-page app to handle its own routes. Requests for
+	// missing files that have an extension still receive a 404.
+	SPAFallback bool
+	// Precompressed causes the handler to look for "name.br" and "name.gz"
+	// variants of each requested file and serve them, with the appropriate
+	// Content-Encoding, to clients that accept them.
+	Precompressed bool
+	// CachePolicy determines the Cache-Control header for each file served.
+	// Defaults to NoCachePolicy.
+	CachePolicy CachePolicy
+}
+
+type staticETag struct {
+	modTime time.Time
+	size    int
+	etag    string
+}
+
+type staticHandler struct {
+	fs      embedded.FileSystem
+	options StaticOptions
+	lock    sync.Mutex
+	etags   map[string]staticETag
+}
+
+// StaticFiles returns a handler that serves the contents of the file system.
+// The file path is taken from RemainingPath(), so the handler may be mounted
+// on a Router below some prefix. Responses carry a strong ETag computed from
+// the file content and support conditional and range requests. Only GET and
+// HEAD requests are accepted.
+func StaticFiles(fs embedded.FileSystem, options StaticOptions) http.Handler {
+	if options.Index == "" {
+		options.Index = DefaultIndexFile
+	}
+	if options.CachePolicy == nil {
+		options.CachePolicy = NoCachePolicy
+	}
+	return &staticHandler{
+		fs:      fs,
+		options: options,
+		etags:   make(map[string]staticETag),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		xhttp.WriteHTTPStatus(w, http.StatusMethodNotAllowed)
+		return
+	}
+	requested := embedded.ToEFSPath(RemainingPath(req))
+	name := requested
+	fi, err := h.stat(name)
+	if err == nil && fi.IsDir() {
+		dir := name
+		name = path.Join(dir, h.options.Index)
+		if fi, err = h.stat(name); err != nil {
+			if h.options.DirectoryListing {
+				h.serveListing(w, req, dir)
+				return
+			}
+		}
+	}
+	if err != nil && h.options.SPAFallback && path.Ext(requested) == "" {
+		name = "/" + h.options.Index
+		fi, err = h.stat(name)
+	}
+	if err != nil || fi.IsDir() {
+		xhttp.WriteHTTPStatus(w, http.StatusNotFound)
+		return
+	}
+	h.serveFile(w, req, name, fi)
+}
+
+func (h *staticHandler) stat(name string) (os.FileInfo, error) {
+	f, err := h.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+	return f.Stat()
+}
+
+func (h *staticHandler) serveFile(w http.ResponseWriter, req *http.Request, name string, fi os.FileInfo) {
+	header := w.Header()
+	contentType := contentTypeFor(name)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if cc := h.options.CachePolicy(name); cc != "" {
+		header.Set("Cache-Control", cc)
+	}
+	served := name
+	if h.options.Precompressed {
+		header.Add("Vary", "Accept-Encoding")
+		for _, one := range precompressed {
+			if !acceptsEncoding(req, one.encoding) {
+				continue
+			}
+			if vfi, err := h.stat(name + one.extension); err == nil && !vfi.IsDir() {
+				header.Set("Content-Encoding", one.encoding)
+				served = name + one.extension
+				fi = vfi
+				break
+			}
+		}
+	}
+	data, ok := h.fs.ContentAsBytes(served)
+	if !ok {
+		header.Del("Content-Encoding")
+		xhttp.WriteHTTPStatus(w, http.StatusNotFound)
+		return
+	}
+	header.Set("ETag", h.etag(served, fi.ModTime(), data))
+	http.ServeContent(w, req, name, fi.ModTime(), bytes.NewReader(data))
+}
+
+func (h *staticHandler) etag(name string, modTime time.Time, data []byte) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if one, ok := h.etags[name]; ok && one.modTime.Equal(modTime) && one.size == len(data) && !h.fs.IsLive() {
+		return one.etag
+	}
+	etag := ContentETag(data)
+	h.etags[name] = staticETag{modTime: modTime, size: len(data), etag: etag}
+	return etag
+}
+
+func (h *staticHandler) serveListing(w http.ResponseWriter, req *http.Request, dir string) {
+	f, err := h.fs.Open(dir)
+	if err != nil {
+		xhttp.WriteHTTPStatus(w, http.StatusNotFound)
+		return
+	}
+	defer f.Close() //nolint:errcheck
+	list, err := f.Readdir(-1)
+	if err != nil {
+		xhttp.WriteHTTPStatus(w, http.StatusInternalServerError)
+		return
+	}
+	names := make(map[string]bool, len(list))
+	for _, one := range list {
+		names[one.Name()] = true
+	}
+	var buffer bytes.Buffer
+	title := html.EscapeString(dir)
+	fmt.Fprintf(&buffer, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n<h1>%s</h1>\n<ul>\n", title, title)
+	base := req.URL.Path
+	if dir != "/" {
+		fmt.Fprintf(&buffer, "<li><a href=\"%s\">..</a></li>\n", html.EscapeString((&url.URL{Path: path.Dir(base)}).String()))
+	}
+	for _, one := range list {
+		entry := one.Name()
+		if h.options.Precompressed && isPrecompressedVariant(entry, names) {
+			continue
+		}
+		display := entry
+		if one.IsDir() {
+			display += "/"
+		}
+		link := (&url.URL{Path: path.Join(base, entry)}).String()
+		fmt.Fprintf(&buffer, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(display))
+	}
+	buffer.WriteString("</ul>\n</body></html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(buffer.Len()))
+	w.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		w.Write(buffer.Bytes()) //nolint:errcheck
+	}
+}
+
+func isPrecompressedVariant(name string, names map[string]bool) bool {
+	for _, one := range precompressed {
+		if strings.HasSuffix(name, one.extension) && names[strings.TrimSuffix(name, one.extension)] {
+			return true
+		}
+	}
+	return false
+}
+
+func contentTypeFor(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ct, ok := extraContentTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,131 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/fs/embedded"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStaticFS() embedded.FileSystem {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := make(map[string]*embedded.File)
+	for name, content := range map[string]string{
+		"/index.html":          "<html>app</html>",
+		"/app.js":              "console.log('app');",
+		"/app.js.gz":           "pretend-gzip",
+		"/assets/logo.svg":     "<svg></svg>",
+		"/assets/fonts/a.woff": "font",
+	} {
+		files[name] = embedded.NewFile(name, modTime, int64(len(content)), false, []byte(content))
+	}
+	return embedded.NewEFS(files).PrimaryFileSystem()
+}
+
+func serveWithHeader(h http.Handler, method, target, header, value string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set(header, value)
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestStaticFiles(t *testing.T) {
+	h := web.StaticFiles(newStaticFS(), web.StaticOptions{Precompressed: true})
+
+	w := serve(h, http.MethodGet, "/app.js")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "console.log('app');", w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, web.ContentETag([]byte("console.log('app');")), etag)
+
+	w = serveWithHeader(h, http.MethodGet, "/app.js", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = serveWithHeader(h, http.MethodGet, "/app.js", "Range", "bytes=0-6")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "console", w.Body.String())
+	assert.Equal(t, "bytes 0-6/19", w.Header().Get("Content-Range"))
+
+	w = serveWithHeader(h, http.MethodGet, "/app.js", "Accept-Encoding", "br;q=0, gzip")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "pretend-gzip", w.Body.String())
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	w = serve(h, http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "<html>app</html>", w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, serve(h, http.MethodGet, "/assets").Code)
+	assert.Equal(t, http.StatusNotFound, serve(h, http.MethodGet, "/missing").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(h, http.MethodPost, "/app.js").Code)
+
+	w = serve(h, http.MethodHead, "/assets/logo.svg")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+}
+
+func TestStaticFilesOptions(t *testing.T) {
+	r := web.NewRouter()
+	r.Mount("/static", web.StaticFiles(newStaticFS(), web.StaticOptions{
+		DirectoryListing: true,
+		SPAFallback:      true,
+		Precompressed:    true,
+		CachePolicy:      web.HTMLNoCachePolicy(time.Hour),
+	}))
+
+	w := serve(r, http.MethodGet, "/static/assets")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<a href="/static/assets/fonts">fonts/</a>`)
+	assert.Contains(t, w.Body.String(), `<a href="/static/assets/logo.svg">logo.svg</a>`)
+
+	w = serve(r, http.MethodGet, "/static/assets/logo.svg")
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+
+	w = serve(r, http.MethodGet, "/static/some/client/route")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<html>app</html>", w.Body.String())
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	assert.Equal(t, http.StatusNotFound, serve(r, http.MethodGet, "/static/missing.css").Code)
+
+	w = serve(r, http.MethodGet, "/static/")
+	assert.Equal(t, "<html>app</html>", w.Body.String())
+
+	h := web.StaticFiles(newStaticFS(), web.StaticOptions{
+		Index:            "missing.html",
+		DirectoryListing: true,
+		Precompressed:    true,
+	})
+	w = serve(h, http.MethodGet, "/")
+	assert.Contains(t, w.Body.String(), `<a href="/app.js">app.js</a>`)
+	assert.NotContains(t, w.Body.String(), "app.js.gz")
+
+	// A client route that matches a directory without an index file.
+	h = web.StaticFiles(newStaticFS(), web.StaticOptions{SPAFallback: true})
+	w = serve(h, http.MethodGet, "/assets")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "<html>app</html>", w.Body.String())
+
+	assert.Equal(t, "public, max-age=60, immutable", web.MaxAgePolicy(time.Minute, true)("x.js"))
+}
@@ -0,0 +1,226 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/richardwilkes/toolbox/collection"
+	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio/network"
+)
+
+// DefaultCertReloadInterval is the interval used to check for certificate
+// changes when none is specified.
+const DefaultCertReloadInterval = time.Minute
+
+// CertificateReloader provides a certificate loaded from a pair of PEM files,
+// reloading it whenever the files change. This allows renewed certificates to
+// be picked up without restarting the server.
+type CertificateReloader struct {
+	certFile  string
+	keyFile   string
+	interval  time.Duration
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	certStamp fileStamp
+	keyStamp  fileStamp
+	lastCheck time.Time
+	lastErr   error
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertificateReloader creates a new CertificateReloader and loads the
+// certificate. The files are checked for changes no more often than once per
+// 'interval'. An interval of zero uses DefaultCertReloadInterval, while a
+// negative interval disables automatic reloading.
+func NewCertificateReloader(certFile, keyFile string, interval time.Duration) (*CertificateReloader, error) {
+	if interval == 0 {
+		interval = DefaultCertReloadInterval
+	}
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload the certificate from its files. If loading fails, the previously
+// loaded certificate remains in use.
+func (r *CertificateReloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reload()
+}
+
+func (r *CertificateReloader) reload() error {
+	r.lastCheck = time.Now()
+	certStamp, err := stamp(r.certFile)
+	if err != nil {
+		r.lastErr = err
+		return err
+	}
+	var keyStamp fileStamp
+	if keyStamp, err = stamp(r.keyFile); err != nil {
+		r.lastErr = err
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		r.lastErr = errs.Wrap(err)
+		return r.lastErr
+	}
+	r.cert = &cert
+	r.certStamp = certStamp
+	r.keyStamp = keyStamp
+	r.lastErr = nil
+	return nil
+}
+
+// LastError returns the error from the most recent attempt to reload the
+// certificate, if it failed.
+func (r *CertificateReloader) LastError() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastErr
+}
+
+// GetCertificate returns the current certificate, first reloading it if its
+// files have changed. Suitable for use as tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.interval > 0 && time.Since(r.lastCheck) >= r.interval {
+		r.lastCheck = time.Now()
+		certStamp, err := stamp(r.certFile)
+		var keyStamp fileStamp
+		if err == nil {
+			keyStamp, err = stamp(r.keyFile)
+		}
+		if err != nil {
+			r.lastErr = err
+		} else if certStamp != r.certStamp || keyStamp != r.keyStamp {
+			r.reload() //nolint:errcheck // The error is recorded and the old certificate remains in use
+		}
+	}
+	return r.cert, nil
+}
+
+func stamp(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, errs.Wrap(err)
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// SelfSignedHosts returns the host names and IP addresses a self-signed
+// development certificate should cover: localhost, the loopback addresses and
+// each of the addresses returned by network.ActiveAddresses().
+func SelfSignedHosts() []string {
+	hosts := collection.NewStringSet("localhost", "127.0.0.1", "::1")
+	for addr := range network.ActiveAddresses() {
+		hosts.Add(addr)
+	}
+	return hosts.Values()
+}
+
+// GenerateSelfSignedCertificatePEM generates a self-signed certificate that
+// is valid for the specified hosts, which may be host names or IP addresses,
+// returning the PEM-encoded certificate and private key. Intended for
+// development use only.
+func GenerateSelfSignedCertificatePEM(hosts []string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	var serial *big.Int
+	if serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Self-Signed Development Certificate"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	var keyDER []byte
+	if keyDER, err = x509.MarshalECPrivateKey(key); err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// GenerateSelfSignedCertificate generates a self-signed certificate that is
+// valid for the specified hosts. Intended for development use only.
+func GenerateSelfSignedCertificate(hosts []string, validFor time.Duration) (tls.Certificate, error) {
+	certPEM, keyPEM, err := GenerateSelfSignedCertificatePEM(hosts, validFor)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, errs.Wrap(err)
+	}
+	return cert, nil
+}
+
+// LoadCertPool loads a pool of certificates from a PEM file.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errs.Newf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,119 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package web_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSelfSigned(t *testing.T, dir, prefix, host string) (certFile, keyFile string) {
+	certPEM, keyPEM, err := web.GenerateSelfSignedCertificatePEM([]string{host, "127.0.0.1"}, time.Hour)
+	require.NoError(t, err)
+	certFile = filepath.Join(dir, prefix+".crt")
+	keyFile = filepath.Join(dir, prefix+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func leafName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) //nolint:errcheck
+	certFile, keyFile := writeSelfSigned(t, dir, "server", "first.example.com")
+	r, err := web.NewCertificateReloader(certFile, keyFile, time.Nanosecond)
+	require.NoError(t, err)
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first.example.com", leafName(t, cert))
+	time.Sleep(10 * time.Millisecond)
+	writeSelfSigned(t, dir, "server", "second.example.com")
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second.example.com", leafName(t, cert))
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("garbage"), 0600))
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second.example.com", leafName(t, cert))
+	assert.Error(t, r.LastError())
+	time.Sleep(10 * time.Millisecond)
+	writeSelfSigned(t, dir, "server", "third.example.com")
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "third.example.com", leafName(t, cert))
+	assert.NoError(t, r.LastError())
+	require.NoError(t, os.Remove(certFile))
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "third.example.com", leafName(t, cert))
+	assert.Error(t, r.LastError())
+	writeSelfSigned(t, dir, "server", "fourth.example.com")
+	require.NoError(t, r.Reload())
+	require.NoError(t, os.Remove(keyFile))
+	assert.Error(t, r.Reload())
+	assert.Error(t, r.LastError())
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) //nolint:errcheck
+	caFile, caKeyFile := writeSelfSigned(t, dir, "client", "client.example.com")
+	s := &web.Server{
+		SelfSigned:   true,
+		ClientCAFile: caFile,
+		WebServer: &http.Server{
+			Addr: "127.0.0.1",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprint(w, req.TLS.PeerCertificates[0].Subject.CommonName)
+			}),
+		},
+		StartedChan: make(chan interface{}),
+	}
+	go s.Run() //nolint:errcheck
+	<-s.StartedChan
+	defer s.Shutdown()
+	assert.Equal(t, web.ProtocolHTTPS, s.Protocol())
+
+	clientCert, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+		Certificates:       []tls.Certificate{clientCert},
+	}}}
+	resp, err := client.Get(s.LocalBaseURL())
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "client.example.com", string(data))
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}} //nolint:gosec
+	_, err = client.Get(s.LocalBaseURL())
+	assert.Error(t, err)
+}
@@ -0,0 +1,247 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// Upgrader upgrades HTTP requests to WebSocket connections.
+type Upgrader struct {
+	// CheckOrigin returns true if the request's Origin is acceptable. If nil,
+	// requests with an Origin header whose host does not match the request's
+	// Host header are rejected.
+	CheckOrigin func(req *http.Request) bool
+	// Subprotocols lists the supported subprotocols, in order of preference.
+	Subprotocols []string
+	// ReadLimit is the maximum message size for upgraded connections.
+	// Defaults to DefaultReadLimit.
+	ReadLimit int64
+}
+
+// Upgrade the request to a WebSocket connection. On failure, an HTTP error
+// response has already been sent.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if req.Method != http.MethodGet {
+		return nil, u.reject(w, http.StatusMethodNotAllowed, "method must be GET")
+	}
+	if !headerContainsToken(req.Header, "Connection", "upgrade") || !headerContainsToken(req.Header, "Upgrade", "websocket") {
+		return nil, u.reject(w, http.StatusBadRequest, "not a websocket handshake")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, u.reject(w, http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, u.reject(w, http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, u.reject(w, http.StatusForbidden, "origin not allowed")
+	}
+	subprotocol := u.selectSubprotocol(req)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, u.reject(w, http.StatusInternalServerError, "response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errs.NewWithCause("unable to hijack connection", err)
+	}
+	// The hijacked connection keeps any deadlines the http.Server set for
+	// the request, which would otherwise cut the connection off later.
+	conn.SetDeadline(time.Time{}) //nolint:errcheck
+	var response strings.Builder
+	response.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	response.WriteString(acceptKey(key))
+	response.WriteString("\r\n")
+	if subprotocol != "" {
+		response.WriteString("Sec-WebSocket-Protocol: ")
+		response.WriteString(subprotocol)
+		response.WriteString("\r\n")
+	}
+	response.WriteString("\r\n")
+	if _, err = conn.Write([]byte(response.String())); err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, errs.Wrap(err)
+	}
+	c := newConn(conn, rw.Reader, false, subprotocol)
+	c.ReadLimit = u.ReadLimit
+	return c, nil
+}
+
+func (u *Upgrader) reject(w http.ResponseWriter, status int, reason string) error {
+	http.Error(w, http.StatusText(status), status)
+	return errs.New(reason)
+}
+
+func (u *Upgrader) selectSubprotocol(req *http.Request) string {
+	requested := headerTokens(req.Header, "Sec-WebSocket-Protocol")
+	for _, supported := range u.Subprotocols {
+		for _, one := range requested {
+			if one == supported {
+				return one
+			}
+		}
+	}
+	return ""
+}
+
+// SameOrigin returns true if the request has no Origin header, or if the host
+// of its Origin header matches the request's Host header.
+func SameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// IsUpgradeRequest returns true if the request is asking for a WebSocket
+// upgrade.
+func IsUpgradeRequest(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") && headerContainsToken(req.Header, "Upgrade", "websocket")
+}
+
+// Dial opens a client connection to a "ws" or "wss" URL. The header, if not
+// nil, is sent with the handshake request; a "Sec-WebSocket-Protocol" entry
+// may be used to request subprotocols. The TLS configuration, if not nil, is
+// used for "wss" URLs.
+func Dial(ctx context.Context, rawURL string, header http.Header, tlsConfig *tls.Config) (*Conn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, nil, errs.Newf("unsupported scheme: %s", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline) //nolint:errcheck
+	}
+	if secure {
+		cfg := tlsConfig
+		if cfg == nil {
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		} else {
+			cfg = cfg.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close() //nolint:errcheck
+			return nil, nil, errs.Wrap(err)
+		}
+		conn = tlsConn
+	}
+	var nonce [16]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, nil, errs.Wrap(err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(conn); err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, nil, errs.Wrap(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return nil, nil, errs.Wrap(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(resp.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close() //nolint:errcheck
+		return nil, resp, errs.Newf("websocket handshake failed with status %d", resp.StatusCode)
+	}
+	conn.SetDeadline(time.Time{}) //nolint:errcheck
+	return newConn(conn, reader, true, resp.Header.Get("Sec-WebSocket-Protocol")), resp, nil
+}
+
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, one := range strings.Split(value, ",") {
+			if one = strings.TrimSpace(one); one != "" {
+				tokens = append(tokens, one)
+			}
+		}
+	}
+	return tokens
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, one := range headerTokens(header, name) {
+		if strings.EqualFold(one, token) {
+			return true
+		}
+	}
+	return false
+}
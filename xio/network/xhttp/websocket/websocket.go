@@ -0,0 +1,483 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+// Package websocket provides an implementation of the WebSocket protocol, as
+// described in RFC 6455.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // Required by RFC 6455
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/richardwilkes/toolbox/errs"
+)
+
+// MessageType identifies the type of a data message.
+type MessageType int
+
+// Possible message types.
+const (
+	TextMessage   MessageType = opText
+	BinaryMessage MessageType = opBinary
+)
+
+// Close codes, as defined in RFC 6455, section 7.4.1.
+const (
+	CloseNormal              = 1000
+	CloseGoingAway           = 1001
+	CloseProtocolError       = 1002
+	CloseUnsupportedData     = 1003
+	CloseNoStatus            = 1005
+	CloseAbnormal            = 1006
+	CloseInvalidPayload      = 1007
+	ClosePolicyViolation     = 1008
+	CloseMessageTooBig       = 1009
+	CloseMandatoryExtension  = 1010
+	CloseInternalServerError = 1011
+)
+
+// Defaults for a Conn.
+const (
+	DefaultReadLimit    = 16 * 1024 * 1024
+	DefaultCloseTimeout = 5 * time.Second
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	acceptGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// ErrClosed is returned when attempting to use a connection that has already
+// sent a close frame.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage when the peer closes the connection,
+// or when the connection is closed due to a protocol violation.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("websocket: close %d", e.Code)
+}
+
+// Conn is a WebSocket connection. ReadMessage should only be called from one
+// goroutine at a time. The write methods may be called concurrently with each
+// other and with ReadMessage.
+type Conn struct {
+	// ReadLimit is the maximum size of a message, after reassembly of any
+	// fragments. Defaults to DefaultReadLimit.
+	ReadLimit int64
+	// CloseTimeout is how long Close waits for the peer to acknowledge the
+	// close before closing the underlying connection. Defaults to
+	// DefaultCloseTimeout.
+	CloseTimeout time.Duration
+	// PingHandler is called with the payload of each ping received. The pong
+	// reply is sent automatically before it is called.
+	PingHandler func(data []byte)
+	// PongHandler is called with the payload of each pong received.
+	PongHandler func(data []byte)
+	conn        net.Conn
+	reader      *bufio.Reader
+	client      bool
+	subprotocol string
+	writeLock   sync.Mutex
+	closeSent   bool
+	closeRecv   chan struct{}
+	closeOnce   sync.Once
+	closeErr    *CloseError
+	readSem     chan struct{}
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool, subprotocol string) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:        conn,
+		reader:      reader,
+		client:      client,
+		subprotocol: subprotocol,
+		closeRecv:   make(chan struct{}),
+		readSem:     make(chan struct{}, 1),
+	}
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for future reads from the underlying
+// connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future writes to the underlying
+// connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage reads the next data message, reassembling fragmented messages
+// and handling any control frames that arrive in the meantime. When the peer
+// closes the connection, the close is acknowledged and a *CloseError is
+// returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	limit := c.ReadLimit
+	if limit <= 0 {
+		limit = DefaultReadLimit
+	}
+	c.readSem <- struct{}{}
+	defer func() { <-c.readSem }()
+	select {
+	case <-c.closeRecv:
+		return 0, nil, c.closeErr
+	default:
+	}
+	var msgType MessageType
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame(limit - int64(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil && err != ErrClosed {
+				return 0, nil, err
+			}
+			if c.PingHandler != nil {
+				c.PingHandler(payload)
+			}
+			continue
+		case opPong:
+			if c.PongHandler != nil {
+				c.PongHandler(payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opText, opBinary:
+			if msgType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			msgType = MessageType(op)
+		case opContinuation:
+			if msgType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+		message = append(message, payload...)
+		if fin {
+			if msgType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+			}
+			return msgType, message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame(limit int64) (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&finBit != 0
+	op = header[0] & 0x0F
+	if header[0]&rsvBits != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	masked := header[1]&maskBit != 0
+	if masked == c.client {
+		if c.client {
+			return false, 0, nil, c.fail(CloseProtocolError, "server frames must not be masked")
+		}
+		return false, 0, nil, c.fail(CloseProtocolError, "client frames must be masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	isControl := op&0x8 != 0
+	if isControl && (length > maxControlPayload || !fin) {
+		return false, 0, nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !isControl && (length > 1<<62 || int64(length) > limit) {
+		return false, 0, nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, op, payload, nil
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseProtocolError, "invalid close payload")
+		}
+	}
+	c.closeOnce.Do(func() {
+		c.closeErr = closeErr
+		close(c.closeRecv)
+	})
+	c.writeLock.Lock()
+	alreadySent := c.closeSent
+	c.writeLock.Unlock()
+	if !alreadySent {
+		var reply []byte
+		if closeErr.Code != CloseNoStatus {
+			reply = closePayload(closeErr.Code, "")
+		}
+		c.writeFrame(opClose, reply) //nolint:errcheck
+		c.conn.Close()               //nolint:errcheck
+	}
+	return closeErr
+}
+
+// fail sends a close frame with the code and reason, closes the underlying
+// connection and returns the matching error.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeFrame(opClose, closePayload(code, reason)) //nolint:errcheck
+	c.conn.Close()                                    //nolint:errcheck
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// WriteMessage sends a message in a single frame.
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	return c.WriteFragmented(msgType, data)
+}
+
+// WriteFragmented sends a message split into one frame per fragment. Control
+// frames, such as pings, may be interleaved between the fragments by other
+// goroutines.
+func (c *Conn) WriteFragmented(msgType MessageType, fragments ...[]byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return errs.Newf("invalid message type %d", msgType)
+	}
+	if len(fragments) == 0 {
+		fragments = [][]byte{nil}
+	}
+	op := byte(msgType)
+	for i, fragment := range fragments {
+		if err := c.writeFrameFin(op, fragment, i == len(fragments)-1); err != nil {
+			return err
+		}
+		op = opContinuation
+	}
+	return nil
+}
+
+// Ping sends a ping with the payload, which must be no longer than 125 bytes.
+// The peer's pong is delivered to PongHandler.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errs.New("ping payload too long")
+	}
+	return c.writeFrame(opPing, data)
+}
+
+// Close performs the closing handshake, sending a close frame with the code
+// and reason, then waiting up to CloseTimeout for the peer to respond before
+// closing the underlying connection. If no other goroutine is currently in
+// ReadMessage, any data messages that arrive before the peer's response are
+// discarded and later calls to ReadMessage return the peer's *CloseError.
+func (c *Conn) Close(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		if len(reason) > maxControlPayload-2 {
+			reason = reason[:maxControlPayload-2]
+		}
+		payload = closePayload(code, reason)
+	}
+	err := c.writeFrame(opClose, payload)
+	if err == nil {
+		timeout := c.CloseTimeout
+		if timeout <= 0 {
+			timeout = DefaultCloseTimeout
+		}
+		select {
+		case c.readSem <- struct{}{}:
+			c.awaitClose(timeout)
+			<-c.readSem
+		default:
+			timer := time.NewTimer(timeout)
+			select {
+			case <-c.closeRecv:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+	if closeErr := c.conn.Close(); err == nil || err == ErrClosed {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *Conn) awaitClose(timeout time.Duration) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout)) //nolint:errcheck
+	for {
+		_, op, payload, err := c.readFrame(DefaultReadLimit)
+		if err != nil {
+			return
+		}
+		if op == opClose {
+			c.handleClose(payload) //nolint:errcheck
+			return
+		}
+	}
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	return c.writeFrameFin(op, payload, true)
+}
+
+func (c *Conn) writeFrameFin(op byte, payload []byte, fin bool) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	b0 := op
+	if fin {
+		b0 |= finBit
+	}
+	frame = append(frame, b0)
+	var b1 byte
+	if c.client {
+		b1 = maskBit
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, b1|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, b1|126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(frame, b1|127)
+		frame = append(frame, ext[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func maskBytes(mask [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i&3]
+	}
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return payload
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1011:
+		return false
+	default:
+		return code != 1004 && code != CloseNoStatus && code != CloseAbnormal
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.New() //nolint:gosec // Required by RFC 6455
+	h.Write([]byte(key + acceptGUID)) //nolint:errcheck
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
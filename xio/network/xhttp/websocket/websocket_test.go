@@ -0,0 +1,194 @@
+// Copyright ©2016-2020 by Richard A. Wilkes. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with
+// this file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This Source Code Form is "Incompatible With Secondary Licenses", as
+// defined by the Mozilla Public License, version 2.0.
+
+package websocket_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoServer(t *testing.T, upgrader *websocket.Upgrader) *httptest.Server {
+	return httptest.NewServer(echoHandler(t, upgrader))
+}
+
+func echoHandler(t *testing.T, upgrader *websocket.Upgrader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Wrap the writer the same way web.Server does, to ensure hijacking
+		// passes through.
+		sw := &xhttp.StatusResponseWriter{Original: w}
+		conn, err := upgrader.Upgrade(sw, req)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, http.StatusSwitchingProtocols, sw.Status())
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(data) == "close" {
+				conn.Close(websocket.CloseGoingAway, "bye") //nolint:errcheck
+				return
+			}
+			if err = conn.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func dial(t *testing.T, server *httptest.Server, header http.Header) *websocket.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/echo", header, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return conn
+}
+
+func TestEcho(t *testing.T) {
+	server := echoServer(t, &websocket.Upgrader{Subprotocols: []string{"chat", "json"}})
+	defer server.Close()
+	header := make(http.Header)
+	header.Set("Sec-WebSocket-Protocol", "json, chat")
+	conn := dial(t, server, header)
+	assert.Equal(t, "chat", conn.Subprotocol())
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	msgType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, msgType)
+	assert.Equal(t, "hello", string(data))
+
+	big := []byte(strings.Repeat("0123456789", 10000))
+	require.NoError(t, conn.WriteFragmented(websocket.BinaryMessage, big[:10], big[10:70000], big[70000:]))
+	msgType, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, msgType)
+	assert.Equal(t, big, data)
+
+	pong := make(chan string, 1)
+	conn.PongHandler = func(data []byte) { pong <- string(data) }
+	require.NoError(t, conn.Ping([]byte("are you there?")))
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("after ping")))
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(data))
+	assert.Equal(t, "are you there?", <-pong)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("close")))
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "bye", closeErr.Reason)
+	assert.Equal(t, websocket.ErrClosed, conn.WriteMessage(websocket.TextMessage, []byte("late")))
+}
+
+// deadlineKeeper leaves a deadline on hijacked connections, as the
+// http.Server in older Go releases does when ReadTimeout or WriteTimeout is
+// set.
+type deadlineKeeper struct {
+	http.ResponseWriter
+	deadline time.Time
+}
+
+func (w *deadlineKeeper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		err = conn.SetDeadline(w.deadline)
+	}
+	return conn, rw, err
+}
+
+func TestServerTimeoutsCleared(t *testing.T) {
+	echo := echoHandler(t, &websocket.Upgrader{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		echo.ServeHTTP(&deadlineKeeper{ResponseWriter: w, deadline: time.Now().Add(100 * time.Millisecond)}, req)
+	}))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+	conn := dial(t, server, nil)
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("still here")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "still here", string(data))
+}
+
+func TestClientInitiatedClose(t *testing.T) {
+	server := echoServer(t, &websocket.Upgrader{})
+	defer server.Close()
+	conn := dial(t, server, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		done <- err
+	}()
+	started := time.Now()
+	require.NoError(t, conn.Close(websocket.CloseNormal, ""))
+	assert.True(t, time.Since(started) < websocket.DefaultCloseTimeout)
+	closeErr, ok := (<-done).(*websocket.CloseError)
+	require.True(t, ok)
+	assert.Equal(t, websocket.CloseNormal, closeErr.Code)
+}
+
+func TestCloseWithoutReader(t *testing.T) {
+	server := echoServer(t, &websocket.Upgrader{})
+	defer server.Close()
+	conn := dial(t, server, nil)
+	started := time.Now()
+	require.NoError(t, conn.Close(websocket.CloseNormal, ""))
+	assert.True(t, time.Since(started) < websocket.DefaultCloseTimeout)
+	_, _, err := conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, websocket.CloseNormal, closeErr.Code)
+}
+
+func TestInvalidText(t *testing.T) {
+	server := echoServer(t, &websocket.Upgrader{})
+	defer server.Close()
+	conn := dial(t, server, nil)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte{0xff, 0xfe}))
+	_, _, err := conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok)
+	assert.Equal(t, websocket.CloseInvalidPayload, closeErr.Code)
+}
+
+func TestRejectedHandshakes(t *testing.T) {
+	server := echoServer(t, &websocket.Upgrader{})
+	defer server.Close()
+	header := make(http.Header)
+	header.Set("Origin", "http://evil.example.com")
+	_, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), header, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.Get(server.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -10,15 +10,18 @@
 package xio
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 
 	"github.com/richardwilkes/toolbox/errs"
+	"github.com/richardwilkes/toolbox/xio/network/xhttp"
 )
 
 // RetrieveDataFromURL loads the bytes from the given URL. Only file, http,
-// and https URLs are currently supported.
+// and https URLs are currently supported. http and https URLs are fetched with
+// xhttp.DefaultClient.
 func RetrieveDataFromURL(urlStr string) ([]byte, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
@@ -33,7 +36,7 @@ func RetrieveDataFromURL(urlStr string) ([]byte, error) {
 		return data, nil
 	case "http", "https":
 		var rsp *http.Response
-		if rsp, err = http.Get(urlStr); err != nil { //nolint:gosec
+		if rsp, err = xhttp.DefaultClient.Get(context.Background(), urlStr); err != nil {
 			return nil, errs.NewWithCause(urlStr, err)
 		}
 		defer CloseIgnoringErrors(rsp.Body)